@@ -0,0 +1,89 @@
+package main
+
+import "math"
+
+// AccuracyReading compares one applied reading with the weight known to be on
+// the platform. Error is the computed weight minus Expected.
+type AccuracyReading struct {
+	Reading   int     `json:"reading"`
+	Expected  float64 `json:"expected"`
+	Weight    float64 `json:"weight"`
+	Error     float64 `json:"error"`
+	Tolerance float64 `json:"tolerance"`
+	Pass      bool    `json:"pass"`
+	// Invalid is set (and Pass false) when the reading gave no valid weight.
+	Invalid string `json:"invalid,omitempty"`
+}
+
+// AccuracyReport is the JSON schema for the accuracy report of apply mode,
+// over the Count readings that carry an expected weight. MAE and MaxError
+// are taken over the valid readings; PassRate counts invalid ones as
+// failures. A streamed run (-stream) lists no Readings.
+type AccuracyReport struct {
+	Readings []AccuracyReading `json:"readings"`
+	Count    int               `json:"count"`
+	MAE      float64           `json:"mae"`
+	MaxError float64           `json:"max_error"`
+	Passed   int               `json:"passed"`
+	PassRate float64           `json:"pass_rate"`
+	Pass     bool              `json:"pass"`
+}
+
+// accuracyTally checks applied readings against their expected weights one
+// at a time. Each |error| is checked against tol; when tol is 0 the OIML
+// maximum permissible error for the expected load (class, e) is used
+// instead. Unless keep is set only the totals are kept.
+type accuracyTally struct {
+	tol   float64
+	class string
+	e     float64
+	keep  bool
+	rep   AccuracyReport
+	sum   float64
+	valid int
+}
+
+func newAccuracyTally(tol float64, class string, e float64, keep bool) *accuracyTally {
+	return &accuracyTally{tol: tol, class: class, e: e, keep: keep, rep: AccuracyReport{Readings: []AccuracyReading{}}}
+}
+
+// add checks one reading against the weight expected for it.
+func (t *accuracyTally) add(rr ReadingResult, expected float64) (AccuracyReading, error) {
+	a := AccuracyReading{Reading: rr.Reading, Expected: expected, Tolerance: t.tol, Invalid: rr.Invalid}
+	if t.tol == 0 {
+		mpe, err := MPE(t.class, a.Expected, t.e)
+		if err != nil {
+			return a, err
+		}
+		a.Tolerance = mpe
+	}
+	if rr.Valid {
+		a.Weight = rr.Weight
+		a.Error = rr.Weight - a.Expected
+		a.Pass = math.Abs(a.Error) <= a.Tolerance
+		t.sum += math.Abs(a.Error)
+		t.rep.MaxError = math.Max(t.rep.MaxError, math.Abs(a.Error))
+		t.valid++
+	}
+	if a.Pass {
+		t.rep.Passed++
+	}
+	t.rep.Count++
+	if t.keep {
+		t.rep.Readings = append(t.rep.Readings, a)
+	}
+	return a, nil
+}
+
+// report returns the accuracy report of the readings added so far.
+func (t *accuracyTally) report() AccuracyReport {
+	rep := t.rep
+	if t.valid > 0 {
+		rep.MAE = t.sum / float64(t.valid)
+	}
+	if rep.Count > 0 {
+		rep.PassRate = float64(rep.Passed) / float64(rep.Count)
+	}
+	rep.Pass = rep.Passed == rep.Count
+	return rep
+}
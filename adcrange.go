@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ADCRangeSummary is the JSON schema for overload/underload detection in apply mode.
+// Overload and Underload count channel samples outside the limits; Invalid lists
+// the 1-based reading numbers whose weight was rejected because of them.
+type ADCRangeSummary struct {
+	Min       float64 `json:"adc_min"`
+	Max       float64 `json:"adc_max"`
+	Overload  int     `json:"overload_events"`
+	Underload int     `json:"underload_events"`
+	Invalid   []int   `json:"invalid_readings"`
+}
+
+// check counts out-of-range channels in adc and returns a description of them,
+// or "" when every channel is within (Min, Max).
+func (s *ADCRangeSummary) check(adc [4]float64) string {
+	var parts []string
+	for i := 0; i < 4; i++ {
+		switch {
+		case adc[i] >= s.Max:
+			s.Overload++
+			parts = append(parts, fmt.Sprintf("overload on ch%d", i))
+		case adc[i] <= s.Min:
+			s.Underload++
+			parts = append(parts, fmt.Sprintf("underload on ch%d", i))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// within reports whether every channel of adc is inside (Min, Max) without counting events.
+func (s *ADCRangeSummary) within(adc [4]float64) bool {
+	for i := 0; i < 4; i++ {
+		if adc[i] >= s.Max || adc[i] <= s.Min {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ApplyOptions configures ApplyReadings. The zero value applies the readings
+// as they are, within the rails of a signed 24-bit converter.
+type ApplyOptions struct {
+	// ADCMin and ADCMax are the range limits (see ADCRangeSummary); both 0
+	// means -8388608..8388607.
+	ADCMin, ADCMax float64
+	// Tare is subtracted from every weight: Weight is then the net weight and
+	// Gross the weight before taring.
+	Tare float64
+	// ZeroBand and Division give each valid reading a display weight (see
+	// ApplyZeroBand and RoundToDivision); 0 leaves them off.
+	ZeroBand, Division float64
+	// OutlierK rejects valid readings whose weight is more than OutlierK
+	// scaled median absolute deviations from the median of the batch (0 = no
+	// rejection). Rejected readings are marked invalid.
+	OutlierK float64
+	// Filter is the length of a moving average over the valid weights that
+	// gives each valid reading its Filtered weight (0 or 1 = none).
+	Filter int
+}
+
+// ApplyResult is the result of ApplyReadings, in the JSON schema of the
+// corresponding -json-out sections.
+type ApplyResult struct {
+	Readings []ReadingResult `json:"readings"`
+	ADCRange ADCRangeSummary `json:"adc_range"`
+	Outliers []int           `json:"outliers"`
+	Batch    BatchSummary    `json:"batch"`
+}
+
+// madScale turns a median absolute deviation into a standard deviation
+// estimate for normally distributed data.
+const madScale = 1.4826
+
+// ApplyReadings weighs a batch of 4-channel readings with a calibration's zero
+// and factors in one call: the per-reading loop of apply mode (range checks,
+// tare, display rounding) plus outlier rejection and a moving-average filter,
+// for services that embed the calibration. Readings are numbered from 1.
+func ApplyReadings(readings [][]float64, zero, factors [4]float64, opt ApplyOptions) (ApplyResult, error) {
+	if opt.Filter < 0 || opt.OutlierK < 0 || opt.ZeroBand < 0 || opt.Division < 0 {
+		return ApplyResult{}, errors.New("apply options must not be negative")
+	}
+	res := ApplyResult{ADCRange: ADCRangeSummary{Min: opt.ADCMin, Max: opt.ADCMax, Invalid: []int{}}, Outliers: []int{}}
+	if opt.ADCMin == 0 && opt.ADCMax == 0 {
+		res.ADCRange.Min, res.ADCRange.Max = -8388608, 8388607
+	}
+	res.Readings = make([]ReadingResult, len(readings))
+	for k, row := range readings {
+		if len(row) != 4 {
+			return ApplyResult{}, fmt.Errorf("reading %d has %d values, want 4", k+1, len(row))
+		}
+		adc := [4]float64(row)
+		if err := checkReadingFinite(adc); err != nil {
+			return ApplyResult{}, fmt.Errorf("reading %d: %w", k+1, err)
+		}
+		rr := ReadingResult{Reading: k + 1, ADC: adc}
+		weight := 0.0
+		for i := range adc {
+			rr.Delta[i] = adc[i] - zero[i]
+			rr.Contrib[i] = factors[i] * rr.Delta[i]
+			weight += rr.Contrib[i]
+		}
+		switch {
+		case nonFinite(weight) != "":
+			rr.Delta, rr.Contrib = [4]float64{}, [4]float64{}
+			rr.Invalid = "weight is " + nonFinite(weight)
+		default:
+			rr.Invalid = res.ADCRange.check(adc)
+		}
+		if rr.Invalid != "" {
+			res.ADCRange.Invalid = append(res.ADCRange.Invalid, rr.Reading)
+		} else {
+			rr.Valid, rr.Weight = true, weight-opt.Tare
+			if opt.Tare != 0 {
+				rr.Gross = &weight
+			}
+		}
+		res.Readings[k] = rr
+	}
+
+	if opt.OutlierK > 0 {
+		var weights []float64
+		for _, rr := range res.Readings {
+			if rr.Valid {
+				weights = append(weights, rr.Weight)
+			}
+		}
+		med := median(weights)
+		for i, w := range weights {
+			weights[i] = math.Abs(w - med)
+		}
+		if limit := opt.OutlierK * madScale * median(weights); limit > 0 {
+			for k := range res.Readings {
+				rr := &res.Readings[k]
+				if rr.Valid && math.Abs(rr.Weight-med) > limit {
+					rr.Valid = false
+					rr.Invalid = fmt.Sprintf("outlier (%.4g from the median %.4g, limit %.4g)", rr.Weight-med, med, limit)
+					res.Outliers = append(res.Outliers, rr.Reading)
+				}
+			}
+		}
+	}
+
+	var window []float64
+	var batch batchTally
+	for k := range res.Readings {
+		rr := &res.Readings[k]
+		if rr.Valid {
+			if opt.ZeroBand > 0 || opt.Division > 0 {
+				disp := RoundToDivision(ApplyZeroBand(rr.Weight, opt.ZeroBand), opt.Division)
+				rr.Display = &disp
+			}
+			if opt.Filter > 1 {
+				window = append(window, rr.Weight)
+				if len(window) > opt.Filter {
+					window = window[1:]
+				}
+				avg := 0.0
+				for _, w := range window {
+					avg += w / float64(len(window))
+				}
+				rr.Filtered = &avg
+			}
+		}
+		batch.add(*rr)
+	}
+	res.Batch = batch.summary(nil)
+	return res, nil
+}
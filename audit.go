@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// AuditEntry is one line of the append-only audit log (JSON Lines). Before and
+// After hold the affected values around the operation. Each entry's Hash
+// covers its content and the previous entry's hash, so edits or deletions
+// anywhere in the log break the chain.
+type AuditEntry struct {
+	Time      time.Time       `json:"time"`
+	Operation string          `json:"operation"`
+	Operator  string          `json:"operator"`
+	Scale     string          `json:"scale,omitempty"`
+	Detail    string          `json:"detail,omitempty"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	Prev      string          `json:"prev"`
+	Hash      string          `json:"hash"`
+}
+
+// AuditCalibration is the before/after snapshot of a calibration version.
+type AuditCalibration struct {
+	Version  int        `json:"version"`
+	Checksum string     `json:"checksum"`
+	Zero     [4]float64 `json:"zero"`
+	Factors  [4]float64 `json:"factors"`
+	// Session is the metadata the version was recorded with.
+	Session *SessionMeta `json:"session,omitempty"`
+}
+
+// auditSnapshot returns the audit snapshot of s, or nil for no session.
+func auditSnapshot(s *Session) any {
+	if s == nil {
+		return nil
+	}
+	return AuditCalibration{Version: s.Version, Checksum: s.Checksum, Zero: s.Calibration.Zero, Factors: s.Result.Factors, Session: s.Result.Session}
+}
+
+// auditPath returns the -audit-log flag value, falling back to $CAL_AUDIT_LOG.
+func auditPath(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	return os.Getenv("CAL_AUDIT_LOG")
+}
+
+// operatorName returns the -operator flag value, falling back to
+// $CAL_OPERATOR and then the login name.
+func operatorName(flagValue string) string {
+	for _, v := range []string{flagValue, os.Getenv("CAL_OPERATOR"), os.Getenv("USER"), os.Getenv("USERNAME")} {
+		if v != "" {
+			return v
+		}
+	}
+	return "unknown"
+}
+
+func (e AuditEntry) computeHash() string {
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// AppendAudit appends an entry for operation to the log at path. before and
+// after are marshalled to JSON; nil values are omitted. An empty path
+// disables auditing.
+func AppendAudit(path, operation, operator, scale, detail string, before, after any) error {
+	if path == "" {
+		return nil
+	}
+	// hold the lock from reading the last hash to appending, so concurrent
+	// writers cannot fork the chain
+	unlock, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	entries, err := ReadAudit(path)
+	if err != nil {
+		return err
+	}
+	e := AuditEntry{Time: time.Now().UTC(), Operation: operation, Operator: operator, Scale: scale, Detail: detail}
+	if before != nil {
+		if e.Before, err = json.Marshal(before); err != nil {
+			return err
+		}
+	}
+	if after != nil {
+		if e.After, err = json.Marshal(after); err != nil {
+			return err
+		}
+	}
+	if n := len(entries); n > 0 {
+		e.Prev = entries[n-1].Hash
+	}
+	e.Hash = e.computeHash()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadAudit reads every entry of the log at path. A missing log is empty.
+func ReadAudit(path string) ([]AuditEntry, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []AuditEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for n := 1; sc.Scan(); n++ {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		var e AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, n, err)
+		}
+		out = append(out, e)
+	}
+	return out, sc.Err()
+}
+
+// VerifyAudit checks the hash chain and returns the 1-based index of the first
+// broken entry, or 0 when the chain is intact.
+func VerifyAudit(entries []AuditEntry) int {
+	prev := ""
+	for i, e := range entries {
+		if e.Prev != prev || e.computeHash() != e.Hash {
+			return i + 1
+		}
+		prev = e.Hash
+	}
+	return 0
+}
+
+// runAudit implements `calibrate audit`: export the audit log as JSON or CSV,
+// optionally filtered, after verifying its hash chain.
+func runAudit(args []string) int {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	logFlag := fs.String("audit-log", "", "audit log file (default $CAL_AUDIT_LOG)")
+	format := fs.String("format", "json", "export format: json or csv")
+	scale := fs.String("scale", "", "only export entries of this scale")
+	since := fs.String("since", "", "only export entries at or after this date (YYYY-MM-DD or RFC 3339)")
+	out := fs.String("o", "", "write the export to this file instead of stdout")
+	_ = fs.Parse(args)
+
+	path := auditPath(*logFlag)
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "error: no audit log configured (use -audit-log or CAL_AUDIT_LOG)")
+		return 2
+	}
+	entries, err := ReadAudit(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading audit log: %v\n", err)
+		return 1
+	}
+	if bad := VerifyAudit(entries); bad != 0 {
+		fmt.Fprintf(os.Stderr, "WARNING: audit log hash chain is broken at entry %d; the log has been modified\n", bad)
+	}
+	var from time.Time
+	if *since != "" {
+		if from, err = parseCalDate(*since); err != nil {
+			fmt.Fprintf(os.Stderr, "error: invalid -since: %v\n", err)
+			return 2
+		}
+	}
+	selected := []AuditEntry{}
+	for _, e := range entries {
+		if (*scale == "" || e.Scale == *scale) && !e.Time.Before(from) {
+			selected = append(selected, e)
+		}
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error creating export: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	switch *format {
+	case "json":
+		b, _ := json.MarshalIndent(selected, "", "  ")
+		fmt.Fprintln(w, string(b))
+	case "csv":
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"time", "operation", "operator", "scale", "detail", "before", "after", "hash"})
+		for _, e := range selected {
+			_ = cw.Write([]string{e.Time.Format(time.RFC3339), e.Operation, e.Operator, e.Scale, e.Detail,
+				string(e.Before), string(e.After), e.Hash})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing csv: %v\n", err)
+			return 1
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "error: -format must be json or csv, got %q\n", *format)
+		return 2
+	}
+	return 0
+}
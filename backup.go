@@ -0,0 +1,340 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// backupFormat identifies store backup archives.
+const backupFormat = "calibration-backup/1"
+
+// BackupManifest describes a backup archive. The archive is a gzipped tar
+// holding manifest.json followed by store.json, a backend-neutral dump of the
+// store; SHA256 covers store.json. Encrypted sessions are copied sealed, so a
+// backup of an encrypted store needs the same key after restoring.
+type BackupManifest struct {
+	Format    string    `json:"format"`
+	Created   time.Time `json:"created"`
+	Source    string    `json:"source"`
+	SHA256    string    `json:"sha256"`
+	Size      int64     `json:"size"`
+	Sessions  int       `json:"sessions"`
+	Batches   int       `json:"batches"`
+	Scales    int       `json:"scales"`
+	Encrypted bool      `json:"encrypted"`
+}
+
+// StoreDump is the complete content of a store. Checks and reference weights
+// are not counted in the manifest; they are covered by its checksum.
+type StoreDump struct {
+	Sessions []Session         `json:"sessions"`
+	Batches  []BatchSummary    `json:"batches"`
+	Checks   []CheckRecord     `json:"checks,omitempty"`
+	Active   map[string]int    `json:"active"`
+	Scales   []ScaleInfo       `json:"scales"`
+	Weights  []ReferenceWeight `json:"reference_weights,omitempty"`
+	Products []Product         `json:"products,omitempty"`
+}
+
+// DumpStore reads every record of st.
+func DumpStore(st Store) (StoreDump, error) {
+	var d StoreDump
+	var err error
+	if d.Sessions, err = st.Sessions(""); err != nil {
+		return d, err
+	}
+	if d.Batches, err = st.Batches(""); err != nil {
+		return d, err
+	}
+	if d.Checks, err = st.Checks(""); err != nil {
+		return d, err
+	}
+	if d.Scales, err = st.Scales(); err != nil {
+		return d, err
+	}
+	if d.Weights, err = st.RefWeights(); err != nil {
+		return d, err
+	}
+	if d.Products, err = st.Products(); err != nil {
+		return d, err
+	}
+	d.Active = map[string]int{}
+	for _, s := range d.Sessions {
+		if _, ok := d.Active[s.Scale]; ok {
+			continue
+		}
+		v, err := st.Active(s.Scale)
+		if err != nil {
+			return d, err
+		}
+		d.Active[s.Scale] = v
+	}
+	return d, nil
+}
+
+// RestoreStore writes d into st, which should be empty. Backends assign new
+// IDs, so batch summaries are re-pointed at the sessions' new IDs.
+func RestoreStore(st Store, d StoreDump) error {
+	sort.SliceStable(d.Sessions, func(i, j int) bool { return d.Sessions[i].ID < d.Sessions[j].ID })
+	ids := map[int64]int64{}
+	for _, s := range d.Sessions {
+		old := s.ID
+		s.ID = 0
+		if err := st.SaveSession(&s); err != nil {
+			return err
+		}
+		ids[old] = s.ID
+	}
+	for _, b := range d.Batches {
+		b.ID, b.SessionID = 0, ids[b.SessionID]
+		if err := st.SaveBatch(&b); err != nil {
+			return err
+		}
+	}
+	for _, c := range d.Checks {
+		c.ID = 0
+		if c.SessionID != 0 {
+			c.SessionID = ids[c.SessionID]
+		}
+		if err := st.SaveCheck(&c); err != nil {
+			return err
+		}
+	}
+	for i := range d.Scales {
+		if err := st.SaveScale(&d.Scales[i]); err != nil {
+			return err
+		}
+	}
+	for i := range d.Weights {
+		if err := st.SaveRefWeight(&d.Weights[i]); err != nil {
+			return err
+		}
+	}
+	for i := range d.Products {
+		if err := st.SaveProduct(&d.Products[i]); err != nil {
+			return err
+		}
+	}
+	var scales []string
+	for sc := range d.Active {
+		scales = append(scales, sc)
+	}
+	sort.Strings(scales)
+	for _, sc := range scales {
+		if d.Active[sc] == 0 {
+			continue
+		}
+		if err := st.SetActive(sc, d.Active[sc]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteBackup writes the archive of d to path; source names the store it came from.
+func WriteBackup(path, source string, d StoreDump) (BackupManifest, error) {
+	body, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	sum := sha256.Sum256(body)
+	m := BackupManifest{Format: backupFormat, Created: time.Now().UTC(), Source: source,
+		SHA256: hex.EncodeToString(sum[:]), Size: int64(len(body)),
+		Sessions: len(d.Sessions), Batches: len(d.Batches), Scales: len(d.Scales)}
+	for _, s := range d.Sessions {
+		if s.Sealed != "" {
+			m.Encrypted = true
+		}
+	}
+	head, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return m, err
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range []struct {
+		name string
+		data []byte
+	}{{"manifest.json", head}, {"store.json", body}} {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.data)), ModTime: m.Created}
+		if err = tw.WriteHeader(hdr); err != nil {
+			break
+		}
+		if _, err = tw.Write(e.data); err != nil {
+			break
+		}
+	}
+	if err = errors.Join(err, tw.Close(), gz.Close()); err != nil {
+		return m, err
+	}
+	return m, writeFileAtomic(path, buf.Bytes(), 0644)
+}
+
+// ReadBackup reads and verifies the archive at path: the manifest format, the
+// SHA-256 and size of the dump, the record counts, and the checksum of every
+// session that is not encrypted.
+func ReadBackup(path string) (BackupManifest, StoreDump, error) {
+	var m BackupManifest
+	var d StoreDump
+	f, err := os.Open(path)
+	if err != nil {
+		return m, d, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return m, d, err
+	}
+	tr := tar.NewReader(gz)
+	var head, body []byte
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return m, d, err
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return m, d, err
+		}
+		switch hdr.Name {
+		case "manifest.json":
+			head = data
+		case "store.json":
+			body = data
+		}
+	}
+	if head == nil || body == nil {
+		return m, d, errors.New("not a store backup (manifest.json or store.json missing)")
+	}
+	if err := json.Unmarshal(head, &m); err != nil {
+		return m, d, fmt.Errorf("manifest: %w", err)
+	}
+	if m.Format != backupFormat {
+		return m, d, fmt.Errorf("unsupported backup format %q", m.Format)
+	}
+	sum := sha256.Sum256(body)
+	if hex.EncodeToString(sum[:]) != m.SHA256 || int64(len(body)) != m.Size {
+		return m, d, errors.New("store.json does not match the manifest checksum")
+	}
+	if err := json.Unmarshal(body, &d); err != nil {
+		return m, d, fmt.Errorf("store.json: %w", err)
+	}
+	if len(d.Sessions) != m.Sessions || len(d.Batches) != m.Batches || len(d.Scales) != m.Scales {
+		return m, d, errors.New("record counts do not match the manifest")
+	}
+	for _, s := range d.Sessions {
+		if s.Sealed == "" && CalibrationChecksum(s.Calibration) != s.Checksum {
+			return m, d, fmt.Errorf("session #%d (scale %s v%d) fails its calibration checksum", s.ID, s.Scale, s.Version)
+		}
+	}
+	return m, d, nil
+}
+
+// runBackup implements `calibrate backup`: snapshot the whole store to an archive.
+func runBackup(args []string) int {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	storeFlag := fs.String("store", "", "calibration store to back up (default $CAL_STORE)")
+	outPath := fs.String("o", "", "archive to write, e.g. calstore-backup.tar.gz (required)")
+	_ = fs.Parse(args)
+
+	if *outPath == "" {
+		fmt.Fprintln(os.Stderr, "error: -o is required")
+		return 2
+	}
+	spec := storeSpec(*storeFlag)
+	if spec == "" {
+		fmt.Fprintln(os.Stderr, "error: no store configured (use -store or CAL_STORE)")
+		return 1
+	}
+	st, err := openBackend(spec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error opening store: %v\n", err)
+		return 1
+	}
+	defer st.Close()
+	d, err := DumpStore(st)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading store: %v\n", err)
+		return 1
+	}
+	m, err := WriteBackup(*outPath, spec, d)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error writing %s: %v\n", *outPath, err)
+		return 1
+	}
+	if _, _, err := ReadBackup(*outPath); err != nil {
+		fmt.Fprintf(os.Stderr, "error: backup %s failed verification: %v\n", *outPath, err)
+		return 1
+	}
+	fmt.Printf("Backed up %d sessions, %d batches, %d registered scales to %s (sha256 %.12s, verified)\n",
+		m.Sessions, m.Batches, m.Scales, *outPath, m.SHA256)
+	return 0
+}
+
+// runRestore implements `calibrate restore`: verify an archive and load it
+// into an empty store, which may use a different backend than the original.
+func runRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	storeFlag := fs.String("store", "", "empty calibration store to restore into (default $CAL_STORE)")
+	inPath := fs.String("in", "", "archive to restore (required)")
+	verifyOnly := fs.Bool("verify", false, "only verify the archive")
+	_ = fs.Parse(args)
+
+	if *inPath == "" {
+		fmt.Fprintln(os.Stderr, "error: -in is required")
+		return 2
+	}
+	m, d, err := ReadBackup(*inPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s: %v\n", *inPath, err)
+		return 1
+	}
+	fmt.Printf("Backup %s: created %s from %s, %d sessions, %d batches, %d registered scales, encrypted=%v: OK\n",
+		*inPath, m.Created.Format("2006-01-02 15:04:05"), m.Source, m.Sessions, m.Batches, m.Scales, m.Encrypted)
+	if *verifyOnly {
+		return 0
+	}
+
+	spec := storeSpec(*storeFlag)
+	if spec == "" {
+		fmt.Fprintln(os.Stderr, "error: no store configured (use -store or CAL_STORE)")
+		return 1
+	}
+	st, err := openBackend(spec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error opening store: %v\n", err)
+		return 1
+	}
+	defer st.Close()
+	cur, err := DumpStore(st)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading store: %v\n", err)
+		return 1
+	}
+	if len(cur.Sessions) > 0 || len(cur.Batches) > 0 || len(cur.Scales) > 0 || len(cur.Weights) > 0 || len(cur.Products) > 0 {
+		fmt.Fprintf(os.Stderr, "error: store %s is not empty; restore into a new store\n", spec)
+		return 1
+	}
+	if err := RestoreStore(st, d); err != nil {
+		fmt.Fprintf(os.Stderr, "error restoring: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Restored into %s\n", spec)
+	return 0
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"Calibration-Demo/core"
+)
+
+// BalanceTest is the hypothesis test of equal corner sensitivities: H0 is
+// that the four (polarity-corrected) factors are equal, tested with the F
+// statistic of the three contrasts f0-f1, f1-f2, f2-f3 under the factor
+// covariance of the fit.
+type BalanceTest struct {
+	F      float64 `json:"f_statistic"`
+	DF1    int     `json:"df1"`
+	DF2    int     `json:"df2"`
+	PValue float64 `json:"p_value"`
+	Alpha  float64 `json:"alpha"`
+	// Spread is (max - min) / mean of the polarity-corrected factors.
+	Spread     float64 `json:"spread"`
+	Imbalanced bool    `json:"imbalanced"`
+	// Untestable explains why no test was possible (e.g. an exact fit leaves
+	// no residual variance to test against).
+	Untestable string `json:"untestable,omitempty"`
+}
+
+// TestCornerBalance tests whether the factors are statistically
+// distinguishable. cov is the factor covariance (see FactorCovariance) and df
+// the residual degrees of freedom of the fit.
+func TestCornerBalance(cal CalibrationData, factors [4]float64, cov [4][4]float64, df int, alpha float64) BalanceTest {
+	t := BalanceTest{DF1: 3, DF2: df, Alpha: alpha, PValue: 1}
+	pol := channelPolarity(cal)
+	var f [4]float64
+	lo, hi, mean := math.Inf(1), math.Inf(-1), 0.0
+	for i := range f {
+		p := pol[i]
+		if p == 0 {
+			p = 1
+		}
+		f[i] = p * factors[i]
+		lo, hi, mean = math.Min(lo, f[i]), math.Max(hi, f[i]), mean+f[i]/4
+		for j := range f {
+			q := pol[j]
+			if q == 0 {
+				q = 1
+			}
+			cov[i][j] *= p * q
+		}
+	}
+	if mean != 0 {
+		t.Spread = (hi - lo) / math.Abs(mean)
+	}
+	if df < 1 {
+		t.Untestable = "no residual degrees of freedom"
+		return t
+	}
+
+	// contrasts d = C f and their covariance C Cov C^T (3x3, padded to 4x4
+	// with a unit diagonal for solve4x4)
+	var d [4]float64
+	var M [4][4]float64
+	for a := 0; a < 3; a++ {
+		d[a] = f[a] - f[a+1]
+		for b := 0; b < 3; b++ {
+			M[a][b] = cov[a][b] - cov[a][b+1] - cov[a+1][b] + cov[a+1][b+1]
+		}
+	}
+	M[3][3] = 1
+	x, err := core.Solve4x4(M, d)
+	if err != nil {
+		t.Untestable = "the fit has no residual variance (exact fit)"
+		return t
+	}
+	w := d[0]*x[0] + d[1]*x[1] + d[2]*x[2]
+	if math.IsNaN(w) || math.IsInf(w, 0) || w < 0 {
+		t.Untestable = "the factor covariance is degenerate"
+		return t
+	}
+	t.F = w / 3
+	t.PValue = fDistSurvival(t.F, 3, float64(df))
+	t.Imbalanced = t.PValue < alpha
+	return t
+}
+
+// Describe is the test result in one line.
+func (t BalanceTest) Describe() string {
+	if t.Untestable != "" {
+		return fmt.Sprintf("not testable: %s (factor spread %.3g%%)", t.Untestable, 100*t.Spread)
+	}
+	verdict := "balanced"
+	if t.Imbalanced {
+		verdict = "IMBALANCED"
+	}
+	return fmt.Sprintf("F = %.4g (%d, %d df), p = %.3g: %s at alpha %g (factor spread %.3g%%)",
+		t.F, t.DF1, t.DF2, t.PValue, verdict, t.Alpha, 100*t.Spread)
+}
+
+// fDistSurvival returns P(X > x) for X ~ F(d1, d2).
+func fDistSurvival(x, d1, d2 float64) float64 {
+	if x <= 0 {
+		return 1
+	}
+	return regIncBeta(d2/2, d1/2, d2/(d2+d1*x))
+}
+
+// regIncBeta is the regularized incomplete beta function I_x(a, b), by the
+// continued fraction of Numerical Recipes (betacf).
+func regIncBeta(a, b, x float64) float64 {
+	switch {
+	case x <= 0:
+		return 0
+	case x >= 1:
+		return 1
+	}
+	la, _ := math.Lgamma(a)
+	lb, _ := math.Lgamma(b)
+	lab, _ := math.Lgamma(a + b)
+	front := math.Exp(lab - la - lb + a*math.Log(x) + b*math.Log(1-x))
+	if x < (a+1)/(a+b+2) {
+		return front * betaCF(a, b, x) / a
+	}
+	return 1 - front*betaCF(b, a, 1-x)/b
+}
+
+func betaCF(a, b, x float64) float64 {
+	const tiny = 1e-300
+	qab, qap, qam := a+b, a+1, a-1
+	c, d := 1.0, 1-qab*x/qap
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+	for m := 1; m <= 300; m++ {
+		fm := float64(m)
+		aa := fm * (b - fm) * x / ((qam + 2*fm) * (a + 2*fm))
+		d = 1 + aa*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + aa/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		h *= d * c
+		aa = -(a + fm) * (qab + fm) * x / ((a + 2*fm) * (qap + 2*fm))
+		d = 1 + aa*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + aa/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		del := d * c
+		h *= del
+		if math.Abs(del-1) < 1e-15 {
+			break
+		}
+	}
+	return h
+}
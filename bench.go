@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+)
+
+// BenchCase is the measured throughput of one benchmark: Ops operations of
+// Unit (fits, readings) in Seconds.
+type BenchCase struct {
+	Name        string  `json:"name"`
+	Unit        string  `json:"unit"`
+	Ops         int     `json:"ops"`
+	Seconds     float64 `json:"seconds"`
+	PerSecond   float64 `json:"per_second"`
+	NsPerOp     float64 `json:"ns_per_op"`
+	AllocsPerOp float64 `json:"allocs_per_op"`
+}
+
+// BenchReport is the JSON schema of `calibrate bench`.
+type BenchReport struct {
+	Calibration string      `json:"calibration"`
+	Readings    int         `json:"readings"`
+	GOMAXPROCS  int         `json:"gomaxprocs"`
+	GoVersion   string      `json:"go_version"`
+	Cases       []BenchCase `json:"cases"`
+}
+
+// benchLoop calls op, which performs n operations, in growing rounds until d
+// has passed, and reports the throughput and heap allocations per operation.
+func benchLoop(name, unit string, n int, d time.Duration, op func()) BenchCase {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	rounds := 0
+	for batch := 1; time.Since(start) < d; batch *= 2 {
+		for range batch {
+			op()
+		}
+		rounds += batch
+	}
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	c := BenchCase{Name: name, Unit: unit, Ops: rounds * n, Seconds: elapsed.Seconds()}
+	c.PerSecond = float64(c.Ops) / c.Seconds
+	c.NsPerOp = float64(elapsed.Nanoseconds()) / float64(c.Ops)
+	c.AllocsPerOp = float64(after.Mallocs-before.Mallocs) / float64(c.Ops)
+	return c
+}
+
+// runBench implements `calibrate bench`: the throughput of the solver (fits
+// per second of the calibration) and of the apply path (readings per second),
+// so performance regressions can be measured.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	calPath := fs.String("cal", "calibration.json", "calibration to fit and apply")
+	adcFile := fs.String("adc-file", "", "readings to apply (same formats as the main -adc-file; default the calibration's own five placements)")
+	d := fs.Duration("time", time.Second, "how long to run each benchmark")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	_ = fs.Parse(args)
+
+	if *d <= 0 {
+		fmt.Fprintln(os.Stderr, "error: -time must be > 0")
+		return 2
+	}
+	cal, err := loadCalibrationFile(*calPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading calibration: %v\n", err)
+		return 1
+	}
+	ridge := envRidge()
+	factors, _, _, err := ComputeFactors(cal, ridge)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	readings := [][4]float64{cal.OnCell0, cal.OnCell1, cal.OnCell2, cal.OnCell3, cal.OnCenter}
+	if *adcFile != "" {
+		if readings, err = LoadReadings(*adcFile); err != nil {
+			fmt.Fprintf(os.Stderr, "error reading adc file: %v\n", err)
+			return 1
+		}
+		if len(readings) == 0 {
+			fmt.Fprintln(os.Stderr, "error: the adc file has no readings")
+			return 1
+		}
+	}
+
+	rep := BenchReport{Calibration: *calPath, Readings: len(readings), GOMAXPROCS: runtime.GOMAXPROCS(0), GoVersion: runtime.Version()}
+	var sink float64
+	rep.Cases = append(rep.Cases, benchLoop("solver", "fits", 1, *d, func() {
+		f, _, _, _ := ComputeFactors(cal, ridge)
+		sink += f[0]
+	}))
+	weights := make([]float64, len(readings))
+	rep.Cases = append(rep.Cases, benchLoop("apply", "readings", len(readings), *d, func() {
+		weights = ComputeWeights(weights, readings, cal.Zero, factors)
+		sink += weights[0]
+	}))
+	_ = sink
+
+	if *asJSON {
+		out, _ := json.MarshalIndent(rep, "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+	fmt.Printf("Benchmark of %s (%d reading(s) applied, GOMAXPROCS %d, %s):\n", rep.Calibration, rep.Readings, rep.GOMAXPROCS, rep.GoVersion)
+	for _, c := range rep.Cases {
+		fmt.Printf("  %-7s %12.0f %s/s %12.1f ns/op %8.2f allocs/op  (%d in %.2fs)\n",
+			c.Name, c.PerSecond, c.Unit, c.NsPerOp, c.AllocsPerOp, c.Ops, c.Seconds)
+	}
+	return 0
+}
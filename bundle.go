@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// bundleFormat identifies calibration bundle files.
+const bundleFormat = "calibration-bundle/1"
+
+// Bundle is a portable single-file copy of the calibration records of one or
+// more scales: every version with its raw calibration captures, results and
+// signature, the applied-batch summaries, the registry entry and the active
+// version. Bundles are plain JSON; calibrations from an encrypted store are
+// exported decrypted.
+type Bundle struct {
+	Format   string        `json:"format"`
+	Exported time.Time     `json:"exported"`
+	Scales   []BundleScale `json:"scales"`
+}
+
+// BundleScale holds the records of one scale in a bundle.
+type BundleScale struct {
+	Scale    string         `json:"scale"`
+	Info     *ScaleInfo     `json:"info,omitempty"`
+	Active   int            `json:"active"`
+	Sessions []Session      `json:"sessions"`
+	Batches  []BatchSummary `json:"batches,omitempty"`
+}
+
+// runExport implements `calibrate export`: write the calibration records of
+// one scale, or all scales, to a bundle file.
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	storeFlag, storeKey := storeFlags(fs)
+	scale := fs.String("scale", "", "only export this scale (default all scales)")
+	outPath := fs.String("o", "", "bundle file to write (required)")
+	noBatches := fs.Bool("no-batches", false, "leave the applied-batch summaries out")
+	_ = fs.Parse(args)
+
+	if *outPath == "" {
+		fmt.Fprintln(os.Stderr, "error: -o is required")
+		return 2
+	}
+	st := openStoreOrExit(*storeFlag, *storeKey)
+	if st == nil {
+		return 1
+	}
+	defer st.Close()
+	sessions, err := st.Sessions(*scale)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading sessions: %v\n", err)
+		return 1
+	}
+	batches, err := st.Batches(*scale)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading batches: %v\n", err)
+		return 1
+	}
+	registry, err := st.Scales()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading registry: %v\n", err)
+		return 1
+	}
+
+	byScale := map[string]*BundleScale{}
+	var names []string
+	get := func(name string) *BundleScale {
+		if bs, ok := byScale[name]; ok {
+			return bs
+		}
+		bs := &BundleScale{Scale: name, Sessions: []Session{}}
+		bs.Active, _ = st.Active(name)
+		byScale[name] = bs
+		names = append(names, name)
+		return bs
+	}
+	for _, s := range sessions {
+		bs := get(s.Scale)
+		bs.Sessions = append(bs.Sessions, s)
+	}
+	if !*noBatches {
+		for _, b := range batches {
+			if bs, ok := byScale[b.Scale]; ok {
+				bs.Batches = append(bs.Batches, b)
+			}
+		}
+	}
+	for i := range registry {
+		if *scale == "" || registry[i].ID == *scale {
+			get(registry[i].ID).Info = &registry[i]
+		}
+	}
+	if len(names) == 0 {
+		fmt.Fprintln(os.Stderr, "error: nothing to export")
+		return 1
+	}
+	sort.Strings(names)
+
+	bundle := Bundle{Format: bundleFormat, Exported: time.Now().UTC()}
+	total := 0
+	for _, n := range names {
+		bundle.Scales = append(bundle.Scales, *byScale[n])
+		total += len(byScale[n].Sessions)
+	}
+	out, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error encoding bundle: %v\n", err)
+		return 1
+	}
+	if err := writeFileAtomic(*outPath, append(out, '\n'), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing %s: %v\n", *outPath, err)
+		return 1
+	}
+	fmt.Printf("Exported %d scale(s), %d calibration version(s) to %s\n", len(names), total, *outPath)
+	return 0
+}
+
+// runImport implements `calibrate import`: merge a bundle into the store.
+// Versions keep their numbers; a version already present with the same
+// checksum is skipped, so importing a bundle twice changes nothing. A version
+// number taken by a different calibration is a conflict and aborts the import
+// before anything is written.
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	storeFlag, storeKey := storeFlags(fs)
+	inPath := fs.String("in", "", "bundle file to read (required)")
+	scale := fs.String("scale", "", "only import this scale from the bundle")
+	as := fs.String("as", "", "import the scale under this ID instead (needs a single-scale bundle or -scale)")
+	activate := fs.Bool("activate", false, "make the bundle's active version active even when the scale already has one")
+	auditLog := fs.String("audit-log", "", "append the import to this audit log (default $CAL_AUDIT_LOG)")
+	operator := fs.String("operator", "", "operator name for the audit log (default $CAL_OPERATOR, then the login name)")
+	_ = fs.Parse(args)
+
+	if *inPath == "" {
+		fmt.Fprintln(os.Stderr, "error: -in is required")
+		return 2
+	}
+	raw, err := os.ReadFile(*inPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading %s: %v\n", *inPath, err)
+		return 1
+	}
+	var bundle Bundle
+	if err := json.Unmarshal(raw, &bundle); err != nil {
+		fmt.Fprintf(os.Stderr, "error parsing %s: %v\n", *inPath, err)
+		return 1
+	}
+	if bundle.Format != bundleFormat {
+		fmt.Fprintf(os.Stderr, "error: %s is not a calibration bundle (format %q)\n", *inPath, bundle.Format)
+		return 1
+	}
+	var selected []BundleScale
+	for _, bs := range bundle.Scales {
+		if *scale == "" || bs.Scale == *scale {
+			selected = append(selected, bs)
+		}
+	}
+	if len(selected) == 0 {
+		fmt.Fprintln(os.Stderr, "error: no matching scale in the bundle")
+		return 1
+	}
+	if *as != "" {
+		if len(selected) != 1 {
+			fmt.Fprintln(os.Stderr, "error: -as needs a single scale (use -scale)")
+			return 2
+		}
+		selected[0].Scale = *as
+	}
+
+	st := openStoreOrExit(*storeFlag, *storeKey)
+	if st == nil {
+		return 1
+	}
+	defer st.Close()
+	registry, err := st.Scales()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading registry: %v\n", err)
+		return 1
+	}
+	registered := map[string]bool{}
+	for _, sc := range registry {
+		registered[sc.ID] = true
+	}
+
+	// Check every scale before writing so a conflict leaves the store untouched.
+	existing := make([][]Session, len(selected))
+	for i, bs := range selected {
+		if existing[i], err = st.Sessions(bs.Scale); err != nil {
+			fmt.Fprintf(os.Stderr, "error reading sessions: %v\n", err)
+			return 1
+		}
+		if err := versionConflict(bs.Scale, existing[i], bs.Sessions); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v; import under another ID with -as\n", err)
+			return 1
+		}
+	}
+
+	for i, bs := range selected {
+		ids, added, err := mergeVersions(st, bs.Scale, existing[i], bs.Sessions)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error saving session: %v\n", err)
+			return 1
+		}
+		batches := 0
+		for _, b := range bs.Batches {
+			id, ok := ids[b.SessionID]
+			if !ok || !addedSession(id, existing[i]) {
+				continue
+			}
+			b.ID, b.SessionID, b.Scale = 0, id, bs.Scale
+			if err := st.SaveBatch(&b); err != nil {
+				fmt.Fprintf(os.Stderr, "error saving batch: %v\n", err)
+				return 1
+			}
+			batches++
+		}
+		if bs.Info != nil && !registered[bs.Scale] {
+			info := *bs.Info
+			info.ID = bs.Scale
+			if err := st.SaveScale(&info); err != nil {
+				fmt.Fprintf(os.Stderr, "error saving registry: %v\n", err)
+				return 1
+			}
+		}
+		before, _ := ActiveSession(st, bs.Scale)
+		active := 0
+		if before != nil {
+			active = before.Version
+		}
+		if bs.Active > 0 && (active == 0 || *activate) {
+			if err := st.SetActive(bs.Scale, bs.Active); err != nil {
+				fmt.Fprintf(os.Stderr, "error setting active version: %v\n", err)
+				return 1
+			}
+			active = bs.Active
+		}
+		after, _ := ActiveSession(st, bs.Scale)
+		detail := fmt.Sprintf("imported %d version(s) from %s, active v%d", added, *inPath, active)
+		if err := AppendAudit(auditPath(*auditLog), "import", operatorName(*operator), bs.Scale, detail,
+			auditSnapshot(before), auditSnapshot(after)); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing audit log: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Scale %s: %d new version(s), %d already present, %d batch(es); active v%d\n",
+			bs.Scale, added, len(bs.Sessions)-added, batches, active)
+	}
+	return 0
+}
+
+// addedSession reports whether id is not among the sessions that existed
+// before the import, i.e. it was created by it.
+func addedSession(id int64, existing []Session) bool {
+	for _, s := range existing {
+		if s.ID == id {
+			return false
+		}
+	}
+	return true
+}
+
+// versionConflict checks incoming sessions of scale against the existing ones:
+// every calibration must match its checksum, and a version number already in
+// use must hold the same calibration.
+func versionConflict(scale string, existing, incoming []Session) error {
+	byVersion := map[int]string{}
+	for _, s := range existing {
+		byVersion[s.Version] = s.Checksum
+	}
+	for _, s := range incoming {
+		if sum := CalibrationChecksum(s.Calibration); s.Sealed == "" && sum != s.Checksum {
+			return fmt.Errorf("scale %s v%d: checksum mismatch (record damaged or edited)", scale, s.Version)
+		}
+		if c, ok := byVersion[s.Version]; ok && c != s.Checksum {
+			return fmt.Errorf("scale %s v%d already holds a different calibration (checksum %.12s, incoming %.12s)",
+				scale, s.Version, c, s.Checksum)
+		}
+	}
+	return nil
+}
+
+// mergeVersions saves the incoming sessions whose checksum is not among the
+// existing ones under scale, in version order and keeping their version
+// numbers. It returns the map from incoming to stored session IDs and the
+// number of sessions added.
+func mergeVersions(st Store, scale string, existing, incoming []Session) (map[int64]int64, int, error) {
+	ids := map[int64]int64{}
+	have := map[string]int64{}
+	for _, s := range existing {
+		have[s.Checksum] = s.ID
+	}
+	sorted := append([]Session(nil), incoming...)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a].Version < sorted[b].Version })
+	added := 0
+	for _, s := range sorted {
+		if id, ok := have[s.Checksum]; ok {
+			ids[s.ID] = id
+			continue
+		}
+		old := s.ID
+		s.ID, s.Scale = 0, scale
+		if err := st.SaveSession(&s); err != nil {
+			return ids, added, err
+		}
+		ids[old] = s.ID
+		have[s.Checksum] = s.ID
+		added++
+	}
+	return ids, added, nil
+}
@@ -3,9 +3,10 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 	"math"
+
+	"Calibration-Demo/core"
 )
 
 // ComputeFactors performs a least-squares fit to compute 4 scale factors f0..f3
@@ -21,131 +22,118 @@ import (
 // The function returns the normal matrix A and vector b for inspection (useful for debugging calibration data).
 func ComputeFactors(cal CalibrationData, ridge float64) ([4]float64, [4][4]float64, [4]float64, error) {
 	var factors [4]float64
-	W := cal.CalibrationWeight
-	// Build measurement rows: order cell0..cell3, center
-	measurements := [5][4]float64{
-		cal.OnCell0,
-		cal.OnCell1,
-		cal.OnCell2,
-		cal.OnCell3,
-		cal.OnCenter,
+	if err := CheckFinite(cal); err != nil {
+		return factors, [4][4]float64{}, [4]float64{}, err
 	}
-
-	// Build X (5x4) and y (5)
-	const m = 5
-	var X [m][4]float64
-	var y [m]float64
-	for i := 0; i < m; i++ {
-		for j := 0; j < 4; j++ {
-			X[i][j] = measurements[i][j] - cal.Zero[j]
-		}
-		// For each placement the observed weight is W
-		y[i] = W
+	if err := checkStage(cal); err != nil {
+		return factors, [4][4]float64{}, [4]float64{}, err
 	}
-
-	// Compute normal matrix A = X^T X (4x4) and b = X^T y (4)
-	var A [4][4]float64
-	var b [4]float64
+	switch cal.Stage {
+	case stageCoarse:
+		// one row for four unknowns: no normal equations, equal factors
+		factors, err := coarseFactors(cal)
+		return factors, [4][4]float64{}, [4]float64{}, err
+	case stagePartial:
+		// three factors kept, one refitted from two rows
+		factors, err := partialFactors(cal)
+		return factors, [4][4]float64{}, [4]float64{}, err
+	}
+	rows := [core.Placements][4]float64{cal.OnCell0, cal.OnCell1, cal.OnCell2, cal.OnCell3, cal.OnCenter}
+	A, b := core.NormalEquations(rows, cal.Zero, cal.CalibrationWeight, ridge)
 	for i := 0; i < 4; i++ {
 		for j := 0; j < 4; j++ {
-			sum := 0.0
-			for k := 0; k < m; k++ {
-				sum += X[k][i] * X[k][j]
+			if s := nonFinite(A[i][j]); s != "" {
+				return factors, A, b, fmt.Errorf("normal matrix overflowed: A[%d][%d] is %s (ADC deltas too large)", i, j, s)
 			}
-			A[i][j] = sum
-		}
-		sum := 0.0
-		for k := 0; k < m; k++ {
-			sum += X[k][i] * y[k]
-		}
-		b[i] = sum
-	}
-
-	// Apply ridge regularization if requested
-	if ridge != 0 {
-		for i := 0; i < 4; i++ {
-			A[i][i] += ridge
 		}
 	}
 
 	// Solve A f = b
-	sol, err := solve4x4(A, b)
+	sol, err := core.Solve4x4(A, b)
 	if err != nil {
 		return factors, A, b, fmt.Errorf("could not solve normal equations: %w", err)
 	}
 	for i := 0; i < 4; i++ {
+		if s := nonFinite(sol[i]); s != "" {
+			return factors, A, b, fmt.Errorf("solver produced f%d = %s", i, s)
+		}
 		factors[i] = sol[i]
 	}
 	return factors, A, b, nil
 }
 
-// ComputeWeight computes the estimated actual weight for a 4-channel ADC reading given zero reference and factors.
-func ComputeWeight(adc [4]float64, zero [4]float64, factors [4]float64) float64 {
-	w := 0.0
-	for i := 0; i < 4; i++ {
-		w += factors[i] * (adc[i] - zero[i])
+// calibrationOKVar is the residual variance below which a calibration counts as ok.
+const calibrationOKVar = 1e-6
+
+// FitStats evaluates factors on the five calibration rows: the residual sum
+// of squares, the residual variance RSS/(m-p) with m=5 rows and p=4
+// parameters, det(A) and the "error determinant" det(A) * residualVariance.
+// A coarse calibration is evaluated on its center row alone.
+func FitStats(cal CalibrationData, factors [4]float64, A [4][4]float64) (rss, residualVar, detA, errorDet float64) {
+	rows := [][4]float64{cal.OnCell0, cal.OnCell1, cal.OnCell2, cal.OnCell3, cal.OnCenter}
+	if cal.Stage == stageCoarse {
+		rows = rows[4:]
+	}
+	for _, row := range rows {
+		resid := cal.CalibrationWeight - ComputeWeight(row, cal.Zero, factors)
+		rss += resid * resid
 	}
-	return w
+	residualVar = rss
+	if df := float64(len(rows) - 4); df > 0 {
+		residualVar = rss / df
+	}
+	detA = det4x4(A)
+	return rss, residualVar, detA, detA * residualVar
 }
 
-// solve4x4 solves A x = b for 4x4 A and length-4 b using Gaussian elimination with partial pivoting.
-// Returns error if matrix is singular.
-func solve4x4(A [4][4]float64, b [4]float64) ([4]float64, error) {
-	var aug [4][5]float64
-	for i := 0; i < 4; i++ {
-		for j := 0; j < 4; j++ {
-			aug[i][j] = A[i][j]
+// FitCalibration computes the factors and fit statistics of cal, i.e. the
+// calibration part of CalibrationResult without the apply-mode sections.
+func FitCalibration(cal CalibrationData, ridge float64) (CalibrationResult, error) {
+	factors, A, _, err := ComputeFactors(cal, ridge)
+	if err != nil {
+		if diag := DiagnoseCollinearity(cal); diag.finite() {
+			return CalibrationResult{}, fmt.Errorf("%w (%s)", err, diag.Summary())
 		}
-		aug[i][4] = b[i]
+		return CalibrationResult{}, err
 	}
-
-	// Forward elimination with partial pivoting
-	for col := 0; col < 4; col++ {
-		// find pivot
-		pivot := col
-		maxAbs := abs(aug[col][col])
-		for r := col + 1; r < 4; r++ {
-			if abs(aug[r][col]) > maxAbs {
-				maxAbs = abs(aug[r][col])
-				pivot = r
-			}
-		}
-		if maxAbs == 0 {
-			return [4]float64{}, errors.New("matrix is singular (zero pivot)")
-		}
-		// swap rows if needed
-		if pivot != col {
-			aug[col], aug[pivot] = aug[pivot], aug[col]
-		}
-		// normalize and eliminate below
-		for r := col + 1; r < 4; r++ {
-			factor := aug[r][col] / aug[col][col]
-			for c := col; c < 5; c++ {
-				aug[r][c] -= factor * aug[col][c]
-			}
-		}
+	rss, residualVar, detA, errorDet := FitStats(cal, factors, A)
+	res := CalibrationResult{
+		Factors:       factors,
+		ResidualVar:   residualVar,
+		RSS:           rss,
+		DetA:          detA,
+		ErrorDet:      errorDet,
+		CalibrationW:  cal.CalibrationWeight,
+		CalibrationOK: residualVar < calibrationOKVar,
 	}
-
-	// Back substitution
-	var x [4]float64
-	for i := 3; i >= 0; i-- {
-		if aug[i][i] == 0 {
-			return [4]float64{}, errors.New("singular matrix during back substitution")
-		}
-		sum := aug[i][4]
-		for j := i + 1; j < 4; j++ {
-			sum -= aug[i][j] * x[j]
-		}
-		x[i] = sum / aug[i][i]
+	switch cal.Stage {
+	case stageCoarse:
+		// no placements to grade; the caller estimates the expected error
+		stage := coarseStage(factors, nil, defaultCornerTol)
+		res.Stage = &stage
+		return res, nil
+	case stagePartial:
+		stage := partialStage(cal, factors)
+		res.Stage = &stage
+		return res, nil
 	}
-	return x, nil
+	grade := GradeCalibration(cal, factors, rss, nil)
+	stage := fullStage(cal, factors)
+	res.Grade, res.Stage = &grade, &stage
+	return res, nil
 }
 
-func abs(a float64) float64 {
-	if a < 0 {
-		return -a
-	}
-	return a
+// ComputeWeight computes the estimated actual weight for a 4-channel ADC reading given zero reference and factors.
+func ComputeWeight(adc [4]float64, zero [4]float64, factors [4]float64) float64 {
+	return core.Weight(adc, zero, factors)
+}
+
+// ComputeWeights computes the weight of each reading into dst, which is
+// returned resliced to len(readings). It allocates only when dst has too
+// little capacity, so a service reusing its buffer weighs batches without
+// allocating.
+func ComputeWeights(dst []float64, readings [][4]float64, zero [4]float64, factors [4]float64) []float64 {
+	return core.Weights(dst, readings, zero, factors)
 }
 
 // det4x4 computes determinant of a 4x4 matrix using LU-like elimination with partial pivoting.
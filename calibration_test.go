@@ -0,0 +1,124 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+// exactCalibration returns a calibration whose rows read exactly w with
+// truth, with the load shares of synthCalibration and no noise.
+func exactCalibration(seed uint64, truth [4]float64, w float64) CalibrationData {
+	return synthCalibration(rand.New(rand.NewPCG(seed, seed)), truth, w, 0)
+}
+
+func TestComputeFactors(t *testing.T) {
+	tests := []struct {
+		name  string
+		truth [4]float64
+		w     float64
+		ridge float64
+	}{
+		{"equal cells", [4]float64{0.005, 0.005, 0.005, 0.005}, 100, 0},
+		{"spread cells", [4]float64{0.004, 0.0045, 0.0055, 0.006}, 500, 0},
+		{"inverted cell", [4]float64{0.002, -0.0022, 0.0021, 0.0019}, 1000, 0},
+		{"small ridge", [4]float64{0.003, 0.003, 0.0031, 0.0029}, 200, 1e-9},
+	}
+	for k, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cal := exactCalibration(uint64(k), tt.truth, tt.w)
+			factors, A, b, err := ComputeFactors(cal, tt.ridge)
+			if err != nil {
+				t.Fatalf("ComputeFactors: %v", err)
+			}
+			for ch := range factors {
+				if rel := math.Abs(factors[ch]-tt.truth[ch]) / math.Abs(tt.truth[ch]); rel > 1e-6 {
+					t.Errorf("f%d = %g, want %g", ch, factors[ch], tt.truth[ch])
+				}
+			}
+			if A == ([4][4]float64{}) || b == ([4]float64{}) {
+				t.Error("the normal equations were not returned")
+			}
+		})
+	}
+}
+
+func TestComputeFactorsErrors(t *testing.T) {
+	good := exactCalibration(1, [4]float64{0.005, 0.005, 0.005, 0.005}, 100)
+	tests := []struct {
+		name   string
+		modify func(*CalibrationData)
+		want   string
+	}{
+		{"NaN reading", func(c *CalibrationData) { c.OnCell2[1] = math.NaN() }, "on_cell_2[1] is NaN"},
+		{"infinite weight", func(c *CalibrationData) { c.CalibrationWeight = math.Inf(1) }, "calibration_weight"},
+		{"no load on any row", func(c *CalibrationData) {
+			c.OnCell0, c.OnCell1, c.OnCell2, c.OnCell3, c.OnCenter = c.Zero, c.Zero, c.Zero, c.Zero, c.Zero
+		}, "could not solve"},
+		{"overflowing deltas", func(c *CalibrationData) { c.OnCell0[0] = 1e300 }, "normal matrix overflowed"},
+		{"unknown stage", func(c *CalibrationData) { c.Stage = "rough" }, "unknown stage"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cal := good
+			tt.modify(&cal)
+			_, _, _, err := ComputeFactors(cal, 0)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("ComputeFactors error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFitCalibration(t *testing.T) {
+	truth := [4]float64{0.004, 0.0045, 0.0055, 0.006}
+	exact := exactCalibration(7, truth, 500)
+	noisy := synthCalibration(rand.New(rand.NewPCG(7, 7)), truth, 500, 50)
+	tests := []struct {
+		name   string
+		cal    CalibrationData
+		wantOK bool
+	}{
+		{"exact rows", exact, true},
+		{"noisy rows", noisy, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := FitCalibration(tt.cal, 0)
+			if err != nil {
+				t.Fatalf("FitCalibration: %v", err)
+			}
+			if res.CalibrationOK != tt.wantOK {
+				t.Errorf("CalibrationOK = %v (residual variance %g), want %v", res.CalibrationOK, res.ResidualVar, tt.wantOK)
+			}
+			if res.Grade == nil || res.Stage == nil {
+				t.Error("a full calibration has no grade or stage")
+			}
+			rss, _, _, _ := FitStats(tt.cal, res.Factors, [4][4]float64{})
+			if rss != res.RSS {
+				t.Errorf("RSS = %g, FitStats gives %g", res.RSS, rss)
+			}
+		})
+	}
+}
+
+func TestComputeWeight(t *testing.T) {
+	truth := [4]float64{0.004, 0.0045, 0.0055, 0.006}
+	cal := exactCalibration(3, truth, 500)
+	factors, _, _, err := ComputeFactors(cal, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readings := [][4]float64{cal.Zero, cal.OnCell0, cal.OnCell3, cal.OnCenter}
+	want := []float64{0, 500, 500, 500}
+	got := ComputeWeights(nil, readings, cal.Zero, factors)
+	for k := range readings {
+		if w := ComputeWeight(readings[k], cal.Zero, factors); w != got[k] {
+			t.Errorf("reading %d: ComputeWeight = %g, ComputeWeights = %g", k, w, got[k])
+		}
+		if math.Abs(got[k]-want[k]) > 1e-6 {
+			t.Errorf("reading %d weighs %g, want %g", k, got[k], want[k])
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// ChannelHealth describes the behaviour of one load cell over an apply run.
+// Span is the max-min range of its delta; Noise is the median absolute
+// difference between consecutive deltas, which ignores occasional load steps
+// but tracks continuous jitter.
+type ChannelHealth struct {
+	Channel int     `json:"channel"`
+	Span    float64 `json:"span"`
+	Noise   float64 `json:"noise"`
+	Status  string  `json:"status"`
+}
+
+// CellHealthSummary is the JSON schema for dead/degraded cell detection.
+// CenterShare is each cell's share of a centered load (from the on_center row),
+// used to scale the degraded-mode estimate from the remaining cells.
+type CellHealthSummary struct {
+	Channels    []ChannelHealth `json:"channels"`
+	Degraded    []int           `json:"degraded_channels"`
+	CenterShare [4]float64      `json:"center_share"`
+}
+
+// Cell health statuses.
+const (
+	cellOK    = "ok"
+	cellDead  = "dead"
+	cellNoisy = "noisy"
+)
+
+// AssessCells flags channels that look broken over a sequence of readings.
+//
+// A channel is dead when its delta span is below deadRatio times the median
+// span of the other channels while those move by at least minMove counts. It is
+// noisy when its consecutive-difference noise exceeds noiseRatio times the
+// median noise of the other channels (and at least one count). At least three
+// readings are needed; with fewer every channel is reported ok.
+func AssessCells(readings [][4]float64, zero [4]float64, deadRatio, noiseRatio, minMove float64) CellHealthSummary {
+	var s CellHealthSummary
+	s.Degraded = []int{}
+	var span, noise [4]float64
+	if len(readings) >= 3 {
+		for ch := 0; ch < 4; ch++ {
+			lo, hi := math.Inf(1), math.Inf(-1)
+			diffs := make([]float64, 0, len(readings)-1)
+			for k, r := range readings {
+				d := r[ch] - zero[ch]
+				lo = math.Min(lo, d)
+				hi = math.Max(hi, d)
+				if k > 0 {
+					diffs = append(diffs, math.Abs(r[ch]-readings[k-1][ch]))
+				}
+			}
+			span[ch] = hi - lo
+			noise[ch] = median(diffs)
+		}
+	}
+	for ch := 0; ch < 4; ch++ {
+		h := ChannelHealth{Channel: ch, Span: span[ch], Noise: noise[ch], Status: cellOK}
+		if len(readings) >= 3 {
+			var otherSpan, otherNoise []float64
+			for o := 0; o < 4; o++ {
+				if o != ch {
+					otherSpan = append(otherSpan, span[o])
+					otherNoise = append(otherNoise, noise[o])
+				}
+			}
+			ms, mn := median(otherSpan), median(otherNoise)
+			switch {
+			case ms >= minMove && span[ch] < deadRatio*ms:
+				h.Status = cellDead
+			case noise[ch] > 1 && noise[ch] > noiseRatio*mn:
+				h.Status = cellNoisy
+			}
+		}
+		if h.Status != cellOK {
+			s.Degraded = append(s.Degraded, ch)
+		}
+		s.Channels = append(s.Channels, h)
+	}
+	return s
+}
+
+// CenterShares returns each cell's fraction of the total contribution for the
+// on_center calibration row. The shares sum to 1 unless the row is degenerate.
+func CenterShares(cal CalibrationData, factors [4]float64) [4]float64 {
+	var share [4]float64
+	total := 0.0
+	for i := 0; i < 4; i++ {
+		share[i] = factors[i] * (cal.OnCenter[i] - cal.Zero[i])
+		total += share[i]
+	}
+	if total == 0 {
+		return [4]float64{}
+	}
+	for i := 0; i < 4; i++ {
+		share[i] /= total
+	}
+	return share
+}
+
+// DegradedWeight estimates the weight from the cells not listed in exclude,
+// scaling their sum by the share of a centered load they normally carry. The
+// estimate is exact for centered loads and degrades with eccentricity. It
+// returns false when the remaining cells carry no share.
+func DegradedWeight(contrib [4]float64, exclude []int, share [4]float64) (float64, bool) {
+	skip := [4]bool{}
+	for _, ch := range exclude {
+		skip[ch] = true
+	}
+	sum, carried := 0.0, 0.0
+	for i := 0; i < 4; i++ {
+		if skip[i] {
+			continue
+		}
+		sum += contrib[i]
+		carried += share[i]
+	}
+	if carried <= 0 {
+		return 0, false
+	}
+	return sum / carried, true
+}
+
+func median(v []float64) float64 {
+	if len(v) == 0 {
+		return 0
+	}
+	c := append([]float64(nil), v...)
+	sort.Float64s(c)
+	n := len(c)
+	if n%2 == 1 {
+		return c[n/2]
+	}
+	return (c[n/2-1] + c[n/2]) / 2
+}
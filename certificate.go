@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// WriteCertificate writes a plain-text calibration certificate summarizing the
+// fitted factors and every test section present in res.
+func WriteCertificate(path, calPath string, res CalibrationResult) error {
+	var sb strings.Builder
+	passFail := func(ok bool) string {
+		if ok {
+			return "PASS"
+		}
+		return "FAIL"
+	}
+	sb.WriteString("CALIBRATION CERTIFICATE\n")
+	sb.WriteString("=======================\n")
+	sb.WriteString(fmt.Sprintf("Issued:             %s\n", nowUTC().Format(time.RFC3339)))
+	sb.WriteString(fmt.Sprintf("Calibration file:   %s\n", calPath))
+	sb.WriteString(fmt.Sprintf("Calibration weight: %g\n", res.CalibrationW))
+	if res.Session != nil {
+		for _, l := range res.Session.Lines() {
+			sb.WriteString(fmt.Sprintf("%-20s%s\n", l[0]+":", l[1]))
+		}
+	}
+	sb.WriteString("\nFactors (weight per ADC count):\n")
+	for i, f := range res.Factors {
+		sb.WriteString(fmt.Sprintf("  f%d = %s\n", i, formatFixed(f, 10)))
+	}
+	sb.WriteString(fmt.Sprintf("Residual variance:  %.6g (RSS %.6g)\n", res.ResidualVar, res.RSS))
+	if g := res.Grade; g != nil {
+		sb.WriteString(fmt.Sprintf("Grade:              %s (%.1f/100)\n", g.Letter, g.Score))
+		for _, p := range g.Penalties {
+			sb.WriteString(fmt.Sprintf("  %s -%.1f: %s\n", p.Aspect, p.Points, p.Reason))
+		}
+	}
+
+	if r := res.Eccentricity; r != nil {
+		sb.WriteString(fmt.Sprintf("\nEccentricity (class %s, e = %g, load %g, MPE ±%g): %s, max |error| %.4f\n",
+			r.Class, r.E, r.TestWeight, r.MPE, passFail(r.Pass), r.MaxError))
+	}
+	if r := res.Linearity; r != nil {
+		sb.WriteString(fmt.Sprintf("\nLinearity (%d loads): %s, max |error| %.4f, max deviation %.4f (%.3f%%)\n",
+			len(r.Points), passFail(r.Pass), r.MaxError, r.MaxDeviation, r.MaxDeviationPct))
+	}
+	if r := res.Accuracy; r != nil {
+		sb.WriteString(fmt.Sprintf("\nAccuracy (%d readings with expected weight): %s, MAE %.4f, max |error| %.4f, pass rate %.1f%%\n",
+			r.Count, passFail(r.Pass), r.MAE, r.MaxError, 100*r.PassRate))
+	}
+	if r := res.Repeatability; r != nil {
+		sb.WriteString(fmt.Sprintf("\nRepeatability (%d placements of %g): %s\n", len(r.Indications), r.TestWeight, passFail(r.Pass)))
+		sb.WriteString(fmt.Sprintf("  mean %.4f, std dev %.4f, range %.4f (MPE %g), mean error %+.4f\n",
+			r.Mean, r.StdDev, r.Range, r.MPE, r.MeanError))
+	}
+	if r := res.MinimumWeight; r != nil {
+		sb.WriteString(fmt.Sprintf("\nMinimum weight (USP <41>): %.4f (s used %.4f, tolerance %g%%)\n",
+			r.MinimumWeight, r.StdDevUsed, r.Tolerance*100))
+	}
+	return writeFileAtomic(path, []byte(sb.String()), 0644)
+}
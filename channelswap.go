@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ChannelSwapReport describes a suspected swap between calibration rows and
+// ADC channels: Dominant[X] is the channel that responded most to on_cell_X.
+type ChannelSwapReport struct {
+	Dominant [4]int `json:"dominant_channels"`
+	// Fixed is set when -fix-mapping relabeled the rows before fitting.
+	Fixed bool `json:"fixed"`
+}
+
+// DetectChannelSwap reports whether the on_cell rows peak on a permutation of
+// the channels other than the identity, the signature of two cells wired to
+// each other's ADC inputs or of rows entered under each other's names. Rows
+// peaking on the same channel are left to the sanity checks.
+func DetectChannelSwap(cal CalibrationData) (ChannelSwapReport, bool) {
+	dom := dominantChannels(cal)
+	var seen [4]bool
+	identity := true
+	for cell, ch := range dom {
+		if seen[ch] {
+			return ChannelSwapReport{}, false
+		}
+		seen[ch] = true
+		identity = identity && ch == cell
+	}
+	return ChannelSwapReport{Dominant: dom}, !identity
+}
+
+// Describe lists the rows that peak on another channel, e.g.
+// "on_cell_1 -> ch2, on_cell_2 -> ch1".
+func (r ChannelSwapReport) Describe() string {
+	var parts []string
+	for cell, ch := range r.Dominant {
+		if ch != cell {
+			parts = append(parts, fmt.Sprintf("%s -> ch%d", calRowNames[cell], ch))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// FixChannelMapping relabels the on_cell rows so that on_cell_X is the row
+// that peaks on channel X. The fitted factors do not change (every row
+// carries the same weight), but per-cell diagnostics and stored data then
+// refer to the right cells.
+func FixChannelMapping(cal CalibrationData, r ChannelSwapReport) CalibrationData {
+	rows := calRows(cal)
+	var fixed [4][4]float64
+	for cell, ch := range r.Dominant {
+		fixed[ch] = rows[cell]
+	}
+	cal.OnCell0, cal.OnCell1, cal.OnCell2, cal.OnCell3 = fixed[0], fixed[1], fixed[2], fixed[3]
+	return cal
+}
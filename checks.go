@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// checkFlags are the flags shared by the verification commands: where the
+// calibration and the readings come from, and who made the check.
+type checkFlags struct {
+	store, storeKey *string
+	scale           *string
+	adc             *string
+	source          *string
+	operator        *string
+	asJSON          *bool
+}
+
+func newCheckFlags(fs *flag.FlagSet, what string) *checkFlags {
+	c := &checkFlags{}
+	c.store, c.storeKey = storeFlags(fs)
+	c.scale = fs.String("scale", "", "scale to check against its active calibration (required)")
+	c.adc = fs.String("adc", "", "one reading "+what+", as comma-separated ADC counts")
+	c.source = fs.String("source", "", "readings "+what+": capture file (same formats as -adc-file) or cmd:<command> sampling the scale live; several readings are averaged")
+	c.operator = fs.String("operator", "", "operator making the check (default $CAL_OPERATOR or the login name)")
+	c.asJSON = fs.Bool("json", false, "print the recorded check as JSON")
+	return c
+}
+
+// readings returns the readings given by -adc or -source and where they came from.
+func (c *checkFlags) readings() ([][4]float64, string, error) {
+	switch {
+	case *c.adc != "" && *c.source != "":
+		return nil, "", errors.New("give either -adc or -source, not both")
+	case *c.adc != "":
+		adc, err := parseADCList(*c.adc)
+		if err != nil {
+			return nil, "", fmt.Errorf("-adc: %w", err)
+		}
+		return [][4]float64{adc}, "-adc", nil
+	case *c.source != "":
+		readings, err := ReadReadingsSource(*c.source)
+		if err != nil {
+			return nil, "", err
+		}
+		for i, r := range readings {
+			if err := checkReadingFinite(r); err != nil {
+				return nil, "", fmt.Errorf("reading %d: %w", i+1, err)
+			}
+		}
+		return readings, *c.source, nil
+	}
+	return nil, "", errors.New("give the reading with -adc or -source")
+}
+
+// parseADCList parses "a,b,c,d" into a finite 4-channel reading.
+func parseADCList(s string) ([4]float64, error) {
+	var adc [4]float64
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return adc, fmt.Errorf("want 4 comma-separated values, got %d", len(parts))
+	}
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return adc, fmt.Errorf("value %d: %w", i+1, err)
+		}
+		adc[i] = v
+	}
+	return adc, checkReadingFinite(adc)
+}
+
+// record stores the check against the active calibration of the scale and
+// prints it. It returns the exit code: 0 when the check passed, 4 when it
+// is out of tolerance.
+func (c *checkFlags) record(st Store, active *Session, rec *CheckRecord, describe func(*CheckRecord) string) int {
+	rec.Scale, rec.Version, rec.SessionID = active.Scale, active.Version, active.ID
+	rec.Operator = operatorName(*c.operator)
+	if err := st.SaveCheck(rec); err != nil {
+		fmt.Fprintf(os.Stderr, "error recording check: %v\n", err)
+		return 1
+	}
+	if *c.asJSON {
+		out, _ := json.MarshalIndent(rec, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		verdict := "PASS"
+		if !rec.Pass {
+			verdict = "FAIL"
+		}
+		fmt.Printf("%s check of scale %s (calibration v%d): %s: %s\n",
+			strings.ToUpper(rec.Check[:1])+rec.Check[1:], rec.Scale, rec.Version, describe(rec), verdict)
+		fmt.Printf("Recorded as check #%d by %s.\n", rec.ID, rec.Operator)
+	}
+	if !rec.Pass {
+		return 4
+	}
+	return 0
+}
+
+// activeForCheck opens the store and returns the active calibration of scale.
+func activeForCheck(c *checkFlags) (Store, *Session, int) {
+	if *c.scale == "" {
+		fmt.Fprintln(os.Stderr, "error: -scale is required")
+		return nil, nil, 2
+	}
+	st := openStoreOrExit(*c.store, *c.storeKey)
+	if st == nil {
+		return nil, nil, 1
+	}
+	active, err := ActiveSession(st, *c.scale)
+	if err == nil && active == nil {
+		err = fmt.Errorf("scale %q has no active calibration", *c.scale)
+	}
+	if err != nil {
+		st.Close()
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return nil, nil, 1
+	}
+	return st, active, 0
+}
+
+// scaleCheckTolerances returns the registered check tolerances of scale, or
+// the zero value when it has none.
+func scaleCheckTolerances(st Store, scale string) (CheckTolerances, error) {
+	registry, err := st.Scales()
+	if err != nil {
+		return CheckTolerances{}, err
+	}
+	for _, sc := range registry {
+		if sc.ID == scale && sc.Check != nil {
+			return *sc.Check, nil
+		}
+	}
+	return CheckTolerances{}, nil
+}
+
+// runVerifySpan implements `calibrate verify-span`: the routine check with a
+// known test weight. The weight computed from the reading(s) with the active
+// calibration is compared with the nominal value and the result is recorded
+// in the store's history.
+func runVerifySpan(args []string) int {
+	fs := flag.NewFlagSet("verify-span", flag.ExitOnError)
+	c := newCheckFlags(fs, "with the test weight on the platform")
+	nominal := fs.Float64("weight", 0, "nominal value of the test weight (default the scale's registered span weight, or the -ref-weight's nominal)")
+	refWeight := fs.String("ref-weight", "", "registered reference weight used as the test weight")
+	tol := fs.Float64("tol", 0, "largest allowed |error| in weight units (default the scale's registered span tolerance, else the MPE of -class/-e)")
+	class := fs.String("class", "III", "accuracy class for the default tolerance: I, II, III or IIII")
+	e := fs.Float64("e", 1, "verification scale interval e for the default tolerance, in weight units")
+	_ = fs.Parse(args)
+
+	readings, source, err := c.readings()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+	st, active, code := activeForCheck(c)
+	if st == nil {
+		return code
+	}
+	defer st.Close()
+
+	registered, err := scaleCheckTolerances(st, active.Scale)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading registry: %v\n", err)
+		return 1
+	}
+	if *refWeight != "" {
+		weights, err := st.RefWeights()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading reference weights: %v\n", err)
+			return 1
+		}
+		w, warnings, err := CheckReferenceWeight(weights, *refWeight, *nominal, nowUTC())
+		if err == nil && w == nil {
+			err = fmt.Errorf("reference weight %q is not registered", *refWeight)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		for _, msg := range warnings {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", msg)
+		}
+		if *nominal == 0 {
+			*nominal = w.Nominal
+		}
+	}
+	if *nominal == 0 {
+		*nominal = registered.SpanWeight
+	}
+	if *nominal <= 0 {
+		fmt.Fprintln(os.Stderr, "error: no test weight: give -weight, -ref-weight or register a span weight for the scale")
+		return 2
+	}
+	limit := *tol
+	if limit == 0 {
+		limit = registered.SpanTol
+	}
+	if limit == 0 {
+		if limit, err = MPE(*class, *nominal, *e); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 2
+		}
+	}
+
+	measured, _ := meanWeight(readings, active)
+	rec := &CheckRecord{
+		CheckResult: CheckResult{Time: nowUTC(), Check: "span", Measured: measured, Expected: *nominal, Tolerance: limit},
+		Source:      source,
+		Readings:    len(readings),
+	}
+	rec.Pass = math.Abs(measured-*nominal) <= limit
+	return c.record(st, active, rec, func(r *CheckRecord) string {
+		return fmt.Sprintf("measured %.4f (%d reading(s)), nominal %g, error %+.4f, tolerance ±%g",
+			r.Measured, r.Readings, r.Expected, r.Measured-r.Expected, r.Tolerance)
+	})
+}
+
+// runVerifyZero implements `calibrate verify-zero`: the routine check of the
+// empty platform. The reading(s) are compared with the zero of the active
+// calibration: each channel's drift in counts, and the weight the drift
+// amounts to, which must stay within the tolerance band. The result is
+// recorded in the store's history.
+func runVerifyZero(args []string) int {
+	fs := flag.NewFlagSet("verify-zero", flag.ExitOnError)
+	c := newCheckFlags(fs, "of the empty platform")
+	tol := fs.Float64("tol", 0, "largest allowed |zero weight| in weight units (default the scale's registered zero tolerance, else 0.25e)")
+	driftTol := fs.Float64("drift-tol", 0, "largest allowed drift of any channel from the calibration zero, in counts (0 = not checked)")
+	e := fs.Float64("e", 1, "verification scale interval e for the default tolerance, in weight units")
+	_ = fs.Parse(args)
+
+	if *tol < 0 || *driftTol < 0 || *e <= 0 {
+		fmt.Fprintln(os.Stderr, "error: -tol and -drift-tol must be >= 0 and -e > 0")
+		return 2
+	}
+	readings, source, err := c.readings()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+	st, active, code := activeForCheck(c)
+	if st == nil {
+		return code
+	}
+	defer st.Close()
+
+	limit := *tol
+	if limit == 0 {
+		registered, err := scaleCheckTolerances(st, active.Scale)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading registry: %v\n", err)
+			return 1
+		}
+		limit = registered.ZeroTol
+	}
+	if limit == 0 {
+		// OIML R76 zero-setting accuracy
+		limit = 0.25 * *e
+	}
+
+	var drift [4]float64
+	for _, r := range readings {
+		for ch := range drift {
+			drift[ch] += (r[ch] - active.Calibration.Zero[ch]) / float64(len(readings))
+		}
+	}
+	measured, _ := meanWeight(readings, active)
+	rec := &CheckRecord{
+		CheckResult: CheckResult{Time: nowUTC(), Check: "zero", Measured: measured, Tolerance: limit},
+		Source:      source,
+		Readings:    len(readings),
+		Drift:       &drift,
+		DriftTol:    *driftTol,
+	}
+	rec.Pass = math.Abs(measured) <= limit
+	for _, d := range drift {
+		if *driftTol > 0 && math.Abs(d) > *driftTol {
+			rec.Pass = false
+		}
+	}
+	if !*c.asJSON {
+		fmt.Println("Drift from the calibration zero:")
+		for ch, d := range drift {
+			mark := ""
+			if *driftTol > 0 && math.Abs(d) > *driftTol {
+				mark = fmt.Sprintf("  exceeds ±%g", *driftTol)
+			}
+			fmt.Printf("  ch%d: %+10.2f counts (%+.4f in weight)%s\n", ch, d, active.Result.Factors[ch]*d, mark)
+		}
+	}
+	return c.record(st, active, rec, func(r *CheckRecord) string {
+		s := fmt.Sprintf("zero reads %+.4f (%d reading(s)), tolerance ±%g", r.Measured, r.Readings, r.Tolerance)
+		if r.DriftTol > 0 {
+			s += fmt.Sprintf(", channel drift limit ±%g counts", r.DriftTol)
+		}
+		return s
+	})
+}
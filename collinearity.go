@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// collinearCondition is the condition number of the normal matrix above which
+// the fit counts as ill-conditioned and the rows are diagnosed.
+const collinearCondition = 1e8
+
+// RowCorrelation is a pair of calibration rows whose deltas point in (nearly)
+// the same direction.
+type RowCorrelation struct {
+	RowA        string  `json:"row_a"`
+	RowB        string  `json:"row_b"`
+	Correlation float64 `json:"correlation"`
+}
+
+// RowIndependence is the share of a row's delta not explained by the other
+// rows: 1 for a row orthogonal to them, 0 for a linear combination of them.
+type RowIndependence struct {
+	Row          string  `json:"row"`
+	Independence float64 `json:"independence"`
+}
+
+// CollinearityReport explains a near-singular normal matrix in terms of the
+// calibration rows.
+type CollinearityReport struct {
+	Condition  float64           `json:"condition_number"`
+	Rank       int               `json:"rank"`
+	Correlated []RowCorrelation  `json:"correlated_rows,omitempty"`
+	Rows       []RowIndependence `json:"rows"`
+	Redo       string            `json:"redo"`
+}
+
+// deltaRows returns the five calibration rows minus the zero reading.
+func deltaRows(cal CalibrationData) [5][4]float64 {
+	var out [5][4]float64
+	for i, row := range calRows(cal) {
+		for ch := range row {
+			out[i][ch] = row[ch] - cal.Zero[ch]
+		}
+	}
+	return out
+}
+
+func dot4(a, b [4]float64) float64 {
+	return a[0]*b[0] + a[1]*b[1] + a[2]*b[2] + a[3]*b[3]
+}
+
+// symEigen4 returns the eigenvalues of the symmetric matrix A (Jacobi rotations).
+func symEigen4(A [4][4]float64) [4]float64 {
+	for sweep := 0; sweep < 100; sweep++ {
+		p, q, off := 0, 1, 0.0
+		for i := 0; i < 4; i++ {
+			for j := i + 1; j < 4; j++ {
+				if math.Abs(A[i][j]) > off {
+					p, q, off = i, j, math.Abs(A[i][j])
+				}
+			}
+		}
+		if off <= 1e-15*(math.Abs(A[p][p])+math.Abs(A[q][q])) || off == 0 {
+			break
+		}
+		theta := (A[q][q] - A[p][p]) / (2 * A[p][q])
+		t := math.Copysign(1, theta) / (math.Abs(theta) + math.Sqrt(theta*theta+1))
+		c := 1 / math.Sqrt(t*t+1)
+		s := t * c
+		for k := 0; k < 4; k++ {
+			akp, akq := A[k][p], A[k][q]
+			A[k][p], A[k][q] = c*akp-s*akq, s*akp+c*akq
+		}
+		for k := 0; k < 4; k++ {
+			apk, aqk := A[p][k], A[q][k]
+			A[p][k], A[q][k] = c*apk-s*aqk, s*apk+c*aqk
+		}
+	}
+	return [4]float64{A[0][0], A[1][1], A[2][2], A[3][3]}
+}
+
+// independence returns the norm of row i after removing its projection onto
+// the span of the other rows, relative to its own norm.
+func independence(rows [5][4]float64, i int) float64 {
+	norm := math.Sqrt(dot4(rows[i], rows[i]))
+	if norm == 0 {
+		return 0
+	}
+	var basis [][4]float64
+	for j, r := range rows {
+		if j == i {
+			continue
+		}
+		for _, e := range basis {
+			d := dot4(r, e)
+			for ch := range r {
+				r[ch] -= d * e[ch]
+			}
+		}
+		if n := math.Sqrt(dot4(r, r)); n > 1e-9*norm {
+			for ch := range r {
+				r[ch] /= n
+			}
+			basis = append(basis, r)
+		}
+	}
+	r := rows[i]
+	for _, e := range basis {
+		d := dot4(r, e)
+		for ch := range r {
+			r[ch] -= d * e[ch]
+		}
+	}
+	return math.Sqrt(dot4(r, r)) / norm
+}
+
+// DiagnoseCollinearity computes the condition number and rank of the normal
+// matrix X^T X, the pairs of rows whose deltas correlate above 0.995 and how
+// independent each row is of the others, and names the placement to redo:
+// the least independent row (a row without any load first).
+func DiagnoseCollinearity(cal CalibrationData) CollinearityReport {
+	rows := deltaRows(cal)
+	var A [4][4]float64
+	for _, r := range rows {
+		for i := 0; i < 4; i++ {
+			for j := 0; j < 4; j++ {
+				A[i][j] += r[i] * r[j]
+			}
+		}
+	}
+	ev := symEigen4(A)
+	sort.Float64s(ev[:])
+	// a singular matrix reports the largest float rather than +Inf, which
+	// JSON cannot carry
+	rep := CollinearityReport{Condition: math.MaxFloat64}
+	if ev[0] > 0 {
+		rep.Condition = ev[3] / ev[0]
+	}
+	for _, e := range ev {
+		if e > ev[3]*1e-12 {
+			rep.Rank++
+		}
+	}
+	for i := 0; i < 5; i++ {
+		for j := i + 1; j < 5; j++ {
+			ni, nj := math.Sqrt(dot4(rows[i], rows[i])), math.Sqrt(dot4(rows[j], rows[j]))
+			if ni == 0 || nj == 0 {
+				continue
+			}
+			if c := dot4(rows[i], rows[j]) / (ni * nj); math.Abs(c) >= 0.995 {
+				rep.Correlated = append(rep.Correlated, RowCorrelation{calRowNames[i], calRowNames[j], c})
+			}
+		}
+	}
+	sort.SliceStable(rep.Correlated, func(a, b int) bool {
+		return math.Abs(rep.Correlated[a].Correlation) > math.Abs(rep.Correlated[b].Correlation)
+	})
+	least := 0
+	for i := range rows {
+		rep.Rows = append(rep.Rows, RowIndependence{calRowNames[i], independence(rows, i)})
+		if rep.Rows[i].Independence < rep.Rows[least].Independence {
+			least = i
+		}
+	}
+	rep.Redo = calRowNames[least]
+	return rep
+}
+
+// finite reports whether the diagnosis is free of NaN/Inf, which rows large
+// enough to overflow the normal matrix produce.
+func (r CollinearityReport) finite() bool {
+	_, _, bad := nonFiniteField(r)
+	return !bad
+}
+
+// Summary is a one-line account of the diagnosis for error messages.
+func (r CollinearityReport) Summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "rank %d of 4, condition number %.3g", r.Rank, r.Condition)
+	for _, p := range r.Correlated {
+		fmt.Fprintf(&b, "; %s and %s correlate %.4f", p.RowA, p.RowB, p.Correlation)
+	}
+	fmt.Fprintf(&b, "; redo the %s placement", r.Redo)
+	return b.String()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// PlatformsConfig is the -platforms file of `calibrate live`: the platforms
+// whose weights are summed into one combined weight, such as the corner
+// platforms under a tank.
+type PlatformsConfig struct {
+	Platforms []PlatformConfig `json:"platforms"`
+}
+
+// PlatformConfig is one platform: its calibration file (relative to the
+// config file) or the scale whose active calibration the store holds.
+type PlatformConfig struct {
+	Name  string `json:"name"`
+	Cal   string `json:"cal,omitempty"`
+	Scale string `json:"scale,omitempty"`
+}
+
+// livePlatform is one calibrated platform of `calibrate live`, with the
+// per-reading stages applied to its channels.
+type livePlatform struct {
+	name          string
+	units         string
+	zero, factors [4]float64
+	// cov is the covariance of the factors; covOK is unset for coarse and
+	// partial calibrations, which have none.
+	cov      [4][4]float64
+	covOK    bool
+	deadband *channelDeadband
+	decim    *decimator
+}
+
+func newLivePlatform(name string, cal CalibrationData) (livePlatform, error) {
+	factors, A, _, err := ComputeFactors(cal, envRidge())
+	if err != nil {
+		return livePlatform{}, err
+	}
+	p := livePlatform{name: name, units: cal.Units, zero: cal.Zero, factors: factors}
+	if cal.Stage != stageCoarse && cal.Stage != stagePartial {
+		_, residualVar, _, _ := FitStats(cal, factors, A)
+		p.cov, err = FactorCovariance(A, residualVar)
+		p.covOK = err == nil
+	}
+	return p, nil
+}
+
+// uncertainty returns the expanded uncertainty of the platform's weight for
+// the reading adc (see ReadingUncertainty), and false without a covariance.
+func (p *livePlatform) uncertainty(adc [4]float64) (float64, bool) {
+	if !p.covOK {
+		return 0, false
+	}
+	var delta [4]float64
+	for i := range delta {
+		delta[i] = adc[i] - p.zero[i]
+	}
+	return ReadingUncertainty(delta, p.factors, p.cov, [4]float64{}), true
+}
+
+// LoadPlatforms reads a -platforms file and the calibration of each platform;
+// platforms given by scale are read from the store spec (with key).
+func LoadPlatforms(path, spec, key string) ([]livePlatform, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg PlatformsConfig
+	if err := decodeJSON(path, b, &cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.Platforms) == 0 {
+		return nil, fmt.Errorf("%s: no platforms", path)
+	}
+	var st Store
+	defer func() {
+		if st != nil {
+			st.Close()
+		}
+	}()
+	var out []livePlatform
+	seen := map[string]bool{}
+	for i, pc := range cfg.Platforms {
+		name := pc.Name
+		if name == "" {
+			name = fmt.Sprintf("platform %d", i+1)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%s: duplicate platform %q", path, name)
+		}
+		seen[name] = true
+		var cal CalibrationData
+		switch {
+		case (pc.Cal == "") == (pc.Scale == ""):
+			return nil, fmt.Errorf("%s: %s: give either cal or scale", path, name)
+		case pc.Cal != "":
+			file := pc.Cal
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(filepath.Dir(path), file)
+			}
+			if cal, err = loadCalibrationFile(file); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		default:
+			if st == nil {
+				if spec == "" {
+					return nil, fmt.Errorf("%s: scale %q needs -store (or CAL_STORE)", name, pc.Scale)
+				}
+				if st, err = OpenStore(spec, key); err != nil {
+					return nil, err
+				}
+			}
+			active, err := ActiveSession(st, pc.Scale)
+			if err != nil {
+				return nil, err
+			}
+			if active == nil {
+				return nil, fmt.Errorf("%s: scale %q has no active calibration", name, pc.Scale)
+			}
+			cal = active.Calibration
+		}
+		p, err := newLivePlatform(name, cal)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if u := platformsUnits(out); p.units != "" && u != "" && p.units != u {
+			return nil, fmt.Errorf("%s: units %q differ from the other platforms' %q; combined weights need one unit", name, p.units, u)
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// platformsUnits returns the units the platforms agree on, "" when none
+// names any.
+func platformsUnits(platforms []livePlatform) string {
+	for _, p := range platforms {
+		if p.units != "" {
+			return p.units
+		}
+	}
+	return ""
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// commands maps subcommand names (the first CLI argument) to their entry
+// points. Each receives the remaining arguments and returns the exit code.
+// Without a subcommand the tool runs the classic calibrate/apply flow.
+var commands = map[string]func(args []string) int{
+	"activate":     runActivate,
+	"audit":        runAudit,
+	"backup":       runBackup,
+	"bench":        runBench,
+	"coarse":       runCoarse,
+	"convert":      runConvert,
+	"daemon":       runDaemon,
+	"due":          runDue,
+	"export":       runExport,
+	"fleet":        runFleet,
+	"grafana":      runGrafana,
+	"history":      runHistory,
+	"import":       runImport,
+	"keygen":       runKeygen,
+	"live":         runLive,
+	"migrate":      runMigrate,
+	"openapi":      runOpenAPI,
+	"product":      runProduct,
+	"prune":        runPrune,
+	"record":       runRecord,
+	"refweight":    runRefWeight,
+	"register":     runRegister,
+	"replace-cell": runReplaceCell,
+	"replay":       runReplay,
+	"restore":      runRestore,
+	"rezero":       runRezero,
+	"schema":       runSchema,
+	"selftest":     runSelfTest,
+	"serve":        runServe,
+	"sign":         runSign,
+	"sync":         runSync,
+	"trend":        runTrend,
+	"verify":       runVerify,
+	"verify-fleet": runVerifyFleet,
+	"verify-span":  runVerifySpan,
+	"verify-zero":  runVerifyZero,
+	"version":      runVersion,
+	"warnings":     runWarnings,
+}
+
+// commandNames lists the registered subcommands in sorted order.
+func commandNames() []string {
+	var names []string
+	for n := range commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// openStoreOrExit opens the store named by the -store flag or $CAL_STORE for a
+// subcommand, printing the error and returning nil when that fails.
+func openStoreOrExit(spec, key string) Store {
+	spec = storeSpec(spec)
+	if spec == "" {
+		fmt.Fprintln(os.Stderr, "error: no store configured (use -store or CAL_STORE)")
+		return nil
+	}
+	st, err := OpenStore(spec, storeKeySpec(key))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error opening store: %v\n", err)
+		return nil
+	}
+	return st
+}
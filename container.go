@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Container deployments configure through the environment and collect
+// stdout, so serve takes every flag from CAL_<FLAG> as well and can log JSON
+// lines to stdout.
+
+// envFlags sets each flag not given on the command line from the environment
+// variable CAL_<NAME> (upper case, - as _), or the one named in rename. An
+// invalid value is an error naming the variable.
+func envFlags(fs *flag.FlagSet, rename map[string]string) error {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := rename[f.Name]
+		if name == "" {
+			name = "CAL_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		}
+		v, ok := os.LookupEnv(name)
+		if given[f.Name] || !ok || err != nil {
+			return
+		}
+		if e := fs.Set(f.Name, v); e != nil {
+			err = fmt.Errorf("%s=%q: %v", name, v, e)
+		}
+	})
+	return err
+}
+
+// logFormats are the -log-format handlers besides text and json, added from
+// init() by the files that provide them (syslog.go).
+var logFormats = map[string]func() (slog.Handler, error){}
+
+// setLogFormat switches the log package to JSON lines on stdout for "json",
+// or to a handler of logFormats (the local syslog or journald socket); "text"
+// keeps the default (timestamped lines on stderr).
+func setLogFormat(format string) error {
+	switch format {
+	case "text":
+	case "json":
+		slog.SetDefault(slog.New(levelPrefixHandler{slog.NewJSONHandler(os.Stdout, nil)}))
+	default:
+		open, ok := logFormats[format]
+		if !ok {
+			if format == "syslog" || format == "journald" {
+				return notBuiltIn("-log-format "+format, "syslog")
+			}
+			return fmt.Errorf("unknown log format %q (%s)", format, strings.Join(features("log formats"), ", "))
+		}
+		h, err := open()
+		if err != nil {
+			return fmt.Errorf("-log-format %s: %v", format, err)
+		}
+		slog.SetDefault(slog.New(levelPrefixHandler{h}))
+	}
+	return nil
+}
+
+func init() { registerFeature("log formats", "text", "json") }
+
+// levelPrefixHandler turns the "warning: " and "error: " prefixes of log
+// messages into the record's level, so log collectors can filter on it.
+type levelPrefixHandler struct{ slog.Handler }
+
+func (h levelPrefixHandler) Handle(ctx context.Context, r slog.Record) error {
+	for prefix, level := range map[string]slog.Level{"warning: ": slog.LevelWarn, "error: ": slog.LevelError} {
+		if msg, ok := strings.CutPrefix(r.Message, prefix); ok {
+			r.Message, r.Level = msg, level
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h levelPrefixHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return levelPrefixHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h levelPrefixHandler) WithGroup(name string) slog.Handler {
+	return levelPrefixHandler{h.Handler.WithGroup(name)}
+}
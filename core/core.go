@@ -0,0 +1,143 @@
+// Package core is the arithmetic of the 4-cell calibration: the weight of a
+// reading and the least-squares solver for the factors. It imports nothing
+// but errors (no fmt or reflection), so it builds with TinyGo and the
+// microcontroller doing the weighing runs the same code as the calibrate
+// tool:
+//
+//	tinygo build -target=pico ./core
+//
+// Validation, diagnostics and file formats stay in the tool.
+package core
+
+import "errors"
+
+// Placements is the number of calibration placements: the load on each of
+// the four cells, then on the center.
+const Placements = 5
+
+// Weight computes the weight of a 4-channel ADC reading given the zero
+// reference and the factors (weight per count).
+func Weight(adc, zero, factors [4]float64) float64 {
+	w := 0.0
+	for i := 0; i < 4; i++ {
+		w += factors[i] * (adc[i] - zero[i])
+	}
+	return w
+}
+
+// Weights computes the weight of each reading into dst, which is returned
+// resliced to len(readings). It allocates only when dst has too little
+// capacity.
+func Weights(dst []float64, readings [][4]float64, zero, factors [4]float64) []float64 {
+	if cap(dst) < len(readings) {
+		dst = make([]float64, len(readings))
+	}
+	dst = dst[:len(readings)]
+	for k := range readings {
+		dst[k] = Weight(readings[k], zero, factors)
+	}
+	return dst
+}
+
+// NormalEquations builds the least-squares system A f = b for the factors f
+// such that every placement row reads the calibration weight w:
+//
+//	w ≈ sum_j f_j * (row_ij - zero_j)
+//
+// A = X^T X and b = X^T y for the delta rows X and y all w. A ridge > 0 is
+// added to the diagonal of A to stabilize the solution.
+func NormalEquations(rows [Placements][4]float64, zero [4]float64, w, ridge float64) (A [4][4]float64, b [4]float64) {
+	var X [Placements][4]float64
+	for i := range rows {
+		for j := 0; j < 4; j++ {
+			X[i][j] = rows[i][j] - zero[j]
+		}
+	}
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			sum := 0.0
+			for k := range X {
+				sum += X[k][i] * X[k][j]
+			}
+			A[i][j] = sum
+		}
+		sum := 0.0
+		for k := range X {
+			sum += X[k][i] * w
+		}
+		b[i] = sum
+	}
+	if ridge != 0 {
+		for i := 0; i < 4; i++ {
+			A[i][i] += ridge
+		}
+	}
+	return A, b
+}
+
+// Factors fits the factors of a calibration: rows are the readings of the
+// placements (cell 0..3, center) with weight w on the platform.
+func Factors(rows [Placements][4]float64, zero [4]float64, w, ridge float64) ([4]float64, error) {
+	A, b := NormalEquations(rows, zero, w, ridge)
+	return Solve4x4(A, b)
+}
+
+// Solve4x4 solves A x = b for 4x4 A and length-4 b using Gaussian
+// elimination with partial pivoting. It returns an error if A is singular.
+func Solve4x4(A [4][4]float64, b [4]float64) ([4]float64, error) {
+	var aug [4][5]float64
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			aug[i][j] = A[i][j]
+		}
+		aug[i][4] = b[i]
+	}
+
+	// Forward elimination with partial pivoting
+	for col := 0; col < 4; col++ {
+		// find pivot
+		pivot := col
+		maxAbs := abs(aug[col][col])
+		for r := col + 1; r < 4; r++ {
+			if abs(aug[r][col]) > maxAbs {
+				maxAbs = abs(aug[r][col])
+				pivot = r
+			}
+		}
+		if maxAbs == 0 {
+			return [4]float64{}, errors.New("matrix is singular (zero pivot)")
+		}
+		// swap rows if needed
+		if pivot != col {
+			aug[col], aug[pivot] = aug[pivot], aug[col]
+		}
+		// normalize and eliminate below
+		for r := col + 1; r < 4; r++ {
+			factor := aug[r][col] / aug[col][col]
+			for c := col; c < 5; c++ {
+				aug[r][c] -= factor * aug[col][c]
+			}
+		}
+	}
+
+	// Back substitution
+	var x [4]float64
+	for i := 3; i >= 0; i-- {
+		if aug[i][i] == 0 {
+			return [4]float64{}, errors.New("singular matrix during back substitution")
+		}
+		sum := aug[i][4]
+		for j := i + 1; j < 4; j++ {
+			sum -= aug[i][j] * x[j]
+		}
+		x[i] = sum / aug[i][i]
+	}
+	return x, nil
+}
+
+func abs(a float64) float64 {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
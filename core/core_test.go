@@ -0,0 +1,179 @@
+package core
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSolve4x4(t *testing.T) {
+	tests := []struct {
+		name    string
+		A       [4][4]float64
+		b       [4]float64
+		want    [4]float64
+		wantErr bool
+	}{
+		{
+			name: "identity",
+			A:    [4][4]float64{{1, 0, 0, 0}, {0, 1, 0, 0}, {0, 0, 1, 0}, {0, 0, 0, 1}},
+			b:    [4]float64{1, 2, 3, 4},
+			want: [4]float64{1, 2, 3, 4},
+		},
+		{
+			name: "diagonal",
+			A:    [4][4]float64{{2, 0, 0, 0}, {0, 4, 0, 0}, {0, 0, 0.5, 0}, {0, 0, 0, -1}},
+			b:    [4]float64{2, 2, 2, 2},
+			want: [4]float64{1, 0.5, 4, -2},
+		},
+		{
+			// a zero on the diagonal needs a row swap
+			name: "pivoting",
+			A:    [4][4]float64{{0, 1, 0, 0}, {1, 0, 0, 0}, {0, 0, 0, 1}, {0, 0, 1, 0}},
+			b:    [4]float64{5, 6, 7, 8},
+			want: [4]float64{6, 5, 8, 7},
+		},
+		{
+			name: "dense",
+			A:    [4][4]float64{{4, 1, 0, 1}, {1, 5, 2, 0}, {0, 2, 6, 1}, {1, 0, 1, 3}},
+			b:    [4]float64{6, 8, 9, 5},
+			want: [4]float64{1, 1, 1, 1},
+		},
+		{
+			name:    "zero matrix",
+			b:       [4]float64{1, 1, 1, 1},
+			wantErr: true,
+		},
+		{
+			name:    "repeated row",
+			A:       [4][4]float64{{1, 2, 3, 4}, {1, 2, 3, 4}, {0, 0, 1, 0}, {0, 0, 0, 1}},
+			b:       [4]float64{1, 1, 1, 1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Solve4x4(tt.A, tt.b)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Solve4x4 = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Solve4x4: %v", err)
+			}
+			for i := range got {
+				if math.Abs(got[i]-tt.want[i]) > 1e-12 {
+					t.Fatalf("Solve4x4 = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWeight(t *testing.T) {
+	tests := []struct {
+		name               string
+		adc, zero, factors [4]float64
+		want               float64
+	}{
+		{"at zero", [4]float64{10, 20, 30, 40}, [4]float64{10, 20, 30, 40}, [4]float64{1, 1, 1, 1}, 0},
+		{"unit factors", [4]float64{11, 22, 33, 44}, [4]float64{10, 20, 30, 40}, [4]float64{1, 1, 1, 1}, 10},
+		{"mixed factors", [4]float64{110, 100, 100, 100}, [4]float64{100, 100, 100, 100}, [4]float64{0.5, 2, 3, 4}, 5},
+		{"inverted cell", [4]float64{90, 110, 100, 100}, [4]float64{100, 100, 100, 100}, [4]float64{-1, 1, 1, 1}, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Weight(tt.adc, tt.zero, tt.factors); got != tt.want {
+				t.Errorf("Weight = %g, want %g", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeights(t *testing.T) {
+	zero, factors := [4]float64{}, [4]float64{1, 2, 3, 4}
+	readings := [][4]float64{{1, 0, 0, 0}, {0, 1, 0, 0}, {0, 0, 1, 0}, {0, 0, 0, 1}}
+	tests := []struct {
+		name string
+		dst  []float64
+	}{
+		{"nil buffer", nil},
+		{"short buffer", make([]float64, 2)},
+		{"large buffer", make([]float64, 0, 16)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Weights(tt.dst, readings, zero, factors)
+			if len(got) != len(readings) {
+				t.Fatalf("len = %d, want %d", len(got), len(readings))
+			}
+			for k, w := range got {
+				if want := factors[k]; w != want {
+					t.Errorf("weight %d = %g, want %g", k, w, want)
+				}
+			}
+			if cap(tt.dst) >= len(readings) && &got[0] != &tt.dst[:1][0] {
+				t.Error("a buffer with room was not reused")
+			}
+		})
+	}
+}
+
+// exactRows returns placement rows that read exactly w with factors.
+func exactRows(zero, factors [4]float64, w float64) [Placements][4]float64 {
+	shares := [Placements][4]float64{
+		{0.7, 0.1, 0.1, 0.1},
+		{0.1, 0.7, 0.1, 0.1},
+		{0.1, 0.1, 0.7, 0.1},
+		{0.1, 0.1, 0.1, 0.7},
+		{0.25, 0.25, 0.25, 0.25},
+	}
+	var rows [Placements][4]float64
+	for i := range rows {
+		for ch := range rows[i] {
+			rows[i][ch] = zero[ch] + shares[i][ch]*w/factors[ch]
+		}
+	}
+	return rows
+}
+
+func TestFactors(t *testing.T) {
+	tests := []struct {
+		name    string
+		zero    [4]float64
+		factors [4]float64
+		w       float64
+	}{
+		{"equal cells", [4]float64{}, [4]float64{0.01, 0.01, 0.01, 0.01}, 100},
+		{"offset zero", [4]float64{1000, -2000, 500, 0}, [4]float64{0.004, 0.005, 0.006, 0.007}, 250},
+		{"inverted cell", [4]float64{100000, 100000, 100000, 100000}, [4]float64{0.002, -0.0021, 0.0019, 0.002}, 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Factors(exactRows(tt.zero, tt.factors, tt.w), tt.zero, tt.w, 0)
+			if err != nil {
+				t.Fatalf("Factors: %v", err)
+			}
+			for ch := range got {
+				if rel := math.Abs(got[ch]-tt.factors[ch]) / math.Abs(tt.factors[ch]); rel > 1e-9 {
+					t.Errorf("f%d = %g, want %g", ch, got[ch], tt.factors[ch])
+				}
+			}
+		})
+	}
+}
+
+func TestFactorsSingular(t *testing.T) {
+	var rows [Placements][4]float64
+	for i := range rows {
+		rows[i] = [4]float64{10, 10, 10, 10} // every placement reads the same
+	}
+	if f, err := Factors(rows, [4]float64{}, 100, 0); err == nil {
+		t.Fatalf("Factors = %v, want an error", f)
+	}
+	// the ridge makes the same system solvable
+	if _, err := Factors(rows, [4]float64{}, 100, 1e-6); err != nil {
+		t.Fatalf("Factors with ridge: %v", err)
+	}
+}
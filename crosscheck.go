@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// CrossCheck compares the normal-equation factors with an independent
+// Householder QR solution of the same least-squares problem.
+type CrossCheck struct {
+	QRFactors  [4]float64 `json:"qr_factors"`
+	MaxRelDiff float64    `json:"max_rel_diff"`
+	Tolerance  float64    `json:"tolerance"`
+	Agree      bool       `json:"agree"`
+}
+
+// solveQR solves min ||X f - y||^2 + ridge ||f||^2 by Householder QR of X
+// (with sqrt(ridge) I appended for the ridge term), never forming X^T X.
+func solveQR(X [][4]float64, y []float64, ridge float64) ([4]float64, error) {
+	var f [4]float64
+	if ridge < 0 {
+		return f, errors.New("a negative ridge has no least-squares form")
+	}
+	rows := append([][4]float64(nil), X...)
+	rhs := append([]float64(nil), y...)
+	if ridge > 0 {
+		for i := 0; i < 4; i++ {
+			var r [4]float64
+			r[i] = math.Sqrt(ridge)
+			rows = append(rows, r)
+			rhs = append(rhs, 0)
+		}
+	}
+	m := len(rows)
+	if m < 4 {
+		return f, errors.New("fewer rows than factors")
+	}
+	for k := 0; k < 4; k++ {
+		norm := 0.0
+		for i := k; i < m; i++ {
+			norm = math.Hypot(norm, rows[i][k])
+		}
+		if norm == 0 {
+			return f, errors.New("matrix is rank deficient")
+		}
+		if rows[k][k] > 0 {
+			norm = -norm
+		}
+		// Householder reflection I - 2vv^T/(v^T v) with v = x - norm e_k
+		v := make([]float64, m)
+		for i := k; i < m; i++ {
+			v[i] = rows[i][k]
+		}
+		v[k] -= norm
+		vv := 0.0
+		for i := k; i < m; i++ {
+			vv += v[i] * v[i]
+		}
+		apply := func(get func(i int) float64, set func(i int, x float64)) {
+			s := 0.0
+			for i := k; i < m; i++ {
+				s += v[i] * get(i)
+			}
+			s = 2 * s / vv
+			for i := k; i < m; i++ {
+				set(i, get(i)-s*v[i])
+			}
+		}
+		for j := k; j < 4; j++ {
+			apply(func(i int) float64 { return rows[i][j] }, func(i int, x float64) { rows[i][j] = x })
+		}
+		apply(func(i int) float64 { return rhs[i] }, func(i int, x float64) { rhs[i] = x })
+	}
+	for i := 3; i >= 0; i-- {
+		if rows[i][i] == 0 {
+			return f, errors.New("matrix is rank deficient")
+		}
+		s := rhs[i]
+		for j := i + 1; j < 4; j++ {
+			s -= rows[i][j] * f[j]
+		}
+		f[i] = s / rows[i][i]
+	}
+	return f, nil
+}
+
+// CrossCheckFactors refits cal with solveQR and compares the result with
+// factors from ComputeFactors; they agree when every factor differs by at
+// most tol relative to the largest |factor|.
+func CrossCheckFactors(cal CalibrationData, factors [4]float64, ridge, tol float64) (CrossCheck, error) {
+	rows := deltaRows(cal)
+	y := make([]float64, len(rows))
+	for i := range y {
+		y[i] = cal.CalibrationWeight
+	}
+	qr, err := solveQR(rows[:], y, ridge)
+	if err != nil {
+		return CrossCheck{}, fmt.Errorf("QR solver: %w", err)
+	}
+	c := CrossCheck{QRFactors: qr, Tolerance: tol}
+	scale := 0.0
+	for _, f := range factors {
+		scale = math.Max(scale, math.Abs(f))
+	}
+	for i := range factors {
+		d := math.Abs(factors[i] - qr[i])
+		if scale > 0 {
+			d /= scale
+		}
+		c.MaxRelDiff = math.Max(c.MaxRelDiff, d)
+	}
+	c.Agree = c.MaxRelDiff <= tol
+	return c, nil
+}
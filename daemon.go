@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// CheckTolerances are the limits of the automatic checks `calibrate daemon`
+// runs between full calibrations. A zero tolerance disables that check.
+type CheckTolerances struct {
+	// ZeroTol is the largest weight shown with the platform empty.
+	ZeroTol float64 `json:"zero_tol,omitempty"`
+	// SpanTol is the largest error on the span check weight, measured
+	// from the current zero when a zero reading is available.
+	SpanTol    float64 `json:"span_tol,omitempty"`
+	SpanWeight float64 `json:"span_weight,omitempty"`
+}
+
+// CheckResult is the outcome of one zero or span check.
+type CheckResult struct {
+	Time      time.Time `json:"time"`
+	Scale     string    `json:"scale"`
+	Version   int       `json:"version"`
+	Check     string    `json:"check"`
+	Measured  float64   `json:"measured"`
+	Expected  float64   `json:"expected"`
+	Tolerance float64   `json:"tolerance"`
+	Pass      bool      `json:"pass"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Alert is sent to the alert sinks when a check changes state.
+type Alert struct {
+	Status string `json:"status"` // out_of_spec, back_in_spec or error
+	CheckResult
+}
+
+// meanWeight converts the mean of readings to a weight with the calibration.
+func meanWeight(readings [][4]float64, s *Session) (float64, error) {
+	if len(readings) == 0 {
+		return 0, fmt.Errorf("no readings")
+	}
+	var mean [4]float64
+	for _, r := range readings {
+		for ch := range mean {
+			mean[ch] += r[ch] / float64(len(readings))
+		}
+	}
+	return ComputeWeight(mean, s.Calibration.Zero, s.Result.Factors), nil
+}
+
+// RunChecks performs the zero and span checks of one scale. zeroSrc and
+// spanSrc are readings sources (see ReadReadingsSource); an empty source or
+// a zero tolerance skips that check.
+func RunChecks(active *Session, tol CheckTolerances, zeroSrc, spanSrc string, now time.Time) []CheckResult {
+	var out []CheckResult
+	result := func(check string, expected, limit float64) *CheckResult {
+		out = append(out, CheckResult{Time: now, Scale: active.Scale, Version: active.Version, Check: check, Expected: expected, Tolerance: limit})
+		return &out[len(out)-1]
+	}
+	var zero *float64
+	if zeroSrc != "" && tol.ZeroTol > 0 {
+		r := result("zero", 0, tol.ZeroTol)
+		readings, err := ReadReadingsSource(zeroSrc)
+		if err == nil {
+			r.Measured, err = meanWeight(readings, active)
+		}
+		if err != nil {
+			r.Error = err.Error()
+		} else {
+			r.Pass = math.Abs(r.Measured) <= tol.ZeroTol
+			zero = &r.Measured
+		}
+	}
+	if spanSrc != "" && tol.SpanTol > 0 {
+		r := result("span", tol.SpanWeight, tol.SpanTol)
+		readings, err := ReadReadingsSource(spanSrc)
+		if err == nil {
+			r.Measured, err = meanWeight(readings, active)
+		}
+		if err != nil {
+			r.Error = err.Error()
+		} else {
+			if zero != nil {
+				r.Measured -= *zero
+			}
+			r.Pass = math.Abs(r.Measured-tol.SpanWeight) <= tol.SpanTol
+		}
+	}
+	return out
+}
+
+// alertSinks delivers alerts to an append-only JSON-lines file, a webhook
+// (HTTP POST of the alert JSON) and an MQTT topic; every alert is also logged.
+// The webhook and MQTT deliveries go through outboxes, so a broker or
+// endpoint outage delays alerts without losing them or stalling the checks.
+type alertSinks struct {
+	logPath string
+	webhook *outbox
+	mqtt    *outbox
+}
+
+// mqttAlerts, set by mqtt.go, checks an -alert-mqtt target and returns the
+// delivery of an alert to it.
+var mqttAlerts func(spec string) (func(payload []byte) error, error)
+
+func init() { registerFeature("alerts", "log", "webhook") }
+
+// newAlertSinks sets up the outputs of the non-empty targets, queueing up to
+// queue alerts for each remote one; mqtt is the delivery of -alert-mqtt, nil
+// for none.
+func newAlertSinks(logPath, webhook string, mqtt func([]byte) error, queue int) *alertSinks {
+	a := &alertSinks{logPath: logPath}
+	if webhook != "" {
+		client := &http.Client{Timeout: 10 * time.Second}
+		a.webhook = newOutbox("alert webhook", queue, func(payload []byte) error {
+			resp, err := client.Post(webhook, "application/json", bytes.NewReader(payload))
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				return fmt.Errorf("%s", resp.Status)
+			}
+			return nil
+		})
+	}
+	if mqtt != nil {
+		a.mqtt = newOutbox("alert mqtt", queue, mqtt)
+	}
+	return a
+}
+
+// outboxes returns the remote outputs that are configured.
+func (a *alertSinks) outboxes() []*outbox {
+	var out []*outbox
+	for _, o := range []*outbox{a.webhook, a.mqtt} {
+		if o != nil {
+			out = append(out, o)
+		}
+	}
+	return out
+}
+
+// health returns the delivery state of the remote outputs.
+func (a *alertSinks) health() []SinkHealth {
+	out := []SinkHealth{}
+	for _, o := range a.outboxes() {
+		out = append(out, o.Health())
+	}
+	return out
+}
+
+// close delivers what is still queued until ctx is done and returns the
+// number of alerts that could not be delivered.
+func (a *alertSinks) close(ctx context.Context) int {
+	lost := 0
+	for _, o := range a.outboxes() {
+		if n := o.close(ctx); n > 0 {
+			log.Printf("warning: %s: %d alert(s) undelivered at shutdown", o.name, n)
+			lost += n
+		}
+	}
+	return lost
+}
+
+func (a *alertSinks) send(al Alert) {
+	detail := fmt.Sprintf("%s check %s: measured %g, expected %g ± %g", al.Check, strings.ReplaceAll(al.Status, "_", " "), al.Measured, al.Expected, al.Tolerance)
+	if al.Error != "" {
+		detail = fmt.Sprintf("%s check failed: %s", al.Check, al.Error)
+	}
+	slog.Warn(fmt.Sprintf("ALERT %s v%d: %s", al.Scale, al.Version, detail),
+		"scale", al.Scale, "version", al.Version, "check", al.Check, "status", al.Status)
+	payload, _ := json.Marshal(al)
+	if a.logPath != "" {
+		if err := appendLine(a.logPath, payload); err != nil {
+			log.Printf("warning: alert log: %v", err)
+		}
+	}
+	for _, o := range a.outboxes() {
+		o.enqueue(payload)
+	}
+}
+
+// appendLine appends data and a newline to the file at path.
+func appendLine(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// checkScheduler runs the checks of every configured scale and alerts on
+// state changes: a check going out of spec (or failing to read), and coming
+// back into spec. Repeated failures alert once.
+type checkScheduler struct {
+	storeSpec  string
+	storeKey   string
+	scales     []string
+	zeroSrc    string
+	spanSrc    string
+	alerts     *alertSinks
+	hooks      *hookSinks
+	state      map[string]string
+	retention  RetentionPolicy
+	auditLog   string
+	healthFile string
+	// rounds and alerted count the work done, for the shutdown summary.
+	rounds  int
+	alerted int
+}
+
+// DaemonHealth is the JSON schema of the daemon's -health-file, rewritten
+// after every round for monitoring.
+type DaemonHealth struct {
+	Time   time.Time    `json:"time"`
+	Rounds int          `json:"rounds"`
+	Store  string       `json:"store"`
+	Sinks  []SinkHealth `json:"alert_sinks"`
+}
+
+// storeRetries is how often a round retries opening a store that is
+// unavailable (a busy database, an unmounted share), with doubling delays
+// from one second.
+const storeRetries = 3
+
+// openStore opens the store, retrying with backoff unless ctx is done.
+func (c *checkScheduler) openStore(ctx context.Context) (Store, error) {
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		st, err := OpenStore(c.storeSpec, c.storeKey)
+		if err == nil || attempt == storeRetries {
+			return st, err
+		}
+		log.Printf("warning: opening store: %v; retrying in %s", err, delay)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// cycle runs one round of checks, then enforces the retention policy, and
+// reports whether every check passed. Once ctx is cancelled the scale being
+// checked is finished and the rest of the round skipped.
+func (c *checkScheduler) cycle(ctx context.Context, now time.Time) bool {
+	c.rounds++
+	ok, storeErr := c.round(ctx, now)
+	if c.healthFile != "" {
+		h := DaemonHealth{Time: now, Rounds: c.rounds, Store: "ok", Sinks: append(c.alerts.health(), c.hooks.health()...)}
+		if storeErr != nil {
+			h.Store = storeErr.Error()
+		}
+		out, _ := json.MarshalIndent(h, "", "  ")
+		if err := writeFileAtomic(c.healthFile, append(out, '\n'), 0644); err != nil {
+			log.Printf("warning: health file: %v", err)
+		}
+	}
+	return ok
+}
+
+// round is one cycle against the store; the error is that of opening it.
+func (c *checkScheduler) round(ctx context.Context, now time.Time) (bool, error) {
+	st, err := c.openStore(ctx)
+	if err != nil {
+		log.Printf("error opening store: %v", err)
+		return false, err
+	}
+	defer st.Close()
+	ok := c.check(ctx, st, now)
+	if !c.retention.empty() && ctx.Err() == nil {
+		res, err := PruneStore(st, c.retention, now, false, c.auditLog, operatorName(""))
+		if err != nil {
+			log.Printf("error pruning store: %v", err)
+		} else if len(res.Versions) > 0 || res.Batches > 0 {
+			log.Printf("pruned %d calibration versions and %d batch summaries", len(res.Versions), res.Batches)
+		}
+	}
+	return ok, nil
+}
+
+func (c *checkScheduler) check(ctx context.Context, st Store, now time.Time) bool {
+	if c.zeroSrc == "" && c.spanSrc == "" {
+		return true
+	}
+	registry, err := st.Scales()
+	if err != nil {
+		log.Printf("error reading registry: %v", err)
+		return false
+	}
+	ok := true
+	for _, sc := range registry {
+		if ctx.Err() != nil {
+			log.Printf("shutting down: skipping the remaining scales of this round")
+			break
+		}
+		if len(c.scales) > 0 && !containsString(c.scales, sc.ID) {
+			continue
+		}
+		if sc.Check == nil {
+			if len(c.scales) > 0 {
+				log.Printf("%s: no check tolerances registered, skipping", sc.ID)
+			}
+			continue
+		}
+		active, err := ActiveSession(st, sc.ID)
+		if err != nil {
+			log.Printf("%s: %v", sc.ID, err)
+			ok = false
+			continue
+		}
+		if active == nil {
+			log.Printf("%s: no active calibration, skipping", sc.ID)
+			continue
+		}
+		// an expired calibration fires its hook once per version
+		if e := dueEntry(active, 0, now); e.Status == "EXPIRED" && c.state[sc.ID+"/expired"] != e.Expiry {
+			c.state[sc.ID+"/expired"] = e.Expiry
+			c.hooks.fire(HookEvent{Event: eventExpired, Time: now, Scale: sc.ID, Version: active.Version,
+				Fields: map[string]any{"expiry": e.Expiry, "days_expired": -e.DaysLeft}})
+		}
+		expand := func(src string) string { return strings.ReplaceAll(src, "{scale}", sc.ID) }
+		for _, r := range RunChecks(active, *sc.Check, expand(c.zeroSrc), expand(c.spanSrc), now) {
+			status := "back_in_spec"
+			switch {
+			case r.Error != "":
+				status = "error"
+			case !r.Pass:
+				status = "out_of_spec"
+			}
+			if status != "back_in_spec" {
+				ok = false
+			}
+			key := r.Scale + "/" + r.Check
+			prev, seen := c.state[key]
+			c.state[key] = status
+			if prev == status || (!seen && status == "back_in_spec") {
+				continue
+			}
+			c.alerts.send(Alert{Status: status, CheckResult: r})
+			c.alerted++
+			if status == "out_of_spec" {
+				c.hooks.fire(HookEvent{Event: eventDrift, Time: r.Time, Scale: r.Scale, Version: r.Version,
+					Fields: map[string]any{"check": r.Check, "measured": r.Measured, "expected": r.Expected, "tolerance": r.Tolerance}})
+			}
+		}
+	}
+	return ok
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// runDaemon implements `calibrate daemon`: run the zero/span checks of the
+// registered scales on a schedule and alert when a scale drifts out of spec
+// between full calibrations. Each round also enforces the retention policy.
+func runDaemon(args []string) int {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	storeFlag, storeKey := storeFlags(fs)
+	scales := fs.String("scale", "", "comma-separated scales to check (default every registered scale with check tolerances)")
+	every := fs.Duration("every", time.Hour, "interval between checks")
+	zeroSrc := fs.String("zero-source", "", "readings of the empty platform: capture file or cmd:<command>; {scale} is replaced by the scale ID")
+	spanSrc := fs.String("span-source", "", "readings with the span check weight applied: capture file or cmd:<command>")
+	alertLog := fs.String("alert-log", "", "append alerts as JSON lines to this file")
+	webhook := fs.String("alert-webhook", "", "POST alerts as JSON to this URL")
+	mqtt := fs.String("alert-mqtt", "", "publish alerts to mqtt://[user:pass@]host[:port]/topic (-tags mqtt)")
+	alertQueue := fs.Int("alert-queue", 1000, "alerts kept per webhook/MQTT output while it is unreachable; the oldest are dropped beyond this")
+	drain := fs.Duration("drain-timeout", 30*time.Second, "at exit, how long to keep trying to deliver queued alerts")
+	hooksFile := fs.String("hooks", "", "call the webhooks of this JSON file on drift alarms and expired calibrations (default $CAL_HOOKS)")
+	healthFile := fs.String("health-file", "", "write the store and alert output health as JSON to this file after every round")
+	once := fs.Bool("once", false, "run the checks once and exit (1 when any is out of spec)")
+	policy := retentionFlags(fs)
+	auditLog := fs.String("audit-log", "", "record pruned calibrations in this audit log (default $CAL_AUDIT_LOG)")
+	logFormat := fs.String("log-format", "text", "text (timestamped lines on stderr), json (one JSON object per line on stdout), syslog or journald (-tags syslog)")
+	_ = fs.Parse(args)
+	if err := setLogFormat(*logFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+
+	spec := storeSpec(*storeFlag)
+	if spec == "" {
+		fmt.Fprintln(os.Stderr, "error: no store configured (use -store or CAL_STORE)")
+		return 2
+	}
+	retention, err := policy()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+	if *zeroSrc == "" && *spanSrc == "" && retention.empty() {
+		fmt.Fprintln(os.Stderr, "error: nothing to do: give -zero-source/-span-source or a retention policy (-keep-versions/-keep-days)")
+		return 2
+	}
+	if *every <= 0 {
+		fmt.Fprintln(os.Stderr, "error: -every must be positive")
+		return 2
+	}
+	if *alertQueue < 1 {
+		fmt.Fprintln(os.Stderr, "error: -alert-queue must be at least 1")
+		return 2
+	}
+	var mqttDeliver func([]byte) error
+	if *mqtt != "" {
+		if mqttAlerts == nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", notBuiltIn("-alert-mqtt", "mqtt"))
+			return 2
+		}
+		if mqttDeliver, err = mqttAlerts(*mqtt); err != nil {
+			fmt.Fprintf(os.Stderr, "error: -alert-mqtt: %v\n", err)
+			return 2
+		}
+	}
+	var hooks *hookSinks
+	if path := hooksPath(*hooksFile); path != "" {
+		if hooks, err = LoadHooks(path); err != nil {
+			fmt.Fprintf(os.Stderr, "error: -hooks: %v\n", err)
+			return 2
+		}
+	}
+	c := &checkScheduler{
+		storeSpec:  spec,
+		storeKey:   storeKeySpec(*storeKey),
+		zeroSrc:    *zeroSrc,
+		spanSrc:    *spanSrc,
+		alerts:     newAlertSinks(*alertLog, *webhook, mqttDeliver, *alertQueue),
+		hooks:      hooks,
+		state:      map[string]string{},
+		retention:  retention,
+		auditLog:   auditPath(*auditLog),
+		healthFile: *healthFile,
+	}
+	if *scales != "" {
+		for _, s := range strings.Split(*scales, ",") {
+			c.scales = append(c.scales, strings.TrimSpace(s))
+		}
+	}
+
+	ctx, stop := shutdownContext()
+	defer stop()
+	// flush the alert and hook queues on the way out, however the daemon
+	// stops
+	flush := func() int {
+		dctx, cancel := context.WithTimeout(context.Background(), *drain)
+		defer cancel()
+		return c.alerts.close(dctx) + c.hooks.close(dctx)
+	}
+	if *once {
+		ok := c.cycle(ctx, time.Now().UTC())
+		if flush() > 0 || !ok {
+			return 1
+		}
+		return 0
+	}
+	log.Printf("checking %s every %s", spec, *every)
+	ticker := time.NewTicker(*every)
+	defer ticker.Stop()
+	for {
+		c.cycle(ctx, time.Now().UTC())
+		select {
+		case <-ctx.Done():
+			lost := flush()
+			log.Printf("stopped cleanly after %d round(s), %d alert(s) sent, %d undelivered", c.rounds, c.alerted, lost)
+			return 0
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// decimator reduces a reading stream to a lower rate by averaging: input
+// reading i (0-based) falls in output reading floor(i * out / in), so each
+// output averages the in/out input readings of its interval, which also
+// filters out what would alias at the lower rate. Ratios that are not whole
+// numbers give intervals of alternating lengths.
+type decimator struct {
+	in, out float64
+	inRange func([4]float64) bool
+	seen    int
+	cur     *decimated
+	sum     [4]float64
+	tilts   int
+	tiltSum float64
+	// outputs counts the output readings.
+	outputs int
+}
+
+// decimated is one output reading: the mean of the in-range readings from..to
+// (1-based input numbers), or the first reading of the interval when none is
+// in range, so it is reported invalid. Expected is the first expected weight
+// given in the interval and the tilt their mean.
+type decimated struct {
+	adc      [4]float64
+	meta     readingMeta
+	from, to int
+	averaged int
+}
+
+func newDecimator(in, out float64, inRange func([4]float64) bool) *decimator {
+	return &decimator{in: in, out: out, inRange: inRange}
+}
+
+// blockOf returns the output reading of input reading i (0-based).
+func (d *decimator) blockOf(i int) int {
+	// the small offset keeps exact ratios exact despite rounding
+	return int(math.Floor(float64(i)*d.out/d.in + 1e-9))
+}
+
+// add takes the next input reading and returns the output reading when this
+// one completes it.
+func (d *decimator) add(adc [4]float64, meta readingMeta) (decimated, bool) {
+	i := d.seen
+	d.seen++
+	if d.cur == nil {
+		d.cur = &decimated{adc: adc, from: i + 1}
+		d.sum, d.tilts, d.tiltSum = [4]float64{}, 0, 0
+	}
+	c := d.cur
+	c.to = i + 1
+	if d.inRange(adc) {
+		for ch := range adc {
+			d.sum[ch] += adc[ch]
+		}
+		c.averaged++
+	}
+	if c.meta.Expected == nil {
+		c.meta.Expected = meta.Expected
+	}
+	if meta.Tilt != nil {
+		d.tilts++
+		d.tiltSum += *meta.Tilt
+	}
+	if d.blockOf(i+1) != d.blockOf(i) {
+		return d.flush()
+	}
+	return decimated{}, false
+}
+
+// flush returns the output reading of the readings added since the last
+// one, if any: at the end of the input, a short last interval.
+func (d *decimator) flush() (decimated, bool) {
+	c := d.cur
+	if c == nil {
+		return decimated{}, false
+	}
+	d.cur = nil
+	if c.averaged > 0 {
+		for ch := range c.adc {
+			c.adc[ch] = d.sum[ch] / float64(c.averaged)
+		}
+	}
+	if d.tilts > 0 {
+		t := d.tiltSum / float64(d.tilts)
+		c.meta.Tilt = &t
+	}
+	d.outputs++
+	return *c, true
+}
+
+// DecimationSummary is the decimation section of apply mode.
+type DecimationSummary struct {
+	// InRate and OutRate are the sample rates in Hz when -sample-rate is
+	// given; Factor is InRate/OutRate, the input readings per output.
+	InRate  float64 `json:"in_rate_hz,omitempty"`
+	OutRate float64 `json:"out_rate_hz,omitempty"`
+	Factor  float64 `json:"factor"`
+	Inputs  int     `json:"input_readings"`
+	Outputs int     `json:"output_readings"`
+}
+
+func (d *decimator) summary(inRate float64) *DecimationSummary {
+	s := &DecimationSummary{Factor: d.in / d.out, Inputs: d.seen, Outputs: d.outputs}
+	if inRate > 0 {
+		s.InRate, s.OutRate = inRate, inRate/s.Factor
+	}
+	return s
+}
+
+// decimationRatio returns the in and out rates of the decimator for
+// -decimate n or -resample-rate out (with the input rate rate); both 0 when
+// neither is given.
+func decimationRatio(n int, out, rate float64) (float64, float64, error) {
+	switch {
+	case n == 0 && out == 0:
+		return 0, 0, nil
+	case n != 0 && out != 0:
+		return 0, 0, errors.New("give either -decimate or -resample-rate")
+	case n < 0:
+		return 0, 0, errors.New("-decimate must be >= 1")
+	case n > 0:
+		return float64(n), 1, nil
+	case out < 0 || math.IsInf(out, 0) || math.IsNaN(out):
+		return 0, 0, errors.New("-resample-rate must be > 0")
+	case out > 0 && rate <= 0:
+		return 0, 0, errors.New("-resample-rate needs -sample-rate, the rate of the readings")
+	case out > rate:
+		return 0, 0, fmt.Errorf("-resample-rate %g Hz is above -sample-rate %g Hz; readings are only decimated, not interpolated", out, rate)
+	}
+	return rate, out, nil
+}
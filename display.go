@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// RoundToDivision rounds w to the nearest multiple of the display division d.
+// A non-positive d leaves w unchanged.
+func RoundToDivision(w, d float64) float64 {
+	if d <= 0 {
+		return w
+	}
+	r := math.Round(w/d) * d
+	if r == 0 {
+		return 0 // avoid printing -0
+	}
+	// trim float noise such as 0.30000000000000004
+	v, _ := strconv.ParseFloat(strconv.FormatFloat(r, 'f', divisionDecimals(d), 64), 64)
+	return v
+}
+
+// ApplyZeroBand returns 0 when w lies within ±band of zero, so residual
+// readings on an empty platform display as exactly zero. A non-positive band
+// leaves w unchanged.
+func ApplyZeroBand(w, band float64) float64 {
+	if band > 0 && math.Abs(w) <= band {
+		return 0
+	}
+	return w
+}
+
+// divisionDecimals returns how many decimals are needed to print multiples of d.
+func divisionDecimals(d float64) int {
+	if d <= 0 {
+		return 2
+	}
+	s := strconv.FormatFloat(d, 'f', -1, 64)
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		return len(s) - i - 1
+	}
+	return 0
+}
+
+// formatFixed formats v in plain decimal notation, never with an exponent,
+// rounded to sig significant digits (0 = the shortest exact form). Output
+// formatted this way keeps its shape across runs and diffs line by line.
+func formatFixed(v float64, sig int) string {
+	if sig > 0 {
+		v, _ = strconv.ParseFloat(strconv.FormatFloat(v, 'g', sig, 64), 64)
+	}
+	if v == 0 {
+		return "0" // avoid printing -0
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// formatVector formats a 4-channel vector as [a b c d] with formatFixed.
+func formatVector(v [4]float64) string {
+	parts := make([]string, len(v))
+	for i, x := range v {
+		parts[i] = formatFixed(x, 0)
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+// formatDivision formats w with the decimals of display division d.
+func formatDivision(w, d float64) string {
+	return strconv.FormatFloat(w, 'f', divisionDecimals(d), 64)
+}
+
+// displayHysteresis holds the displayed weight until the weight moves more
+// than half a division plus band away from it, so a weight sitting on the
+// boundary between two divisions does not flicker between them. With no
+// division the display follows the weight once it moves more than band.
+type displayHysteresis struct {
+	band, div float64
+	shown     float64
+	set       bool
+}
+
+// step returns the display weight for the next weight w.
+func (h *displayHysteresis) step(w float64) float64 {
+	if !h.set || math.Abs(w-h.shown) > h.div/2+h.band {
+		h.shown, h.set = RoundToDivision(w, h.div), true
+	}
+	return h.shown
+}
+
+// channelDeadband holds each channel's ADC counts until they move more than
+// the channel's band from the held value, so channel noise below the band
+// does not reach the weight. A zero band passes the channel through.
+type channelDeadband struct {
+	bands  [4]float64
+	held   [4]float64
+	primed bool
+}
+
+func (c *channelDeadband) apply(adc [4]float64) [4]float64 {
+	for ch := range adc {
+		if !c.primed || math.Abs(adc[ch]-c.held[ch]) > c.bands[ch] {
+			c.held[ch] = adc[ch]
+		}
+	}
+	c.primed = true
+	return c.held
+}
+
+// parseChannelBands reads -channel-deadband: one band in ADC counts for every
+// channel, or four comma-separated ones.
+func parseChannelBands(s string) ([4]float64, error) {
+	var bands [4]float64
+	parts := strings.Split(s, ",")
+	if len(parts) != 1 && len(parts) != 4 {
+		return bands, fmt.Errorf("want one band or four comma-separated bands, got %d", len(parts))
+	}
+	for i := range bands {
+		p := strings.TrimSpace(parts[min(i, len(parts)-1)])
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil || !(v >= 0) || math.IsInf(v, 0) {
+			return bands, fmt.Errorf("invalid band %q (ADC counts >= 0)", p)
+		}
+		bands[i] = v
+	}
+	return bands, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// DynamicItem is one object detected crossing the platform in dynamic
+// (in-motion) weighing. Start and End are 1-based reading numbers of the
+// transient window; the weight comes from the plateau in its middle.
+type DynamicItem struct {
+	Item       int     `json:"item"`
+	Start      int     `json:"start"`
+	End        int     `json:"end"`
+	Samples    int     `json:"plateau_samples"`
+	Weight     float64 `json:"weight"`
+	StdErr     float64 `json:"std_err"`
+	CI95       float64 `json:"ci95"`
+	Slope      float64 `json:"slope"`
+	Confidence string  `json:"confidence"`
+	// Class is the checkweighing zone of the item with -product.
+	Class string `json:"class,omitempty"`
+}
+
+// DynamicReport is the JSON schema for the dynamic weighing section.
+type DynamicReport struct {
+	Trigger float64       `json:"trigger"`
+	Trim    float64       `json:"trim"`
+	Items   []DynamicItem `json:"items"`
+}
+
+// DetectItems finds transients in a weight stream and estimates each item's
+// weight.
+//
+// A window opens when the weight rises to trigger and closes when it falls
+// back below trigger/2 (hysteresis), or at an invalid reading (NaN). The
+// fraction trim of the window is dropped at each edge to skip the ramps, and a
+// line is fitted to the remaining plateau: the item weight is the plateau
+// mean, the slope (per reading) shows whether the signal had settled. The
+// confidence is "high" when the 95% interval is within div/2 and the plateau
+// is flat, "medium" when the interval is within div, and "low" otherwise or
+// when fewer than minSamples plateau readings are left.
+func DetectItems(weights []float64, trigger, trim float64, minSamples int, div float64) []DynamicItem {
+	var items []DynamicItem
+	start := -1
+	closeWindow := func(end int) {
+		if start < 0 {
+			return
+		}
+		items = append(items, plateau(weights[start:end], start, trim, minSamples, div))
+		items[len(items)-1].Item = len(items)
+		start = -1
+	}
+	for i, w := range weights {
+		switch {
+		case math.IsNaN(w):
+			closeWindow(i)
+		case start < 0 && w >= trigger:
+			start = i
+		case start >= 0 && w < trigger/2:
+			closeWindow(i)
+		}
+	}
+	closeWindow(len(weights))
+	return items
+}
+
+func plateau(win []float64, offset int, trim float64, minSamples int, div float64) DynamicItem {
+	it := DynamicItem{Start: offset + 1, End: offset + len(win)}
+	if len(win) == 0 {
+		it.Confidence = "low"
+		return it
+	}
+	cut := int(math.Floor(float64(len(win)) * trim))
+	p := win[cut : len(win)-cut]
+	if len(p) == 0 {
+		p = win
+	}
+	n := float64(len(p))
+	it.Samples = len(p)
+	var sx, sy, sxx, sxy float64
+	for i, w := range p {
+		x := float64(i)
+		sx += x
+		sy += w
+		sxx += x * x
+		sxy += x * w
+	}
+	it.Weight = sy / n
+	if den := n*sxx - sx*sx; den != 0 {
+		it.Slope = (n*sxy - sx*sy) / den
+	}
+	if len(p) > 1 {
+		ss := 0.0
+		for _, w := range p {
+			ss += (w - it.Weight) * (w - it.Weight)
+		}
+		it.StdErr = math.Sqrt(ss/(n-1)) / math.Sqrt(n)
+		it.CI95 = 1.96 * it.StdErr
+	}
+	drift := math.Abs(it.Slope) * n
+	switch {
+	case len(p) < minSamples:
+		it.Confidence = "low"
+	case it.CI95 <= div/2 && drift <= div:
+		it.Confidence = "high"
+	case it.CI95 <= div:
+		it.Confidence = "medium"
+	default:
+		it.Confidence = "low"
+	}
+	return it
+}
+
+// weighDynamic detects the items crossing the platform in the weights of
+// the run (-dynamic) and classifies them with -product.
+func (c *calibrateRun) weighDynamic() {
+	f := c.f
+	if !f.dynamic || len(c.w.results) == 0 {
+		return
+	}
+	weights := make([]float64, len(c.w.results))
+	for i, rr := range c.w.results {
+		weights[i] = rr.Weight
+		if !rr.Valid {
+			weights[i] = math.NaN()
+		}
+	}
+	div := f.displayDiv
+	if div == 0 {
+		div = f.verifInterval
+	}
+	rep := &DynamicReport{Trigger: f.dynTrigger, Trim: f.dynTrim}
+	rep.Items = DetectItems(weights, f.dynTrigger, f.dynTrim, f.dynMinSamples, div)
+	c.res.Dynamic = rep
+	emit(&c.sb, "\nDynamic weighing: %d item(s) (trigger %g, trim %.0f%%)\n", len(rep.Items), f.dynTrigger, f.dynTrim*100)
+	for i := range rep.Items {
+		it := &rep.Items[i]
+		class := ""
+		if cw := c.res.Checkweigh; cw != nil {
+			it.Class = cw.add(it.Weight)
+			class = ", " + strings.ToUpper(it.Class)
+			c.classified(it.Class, map[string]any{"item": it.Item, "weight": it.Weight, "start": it.Start, "end": it.End})
+		}
+		emit(&c.sb, "  Item %d: readings %d-%d, weight = %.4f ± %.4f (95%%, %d plateau samples, slope %+.4g/reading), confidence %s%s\n",
+			it.Item, it.Start, it.End, it.Weight, it.CI95, it.Samples, it.Slope, it.Confidence, class)
+	}
+}
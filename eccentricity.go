@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+)
+
+// EccentricityInput is the JSON schema for -ecc-file: readings taken with the
+// same test weight at the center and then over each quadrant (cell 0..3 side).
+type EccentricityInput struct {
+	TestWeight float64       `json:"test_weight"`
+	Center     [4]float64    `json:"center"`
+	Quadrants  [4][4]float64 `json:"quadrants"`
+}
+
+// EccentricityPosition is the result for one test position.
+type EccentricityPosition struct {
+	Position     string  `json:"position"`
+	Indication   float64 `json:"indication"`
+	Error        float64 `json:"error"`
+	Eccentricity float64 `json:"eccentricity"`
+	Pass         bool    `json:"pass"`
+}
+
+// EccentricityReport is the JSON schema for the eccentricity test section.
+// Error is indication minus test weight; Eccentricity is indication minus the
+// center indication. A position passes when |Error| <= MPE.
+type EccentricityReport struct {
+	Class      string                 `json:"class"`
+	E          float64                `json:"e"`
+	TestWeight float64                `json:"test_weight"`
+	MPE        float64                `json:"mpe"`
+	Positions  []EccentricityPosition `json:"positions"`
+	MaxError   float64                `json:"max_error"`
+	Pass       bool                   `json:"pass"`
+}
+
+// LoadEccentricityInput reads and validates an -ecc-file.
+func LoadEccentricityInput(path string) (EccentricityInput, error) {
+	var in EccentricityInput
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return in, err
+	}
+	if err := json.Unmarshal(b, &in); err != nil {
+		return in, err
+	}
+	if in.TestWeight <= 0 {
+		return in, fmt.Errorf("test_weight must be > 0")
+	}
+	return in, nil
+}
+
+// EccentricityTest evaluates the readings of in against the OIML R76 maximum
+// permissible error for the test weight.
+func EccentricityTest(in EccentricityInput, zero, factors [4]float64, class string, e float64) (EccentricityReport, error) {
+	mpe, err := MPE(class, in.TestWeight, e)
+	if err != nil {
+		return EccentricityReport{}, err
+	}
+	rep := EccentricityReport{Class: class, E: e, TestWeight: in.TestWeight, MPE: mpe, Pass: true}
+	center := ComputeWeight(in.Center, zero, factors)
+	add := func(name string, ind float64) {
+		p := EccentricityPosition{
+			Position:     name,
+			Indication:   ind,
+			Error:        ind - in.TestWeight,
+			Eccentricity: ind - center,
+		}
+		p.Pass = math.Abs(p.Error) <= mpe
+		if !p.Pass {
+			rep.Pass = false
+		}
+		rep.MaxError = math.Max(rep.MaxError, math.Abs(p.Error))
+		rep.Positions = append(rep.Positions, p)
+	}
+	add("center", center)
+	for q := 0; q < 4; q++ {
+		add(fmt.Sprintf("quadrant %d", q), ComputeWeight(in.Quadrants[q], zero, factors))
+	}
+	return rep, nil
+}
@@ -0,0 +1,335 @@
+//go:build esphome || full
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerLiveOutput("esphome", func(fs *flag.FlagSet) func(cfg liveSinkConfig) (liveSink, error) {
+		addr := fs.String("esphome", "", "also serve the weight over the ESPHome native API on this address (e.g. :6053), as an ESPHome scale node")
+		password := fs.String("esphome-password", "", "ESPHome API password")
+		interval := fs.Duration("esphome-interval", time.Second, "send the ESPHome weight at most this often")
+		return func(cfg liveSinkConfig) (liveSink, error) {
+			if *addr == "" {
+				return nil, nil
+			}
+			if *interval <= 0 {
+				return nil, errors.New("-esphome-interval must be positive")
+			}
+			acc := cfg.decimals
+			if acc < 0 {
+				acc = 2
+			}
+			s, err := newESPHomeServer(*addr, cfg.scale, *password, cfg.units, acc, *interval)
+			if err != nil {
+				return nil, fmt.Errorf("-esphome: %v", err)
+			}
+			return s, nil
+		}
+	})
+}
+
+// esphomeServer speaks the plaintext ESPHome native API (the protocol Home
+// Assistant's ESPHome integration uses on port 6053), presenting the scale
+// as an ESPHome node with one weight sensor. Frames are a zero byte, the
+// varint length and message type, and a protobuf message; only the messages
+// a sensor node needs are implemented. Noise encryption is not supported,
+// and the node is not announced over mDNS: add it in Home Assistant by host.
+type esphomeServer struct {
+	ln       net.Listener
+	name     string
+	password string
+	units    string
+	decimals int
+	interval time.Duration
+
+	mu       sync.Mutex
+	state    float32
+	hasState bool
+	clients  map[*esphomeClient]struct{}
+	wg       sync.WaitGroup
+}
+
+// ESPHome API message types.
+const (
+	esphomeHelloRequest           = 1
+	esphomeHelloResponse          = 2
+	esphomeConnectRequest         = 3
+	esphomeConnectResponse        = 4
+	esphomeDisconnectRequest      = 5
+	esphomeDisconnectResponse     = 6
+	esphomePingRequest            = 7
+	esphomePingResponse           = 8
+	esphomeDeviceInfoRequest      = 9
+	esphomeDeviceInfoResponse     = 10
+	esphomeListEntitiesRequest    = 11
+	esphomeListEntitiesSensor     = 16
+	esphomeListEntitiesDone       = 19
+	esphomeSubscribeStatesRequest = 20
+	esphomeSensorStateResponse    = 25
+
+	esphomeMaxMessage = 64 << 10
+)
+
+// esphomeSensorKey identifies the weight sensor; ESPHome keys entities by
+// the FNV-1 hash of the object ID.
+var esphomeSensorKey = func() uint32 {
+	h := fnv.New32()
+	h.Write([]byte("weight"))
+	return h.Sum32()
+}()
+
+type esphomeClient struct {
+	conn   net.Conn
+	wmu    sync.Mutex
+	notify chan struct{}
+}
+
+func newESPHomeServer(addr, name, password, units string, decimals int, interval time.Duration) (*esphomeServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &esphomeServer{ln: ln, name: name, password: password, units: units, decimals: decimals,
+		interval: interval, clients: map[*esphomeClient]struct{}{}}
+	s.wg.Go(s.accept)
+	return s, nil
+}
+
+// set records the latest weight and wakes the subscribed clients; it never
+// blocks.
+func (s *esphomeServer) set(w float64) {
+	s.mu.Lock()
+	s.state, s.hasState = float32(w), true
+	for c := range s.clients {
+		select {
+		case c.notify <- struct{}{}:
+		default:
+		}
+	}
+	s.mu.Unlock()
+}
+
+// close stops listening and disconnects the clients.
+// send sets the weight of a valid reading.
+func (s *esphomeServer) send(u weightUpdate, _ []byte) {
+	if u.valid {
+		s.set(u.weight)
+	}
+}
+
+func (s *esphomeServer) close() {
+	s.ln.Close()
+	s.mu.Lock()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *esphomeServer) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Go(func() { s.serve(conn) })
+	}
+}
+
+func (s *esphomeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	c := &esphomeClient{conn: conn, notify: make(chan struct{}, 1)}
+	r := bufio.NewReader(conn)
+	authed := s.password == ""
+	subscribed := false
+	defer func() {
+		if subscribed {
+			s.mu.Lock()
+			delete(s.clients, c)
+			s.mu.Unlock()
+			close(c.notify)
+		}
+	}()
+	for {
+		// Home Assistant pings every 20s or so
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		typ, msg, err := readESPHomeFrame(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("esphome %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		var reply protoEncoder
+		switch typ {
+		case esphomeHelloRequest:
+			reply.int(1, 1) // API version 1.10
+			reply.int(2, 10)
+			reply.str(3, "calibrate "+currentBuild().Version)
+			reply.str(4, s.name)
+			err = c.write(esphomeHelloResponse, reply.b)
+		case esphomeConnectRequest:
+			var password string
+			_ = eachProtoField(msg, func(f protoField) error {
+				if f.num == 1 {
+					password, _ = f.str()
+				}
+				return nil
+			})
+			authed = password == s.password
+			reply.boolean(1, !authed)
+			err = c.write(esphomeConnectResponse, reply.b)
+			if !authed {
+				log.Printf("esphome %s: wrong password", conn.RemoteAddr())
+				return
+			}
+		case esphomeDisconnectRequest:
+			_ = c.write(esphomeDisconnectResponse, nil)
+			return
+		case esphomePingRequest:
+			err = c.write(esphomePingResponse, nil)
+		case esphomeDeviceInfoRequest:
+			err = c.write(esphomeDeviceInfoResponse, s.deviceInfo())
+		case esphomeListEntitiesRequest, esphomeSubscribeStatesRequest:
+			if !authed {
+				return
+			}
+			if typ == esphomeListEntitiesRequest {
+				if err = c.write(esphomeListEntitiesSensor, s.sensorInfo()); err == nil {
+					err = c.write(esphomeListEntitiesDone, nil)
+				}
+				break
+			}
+			if !subscribed {
+				subscribed = true
+				s.mu.Lock()
+				s.clients[c] = struct{}{}
+				if s.hasState {
+					c.notify <- struct{}{}
+				}
+				s.mu.Unlock()
+				s.wg.Go(func() { s.pushStates(c) })
+			}
+		}
+		// other requests (logs, services, time, ...) have no answer here
+		if err != nil {
+			return
+		}
+	}
+}
+
+// pushStates sends the latest weight to a subscribed client whenever it
+// changes, at most once per interval.
+func (s *esphomeServer) pushStates(c *esphomeClient) {
+	for range c.notify {
+		s.mu.Lock()
+		var state protoEncoder
+		state.fixed32(1, esphomeSensorKey)
+		state.float(2, s.state)
+		s.mu.Unlock()
+		if c.write(esphomeSensorStateResponse, state.b) != nil {
+			c.conn.Close()
+			return
+		}
+		time.Sleep(s.interval)
+	}
+}
+
+func (s *esphomeServer) deviceInfo() []byte {
+	var e protoEncoder
+	e.boolean(1, s.password != "")
+	e.str(2, s.name)
+	e.str(3, esphomeMAC(s.name))
+	e.str(4, "2024.12.0")
+	e.str(6, "4-cell load cell scale")
+	e.str(8, "calibration-demo.scale")
+	e.str(9, currentBuild().Version)
+	e.str(12, "Calibration-Demo")
+	e.str(13, s.name)
+	return e.b
+}
+
+func (s *esphomeServer) sensorInfo() []byte {
+	var e protoEncoder
+	e.str(1, "weight")
+	e.fixed32(2, esphomeSensorKey)
+	e.str(3, "Weight")
+	e.str(4, s.name+"sensorweight")
+	e.str(5, "mdi:scale")
+	e.str(6, s.units)
+	e.int(7, int64(s.decimals))
+	e.str(9, "weight")
+	e.int(10, 1) // state class: measurement
+	return e.b
+}
+
+// esphomeMAC is the node's MAC address, which Home Assistant uses as the
+// device's identity: the first hardware address of the host, or one derived
+// from the name (locally administered) when there is none.
+func esphomeMAC(name string) string {
+	ifaces, _ := net.Interfaces()
+	for _, i := range ifaces {
+		if i.Flags&net.FlagLoopback == 0 && len(i.HardwareAddr) == 6 {
+			return strings.ToUpper(i.HardwareAddr.String())
+		}
+	}
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	mac := binary.BigEndian.AppendUint64(nil, h.Sum64())[:6]
+	mac[0] = mac[0]&^1 | 2
+	return strings.ToUpper(net.HardwareAddr(mac).String())
+}
+
+func (c *esphomeClient) write(typ int, msg []byte) error {
+	b := []byte{0}
+	b = binary.AppendUvarint(b, uint64(len(msg)))
+	b = binary.AppendUvarint(b, uint64(typ))
+	b = append(b, msg...)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// readESPHomeFrame reads one plaintext frame.
+func readESPHomeFrame(r *bufio.Reader) (typ int, msg []byte, err error) {
+	pre, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	if pre != 0 {
+		return 0, nil, errors.New("encrypted (Noise) connection; only the plaintext API is supported")
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	t, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if size > esphomeMaxMessage {
+		return 0, nil, fmt.Errorf("message of %d bytes", size)
+	}
+	msg = make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return 0, nil, err
+	}
+	return int(t), msg, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// parseCalDate accepts an RFC 3339 timestamp or a plain YYYY-MM-DD date.
+func parseCalDate(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// CalibrationExpiry returns when cal stops being valid: calibrated_at (or
+// recorded, the time the calibration entered the store, when calibrated_at is
+// absent) plus valid_days. ok is false when the calibration has no validity
+// period.
+func CalibrationExpiry(cal CalibrationData, recorded time.Time) (expiry time.Time, ok bool, err error) {
+	if cal.ValidDays <= 0 {
+		return time.Time{}, false, nil
+	}
+	start := recorded
+	if cal.CalibratedAt != "" {
+		if start, err = parseCalDate(cal.CalibratedAt); err != nil {
+			return time.Time{}, false, fmt.Errorf("invalid calibrated_at %q: %w", cal.CalibratedAt, err)
+		}
+	}
+	if start.IsZero() {
+		return time.Time{}, false, nil
+	}
+	return start.AddDate(0, 0, cal.ValidDays), true, nil
+}
+
+// daysUntil returns the whole days from now until t (negative when past).
+func daysUntil(t, now time.Time) int {
+	return int(math.Floor(t.Sub(now).Hours() / 24))
+}
+
+// DueEntry is one scale in the `due` listing.
+type DueEntry struct {
+	Scale    string `json:"scale"`
+	Version  int    `json:"version"`
+	Expiry   string `json:"expiry,omitempty"`
+	DaysLeft int    `json:"days_left"`
+	Status   string `json:"status"`
+}
+
+// dueEntry classifies the active session of a scale as EXPIRED, due (within
+// the given days), ok, or without a validity period.
+func dueEntry(active *Session, within int, now time.Time) DueEntry {
+	e := DueEntry{Scale: active.Scale, Version: active.Version, Status: "no validity period"}
+	expiry, ok, err := CalibrationExpiry(active.Calibration, active.Time)
+	if err != nil {
+		e.Status = err.Error()
+	} else if ok {
+		e.Expiry = expiry.Format("2006-01-02")
+		e.DaysLeft = daysUntil(expiry, now)
+		switch {
+		case e.DaysLeft < 0:
+			e.Status = "EXPIRED"
+		case e.DaysLeft <= within:
+			e.Status = "due"
+		default:
+			e.Status = "ok"
+		}
+	}
+	return e
+}
+
+// runDue implements `calibrate due`: list the scales whose active calibration
+// has expired or expires within -within days.
+func runDue(args []string) int {
+	fs := flag.NewFlagSet("due", flag.ExitOnError)
+	storeFlag, storeKey := storeFlags(fs)
+	within := fs.Int("within", 30, "also list scales expiring within this many days")
+	all := fs.Bool("all", false, "list every scale, including those not due and those without a validity period")
+	asJSON := fs.Bool("json", false, "print the listing as JSON")
+	_ = fs.Parse(args)
+
+	st := openStoreOrExit(*storeFlag, *storeKey)
+	if st == nil {
+		return 1
+	}
+	defer st.Close()
+	sessions, err := st.Sessions("")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading sessions: %v\n", err)
+		return 1
+	}
+	scales := map[string]bool{}
+	for _, s := range sessions {
+		scales[s.Scale] = true
+	}
+	var names []string
+	for n := range scales {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	now := time.Now().UTC()
+	entries := []DueEntry{}
+	for _, name := range names {
+		active, err := ActiveSession(st, name)
+		if err != nil || active == nil {
+			continue
+		}
+		e := dueEntry(active, *within, now)
+		if *all || e.Status == "EXPIRED" || e.Status == "due" {
+			entries = append(entries, e)
+		}
+	}
+
+	if *asJSON {
+		out, _ := json.MarshalIndent(entries, "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+	fmt.Printf("Scales due for recalibration (within %d days): %d\n", *within, len(entries))
+	for _, e := range entries {
+		fmt.Printf("  %-20s v%-4d expiry %-10s  days left %5d  %s\n", e.Scale, e.Version, e.Expiry, e.DaysLeft, e.Status)
+	}
+	return 0
+}
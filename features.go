@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Optional integrations. The network integrations that only some
+// installations need (kafka, mqtt, hass, redis, esphome, ros, otel and
+// syslog) live in files behind a build tag of that name, and -tags full
+// builds all of them, like the sqlite and bolt stores; the default binary
+// carries none. Each file registers what it adds from init(), so the rest of
+// the code reaches an integration only through registries and hooks that
+// stay empty when it is not compiled in, and `calibrate version` reports
+// exactly what the binary has.
+
+// buildFeatures lists the features compiled in, by kind ("alerts",
+// "live outputs", ...).
+var buildFeatures = map[string][]string{}
+
+// registerFeature records that the named features of kind are compiled in.
+func registerFeature(kind string, names ...string) {
+	buildFeatures[kind] = append(buildFeatures[kind], names...)
+}
+
+// features returns the features of kind, sorted.
+func features(kind string) []string {
+	out := slices.Clone(buildFeatures[kind])
+	slices.Sort(out)
+	return out
+}
+
+// notBuiltIn is the error for an option whose integration is not compiled in.
+func notBuiltIn(option, tag string) error {
+	return fmt.Errorf("%s is not available in this build (build with -tags %s or -tags full)", option, tag)
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockFD is a no-op where flock is unavailable: concurrent runs are not
+// serialized there, though writeFileAtomic still prevents torn files.
+func lockFD(f *os.File) error { return nil }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// nonFinite names a NaN or infinite value ("NaN", "+Inf", "-Inf"), or returns
+// "" for a finite one.
+func nonFinite(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return ""
+}
+
+// CheckFinite returns an error naming the first calibration field that is NaN
+// or infinite. Such values would otherwise turn every factor into NaN.
+func CheckFinite(cal CalibrationData) error {
+	if s := nonFinite(cal.CalibrationWeight); s != "" {
+		return fmt.Errorf("calibration field calibration_weight is %s", s)
+	}
+	rows := calRows(cal)
+	all := append([][4]float64{cal.Zero}, rows[:]...)
+	names := append([]string{"zero"}, calRowNames[:]...)
+	for i, row := range all {
+		for ch, v := range row {
+			if s := nonFinite(v); s != "" {
+				return fmt.Errorf("calibration field %s[%d] is %s", names[i], ch, s)
+			}
+		}
+	}
+	if p := cal.CellPositions; p != nil {
+		for ch, xy := range p {
+			for k, v := range xy {
+				if s := nonFinite(v); s != "" {
+					return fmt.Errorf("calibration field cell_positions[%d][%d] is %s", ch, k, s)
+				}
+			}
+		}
+	}
+	if e := cal.Electrical; e != nil {
+		names := []string{"excitation_v", "adc_ref_v", "gain", "cell_capacity", "tolerance"}
+		for i, v := range []float64{e.ExcitationV, e.ADCRefV, e.Gain, e.CellCapacity, e.Tolerance} {
+			if s := nonFinite(v); s != "" {
+				return fmt.Errorf("calibration field electrical.%s is %s", names[i], s)
+			}
+		}
+		if r := e.RatedOutput; r != nil {
+			for ch, v := range r {
+				if s := nonFinite(v); s != "" {
+					return fmt.Errorf("calibration field electrical.rated_output_mv_v[%d] is %s", ch, s)
+				}
+			}
+		}
+	}
+	if r := cal.Replacement; r != nil {
+		for ch, v := range r.Factors {
+			if s := nonFinite(v); s != "" {
+				return fmt.Errorf("calibration field cell_replacement.kept_factors[%d] is %s", ch, s)
+			}
+		}
+	}
+	return nil
+}
+
+// checkReadingFinite returns an error naming the first NaN or infinite
+// channel of an ADC reading.
+func checkReadingFinite(adc [4]float64) error {
+	for ch, v := range adc {
+		if s := nonFinite(v); s != "" {
+			return fmt.Errorf("channel %d is %s", ch, s)
+		}
+	}
+	return nil
+}
+
+// nonFiniteField walks v (structs by their JSON names, slices, arrays, maps
+// and pointers) and returns the path of the first NaN or infinite float, e.g.
+// "readings[2].weight", and its value. ok is false when every float is finite.
+func nonFiniteField(v any) (path, value string, ok bool) {
+	return walkNonFinite(reflect.ValueOf(v), "")
+}
+
+func walkNonFinite(v reflect.Value, path string) (string, string, bool) {
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		if s := nonFinite(v.Float()); s != "" {
+			return path, s, true
+		}
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			return walkNonFinite(v.Elem(), path)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			sub := name
+			if path != "" {
+				sub = path + "." + name
+			}
+			if p, s, ok := walkNonFinite(v.Field(i), sub); ok {
+				return p, s, true
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if p, s, ok := walkNonFinite(v.Index(i), fmt.Sprintf("%s[%d]", path, i)); ok {
+				return p, s, true
+			}
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			if p, s, ok := walkNonFinite(iter.Value(), fmt.Sprintf("%s[%v]", path, iter.Key())); ok {
+				return p, s, true
+			}
+		}
+	}
+	return "", "", false
+}
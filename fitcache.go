@@ -0,0 +1,70 @@
+package main
+
+import "sync"
+
+// fitKey identifies a fit: the calibration's content checksum (see
+// CalibrationChecksum) and the ridge it was solved with.
+type fitKey struct {
+	checksum string
+	ridge    float64
+}
+
+// fitCache memoizes FitCalibration for the long-running modes, so repeated
+// requests with the same calibration skip the solve. Entries are keyed by
+// content, so a changed calibration never hits a stale entry; past limit the
+// oldest entry is dropped. Failed fits are not cached.
+type fitCache struct {
+	mu      sync.Mutex
+	limit   int
+	entries map[fitKey]CalibrationResult
+	order   []fitKey
+}
+
+// newFitCache returns a cache of at most limit fits; 0 disables caching.
+func newFitCache(limit int) *fitCache {
+	return &fitCache{limit: limit, entries: map[fitKey]CalibrationResult{}}
+}
+
+// fit returns FitCalibration(cal, ridge), from the cache when the same
+// calibration was fitted before. The result is a copy the caller may modify.
+func (c *fitCache) fit(cal CalibrationData, ridge float64) (CalibrationResult, error) {
+	if c == nil || c.limit <= 0 {
+		return FitCalibration(cal, ridge)
+	}
+	key := fitKey{CalibrationChecksum(cal), ridge}
+	c.mu.Lock()
+	res, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok {
+		return cloneFit(res), nil
+	}
+	res, err := FitCalibration(cal, ridge)
+	if err != nil {
+		return res, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		if len(c.order) >= c.limit {
+			delete(c.entries, c.order[0])
+			c.order = c.order[1:]
+		}
+		c.entries[key] = res
+		c.order = append(c.order, key)
+	}
+	return cloneFit(res), nil
+}
+
+// cloneFit copies the parts of a fit result that are shared by pointer.
+func cloneFit(res CalibrationResult) CalibrationResult {
+	if res.Grade != nil {
+		g := *res.Grade
+		g.Penalties = append([]GradePenalty(nil), g.Penalties...)
+		res.Grade = &g
+	}
+	if res.Stage != nil {
+		s := *res.Stage
+		res.Stage = &s
+	}
+	return res
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CellInfo is the registry metadata of one load cell channel.
+type CellInfo struct {
+	Channel  int     `json:"channel"`
+	Serial   string  `json:"serial,omitempty"`
+	Model    string  `json:"model,omitempty"`
+	Capacity float64 `json:"capacity,omitempty"`
+}
+
+// ScaleInfo is a scale registry entry. The ID is the -scale name its
+// calibrations are recorded under; the active calibration comes from the
+// store's active pointer rather than being duplicated here.
+type ScaleInfo struct {
+	ID       string     `json:"id"`
+	Location string     `json:"location,omitempty"`
+	Model    string     `json:"model,omitempty"`
+	Cells    []CellInfo `json:"cells,omitempty"`
+	// Check holds the tolerances of the automatic zero/span checks run by
+	// `calibrate daemon`.
+	Check      *CheckTolerances `json:"check,omitempty"`
+	Registered time.Time        `json:"registered"`
+	Updated    time.Time        `json:"updated"`
+}
+
+// scaleIDPattern is the form of scale IDs the API and the registry accept.
+var scaleIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// checkScaleID refuses scale IDs that could escape a path or a command line
+// they are substituted into (-live-source {scale}): only letters, digits,
+// '.', '_' and '-', and no "..".
+func checkScaleID(id string) error {
+	if !scaleIDPattern.MatchString(id) || strings.Contains(id, "..") {
+		return fmt.Errorf("invalid scale ID %q (use letters, digits, '.', '_' and '-')", id)
+	}
+	return nil
+}
+
+// FleetEntry is one scale in the `fleet` listing.
+type FleetEntry struct {
+	Scale      string   `json:"scale"`
+	Location   string   `json:"location,omitempty"`
+	Registered bool     `json:"registered"`
+	Cells      int      `json:"cells"`
+	Version    int      `json:"version,omitempty"`
+	Checksum   string   `json:"checksum,omitempty"`
+	Expiry     string   `json:"expiry,omitempty"`
+	DaysLeft   int      `json:"days_left,omitempty"`
+	Due        string   `json:"due_status"`
+	LastBatch  string   `json:"last_batch,omitempty"`
+	Issues     []string `json:"issues"`
+	Status     string   `json:"status"`
+}
+
+// qualityIssues lists the quality checks the calibration result fails:
+// the calibration's own OK flag, the residual variance limit (when maxResVar
+// is positive) and any eccentricity, linearity, repeatability or noise test
+// recorded with it.
+func qualityIssues(r CalibrationResult, maxResVar float64) []string {
+	issues := []string{}
+	if !r.CalibrationOK {
+		issues = append(issues, "calibration not ok")
+	}
+	if maxResVar > 0 && r.ResidualVar > maxResVar {
+		issues = append(issues, fmt.Sprintf("residual variance %.4g > %.4g", r.ResidualVar, maxResVar))
+	}
+	if r.Eccentricity != nil && !r.Eccentricity.Pass {
+		issues = append(issues, "eccentricity test failed")
+	}
+	if r.Linearity != nil && !r.Linearity.Pass {
+		issues = append(issues, "linearity test failed")
+	}
+	if r.Repeatability != nil && !r.Repeatability.Pass {
+		issues = append(issues, "repeatability test failed")
+	}
+	if r.Noise != nil && !r.Noise.ResolutionOK {
+		issues = append(issues, "noise exceeds the display division")
+	}
+	return issues
+}
+
+// runRegister implements `calibrate register`: add a scale to the registry or
+// update the fields given on the command line.
+func runRegister(args []string) int {
+	fs := flag.NewFlagSet("register", flag.ExitOnError)
+	storeFlag, storeKey := storeFlags(fs)
+	scale := fs.String("scale", "", "scale ID (the -scale name its calibrations are recorded under)")
+	location := fs.String("location", "", "where the scale is installed")
+	model := fs.String("model", "", "scale or indicator model")
+	serials := fs.String("cell-serials", "", "comma-separated load cell serial numbers, channels 0-3")
+	cellModel := fs.String("cell-model", "", "load cell model (all channels)")
+	cellCap := fs.Float64("cell-capacity", 0, "rated capacity of each load cell")
+	zeroTol := fs.Float64("zero-tol", 0, "daemon checks: largest allowed weight with the platform empty")
+	spanTol := fs.Float64("span-tol", 0, "daemon checks: largest allowed error on the span check weight")
+	spanWeight := fs.Float64("span-weight", 0, "daemon checks: mass of the span check weight")
+	_ = fs.Parse(args)
+
+	if *scale == "" {
+		fmt.Fprintln(os.Stderr, "error: -scale is required")
+		return 2
+	}
+	if err := checkScaleID(*scale); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	st := openStoreOrExit(*storeFlag, *storeKey)
+	if st == nil {
+		return 1
+	}
+	defer st.Close()
+	scales, err := st.Scales()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading registry: %v\n", err)
+		return 1
+	}
+	now := time.Now().UTC()
+	sc := ScaleInfo{ID: *scale, Registered: now}
+	existing := false
+	for _, s := range scales {
+		if s.ID == *scale {
+			sc, existing = s, true
+		}
+	}
+	sc.Updated = now
+	if set["location"] {
+		sc.Location = *location
+	}
+	if set["model"] {
+		sc.Model = *model
+	}
+	if len(sc.Cells) == 0 && (set["cell-serials"] || set["cell-model"] || set["cell-capacity"]) {
+		for ch := 0; ch < 4; ch++ {
+			sc.Cells = append(sc.Cells, CellInfo{Channel: ch})
+		}
+	}
+	if set["cell-serials"] {
+		parts := strings.Split(*serials, ",")
+		if len(parts) != 4 {
+			fmt.Fprintf(os.Stderr, "error: -cell-serials needs 4 values, got %d\n", len(parts))
+			return 2
+		}
+		for ch, p := range parts {
+			sc.Cells[ch].Serial = strings.TrimSpace(p)
+		}
+	}
+	for ch := range sc.Cells {
+		if set["cell-model"] {
+			sc.Cells[ch].Model = *cellModel
+		}
+		if set["cell-capacity"] {
+			sc.Cells[ch].Capacity = *cellCap
+		}
+	}
+	if set["zero-tol"] || set["span-tol"] || set["span-weight"] {
+		if sc.Check == nil {
+			sc.Check = &CheckTolerances{}
+		}
+		if set["zero-tol"] {
+			sc.Check.ZeroTol = *zeroTol
+		}
+		if set["span-tol"] {
+			sc.Check.SpanTol = *spanTol
+		}
+		if set["span-weight"] {
+			sc.Check.SpanWeight = *spanWeight
+		}
+		if (sc.Check.SpanTol > 0) != (sc.Check.SpanWeight > 0) {
+			fmt.Fprintln(os.Stderr, "error: the span check needs both -span-tol and -span-weight")
+			return 2
+		}
+	}
+	if err := st.SaveScale(&sc); err != nil {
+		fmt.Fprintf(os.Stderr, "error saving registry: %v\n", err)
+		return 1
+	}
+	if existing {
+		fmt.Printf("Updated scale %s\n", sc.ID)
+	} else {
+		fmt.Printf("Registered scale %s\n", sc.ID)
+	}
+	return 0
+}
+
+// runFleet implements `calibrate fleet`: the status of every registered scale
+// and every scale with recorded calibrations, optionally narrowed to those
+// failing quality thresholds (-failing) or overdue for recalibration (-overdue).
+func runFleet(args []string) int {
+	fs := flag.NewFlagSet("fleet", flag.ExitOnError)
+	storeFlag, storeKey := storeFlags(fs)
+	failing := fs.Bool("failing", false, "only list scales failing quality thresholds")
+	overdue := fs.Bool("overdue", false, "only list scales whose calibration has expired or is due")
+	within := fs.Int("within", 30, "days before expiry at which a calibration counts as due")
+	maxResVar := fs.Float64("max-resvar", 0, "flag calibrations whose residual variance exceeds this (0 = no limit)")
+	asJSON := fs.Bool("json", false, "print the listing as JSON")
+	_ = fs.Parse(args)
+
+	st := openStoreOrExit(*storeFlag, *storeKey)
+	if st == nil {
+		return 1
+	}
+	defer st.Close()
+	registry, err := st.Scales()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading registry: %v\n", err)
+		return 1
+	}
+	sessions, err := st.Sessions("")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading sessions: %v\n", err)
+		return 1
+	}
+	batches, err := st.Batches("")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading batches: %v\n", err)
+		return 1
+	}
+
+	info := map[string]ScaleInfo{}
+	for _, sc := range registry {
+		info[sc.ID] = sc
+	}
+	names := map[string]bool{}
+	for _, sc := range registry {
+		names[sc.ID] = true
+	}
+	for _, s := range sessions {
+		names[s.Scale] = true
+	}
+	lastBatch := map[string]time.Time{}
+	for _, b := range batches {
+		lastBatch[b.Scale] = b.Time
+	}
+	var sorted []string
+	for n := range names {
+		sorted = append(sorted, n)
+	}
+	sort.Strings(sorted)
+
+	now := time.Now().UTC()
+	entries := []FleetEntry{}
+	for _, name := range sorted {
+		sc, registered := info[name]
+		e := FleetEntry{Scale: name, Location: sc.Location, Registered: registered, Cells: len(sc.Cells), Issues: []string{}}
+		if t, ok := lastBatch[name]; ok {
+			e.LastBatch = t.Format("2006-01-02 15:04")
+		}
+		active, err := ActiveSession(st, name)
+		switch {
+		case err != nil:
+			e.Due = "unknown"
+			e.Issues = append(e.Issues, err.Error())
+		case active == nil:
+			e.Due = "uncalibrated"
+			e.Issues = append(e.Issues, "no active calibration")
+		default:
+			d := dueEntry(active, *within, now)
+			e.Version, e.Checksum, e.Expiry, e.DaysLeft, e.Due = active.Version, active.Checksum, d.Expiry, d.DaysLeft, d.Status
+			e.Issues = append(e.Issues, qualityIssues(active.Result, *maxResVar)...)
+		}
+		isOverdue := e.Due == "EXPIRED" || e.Due == "due"
+		switch {
+		case len(e.Issues) > 0:
+			e.Status = "FAIL"
+		case isOverdue:
+			e.Status = "OVERDUE"
+		default:
+			e.Status = "ok"
+		}
+		if (*failing || *overdue) && !(*failing && len(e.Issues) > 0) && !(*overdue && isOverdue) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	if *asJSON {
+		out, _ := json.MarshalIndent(entries, "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+	fmt.Printf("Fleet status (%d scales):\n", len(entries))
+	for _, e := range entries {
+		loc := e.Location
+		if !e.Registered {
+			loc = "(unregistered)"
+		}
+		fmt.Printf("  %-20s %-20s v%-4d sha256=%.12s  expiry %-10s  %-18s  last batch %-16s  %s\n",
+			e.Scale, loc, e.Version, e.Checksum, e.Expiry, e.Due, e.LastBatch, e.Status)
+		for _, is := range e.Issues {
+			fmt.Printf("      - %s\n", is)
+		}
+	}
+	return 0
+}
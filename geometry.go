@@ -0,0 +1,37 @@
+package main
+
+import "math"
+
+// CenterOfLoad returns the point where the load acts, as the contribution-
+// weighted mean of the cell positions. ok is false when the total is zero.
+func CenterOfLoad(contrib [4]float64, pos [4][2]float64) (x, y float64, ok bool) {
+	total := 0.0
+	for i := 0; i < 4; i++ {
+		total += contrib[i]
+		x += contrib[i] * pos[i][0]
+		y += contrib[i] * pos[i][1]
+	}
+	if total == 0 {
+		return 0, 0, false
+	}
+	return x / total, y / total, true
+}
+
+// OffCenterRatio expresses how far (x, y) lies from the centroid of the cells,
+// as a fraction of the distance from that centroid to the farthest cell: 0 is
+// dead center, 1 is directly over the outermost cell.
+func OffCenterRatio(x, y float64, pos [4][2]float64) float64 {
+	cx, cy := 0.0, 0.0
+	for i := 0; i < 4; i++ {
+		cx += pos[i][0] / 4
+		cy += pos[i][1] / 4
+	}
+	reach := 0.0
+	for i := 0; i < 4; i++ {
+		reach = math.Max(reach, math.Hypot(pos[i][0]-cx, pos[i][1]-cy))
+	}
+	if reach == 0 {
+		return 0
+	}
+	return math.Hypot(x-cx, y-cy) / reach
+}
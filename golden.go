@@ -0,0 +1,462 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// goldenFormat is the version of the golden file layout.
+const goldenFormat = 1
+
+// GoldenRun is a recorded calibrate/apply run: everything it read and
+// everything it produced. Replaying it runs the same arguments on copies of
+// the same inputs, with the clock pinned to Now, and compares the results.
+type GoldenRun struct {
+	Format   int               `json:"format"`
+	Recorded time.Time         `json:"recorded"`
+	Now      string            `json:"now"`
+	Args     []string          `json:"args"`
+	Env      map[string]string `json:"env,omitempty"`
+	Inputs   map[string]string `json:"inputs"`
+	ExitCode int               `json:"exit_code"`
+	Stdout   string            `json:"stdout"`
+	Stderr   string            `json:"stderr"`
+	Outputs  map[string]string `json:"outputs"`
+}
+
+// goldenFileFlags are the calibrate flags naming files, by how the run uses
+// them: "in" files are captured, "out" files compared and "inout" files both.
+var goldenFileFlags = map[string]string{
+	"cal":            "in",
+	"adc-file":       "in",
+	"ecc-file":       "in",
+	"linearity-file": "in",
+	"repeat-file":    "in",
+	"zero-capture":   "in",
+	"tolerance-file": "in",
+	"trusted-key":    "in",
+	"post-script":    "in",
+	"json-out":       "out",
+	"cert-out":       "out",
+	"readings-out":   "out",
+	"proto-out":      "out",
+	"xlsx-out":       "out",
+	"total-file":     "inout",
+}
+
+// goldenRefused are flags whose runs depend on state outside the recorded
+// files (the store, the audit log, the terminal) or reach outside the run
+// (webhooks). A -temp-cals file names further calibration files, which a
+// recording does not capture.
+var goldenRefused = []string{"store", "store-key", "audit-log", "prompt", "hooks", "temp-cals"}
+
+// goldenEnv are the environment variables a recorded run keeps; all other
+// CAL_* variables are cleared so the replay host's settings do not leak in
+// (CAL_HOOKS among them: a replay never fires webhooks).
+var goldenEnv = []string{"CAL_RIDGE", "CAL_PRINT_NORMAL"}
+
+// nowUTC returns the current time, or the time pinned by $CAL_NOW
+// (RFC 3339 or 2006-01-02) for reproducible record/replay runs, or by
+// $SOURCE_DATE_EPOCH (Unix seconds) as in reproducible builds.
+func nowUTC() time.Time {
+	if t, err := parseGoldenNow(os.Getenv("CAL_NOW")); err == nil {
+		return t
+	}
+	if sec, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		return time.Unix(sec, 0).UTC()
+	}
+	return time.Now().UTC()
+}
+
+func parseGoldenNow(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// splitFlagArg splits a command-line token into a flag name and an inline
+// value ("-cal=x" -> "cal", "x", true). ok is false for non-flag tokens.
+func splitFlagArg(arg string) (name, value string, inline, ok bool) {
+	if len(arg) < 2 || arg[0] != '-' || arg == "--" {
+		return "", "", false, false
+	}
+	name = strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+	if i := strings.IndexByte(name, '='); i >= 0 {
+		return name[:i], name[i+1:], true, true
+	}
+	return name, "", false, true
+}
+
+// NewGoldenRun captures the inputs of a calibrate run with args, rewriting
+// every file flag to a copy in the run directory.
+func NewGoldenRun(args []string, now time.Time) (*GoldenRun, error) {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return nil, fmt.Errorf("only the calibrate/apply flow can be recorded, not %q", args[0])
+	}
+	g := &GoldenRun{
+		Format:   goldenFormat,
+		Recorded: time.Now().UTC(),
+		Now:      now.Format(time.RFC3339),
+		Env:      map[string]string{"CAL_OPERATOR": operatorName("")},
+		Inputs:   map[string]string{},
+		Outputs:  map[string]string{},
+	}
+	for _, k := range goldenEnv {
+		if v := os.Getenv(k); v != "" {
+			g.Env[k] = v
+		}
+	}
+
+	// file settings taken from the environment become explicit flags
+	seen := map[string]bool{}
+	for _, a := range args {
+		if name, _, _, ok := splitFlagArg(a); ok {
+			seen[name] = true
+		}
+	}
+	args = append([]string(nil), args...)
+	for flagName, env := range map[string]string{"trusted-key": "CAL_TRUSTED_KEY", "tolerance-file": "CAL_TOLERANCES"} {
+		if v := os.Getenv(env); v != "" && !seen[flagName] {
+			args = append(args, "-"+flagName, v)
+		}
+	}
+	if !seen["cal"] {
+		args = append(args, "-cal", "calibration.json")
+	}
+
+	for i := 0; i < len(args); i++ {
+		name, value, inline, ok := splitFlagArg(args[i])
+		if !ok {
+			continue
+		}
+		if containsString(goldenRefused, name) {
+			return nil, fmt.Errorf("-%s cannot be recorded: the run would depend on state outside its files", name)
+		}
+		if name == "temp" {
+			v := value
+			if !inline && i+1 < len(args) {
+				v = args[i+1]
+			}
+			if strings.HasPrefix(v, "cmd:") {
+				return nil, errors.New("-temp cmd: cannot be recorded: the run would depend on the sensor; give the temperature as a number")
+			}
+		}
+		role, ok := goldenFileFlags[name]
+		if !ok {
+			continue
+		}
+		if !inline {
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("flag -%s needs a value", name)
+			}
+			i++
+			value = args[i]
+		}
+		local := name + "-" + filepath.Base(value)
+		if inline {
+			args[i] = "-" + name + "=" + local
+		} else {
+			args[i] = local
+		}
+		if role == "out" {
+			continue
+		}
+		b, err := os.ReadFile(value)
+		switch {
+		case err == nil:
+			g.Inputs[local] = string(b)
+		case errors.Is(err, os.ErrNotExist) && role == "inout":
+			// created by the run
+		default:
+			return nil, err
+		}
+		if name == "cal" {
+			if sig, err := os.ReadFile(value + ".sig"); err == nil {
+				g.Inputs[local+".sig"] = string(sig)
+			}
+		}
+	}
+	g.Args = args
+	return g, nil
+}
+
+// outputFiles lists the files the run writes, in sorted order.
+func (g *GoldenRun) outputFiles() []string {
+	names := []string{"output.txt"}
+	for i := 0; i < len(g.Args); i++ {
+		name, value, inline, ok := splitFlagArg(g.Args[i])
+		if !ok {
+			continue
+		}
+		role, ok := goldenFileFlags[name]
+		if !ok {
+			continue
+		}
+		if !inline && i+1 < len(g.Args) {
+			i++
+			value = g.Args[i]
+		}
+		if role != "in" && !containsString(names, value) {
+			names = append(names, value)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Execute runs bin with the recorded arguments in a fresh directory holding
+// the inputs and returns what the run produced, in the shape of a GoldenRun.
+func (g *GoldenRun) Execute(bin string) (*GoldenRun, error) {
+	dir, err := os.MkdirTemp("", "calibrate-golden")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	for name, data := range g.Inputs {
+		if filepath.Base(name) != name || name == "." || name == ".." {
+			return nil, fmt.Errorf("invalid input file name %q", name)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "CAL_") {
+			env = append(env, kv)
+		}
+	}
+	for k, v := range g.Env {
+		env = append(env, k+"="+v)
+	}
+	env = append(env, "CAL_NOW="+g.Now)
+
+	var stdout, stderr strings.Builder
+	cmd := exec.Command(bin, g.Args...)
+	cmd.Dir, cmd.Env, cmd.Stdout, cmd.Stderr = dir, env, &stdout, &stderr
+	got := &GoldenRun{Outputs: map[string]string{}}
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, err
+		}
+		got.ExitCode = exitErr.ExitCode()
+	}
+	got.Stdout, got.Stderr = stdout.String(), stderr.String()
+	for _, name := range g.outputFiles() {
+		if b, err := os.ReadFile(filepath.Join(dir, name)); err == nil {
+			got.Outputs[name] = goldenOutput(b)
+		}
+	}
+	return got, nil
+}
+
+// goldenOutput returns the recorded form of an output file: its text, or
+// for a binary file (-proto-out, -xlsx-out), which JSON strings cannot
+// hold, its SHA-256 digest.
+func goldenOutput(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// firstDiff describes the first line where want and got differ.
+func firstDiff(what, want, got string) string {
+	wl, gl := strings.Split(want, "\n"), strings.Split(got, "\n")
+	line := func(lines []string, i int) string {
+		if i >= len(lines) {
+			return "(end of output)"
+		}
+		if i == len(lines)-1 && lines[i] == "" {
+			return "(end of output, after a final newline)"
+		}
+		return lines[i]
+	}
+	for i := 0; i < len(wl) || i < len(gl); i++ {
+		if w, g := line(wl, i), line(gl, i); w != g {
+			return fmt.Sprintf("%s line %d:\n    want: %s\n    got:  %s", what, i+1, w, g)
+		}
+	}
+	return what + " differs"
+}
+
+// Compare lists the differences between the recorded results and got.
+func (g *GoldenRun) Compare(got *GoldenRun) []string {
+	var diffs []string
+	if got.ExitCode != g.ExitCode {
+		diffs = append(diffs, fmt.Sprintf("exit code: want %d, got %d", g.ExitCode, got.ExitCode))
+	}
+	if got.Stdout != g.Stdout {
+		diffs = append(diffs, firstDiff("stdout", g.Stdout, got.Stdout))
+	}
+	if got.Stderr != g.Stderr {
+		diffs = append(diffs, firstDiff("stderr", g.Stderr, got.Stderr))
+	}
+	var names []string
+	for name := range g.Outputs {
+		names = append(names, name)
+	}
+	for name := range got.Outputs {
+		if _, ok := g.Outputs[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		want, inWant := g.Outputs[name]
+		have, inGot := got.Outputs[name]
+		switch {
+		case !inGot:
+			diffs = append(diffs, fmt.Sprintf("%s: not written", name))
+		case !inWant:
+			diffs = append(diffs, fmt.Sprintf("%s: written but not recorded", name))
+		case want != have:
+			diffs = append(diffs, firstDiff(name, want, have))
+		}
+	}
+	return diffs
+}
+
+// LoadGoldenRun reads a golden file.
+func LoadGoldenRun(path string) (*GoldenRun, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var g GoldenRun
+	if err := json.Unmarshal(b, &g); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if g.Format != goldenFormat {
+		return nil, fmt.Errorf("%s: unsupported golden format %d", path, g.Format)
+	}
+	return &g, nil
+}
+
+// runRecord implements `calibrate record`: run the calibrate flow with the
+// given flags and save its inputs and outputs as a golden file.
+func runRecord(args []string) int {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	out := fs.String("o", "golden.json", "golden file to write")
+	nowFlag := fs.String("now", "", "date or RFC 3339 time the run is pinned to (default now)")
+	_ = fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: calibrate record [-o FILE] [-now TIME] -- CALIBRATE-FLAGS...")
+		return 2
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	if *nowFlag != "" {
+		t, err := parseGoldenNow(*nowFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: invalid -now %q (want 2006-01-02 or RFC 3339)\n", *nowFlag)
+			return 2
+		}
+		now = t
+	}
+	g, err := NewGoldenRun(fs.Args(), now)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+	bin, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	got, err := g.Execute(bin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error running calibrate: %v\n", err)
+		return 1
+	}
+	g.ExitCode, g.Stdout, g.Stderr, g.Outputs = got.ExitCode, got.Stdout, got.Stderr, got.Outputs
+	b, _ := json.MarshalIndent(g, "", "  ")
+	if err := writeFileAtomic(*out, append(b, '\n'), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing golden file: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Recorded %s: exit code %d, %d input file(s), %d output file(s), clock pinned to %s\n",
+		*out, g.ExitCode, len(g.Inputs), len(g.Outputs), g.Now)
+	return 0
+}
+
+// runReplay implements `calibrate replay`: rerun golden files (or every
+// golden file in the given directories) and report any difference.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	binFlag := fs.String("bin", "", "calibrate binary to check (default this one)")
+	_ = fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: calibrate replay [-bin PATH] GOLDEN|DIR ...")
+		return 2
+	}
+	bin := *binFlag
+	if bin == "" {
+		var err error
+		if bin, err = os.Executable(); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+	}
+	var paths []string
+	for _, arg := range fs.Args() {
+		info, err := os.Stat(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		matches, _ := filepath.Glob(filepath.Join(arg, "*.json"))
+		paths = append(paths, matches...)
+	}
+
+	passed, failed := 0, 0
+	for _, path := range paths {
+		g, err := LoadGoldenRun(path)
+		var got *GoldenRun
+		if err == nil {
+			got, err = g.Execute(bin)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: error: %v\n", path, err)
+			failed++
+			continue
+		}
+		diffs := g.Compare(got)
+		if len(diffs) == 0 {
+			fmt.Printf("%s: OK\n", path)
+			passed++
+			continue
+		}
+		fmt.Printf("%s: FAIL\n", path)
+		for _, d := range diffs {
+			fmt.Printf("  %s\n", d)
+		}
+		failed++
+	}
+	fmt.Printf("Replayed %d golden run(s): %d identical, %d different\n", passed+failed, passed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
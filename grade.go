@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// GradePenalty is what one aspect of the calibration cost its grade.
+type GradePenalty struct {
+	Aspect string  `json:"aspect"`
+	Points float64 `json:"points"`
+	Reason string  `json:"reason"`
+}
+
+// Grade is the overall quality of a calibration: a score out of 100 and its
+// letter (A >= 90, B >= 80, C >= 70, D >= 60, else F), with the penalties
+// that lowered it, largest first.
+type Grade struct {
+	Letter    string         `json:"letter"`
+	Score     float64        `json:"score"`
+	Penalties []GradePenalty `json:"penalties,omitempty"`
+}
+
+// Penalty caps per aspect: a single bad aspect can take a calibration down
+// to D; an F needs at least two.
+const (
+	gradeResidualMax  = 40
+	gradeConditionMax = 30
+	gradeBalanceMax   = 20
+	gradeNoiseMax     = 20
+)
+
+func clampPoints(p, max float64) float64 {
+	return math.Min(max, math.Max(0, p))
+}
+
+// GradeCalibration combines the fit residuals, the conditioning of the normal
+// matrix, the balance of the factors and, when a zero capture was analysed,
+// the noise-limited resolution into a letter grade:
+//
+//	residuals      20 points per percent of RMS row error relative to W (max 40)
+//	conditioning   5 points per decade of condition number above 1e4 (max 30)
+//	factor balance 20 points per unit of largest/smallest |factor| above 1.25 (max 20)
+//	noise          20 points per division of 1-sigma weight noise above half a division (max 20)
+func GradeCalibration(cal CalibrationData, factors [4]float64, rss float64, noise *NoiseReport) Grade {
+	var pen []GradePenalty
+	add := func(aspect string, points float64, format string, args ...any) {
+		if points = math.Round(points*10) / 10; points > 0 {
+			pen = append(pen, GradePenalty{aspect, points, fmt.Sprintf(format, args...)})
+		}
+	}
+
+	if w := cal.CalibrationWeight; w > 0 {
+		rmsPct := 100 * math.Sqrt(rss/5) / w
+		add("residuals", clampPoints(20*rmsPct, gradeResidualMax), "RMS row error %.3g%% of the calibration weight", rmsPct)
+	}
+
+	cond := DiagnoseCollinearity(cal).Condition
+	add("conditioning", clampPoints(5*(math.Log10(cond)-4), gradeConditionMax), "condition number %.3g", cond)
+
+	lo, hi := math.Inf(1), 0.0
+	for _, f := range factors {
+		lo, hi = math.Min(lo, math.Abs(f)), math.Max(hi, math.Abs(f))
+	}
+	if lo > 0 {
+		ratio := hi / lo
+		add("factor balance", clampPoints(20*(ratio-1.25), gradeBalanceMax), "largest factor is %.3gx the smallest", ratio)
+	} else {
+		add("factor balance", gradeBalanceMax, "a factor is zero")
+	}
+
+	if noise != nil && noise.Division > 0 {
+		r := noise.WeightSigma / noise.Division
+		add("noise", clampPoints(20*(r-0.5), gradeNoiseMax), "1-sigma weight noise %.3g is %.2g display divisions", noise.WeightSigma, r)
+	}
+
+	sort.SliceStable(pen, func(i, j int) bool { return pen[i].Points > pen[j].Points })
+	g := Grade{Score: 100, Penalties: pen}
+	for _, p := range pen {
+		g.Score -= p.Points
+	}
+	g.Score = math.Round(math.Max(0, g.Score)*10) / 10
+	switch {
+	case g.Score >= 90:
+		g.Letter = "A"
+	case g.Score >= 80:
+		g.Letter = "B"
+	case g.Score >= 70:
+		g.Letter = "C"
+	case g.Score >= 60:
+		g.Letter = "D"
+	default:
+		g.Letter = "F"
+	}
+	return g
+}
+
+// Summary is the grade on one line, e.g. "B (84.2/100; residuals -10.2, ...)".
+func (g Grade) Summary() string {
+	if len(g.Penalties) == 0 {
+		return fmt.Sprintf("%s (%.1f/100)", g.Letter, g.Score)
+	}
+	var parts []string
+	for _, p := range g.Penalties {
+		parts = append(parts, fmt.Sprintf("%s -%.1f", p.Aspect, p.Points))
+	}
+	return fmt.Sprintf("%s (%.1f/100; %s)", g.Letter, g.Score, strings.Join(parts, ", "))
+}
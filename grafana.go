@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The Grafana dashboard of `calibrate grafana`, over the /metrics series of
+// serve scraped by Prometheus: an overview of the API, then a row per scale
+// (repeated over the scale variable) with its calibration, checks, live
+// weight, drift and reading error rate.
+
+// grafanaDashboard builds the dashboard. An empty datasource UID makes it an
+// importable export with a DS_PROMETHEUS input chosen on import; scales
+// preselects the scale variable (all scales when empty).
+func grafanaDashboard(title, datasource string, scales []string, refresh string) map[string]any {
+	ds := map[string]any{"type": "prometheus", "uid": datasource}
+	if datasource == "" {
+		ds["uid"] = "${DS_PROMETHEUS}"
+	}
+	g := grafanaLayout{ds: ds}
+
+	g.row("API", "")
+	g.timeseries("Requests", "reqps", 24, 7,
+		grafanaTarget("rate(calibrate_http_requests_total[5m])", "handled"),
+		grafanaTarget("rate(calibrate_http_changes_total[5m])", "changes"),
+		grafanaTarget("rate(calibrate_http_rejected_total[5m])", "rejected (limits)"))
+
+	g.row("Scale $scale", "scale")
+	sel := `{scale="$scale"}`
+	g.stat("Calibration age", "s", nil, grafanaTarget("calibrate_calibration_age_seconds"+sel, ""))
+	g.stat("Active version", "none", nil, grafanaTarget("calibrate_calibration_version"+sel, ""))
+	g.stat("Quality score", "none", grafanaThresholds("red", 60, "orange", 80, "green"),
+		grafanaTarget("calibrate_calibration_quality_score"+sel, ""))
+	g.stat("Residual variance", "none", nil, grafanaTarget("calibrate_calibration_residual_variance"+sel, ""))
+	pass := g.stat("Last checks", "none", grafanaThresholds("red", 1, "green"),
+		grafanaTarget(`calibrate_check_pass{scale="$scale"}`, "{{check}}"))
+	pass["fieldConfig"].(map[string]any)["defaults"].(map[string]any)["mappings"] = []any{map[string]any{
+		"type": "value", "options": map[string]any{"0": map[string]any{"text": "FAIL"}, "1": map[string]any{"text": "PASS"}}}}
+	g.stat("Live streams", "none", nil, grafanaTarget("calibrate_streams"+sel, ""))
+	g.timeseries("Live weight", "none", 12, 8, grafanaTarget("calibrate_weight"+sel, "weight"))
+	g.timeseries("Reading error rate", "percentunit", 12, 8,
+		grafanaTarget(`rate(calibrate_readings_dropped_total{scale="$scale"}[5m]) / rate(calibrate_readings_total{scale="$scale"}[5m])`, "dropped"))
+	g.timeseries("Zero drift (ADC counts)", "none", 12, 8, grafanaTarget("calibrate_zero_drift_counts"+sel, "ch{{channel}}"))
+	g.timeseries("Check deviation (measured - expected)", "none", 12, 8, grafanaTarget("calibrate_check_deviation"+sel, "{{check}}"))
+
+	current := map[string]any{"text": []string{"All"}, "value": []string{"$__all"}}
+	if len(scales) > 0 {
+		current = map[string]any{"text": scales, "value": scales}
+	}
+	variable := map[string]any{
+		"name": "scale", "label": "Scale", "type": "query", "datasource": ds,
+		"definition": "label_values(calibrate_calibration_version, scale)",
+		"query":      map[string]any{"query": "label_values(calibrate_calibration_version, scale)", "refId": "scales"},
+		"refresh":    2, "sort": 1, "multi": true, "includeAll": true, "current": current,
+	}
+	dash := map[string]any{
+		"title": title, "uid": "calibrate-scales", "tags": []string{"calibrate"},
+		"timezone": "browser", "schemaVersion": 39, "version": 1, "editable": true,
+		"refresh": refresh, "time": map[string]any{"from": "now-6h", "to": "now"},
+		"templating": map[string]any{"list": []any{variable}},
+		"panels":     g.panels,
+	}
+	if datasource == "" {
+		dash["__inputs"] = []any{map[string]any{"name": "DS_PROMETHEUS", "label": "Prometheus", "description": "Prometheus scraping calibrate serve /metrics",
+			"type": "datasource", "pluginId": "prometheus", "pluginName": "Prometheus"}}
+	}
+	return dash
+}
+
+// grafanaLayout places panels on Grafana's 24-column grid, left to right and
+// then down.
+type grafanaLayout struct {
+	ds     map[string]any
+	panels []any
+	x, y   int
+	rowH   int
+}
+
+func (g *grafanaLayout) place(p map[string]any, w, h int) map[string]any {
+	if g.x+w > 24 {
+		g.x, g.y, g.rowH = 0, g.y+g.rowH, 0
+	}
+	p["id"] = len(g.panels) + 1
+	p["gridPos"] = map[string]any{"x": g.x, "y": g.y, "w": w, "h": h}
+	g.x += w
+	g.rowH = max(g.rowH, h)
+	g.panels = append(g.panels, p)
+	return p
+}
+
+// row starts a row, repeated over the variable when repeat is set.
+func (g *grafanaLayout) row(title, repeat string) {
+	g.x, g.y, g.rowH = 0, g.y+g.rowH, 0
+	p := map[string]any{"type": "row", "title": title, "collapsed": false, "panels": []any{}}
+	if repeat != "" {
+		p["repeat"] = repeat
+	}
+	g.place(p, 24, 1)
+	g.x, g.y, g.rowH = 0, g.y+1, 0
+}
+
+func (g *grafanaLayout) stat(title, unit string, thresholds map[string]any, targets ...map[string]any) map[string]any {
+	defaults := map[string]any{"unit": unit}
+	if thresholds != nil {
+		defaults["thresholds"] = thresholds
+		defaults["color"] = map[string]any{"mode": "thresholds"}
+	}
+	return g.place(map[string]any{
+		"type": "stat", "title": title, "datasource": g.ds, "targets": targets,
+		"fieldConfig": map[string]any{"defaults": defaults, "overrides": []any{}},
+		"options": map[string]any{"reduceOptions": map[string]any{"calcs": []string{"lastNotNull"}, "fields": "", "values": false},
+			"colorMode": "value", "graphMode": "none", "textMode": "auto"},
+	}, 4, 4)
+}
+
+func (g *grafanaLayout) timeseries(title, unit string, w, h int, targets ...map[string]any) map[string]any {
+	return g.place(map[string]any{
+		"type": "timeseries", "title": title, "datasource": g.ds, "targets": targets,
+		"fieldConfig": map[string]any{"defaults": map[string]any{"unit": unit}, "overrides": []any{}},
+		"options":     map[string]any{"legend": map[string]any{"displayMode": "list", "placement": "bottom", "showLegend": true}},
+	}, w, h)
+}
+
+func grafanaTarget(expr, legend string) map[string]any {
+	return map[string]any{"expr": expr, "legendFormat": legend, "refId": "A"}
+}
+
+// grafanaThresholds turns color, limit, color, ... into absolute thresholds.
+func grafanaThresholds(steps ...any) map[string]any {
+	list := []any{map[string]any{"color": steps[0], "value": nil}}
+	for i := 1; i+1 < len(steps); i += 2 {
+		list = append(list, map[string]any{"color": steps[i+1], "value": steps[i]})
+	}
+	return map[string]any{"mode": "absolute", "steps": list}
+}
+
+// runGrafana implements `calibrate grafana`: print a Grafana dashboard for
+// the Prometheus metrics of serve.
+func runGrafana(args []string) int {
+	fs := flag.NewFlagSet("grafana", flag.ExitOnError)
+	out := fs.String("o", "", "write the dashboard to this file instead of stdout")
+	title := fs.String("title", "Calibrated scales", "dashboard title")
+	datasource := fs.String("datasource", "", "UID of the Prometheus data source, for provisioning; empty asks for it on import")
+	scales := fs.String("scales", "", "comma-separated scales selected when the dashboard opens (default all)")
+	refresh := fs.String("refresh", "30s", "dashboard auto-refresh interval")
+	_ = fs.Parse(args)
+
+	var selected []string
+	for _, s := range strings.Split(*scales, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			selected = append(selected, s)
+		}
+	}
+	doc, _ := json.MarshalIndent(grafanaDashboard(*title, *datasource, selected, *refresh), "", "  ")
+	doc = append(doc, '\n')
+	if *out == "" {
+		os.Stdout.Write(doc)
+		return 0
+	}
+	if err := writeFileAtomic(*out, doc, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The calibrate.v1.Weights gRPC service (proto/calibration.proto), served by
+// hand on the API listener like the protobuf encoding: gRPC is HTTP/2 with
+// length-prefixed protobuf messages and the status in trailers, which
+// net/http provides (unencrypted HTTP/2 included), so no gRPC runtime is
+// needed for one server-streaming method.
+
+func init() { registerFeature("api", "grpc") }
+
+// gRPC status codes.
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// grpcMaxMessage bounds the request message.
+const grpcMaxMessage = 1 << 20
+
+// streamWeightsRequest is the StreamWeightsRequest message.
+type streamWeightsRequest struct {
+	scale        string
+	filter       int
+	stableWindow int
+	stableBand   float64
+}
+
+func unmarshalStreamWeightsRequest(b []byte) (streamWeightsRequest, error) {
+	req := streamWeightsRequest{stableWindow: 3, stableBand: 0.5}
+	err := eachProtoField(b, func(f protoField) error {
+		var err error
+		var v int64
+		switch f.num {
+		case 1:
+			req.scale, err = f.str()
+		case 2:
+			v, err = f.int()
+			req.filter = int(int32(v))
+		case 3:
+			if v, err = f.int(); v != 0 {
+				req.stableWindow = int(int32(v))
+			}
+		case 4:
+			var band float64
+			if band, err = f.double(); band != 0 {
+				req.stableBand = band
+			}
+		}
+		return err
+	})
+	switch {
+	case err != nil:
+		return req, err
+	case req.scale == "":
+		return req, errors.New("scale is required")
+	case checkScaleID(req.scale) != nil:
+		return req, checkScaleID(req.scale)
+	case req.filter < 0 || req.stableWindow < 1 || req.filter > 10000 || req.stableWindow > 10000:
+		return req, errors.New("filter must be 0..10000 and stable_window 1..10000")
+	case req.stableBand < 0 || math.IsNaN(req.stableBand):
+		return req, errors.New("stable_band must not be negative")
+	}
+	return req, nil
+}
+
+// weightUpdate is the WeightUpdate message.
+type weightUpdate struct {
+	reading  int64
+	time     time.Time
+	weight   float64
+	filtered float64
+	stable   bool
+	valid    bool
+	invalid  string
+	version  int
+	// uncertainty is the expanded (k=2) uncertainty of weight, when
+	// uncertaintyOK.
+	uncertainty   float64
+	uncertaintyOK bool
+}
+
+func (u weightUpdate) marshal() []byte {
+	var e protoEncoder
+	e.int(1, u.reading)
+	e.int(2, u.time.UnixNano())
+	e.double(3, u.weight)
+	e.double(4, u.filtered)
+	e.boolean(5, u.stable)
+	e.boolean(6, u.valid)
+	e.str(7, u.invalid)
+	e.int(8, int64(u.version))
+	if u.uncertaintyOK {
+		e.optDouble(9, &u.uncertainty)
+	}
+	return e.b
+}
+
+// weightJSON is the JSON form of a weightUpdate for the message outputs
+// (Kafka, Redis), with the scale and units.
+type weightJSON struct {
+	Scale          string   `json:"scale"`
+	Reading        int64    `json:"reading"`
+	TimeUnixNano   int64    `json:"time_unix_nano"`
+	Weight         float64  `json:"weight"`
+	FilteredWeight float64  `json:"filtered_weight"`
+	Stable         bool     `json:"stable"`
+	Valid          bool     `json:"valid"`
+	Invalid        string   `json:"invalid,omitempty"`
+	Uncertainty    *float64 `json:"uncertainty,omitempty"`
+	Units          string   `json:"units"`
+}
+
+func (u weightUpdate) json(scale, units string) []byte {
+	j := weightJSON{Scale: scale, Reading: u.reading, TimeUnixNano: u.time.UnixNano(),
+		Weight: u.weight, FilteredWeight: u.filtered, Stable: u.stable, Valid: u.valid, Invalid: u.invalid, Units: units}
+	if u.uncertaintyOK {
+		j.Uncertainty = &u.uncertainty
+	}
+	b, _ := json.Marshal(j)
+	return b
+}
+
+// weightTracker turns weights into updates: a moving average over the last
+// filter valid weights, and stable when the last window valid weights agree
+// within band.
+type weightTracker struct {
+	filter, window int
+	band           float64
+	recent         []float64
+}
+
+func (t *weightTracker) add(w float64) (filtered float64, stable bool) {
+	t.recent = append(t.recent, w)
+	if n := max(t.filter, t.window); len(t.recent) > n {
+		t.recent = t.recent[len(t.recent)-n:]
+	}
+	avg := t.recent[max(len(t.recent)-max(t.filter, 1), 0):]
+	for _, v := range avg {
+		filtered += v / float64(len(avg))
+	}
+	if len(t.recent) < t.window {
+		return filtered, false
+	}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, v := range t.recent[len(t.recent)-t.window:] {
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+	}
+	return filtered, hi-lo <= t.band
+}
+
+// openLiveSource starts the readings source of scale: a file or FIFO, or
+// cmd:<command> whose output is read as it runs. {scale} is replaced in
+// either, so scale must have passed checkScaleID. Closing the reader (or cancelling ctx) stops the source.
+func openLiveSource(ctx context.Context, spec, scale string) (io.ReadCloser, error) {
+	cmdline, isCmd := strings.CutPrefix(spec, "cmd:")
+	if !isCmd {
+		return os.Open(strings.ReplaceAll(spec, "{scale}", scale))
+	}
+	args := strings.Fields(cmdline)
+	if len(args) == 0 {
+		return nil, errors.New("empty -live-source command")
+	}
+	for i := range args {
+		args[i] = strings.ReplaceAll(args[i], "{scale}", scale)
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdReader{out, cmd}, nil
+}
+
+type cmdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (c *cmdReader) Close() error {
+	c.ReadCloser.Close()
+	_ = c.cmd.Process.Kill()
+	_ = c.cmd.Wait()
+	return nil
+}
+
+// grpcFrame prefixes msg with the gRPC message header (uncompressed).
+func grpcFrame(msg []byte) []byte {
+	out := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(out[1:], uint32(len(msg)))
+	return append(out, msg...)
+}
+
+// grpcTrailersOnly answers a call that fails before any message.
+func grpcTrailersOnly(w http.ResponseWriter, code int, format string, args ...any) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", fmt.Sprintf(format, args...))
+	w.WriteHeader(http.StatusOK)
+}
+
+// streamWeights implements calibrate.v1.Weights/StreamWeights: it applies the
+// active calibration of the requested scale to the -live-source readings and
+// pushes a WeightUpdate per reading until the source ends, the client
+// cancels or the server shuts down (UNAVAILABLE, so clients reconnect).
+// Read-only tokens may stream; streams count against the rate limit once.
+func (s *calServer) streamWeights(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		writeError(w, http.StatusUnsupportedMediaType, "StreamWeights is a gRPC method (HTTP/2, application/grpc)")
+		return
+	}
+	tok := s.lookupToken(r)
+	if tok == nil {
+		grpcTrailersOnly(w, grpcUnauthenticated, "missing or invalid API token")
+		return
+	}
+	if ok, wait := s.limiter.allow("token "+tok.name, time.Now()); !ok {
+		s.limited.Add(1)
+		grpcTrailersOnly(w, grpcResourceExhausted, "rate limit exceeded, retry in %s", wait.Round(time.Millisecond))
+		return
+	}
+	s.requests.Add(1)
+
+	var head [5]byte
+	if _, err := io.ReadFull(r.Body, head[:]); err != nil {
+		grpcTrailersOnly(w, grpcInvalidArgument, "reading request: %v", err)
+		return
+	}
+	size := binary.BigEndian.Uint32(head[1:])
+	if head[0] != 0 || size > grpcMaxMessage {
+		grpcTrailersOnly(w, grpcInvalidArgument, "compressed or oversized request message")
+		return
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r.Body, msg); err != nil {
+		grpcTrailersOnly(w, grpcInvalidArgument, "reading request: %v", err)
+		return
+	}
+	req, err := unmarshalStreamWeightsRequest(msg)
+	if err != nil {
+		grpcTrailersOnly(w, grpcInvalidArgument, "%v", err)
+		return
+	}
+	if s.liveSource == "" {
+		grpcTrailersOnly(w, grpcFailedPrecondition, "the server has no -live-source")
+		return
+	}
+
+	s.mu.Lock()
+	var active *Session
+	st, err := OpenStore(s.storeSpec, s.storeKey)
+	if err == nil {
+		active, err = ActiveSession(st, req.scale)
+		st.Close()
+	}
+	s.mu.Unlock()
+	switch {
+	case err != nil:
+		grpcTrailersOnly(w, grpcUnavailable, "reading store: %v", err)
+		return
+	case active == nil:
+		grpcTrailersOnly(w, grpcNotFound, "scale %q has no active calibration", req.scale)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stop := context.AfterFunc(s.quit, cancel)
+	defer stop()
+	src, err := openLiveSource(ctx, s.liveSource, req.scale)
+	if err != nil {
+		grpcTrailersOnly(w, grpcUnavailable, "live source: %v", err)
+		return
+	}
+	// closing the source unblocks the read below when the stream ends
+	closeSrc := sync.OnceFunc(func() { src.Close() })
+	context.AfterFunc(ctx, closeSrc)
+	defer closeSrc()
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	_ = rc.Flush()
+
+	record, end := s.live.stream(req.scale)
+	defer end()
+	limits := ADCRangeSummary{Min: -8388608, Max: 8388607}
+	track := weightTracker{filter: req.filter, window: req.stableWindow, band: req.stableBand}
+	in := bufio.NewScanner(src)
+	var adc [4]float64
+	var n int64
+	_, span := s.tel.start(r.Context(), "stream weights", attr("calibrate.scale", req.scale), attr("calibrate.version", active.Version))
+	defer func() {
+		span.set(attr("calibrate.readings", n))
+		span.end()
+	}()
+	for in.Scan() {
+		n++
+		u := weightUpdate{reading: n, time: time.Now().UTC(), version: active.Version}
+		// the line itself is not echoed: clients see only that it was malformed
+		switch err := parseLiveReading(in.Bytes(), &adc); {
+		case err != nil:
+			u.invalid = "malformed reading"
+		case !limits.within(adc):
+			u.invalid = limits.check(adc)
+		default:
+			u.valid = true
+			u.weight = ComputeWeight(adc, active.Calibration.Zero, active.Result.Factors)
+			u.filtered, u.stable = track.add(u.weight)
+		}
+		record(u)
+		s.tel.countReadings(u.valid, 1)
+		if _, err := w.Write(grpcFrame(u.marshal())); err != nil {
+			return // the client has gone
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+	code, message := grpcOK, ""
+	switch {
+	case s.quit.Err() != nil:
+		code, message = grpcUnavailable, "server shutting down"
+	case r.Context().Err() != nil:
+		return
+	case in.Err() != nil:
+		code, message = grpcUnavailable, "live source: "+in.Err().Error()
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", message)
+}
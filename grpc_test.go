@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamWeightsRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		encode  func(e *protoEncoder)
+		want    streamWeightsRequest
+		wantErr string
+	}{
+		{
+			name:   "defaults",
+			encode: func(e *protoEncoder) { e.str(1, "line1") },
+			want:   streamWeightsRequest{scale: "line1", stableWindow: 3, stableBand: 0.5},
+		},
+		{
+			name: "all fields",
+			encode: func(e *protoEncoder) {
+				e.str(1, "line1")
+				e.int(2, 5)
+				e.int(3, 10)
+				e.double(4, 0.05)
+			},
+			want: streamWeightsRequest{scale: "line1", filter: 5, stableWindow: 10, stableBand: 0.05},
+		},
+		{
+			name: "unknown field skipped",
+			encode: func(e *protoEncoder) {
+				e.str(1, "line1")
+				e.str(99, "from a newer client")
+			},
+			want: streamWeightsRequest{scale: "line1", stableWindow: 3, stableBand: 0.5},
+		},
+		{name: "no scale", encode: func(e *protoEncoder) { e.int(2, 1) }, wantErr: "scale is required"},
+		{name: "bad scale", encode: func(e *protoEncoder) { e.str(1, "../x") }, wantErr: "scale"},
+		{
+			// int32 -1 is sent as a ten-byte varint
+			name: "negative filter",
+			encode: func(e *protoEncoder) {
+				e.str(1, "line1")
+				e.int(2, -1)
+			},
+			wantErr: "filter must be",
+		},
+		{
+			name: "negative band",
+			encode: func(e *protoEncoder) {
+				e.str(1, "line1")
+				e.double(4, -1)
+			},
+			wantErr: "stable_band",
+		},
+		{
+			name: "NaN band",
+			encode: func(e *protoEncoder) {
+				e.str(1, "line1")
+				e.double(4, math.NaN())
+			},
+			wantErr: "stable_band",
+		},
+		{name: "truncated", encode: func(e *protoEncoder) { e.b = []byte{0x0a, 0x05, 'l'} }, wantErr: "truncated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e protoEncoder
+			tt.encode(&e)
+			got, err := unmarshalStreamWeightsRequest(e.b)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("request = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// unmarshalWeightUpdate decodes a WeightUpdate message as a client would.
+func unmarshalWeightUpdate(b []byte) (weightUpdate, error) {
+	var u weightUpdate
+	err := eachProtoField(b, func(f protoField) error {
+		var err error
+		var v int64
+		switch f.num {
+		case 1:
+			u.reading, err = f.int()
+		case 2:
+			v, err = f.int()
+			u.time = time.Unix(0, v)
+		case 3:
+			u.weight, err = f.double()
+		case 4:
+			u.filtered, err = f.double()
+		case 5:
+			u.stable = f.v != 0
+		case 6:
+			u.valid = f.v != 0
+		case 7:
+			u.invalid, err = f.str()
+		case 8:
+			v, err = f.int()
+			u.version = int(v)
+		case 9:
+			u.uncertainty, err = f.double()
+			u.uncertaintyOK = true
+		}
+		return err
+	})
+	return u, err
+}
+
+func TestWeightUpdateRoundTrip(t *testing.T) {
+	at := time.Date(2026, 3, 1, 12, 0, 0, 123456789, time.UTC)
+	tests := []struct {
+		name string
+		u    weightUpdate
+	}{
+		{"valid", weightUpdate{reading: 1, time: at, weight: 12.5, filtered: 12.25, stable: true, valid: true, version: 3}},
+		{"invalid", weightUpdate{reading: 2, time: at, invalid: "adc out of range", version: 3}},
+		{"negative weight", weightUpdate{reading: 3, time: at, weight: -0.5, filtered: -0.25, valid: true, version: 1}},
+		{"with uncertainty", weightUpdate{reading: 4, time: at, weight: 100, valid: true, version: 2, uncertainty: 0.02, uncertaintyOK: true}},
+		// an explicit zero uncertainty is sent, unlike the proto3 defaults
+		{"zero uncertainty", weightUpdate{reading: 5, time: at, valid: true, version: 2, uncertaintyOK: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := tt.u.marshal()
+			frame := grpcFrame(msg)
+			if frame[0] != 0 || binary.BigEndian.Uint32(frame[1:5]) != uint32(len(msg)) {
+				t.Fatalf("frame header % x for a %d-byte message", frame[:5], len(msg))
+			}
+			got, err := unmarshalWeightUpdate(frame[5:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.time.Equal(tt.u.time) {
+				t.Errorf("time = %v, want %v", got.time, tt.u.time)
+			}
+			got.time = tt.u.time
+			if !reflect.DeepEqual(got, tt.u) {
+				t.Errorf("round trip = %+v, want %+v", got, tt.u)
+			}
+
+			var j weightJSON
+			if err := json.Unmarshal(tt.u.json("line1", "kg"), &j); err != nil {
+				t.Fatal(err)
+			}
+			want := weightJSON{Scale: "line1", Reading: tt.u.reading, TimeUnixNano: at.UnixNano(), Weight: tt.u.weight,
+				FilteredWeight: tt.u.filtered, Stable: tt.u.stable, Valid: tt.u.valid, Invalid: tt.u.invalid, Units: "kg"}
+			if tt.u.uncertaintyOK {
+				want.Uncertainty = &tt.u.uncertainty
+			}
+			if !reflect.DeepEqual(j, want) {
+				t.Errorf("JSON = %+v, want %+v", j, want)
+			}
+		})
+	}
+}
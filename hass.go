@@ -0,0 +1,79 @@
+//go:build hass || full
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"strings"
+)
+
+// haDiscovery describes the scale to Home Assistant's MQTT discovery, so it
+// appears as a weight sensor without configuration.
+type haDiscovery struct {
+	prefix string // discovery prefix, "homeassistant" by default
+	scale  string
+	units  string
+	// valueTemplate extracts the weight from a JSON state ("" for a plain
+	// number).
+	valueTemplate string
+}
+
+func init() {
+	mqttDiscovery = func(fs *flag.FlagSet) func(cfg liveSinkConfig, mqtt bool) (mqttAnnouncer, error) {
+		disc := fs.Bool("ha-discovery", false, "with -mqtt, announce the scale as a Home Assistant weight sensor (MQTT discovery)")
+		prefix := fs.String("ha-prefix", "homeassistant", "Home Assistant discovery prefix")
+		return func(cfg liveSinkConfig, mqtt bool) (mqttAnnouncer, error) {
+			if !*disc {
+				return nil, nil
+			}
+			if !mqtt {
+				return nil, errors.New("-ha-discovery needs -mqtt")
+			}
+			d := haDiscovery{prefix: *prefix, scale: cfg.scale, units: cfg.units}
+			if cfg.nodeRED {
+				d.valueTemplate = "{{ value_json.weight }}"
+			}
+			return d, nil
+		}
+	}
+	registerFeature("live outputs", "hass")
+}
+
+// haNodeID turns a scale ID into a discovery node ID ([a-zA-Z0-9_-]).
+func haNodeID(scale string) string {
+	return "calibrate_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, scale)
+}
+
+// config returns the retained discovery message of the weight sensor whose
+// state and availability are published to stateTopic and availTopic.
+func (d haDiscovery) config(stateTopic, availTopic string) (topic string, payload []byte) {
+	node := haNodeID(d.scale)
+	cfg := map[string]any{
+		"name":                "Weight",
+		"unique_id":           node + "_weight",
+		"state_topic":         stateTopic,
+		"availability_topic":  availTopic,
+		"unit_of_measurement": d.units,
+		"device_class":        "weight",
+		"state_class":         "measurement",
+		"device": map[string]any{
+			"identifiers":  []string{node},
+			"name":         d.scale,
+			"model":        "4-cell load cell scale",
+			"manufacturer": "Calibration-Demo",
+			"sw_version":   currentBuild().Version,
+		},
+	}
+	if d.valueTemplate != "" {
+		cfg["value_template"] = d.valueTemplate
+	}
+	payload, _ = json.Marshal(cfg)
+	return d.prefix + "/sensor/" + node + "/weight/config", payload
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// runHistory implements `calibrate history`: list the recorded calibration
+// sessions, applied batches and verification checks of one scale, or of all
+// scales.
+func runHistory(args []string) int {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	storeFlag, storeKey := storeFlags(fs)
+	scale := fs.String("scale", "", "only show this scale (default all scales)")
+	asJSON := fs.Bool("json", false, "print the records as JSON")
+	_ = fs.Parse(args)
+
+	st := openStoreOrExit(*storeFlag, *storeKey)
+	if st == nil {
+		return 1
+	}
+	defer st.Close()
+	sessions, err := st.Sessions(*scale)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading sessions: %v\n", err)
+		return 1
+	}
+	batches, err := st.Batches(*scale)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading batches: %v\n", err)
+		return 1
+	}
+	checks, err := st.Checks(*scale)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading checks: %v\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		out, _ := json.MarshalIndent(struct {
+			Sessions []Session      `json:"sessions"`
+			Batches  []BatchSummary `json:"batches"`
+			Checks   []CheckRecord  `json:"checks"`
+		}{sessions, batches, checks}, "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+
+	active := map[string]int{}
+	fmt.Printf("Calibration versions (%d, * = active):\n", len(sessions))
+	for _, s := range sessions {
+		if _, ok := active[s.Scale]; !ok {
+			active[s.Scale], _ = st.Active(s.Scale)
+		}
+		mark := " "
+		if active[s.Scale] == s.Version {
+			mark = "*"
+		}
+		f := s.Result.Factors
+		stage := ""
+		if sg := s.Result.Stage; sg != nil {
+			stage = fmt.Sprintf("  %s ±%.3g%%", sg.Stage, sg.ExpectedError)
+		}
+		fmt.Printf(" %s#%-4d %s  scale=%s v%d  sha256=%.12s  f=[%.6g %.6g %.6g %.6g]  resvar=%.4g  ok=%v%s  (%s)\n",
+			mark, s.ID, s.Time.Format("2006-01-02 15:04:05"), s.Scale, s.Version, s.Checksum, f[0], f[1], f[2], f[3],
+			s.Result.ResidualVar, s.Result.CalibrationOK, stage, s.Source)
+	}
+	fmt.Printf("Applied batches (%d):\n", len(batches))
+	for _, b := range batches {
+		fmt.Printf("  #%-4d %s  scale=%s  session=#%d  readings=%d (invalid %d)  mean=%.4g  min=%.4g  max=%.4g  accepted=%d (%.4g)\n",
+			b.ID, b.Time.Format("2006-01-02 15:04:05"), b.Scale, b.SessionID, b.Readings, b.Invalid,
+			b.MeanWeight, b.MinWeight, b.MaxWeight, b.Accepted, b.AcceptedTotal)
+	}
+	fmt.Printf("Verification checks (%d):\n", len(checks))
+	for _, c := range checks {
+		verdict := "PASS"
+		if !c.Pass {
+			verdict = "FAIL"
+		}
+		fmt.Printf("  #%-4d %s  scale=%s v%d  %-5s measured=%.4g expected=%.4g ±%.4g  %s  by %s (%s)\n",
+			c.ID, c.Time.Format("2006-01-02 15:04:05"), c.Scale, c.Version, c.Check, c.Measured, c.Expected, c.Tolerance,
+			verdict, c.Operator, c.Source)
+	}
+	return 0
+}
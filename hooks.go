@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Hook events: a stable weight accepted into the totalizer, a -product
+// classification outside the band, a daemon check going out of spec and a
+// calibration in use past its validity period.
+const (
+	eventAccepted = "weight.accepted"
+	eventUnder    = "weight.under"
+	eventOver     = "weight.over"
+	eventDrift    = "drift.alarm"
+	eventExpired  = "calibration.expired"
+)
+
+var hookEvents = []string{eventAccepted, eventUnder, eventOver, eventDrift, eventExpired}
+
+// HookConfig is the -hooks file: the webhooks to call and, per hook, the
+// events it wants.
+type HookConfig struct {
+	Hooks []Hook `json:"hooks"`
+	// Queue is how many events each hook keeps while its endpoint is
+	// unreachable (default 1000); the oldest are dropped beyond it.
+	Queue int `json:"queue,omitempty"`
+}
+
+// Hook is one webhook. Events lists the events it is called for ("*" for
+// all). Template is a text/template producing the JSON body from the event's
+// fields (.event, .time, .scale, .version and the fields of the event, see
+// HookEvent); the json function quotes a value. Without a template the body
+// is the HookEvent itself.
+type Hook struct {
+	Name     string            `json:"name,omitempty"`
+	Events   []string          `json:"events"`
+	URL      string            `json:"url"`
+	Method   string            `json:"method,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Template string            `json:"template,omitempty"`
+}
+
+// HookEvent is an event as delivered without a template. Fields holds the
+// event's own values, e.g. weight, reading and product for the weight events,
+// check, measured, expected and tolerance for drift.alarm, expiry and
+// days_expired for calibration.expired.
+type HookEvent struct {
+	Event   string         `json:"event"`
+	Time    time.Time      `json:"time"`
+	Scale   string         `json:"scale"`
+	Version int            `json:"version,omitempty"`
+	Fields  map[string]any `json:"fields,omitempty"`
+}
+
+// templateData flattens the event for templates.
+func (e HookEvent) templateData() map[string]any {
+	data := map[string]any{"event": e.Event, "time": e.Time.Format(time.RFC3339), "scale": e.Scale, "version": e.Version}
+	for k, v := range e.Fields {
+		data[k] = v
+	}
+	return data
+}
+
+var hookFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// hookSinks delivers events to the configured webhooks, each through its
+// own outbox so an unreachable endpoint delays its events without blocking
+// weighing or losing them.
+type hookSinks struct {
+	hooks []hookSink
+}
+
+type hookSink struct {
+	Hook
+	tmpl *template.Template
+	out  *outbox
+}
+
+// hooksPath returns the -hooks flag value, falling back to $CAL_HOOKS.
+func hooksPath(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	return os.Getenv("CAL_HOOKS")
+}
+
+// LoadHooks reads a -hooks file and starts the delivery of its hooks. Each
+// template is tried on a sample event so a broken one fails here rather than
+// at the first event.
+func LoadHooks(path string) (*hookSinks, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg HookConfig
+	if err := decodeJSON(path, b, &cfg); err != nil {
+		return nil, err
+	}
+	switch {
+	case cfg.Queue == 0:
+		cfg.Queue = 1000
+	case cfg.Queue < 0:
+		return nil, fmt.Errorf("%s: queue must be at least 1", path)
+	}
+	hs := &hookSinks{}
+	for i, h := range cfg.Hooks {
+		name := h.Name
+		if name == "" {
+			name = fmt.Sprintf("hook %d", i+1)
+		}
+		if h.Method == "" {
+			h.Method = http.MethodPost
+		}
+		switch {
+		case !strings.HasPrefix(h.URL, "http://") && !strings.HasPrefix(h.URL, "https://"):
+			return nil, fmt.Errorf("%s: %s: url must be http:// or https://", path, name)
+		case len(h.Events) == 0:
+			return nil, fmt.Errorf("%s: %s: no events (any of %s, or *)", path, name, strings.Join(hookEvents, ", "))
+		}
+		for _, ev := range h.Events {
+			if ev != "*" && !slices.Contains(hookEvents, ev) {
+				return nil, fmt.Errorf("%s: %s: unknown event %q (any of %s, or *)", path, name, ev, strings.Join(hookEvents, ", "))
+			}
+		}
+		s := hookSink{Hook: h}
+		if h.Template != "" {
+			if s.tmpl, err = template.New(name).Funcs(hookFuncs).Option("missingkey=zero").Parse(h.Template); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			sample := HookEvent{Event: eventAccepted, Time: nowUTC(), Scale: "sample", Version: 1, Fields: map[string]any{"weight": 1.0}}
+			if _, err := s.render(sample); err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", path, name, err)
+			}
+		}
+		hs.hooks = append(hs.hooks, s)
+	}
+	// the outboxes start once the whole file is valid
+	for i := range hs.hooks {
+		s := &hs.hooks[i]
+		client := &http.Client{Timeout: 10 * time.Second}
+		name := "hook " + s.URL
+		if s.Name != "" {
+			name = "hook " + s.Name
+		}
+		s.out = newOutbox(name, cfg.Queue, func(payload []byte) error {
+			req, err := http.NewRequest(s.Method, s.URL, bytes.NewReader(payload))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/json")
+			for k, v := range s.Headers {
+				req.Header.Set(k, os.ExpandEnv(v))
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				return fmt.Errorf("%s", resp.Status)
+			}
+			return nil
+		})
+	}
+	return hs, nil
+}
+
+// render produces the body of ev for the hook.
+func (s *hookSink) render(ev HookEvent) ([]byte, error) {
+	if s.tmpl == nil {
+		return json.Marshal(ev)
+	}
+	var buf bytes.Buffer
+	if err := s.tmpl.Execute(&buf, ev.templateData()); err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("template output is not valid JSON: %.200s", buf.String())
+	}
+	return buf.Bytes(), nil
+}
+
+// fire queues ev for every hook that wants it. A nil hookSinks ignores it.
+func (hs *hookSinks) fire(ev HookEvent) {
+	if hs == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = nowUTC()
+	}
+	for i := range hs.hooks {
+		s := &hs.hooks[i]
+		if !slices.Contains(s.Events, ev.Event) && !slices.Contains(s.Events, "*") {
+			continue
+		}
+		payload, err := s.render(ev)
+		if err != nil {
+			log.Printf("warning: %s: %s event not sent: %v", s.out.name, ev.Event, err)
+			continue
+		}
+		s.out.enqueue(payload)
+	}
+}
+
+// health returns the delivery state of the hooks.
+func (hs *hookSinks) health() []SinkHealth {
+	var out []SinkHealth
+	if hs != nil {
+		for _, s := range hs.hooks {
+			out = append(out, s.out.Health())
+		}
+	}
+	return out
+}
+
+// close delivers what is still queued until ctx is done and returns the
+// number of events that could not be delivered.
+func (hs *hookSinks) close(ctx context.Context) int {
+	if hs == nil {
+		return 0
+	}
+	lost := 0
+	for _, s := range hs.hooks {
+		if n := s.out.close(ctx); n > 0 {
+			log.Printf("warning: %s: %d event(s) undelivered at exit", s.out.name, n)
+			lost += n
+		}
+	}
+	return lost
+}
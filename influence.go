@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"Calibration-Demo/core"
+)
+
+// influentialRowFrac is the relative factor change, when a row is left out of
+// the fit, above which the calibration is said to hinge on that row.
+const influentialRowFrac = 0.05
+
+// influenceMinDF is the fewest residual degrees of freedom (rows minus
+// factors) for which rows are singled out as influential: with one, the rows
+// left after dropping any row just determine the factors, so every row moves
+// them by about its residual and none stands out.
+const influenceMinDF = 2
+
+// RowInfluence is the effect of leaving one calibration row out of the fit.
+type RowInfluence struct {
+	Row string `json:"row"`
+	// Factors is the fit of the other four rows; Change is Factors minus the
+	// full fit, and MaxChange the largest |Change| relative to its factor.
+	Factors   [4]float64 `json:"factors_without"`
+	Change    [4]float64 `json:"change"`
+	MaxChange float64    `json:"max_rel_change"`
+	// Singular is set when the other rows cannot determine the factors.
+	Singular bool `json:"singular,omitempty"`
+}
+
+// InfluenceReport lists the influence of every row and the row the fit
+// depends on most.
+type InfluenceReport struct {
+	Rows            []RowInfluence `json:"rows"`
+	MostInfluential string         `json:"most_influential"`
+	MaxChange       float64        `json:"max_rel_change"`
+	// DF is the residual degrees of freedom of the full fit.
+	DF int `json:"df"`
+}
+
+// Influential returns the rows the calibration hinges on: those whose
+// omission moves a factor by more than influentialRowFrac. It is empty below
+// influenceMinDF degrees of freedom.
+func (rep InfluenceReport) Influential() []RowInfluence {
+	if rep.DF < influenceMinDF {
+		return nil
+	}
+	var out []RowInfluence
+	for _, r := range rep.Rows {
+		if r.MaxChange > influentialRowFrac {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// fitDeltas solves the least-squares fit sum_j f_j * delta_ij = w over the
+// given delta rows through the normal equations, as ComputeFactors does.
+func fitDeltas(rows [][4]float64, w, ridge float64) ([4]float64, error) {
+	var A [4][4]float64
+	var b [4]float64
+	for _, r := range rows {
+		for i := 0; i < 4; i++ {
+			for j := 0; j < 4; j++ {
+				A[i][j] += r[i] * r[j]
+			}
+			b[i] += r[i] * w
+		}
+	}
+	for i := 0; i < 4; i++ {
+		A[i][i] += ridge
+	}
+	return core.Solve4x4(A, b)
+}
+
+// RowInfluenceAnalysis refits cal without each of its five rows in turn and
+// reports how far the factors move from the full fit.
+func RowInfluenceAnalysis(cal CalibrationData, factors [4]float64, ridge float64) InfluenceReport {
+	rows := deltaRows(cal)
+	rep := InfluenceReport{DF: len(rows) - len(factors)}
+	for i := range rows {
+		var others [][4]float64
+		for j, r := range rows {
+			if j != i {
+				others = append(others, r)
+			}
+		}
+		ri := RowInfluence{Row: calRowNames[i]}
+		f, err := fitDeltas(others, cal.CalibrationWeight, ridge)
+		if _, _, bad := nonFiniteField(f); err != nil || bad {
+			ri.Singular = true
+			ri.MaxChange = math.MaxFloat64
+		} else {
+			ri.Factors = f
+			for ch := range f {
+				ri.Change[ch] = f[ch] - factors[ch]
+				if factors[ch] != 0 {
+					ri.MaxChange = math.Max(ri.MaxChange, math.Abs(ri.Change[ch]/factors[ch]))
+				}
+			}
+		}
+		rep.Rows = append(rep.Rows, ri)
+		if rep.MostInfluential == "" || ri.MaxChange > rep.MaxChange {
+			rep.MostInfluential, rep.MaxChange = ri.Row, ri.MaxChange
+		}
+	}
+	return rep
+}
+
+// Describe explains the influence of a row in words.
+func (r RowInfluence) Describe() string {
+	if r.Singular {
+		return "the other rows cannot determine the factors without it"
+	}
+	return fmt.Sprintf("leaving it out moves a factor by %.3g%%", 100*r.MaxChange)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// JSONError locates a problem in a JSON file: the 1-based line and byte
+// column of the offending value and its JSON pointer (RFC 6901, "" for the
+// whole document).
+type JSONError struct {
+	File    string
+	Line    int
+	Column  int
+	Pointer string
+	Err     error
+}
+
+func (e *JSONError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %v (at %q)", e.File, e.Line, e.Column, e.Err, e.Pointer)
+}
+
+func (e *JSONError) Unwrap() error { return e.Err }
+
+// jsonFieldError is a validation error about the value at a JSON pointer,
+// returned by decoders that check more than the JSON types.
+type jsonFieldError struct {
+	Pointer string
+	Err     error
+}
+
+func (e *jsonFieldError) Error() string { return e.Err.Error() }
+
+func (e *jsonFieldError) Unwrap() error { return e.Err }
+
+func fieldErrorf(pointer, format string, args ...any) error {
+	return &jsonFieldError{Pointer: pointer, Err: fmt.Errorf(format, args...)}
+}
+
+// decodeJSON unmarshals b into v and turns syntax, type and field errors into
+// a *JSONError locating the problem in file.
+func decodeJSON(file string, b []byte, v any) error {
+	// Custom unmarshalers report offsets relative to the value they decode,
+	// so leading whitespace is trimmed to make the document start at 0.
+	trimmed := bytes.TrimLeft(b, " \t\r\n")
+	if err := json.Unmarshal(trimmed, v); err != nil {
+		return locateJSONError(file, b, len(b)-len(trimmed), err)
+	}
+	return nil
+}
+
+// locateJSONError converts err from decoding b[lead:] into a *JSONError.
+// Errors that carry no position are returned as they are.
+func locateJSONError(file string, b []byte, lead int, err error) error {
+	doc := b[lead:]
+	var (
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+		fieldErr  *jsonFieldError
+	)
+	e := &JSONError{File: file, Err: err}
+	var off int
+	switch {
+	case errors.As(err, &syntaxErr):
+		// the error is found after reading Offset bytes: the culprit is the
+		// last byte read
+		off = max(int(syntaxErr.Offset)-1, 0)
+		e.Pointer = jsonPointerAt(doc, int64(off))
+		e.Err = errors.New(strings.TrimPrefix(syntaxErr.Error(), "json: "))
+	case errors.As(err, &typeErr):
+		e.Pointer, off = jsonValueBefore(doc, typeErr.Offset)
+		e.Err = fmt.Errorf("cannot use a JSON %s as %s", typeErr.Value, typeErr.Type)
+	case errors.As(err, &fieldErr):
+		e.Pointer, off = fieldErr.Pointer, jsonValueStart(doc, fieldErr.Pointer)
+		e.Err = fieldErr.Err
+	default:
+		return err
+	}
+	e.Line, e.Column = lineColumn(b, lead+off)
+	return e
+}
+
+// lineColumn returns the 1-based line and byte column of offset off in b.
+func lineColumn(b []byte, off int) (line, col int) {
+	off = min(off, len(b))
+	line = 1 + bytes.Count(b[:off], []byte("\n"))
+	return line, off - bytes.LastIndexByte(b[:off], '\n')
+}
+
+// jsonFrame is an open object or array while walking a document.
+type jsonFrame struct {
+	array   bool
+	index   int
+	key     string
+	wantKey bool
+}
+
+// walkJSON calls visit with the pointer and start offset of every value in b,
+// in document order, until visit returns false. On a syntax error it stops
+// and returns the pointer of the position it failed at.
+func walkJSON(b []byte, visit func(pointer string, start int64) bool) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var stack []jsonFrame
+	pointer := func() string {
+		var sb strings.Builder
+		for _, f := range stack {
+			sb.WriteByte('/')
+			if f.array {
+				sb.WriteString(strconv.Itoa(f.index))
+			} else {
+				sb.WriteString(strings.NewReplacer("~", "~0", "/", "~1").Replace(f.key))
+			}
+		}
+		return sb.String()
+	}
+	valueDone := func() {
+		if n := len(stack); n > 0 {
+			if stack[n-1].array {
+				stack[n-1].index++
+			} else {
+				stack[n-1].wantKey = true
+			}
+		}
+	}
+	for {
+		start := dec.InputOffset()
+		tok, err := dec.Token()
+		if err == io.EOF && len(stack) == 0 {
+			return "", nil
+		}
+		if err != nil {
+			return pointer(), err
+		}
+		delim, isDelim := tok.(json.Delim)
+		if isDelim && (delim == '}' || delim == ']') {
+			stack = stack[:len(stack)-1]
+			valueDone()
+			continue
+		}
+		if n := len(stack); n > 0 && stack[n-1].wantKey {
+			stack[n-1].key, stack[n-1].wantKey = tok.(string), false
+			continue
+		}
+		// the token starts after any separator and whitespace
+		for start < int64(len(b)) && strings.IndexByte(" \t\r\n,:", b[start]) >= 0 {
+			start++
+		}
+		if !visit(pointer(), start) {
+			return "", nil
+		}
+		switch {
+		case isDelim && delim == '{':
+			stack = append(stack, jsonFrame{wantKey: true})
+		case isDelim && delim == '[':
+			stack = append(stack, jsonFrame{array: true})
+		default:
+			valueDone()
+		}
+	}
+}
+
+// jsonPointerAt returns the pointer of the position where a syntax error at
+// offset off was found.
+func jsonPointerAt(b []byte, off int64) string {
+	p, _ := walkJSON(b[:min(int(off)+1, len(b))], func(string, int64) bool { return true })
+	return p
+}
+
+// jsonValueBefore returns the pointer and start of the last value starting
+// before off (a type error's offset is just past the offending value).
+func jsonValueBefore(b []byte, off int64) (string, int) {
+	pointer, start := "", 0
+	walkJSON(b, func(p string, s int64) bool {
+		if s >= off {
+			return false
+		}
+		pointer, start = p, int(s)
+		return true
+	})
+	return pointer, start
+}
+
+// jsonValueStart returns the start of the value at pointer, or of its
+// nearest existing ancestor when the value is missing.
+func jsonValueStart(b []byte, pointer string) int {
+	start, best := 0, -1
+	walkJSON(b, func(p string, s int64) bool {
+		if (pointer == p || strings.HasPrefix(pointer, p+"/")) && len(p) > best {
+			start, best = int(s), len(p)
+		}
+		return p != pointer
+	})
+	return start
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+)
+
+// JSON Schema (draft 2020-12) documents of the file formats, for integrators
+// who validate payloads before calling the tool. The calibration file and
+// the adc file have hand-written decoders accepting several shapes, so their
+// schemas are assembled here around the generated parts; the result is
+// generated from CalibrationResult, like the OpenAPI document.
+
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// jsonSchemaDocuments are the documents of `calibrate schema`, by name.
+var jsonSchemaDocuments = map[string]func() map[string]any{
+	"calibration": calibrationJSONSchema,
+	"adc":         adcJSONSchema,
+	"result":      resultJSONSchema,
+}
+
+// calibrationJSONSchema accepts both layouts of UnmarshalJSON: v1 with the
+// rows at the top level, v2 with schema_version 2 and the rows in readings.
+func calibrationJSONSchema() map[string]any {
+	s := newJSONSchemas("#/$defs/")
+	v1 := s.object(reflect.TypeFor[CalibrationData]())
+	v1["properties"].(map[string]any)["schema_version"] = map[string]any{"type": "integer", "maximum": 1}
+	v1["description"] = "v1: the rows at the top level"
+
+	rows := []string{"zero", "on_cell_0", "on_cell_1", "on_cell_2", "on_cell_3", "on_center"}
+	props := map[string]any{}
+	for name, p := range v1["properties"].(map[string]any) {
+		if !slices.Contains(rows, name) {
+			props[name] = p
+		}
+	}
+	props["schema_version"] = map[string]any{"const": calSchemaVersion}
+	props["readings"] = s.schema(reflect.TypeFor[calReadings]())
+	required := []string{"readings", "schema_version"}
+	for _, name := range v1["required"].([]string) {
+		if !slices.Contains(rows, name) {
+			required = append(required, name)
+		}
+	}
+	slices.Sort(required)
+	v2 := map[string]any{"type": "object", "description": "v2: the rows under readings", "properties": props, "required": required}
+
+	return map[string]any{
+		"$schema":     jsonSchemaDialect,
+		"title":       "Calibration file",
+		"description": "A calibration (-cal): the reference weight and the four channel ADC counts of the six placements. Unknown properties are ignored.",
+		"oneOf":       []any{v1, v2},
+		"$defs":       s.defs,
+	}
+}
+
+// adcJSONSchema accepts what ADCDocument.UnmarshalJSON reads: {"adc":
+// reading} for one reading, or [item, ..] or {"adc": [item, ..]}, where an
+// item is a reading or {"adc": reading, "expected": weight, "tilt": angle}.
+func adcJSONSchema() map[string]any {
+	ref := func(name string) map[string]any { return map[string]any{"$ref": "#/$defs/" + name} }
+	number := map[string]any{"type": "number"}
+	list := map[string]any{"type": "array", "items": ref("item"), "minItems": 1}
+	angle := map[string]any{"type": "number", "exclusiveMinimum": -90, "exclusiveMaximum": 90}
+	return map[string]any{
+		"$schema":     jsonSchemaDialect,
+		"title":       "ADC readings file",
+		"description": "Readings to apply (-adc-file): one reading, or a list of readings, each optionally with the weight known to be on the platform.",
+		"oneOf": []any{
+			list,
+			map[string]any{
+				"type":       "object",
+				"properties": map[string]any{"adc": map[string]any{"oneOf": []any{ref("reading"), list}}, "expected": number, "tilt": ref("tilt")},
+				"required":   []string{"adc"},
+			},
+		},
+		"$defs": map[string]any{
+			"reading": map[string]any{"type": "array", "description": "ADC counts of channels 0-3", "items": number, "minItems": 4, "maxItems": 4},
+			"tilt": map[string]any{"description": "platform tilt in degrees, or [pitch, roll]", "oneOf": []any{
+				angle, map[string]any{"type": "array", "items": angle, "minItems": 2, "maxItems": 2},
+			}},
+			"item": map[string]any{"oneOf": []any{
+				ref("reading"),
+				map[string]any{
+					"type":       "object",
+					"properties": map[string]any{"adc": ref("reading"), "expected": number, "tilt": ref("tilt")},
+					"required":   []string{"adc"},
+				},
+			}},
+		},
+	}
+}
+
+func resultJSONSchema() map[string]any {
+	s := newJSONSchemas("#/$defs/")
+	doc := s.object(reflect.TypeFor[CalibrationResult]())
+	doc["$schema"] = jsonSchemaDialect
+	doc["title"] = "Calibration result"
+	doc["description"] = "The result of a run (-json-out): the fit, the optional analysis sections and the applied readings."
+	doc["$defs"] = s.defs
+	return doc
+}
+
+// runSchema implements `calibrate schema`: print the JSON Schema of a file
+// format, or write them all to a directory.
+func runSchema(args []string) int {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	dir := fs.String("o", "", "write <name>.schema.json for every format (or the one named) to this directory")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: calibrate schema [-o dir] [calibration|adc|result]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	names := fs.Args()
+	if len(names) > 1 || len(names) == 0 && *dir == "" {
+		fs.Usage()
+		return 2
+	}
+	if len(names) == 0 {
+		names = []string{"calibration", "adc", "result"}
+	}
+	if _, ok := jsonSchemaDocuments[names[0]]; !ok {
+		fmt.Fprintf(os.Stderr, "error: unknown format %q (calibration, adc or result)\n", names[0])
+		return 2
+	}
+	for _, name := range names {
+		doc, _ := json.MarshalIndent(jsonSchemaDocuments[name](), "", "  ")
+		doc = append(doc, '\n')
+		if *dir == "" {
+			os.Stdout.Write(doc)
+			continue
+		}
+		if err := writeFileAtomic(filepath.Join(*dir, name+".schema.json"), doc, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,502 @@
+//go:build kafka || full
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerLiveOutput("kafka", func(fs *flag.FlagSet) func(cfg liveSinkConfig) (liveSink, error) {
+		brokers := fs.String("kafka", "", "also produce every reading to Kafka: bootstrap brokers host[:port][,host[:port]...]")
+		topic := fs.String("kafka-topic", "weights", "Kafka topic; records are keyed by -scale")
+		format := fs.String("kafka-format", "json", "Kafka record value: json or protobuf (calibrate.v1.WeightUpdate)")
+		return func(cfg liveSinkConfig) (liveSink, error) {
+			if *brokers == "" {
+				return nil, nil
+			}
+			p, err := newKafkaPublisher(strings.Split(*brokers, ","), *topic, cfg.scale, *format, cfg.units)
+			if err != nil {
+				return nil, fmt.Errorf("-kafka: %v", err)
+			}
+			return kafkaSink{p}, nil
+		}
+	})
+}
+
+// kafkaSink produces every reading of `calibrate live`, invalid ones included.
+type kafkaSink struct{ p *kafkaPublisher }
+
+func (s kafkaSink) send(u weightUpdate, _ []byte) { s.p.send(u) }
+
+func (s kafkaSink) close() {
+	if lost := s.p.close(); lost > 0 {
+		fmt.Fprintf(os.Stderr, "warning: %d reading(s) not produced to Kafka\n", lost)
+	}
+}
+
+// A Kafka producer for weights, speaking the broker protocol directly like
+// the MQTT alerts: Metadata (v4) to find the leader of the scale's
+// partition, Produce (v3, record batches with magic 2) to append to it. Both
+// versions are understood from Kafka 1.0 through 4.x. No TLS or SASL, no
+// compression, no idempotence: plain acks=1 producing on a plant network.
+
+const (
+	kafkaProduce  = 0
+	kafkaMetadata = 3
+
+	kafkaClientID    = "calibrate"
+	kafkaMaxBatch    = 500
+	kafkaMaxResponse = 16 << 20
+)
+
+// kafkaMessage is one record: the key is the scale ID, the value the
+// encoded weight.
+type kafkaMessage struct {
+	time  time.Time
+	value []byte
+}
+
+// kafkaPublisher produces the updates handed to send to one topic, keyed by
+// the scale ID, from its own goroutine, which also encodes them. Updates
+// queued meanwhile go out as one batch. The queue sheds load, so weighing
+// never waits on the brokers; updates that did not fit or could not be
+// produced are counted.
+type kafkaPublisher struct {
+	brokers []string
+	topic   string
+	key     []byte
+	format  string
+	units   string
+	queue   *pipe[weightUpdate]
+	done    chan struct{}
+	lost    int64
+
+	conn          *kafkaConn
+	partition     int32
+	correlationID int32
+}
+
+func newKafkaPublisher(brokers []string, topic, scale, format, units string) (*kafkaPublisher, error) {
+	if len(brokers) == 0 || topic == "" {
+		return nil, errors.New("want brokers host:port[,host:port...] and a topic")
+	}
+	if format != "json" && format != "protobuf" {
+		return nil, fmt.Errorf("unknown format %q (json or protobuf)", format)
+	}
+	for i, b := range brokers {
+		if _, _, err := net.SplitHostPort(b); err != nil {
+			brokers[i] = net.JoinHostPort(b, "9092")
+		}
+	}
+	p := &kafkaPublisher{brokers: brokers, topic: topic, key: []byte(scale), format: format, units: units,
+		queue: newPipe[weightUpdate]("live→kafka", 4096, true), done: make(chan struct{})}
+	go p.run()
+	return p, nil
+}
+
+// send queues an update without blocking.
+func (p *kafkaPublisher) send(u weightUpdate) { p.queue.send(u) }
+
+// close produces what is queued and disconnects. It returns the number of
+// updates that were not produced.
+func (p *kafkaPublisher) close() int64 {
+	p.queue.close()
+	<-p.done
+	return p.lost + p.queue.Stats().Dropped
+}
+
+func (p *kafkaPublisher) run() {
+	defer close(p.done)
+	backoff, retryAt := time.Duration(0), time.Time{}
+	batch := make([]kafkaMessage, 0, kafkaMaxBatch)
+	var updates []weightUpdate
+	for {
+		updates, ok := p.queue.recvBatch(updates, kafkaMaxBatch)
+		if !ok {
+			break
+		}
+		batch = batch[:0]
+		for _, u := range updates {
+			m := kafkaMessage{time: u.time}
+			if p.format == "protobuf" {
+				m.value = u.marshal()
+			} else {
+				m.value = u.json(string(p.key), p.units)
+			}
+			batch = append(batch, m)
+		}
+		if p.conn == nil && time.Now().Before(retryAt) {
+			p.lost += int64(len(batch))
+			continue
+		}
+		err := p.produce(batch)
+		if err == nil {
+			if backoff > 0 {
+				log.Printf("kafka %s: producing again", p.topic)
+			}
+			backoff = 0
+			continue
+		}
+		p.lost += int64(len(batch))
+		if p.conn != nil {
+			p.conn.Close()
+			p.conn = nil
+		}
+		backoff = min(max(2*backoff, outboxMinBackoff), outboxMaxBackoff)
+		retryAt = time.Now().Add(backoff)
+		log.Printf("warning: kafka %s: %v; retrying in %s", p.topic, err, backoff)
+	}
+	if p.conn != nil {
+		p.conn.Close()
+	}
+}
+
+// produce sends the batch to the partition leader, connecting first when
+// needed.
+func (p *kafkaPublisher) produce(batch []kafkaMessage) error {
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	var req kafkaEncoder
+	req.int16(-1) // no transactional id
+	req.int16(1)  // acks: the leader
+	req.int32(10000)
+	req.int32(1)
+	req.str(p.topic)
+	req.int32(1)
+	req.int32(p.partition)
+	req.bytes(kafkaRecordBatch(p.key, batch))
+	resp, err := p.conn.call(kafkaProduce, 3, p.nextID(), req.b)
+	if err != nil {
+		return err
+	}
+	d := kafkaDecoder{b: resp}
+	for range d.count() {
+		d.str()
+		for range d.count() {
+			d.int32()
+			code := d.int16()
+			d.int64()
+			d.int64()
+			if code != 0 && d.err == nil {
+				return fmt.Errorf("produce: broker error %d", code)
+			}
+		}
+	}
+	return d.err
+}
+
+// connect asks the brokers for the topic's metadata and connects to the
+// leader of the scale's partition.
+func (p *kafkaPublisher) connect() error {
+	var errs []error
+	for _, addr := range p.brokers {
+		c, err := dialKafka(addr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		leader, err := p.metadata(c)
+		c.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+			continue
+		}
+		if p.conn, err = dialKafka(leader); err != nil {
+			return err
+		}
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// metadata picks the scale's partition, as Kafka's default partitioner does
+// for a keyed record (murmur2 of the key), and returns its leader's address.
+func (p *kafkaPublisher) metadata(c *kafkaConn) (string, error) {
+	var req kafkaEncoder
+	req.int32(1)
+	req.str(p.topic)
+	req.boolean(true) // allow auto topic creation
+	resp, err := c.call(kafkaMetadata, 4, p.nextID(), req.b)
+	if err != nil {
+		return "", err
+	}
+	d := kafkaDecoder{b: resp}
+	d.int32() // throttle time
+	brokers := map[int32]string{}
+	for range d.count() {
+		id := d.int32()
+		host := d.str()
+		port := d.int32()
+		d.str() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.str()   // cluster id
+	d.int32() // controller
+	leaders := map[int32]int32{}
+	var topicErr int16
+	for range d.count() {
+		code := d.int16()
+		name := d.str()
+		d.boolean()
+		for range d.count() {
+			d.int16()
+			partition, leader := d.int32(), d.int32()
+			for range 2 { // replicas, in-sync replicas
+				for range d.count() {
+					d.int32()
+				}
+			}
+			if name == p.topic {
+				leaders[partition] = leader
+			}
+		}
+		if name == p.topic {
+			topicErr = code
+		}
+	}
+	switch {
+	case d.err != nil:
+		return "", d.err
+	case topicErr != 0:
+		return "", fmt.Errorf("topic %s: broker error %d", p.topic, topicErr)
+	case len(leaders) == 0:
+		return "", fmt.Errorf("topic %s has no partitions", p.topic)
+	}
+	p.partition = int32(uint32(kafkaMurmur2(p.key)&0x7fffffff) % uint32(len(leaders)))
+	addr, ok := brokers[leaders[p.partition]]
+	if !ok {
+		return "", fmt.Errorf("partition %d of %s has no leader", p.partition, p.topic)
+	}
+	return addr, nil
+}
+
+func (p *kafkaPublisher) nextID() int32 {
+	p.correlationID++
+	return p.correlationID
+}
+
+// kafkaRecordBatch encodes the messages as one uncompressed record batch
+// (magic 2) with the same key.
+func kafkaRecordBatch(key []byte, msgs []kafkaMessage) []byte {
+	base := msgs[0].time.UnixMilli()
+	maxTS := base
+	var records []byte
+	for i, m := range msgs {
+		ts := m.time.UnixMilli()
+		maxTS = max(maxTS, ts)
+		var r []byte
+		r = append(r, 0) // attributes
+		r = binary.AppendVarint(r, ts-base)
+		r = binary.AppendVarint(r, int64(i))
+		r = binary.AppendVarint(r, int64(len(key)))
+		r = append(r, key...)
+		r = binary.AppendVarint(r, int64(len(m.value)))
+		r = append(r, m.value...)
+		r = binary.AppendVarint(r, 0) // headers
+		records = binary.AppendVarint(records, int64(len(r)))
+		records = append(records, r...)
+	}
+	var tail kafkaEncoder // from attributes on, the part the CRC covers
+	tail.int16(0)
+	tail.int32(int32(len(msgs) - 1))
+	tail.int64(base)
+	tail.int64(maxTS)
+	tail.int64(-1) // producer id
+	tail.int16(-1) // producer epoch
+	tail.int32(-1) // base sequence
+	tail.int32(int32(len(msgs)))
+	tail.b = append(tail.b, records...)
+
+	var b kafkaEncoder
+	b.int64(0)                              // base offset
+	b.int32(int32(4 + 1 + 4 + len(tail.b))) // batch length
+	b.int32(-1)                             // partition leader epoch
+	b.b = append(b.b, 2)                    // magic
+	b.int32(int32(crc32.Checksum(tail.b, crc32.MakeTable(crc32.Castagnoli))))
+	b.b = append(b.b, tail.b...)
+	return b.b
+}
+
+// kafkaMurmur2 is the murmur2 hash of Kafka's default partitioner, so a scale
+// lands on the partition Java clients would pick for the same key.
+func kafkaMurmur2(data []byte) int32 {
+	const m, r = 0x5bd1e995, 24
+	h := uint32(0x9747b28c) ^ uint32(len(data))
+	n := len(data) &^ 3
+	for i := 0; i < n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	switch len(data) & 3 {
+	case 3:
+		h ^= uint32(data[n+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[n+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[n])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// kafkaConn is a connection to one broker.
+type kafkaConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dialKafka(addr string) (*kafkaConn, error) {
+	c, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaConn{c, bufio.NewReader(c)}, nil
+}
+
+// call sends a request (header v1) and returns the response body after the
+// correlation id.
+func (c *kafkaConn) call(apiKey, version int16, id int32, body []byte) ([]byte, error) {
+	var req kafkaEncoder
+	req.int32(0) // size, set below
+	req.int16(apiKey)
+	req.int16(version)
+	req.int32(id)
+	req.str(kafkaClientID)
+	req.b = append(req.b, body...)
+	binary.BigEndian.PutUint32(req.b, uint32(len(req.b)-4))
+	_ = c.SetDeadline(time.Now().Add(15 * time.Second))
+	if _, err := c.Write(req.b); err != nil {
+		return nil, err
+	}
+	var head [8]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(head[:4])
+	if size < 4 || size > kafkaMaxResponse {
+		return nil, fmt.Errorf("bad response size %d", size)
+	}
+	if got := int32(binary.BigEndian.Uint32(head[4:])); got != id {
+		return nil, fmt.Errorf("response %d to request %d", got, id)
+	}
+	resp := make([]byte, size-4)
+	if _, err := io.ReadFull(c.r, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// kafkaEncoder appends the protocol's big-endian primitives.
+type kafkaEncoder struct{ b []byte }
+
+func (e *kafkaEncoder) int16(v int16) { e.b = binary.BigEndian.AppendUint16(e.b, uint16(v)) }
+func (e *kafkaEncoder) int32(v int32) { e.b = binary.BigEndian.AppendUint32(e.b, uint32(v)) }
+func (e *kafkaEncoder) int64(v int64) { e.b = binary.BigEndian.AppendUint64(e.b, uint64(v)) }
+
+func (e *kafkaEncoder) boolean(v bool) {
+	if v {
+		e.b = append(e.b, 1)
+	} else {
+		e.b = append(e.b, 0)
+	}
+}
+
+func (e *kafkaEncoder) str(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// kafkaDecoder reads the primitives; after the first error every read
+// returns zero and err says why.
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = errors.New("truncated response")
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if v := d.take(2); v != nil {
+		return int16(binary.BigEndian.Uint16(v))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if v := d.take(4); v != nil {
+		return int32(binary.BigEndian.Uint32(v))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if v := d.take(8); v != nil {
+		return int64(binary.BigEndian.Uint64(v))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) boolean() bool {
+	v := d.take(1)
+	return v != nil && v[0] != 0
+}
+
+// count reads an array length; null reads as 0.
+func (d *kafkaDecoder) count() int {
+	n := int(d.int32())
+	if n > len(d.b) {
+		d.err = errors.New("truncated response")
+		return 0
+	}
+	return max(n, 0)
+}
+
+// str reads a (nullable) string; null reads as "".
+func (d *kafkaDecoder) str() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
@@ -0,0 +1,170 @@
+//go:build kafka || full
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+	"time"
+)
+
+func TestKafkaPrimitives(t *testing.T) {
+	tests := []struct {
+		name   string
+		encode func(e *kafkaEncoder)
+		check  func(d *kafkaDecoder) bool
+	}{
+		{"int16", func(e *kafkaEncoder) { e.int16(-2) }, func(d *kafkaDecoder) bool { return d.int16() == -2 }},
+		{"int32", func(e *kafkaEncoder) { e.int32(1 << 30) }, func(d *kafkaDecoder) bool { return d.int32() == 1<<30 }},
+		{"int64", func(e *kafkaEncoder) { e.int64(-1 << 40) }, func(d *kafkaDecoder) bool { return d.int64() == -1<<40 }},
+		{"true", func(e *kafkaEncoder) { e.boolean(true) }, func(d *kafkaDecoder) bool { return d.boolean() }},
+		{"false", func(e *kafkaEncoder) { e.boolean(false) }, func(d *kafkaDecoder) bool { return !d.boolean() }},
+		{"string", func(e *kafkaEncoder) { e.str("weights") }, func(d *kafkaDecoder) bool { return d.str() == "weights" }},
+		{"empty string", func(e *kafkaEncoder) { e.str("") }, func(d *kafkaDecoder) bool { return d.str() == "" }},
+		{"null string", func(e *kafkaEncoder) { e.int16(-1) }, func(d *kafkaDecoder) bool { return d.str() == "" }},
+		{"count", func(e *kafkaEncoder) {
+			e.int32(2)
+			e.int16(0)
+		}, func(d *kafkaDecoder) bool { return d.count() == 2 }},
+		{"null array", func(e *kafkaEncoder) { e.int32(-1) }, func(d *kafkaDecoder) bool { return d.count() == 0 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e kafkaEncoder
+			tt.encode(&e)
+			d := kafkaDecoder{b: e.b}
+			if !tt.check(&d) || d.err != nil {
+				t.Fatalf("decoding % x failed (err %v)", e.b, d.err)
+			}
+			// one byte short is truncated
+			d = kafkaDecoder{b: e.b[:len(e.b)-1]}
+			if tt.check(&d); d.err == nil && len(e.b) > 1 {
+				t.Errorf("decoding % x succeeded", d.b)
+			}
+		})
+	}
+}
+
+func TestKafkaRecordBatch(t *testing.T) {
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		key  string
+		msgs []kafkaMessage
+	}{
+		{"one record", "line1", []kafkaMessage{{at, []byte(`{"weight":1}`)}}},
+		{"several records", "line1", []kafkaMessage{
+			{at, []byte("a")}, {at.Add(250 * time.Millisecond), []byte("bb")}, {at.Add(time.Second), nil},
+		}},
+		{"out of order times", "x", []kafkaMessage{{at.Add(time.Second), []byte("late")}, {at, []byte("early")}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := kafkaRecordBatch([]byte(tt.key), tt.msgs)
+			d := kafkaDecoder{b: b}
+			if off := d.int64(); off != 0 {
+				t.Errorf("base offset %d", off)
+			}
+			if n := d.int32(); int(n) != len(d.b) {
+				t.Errorf("batch length %d, %d bytes follow", n, len(d.b))
+			}
+			d.int32() // partition leader epoch
+			if magic := d.take(1); magic == nil || magic[0] != 2 {
+				t.Fatalf("magic %v", magic)
+			}
+			if crc := uint32(d.int32()); crc != crc32.Checksum(d.b, crc32.MakeTable(crc32.Castagnoli)) {
+				t.Error("CRC mismatch")
+			}
+			d.int16() // attributes
+			if last := d.int32(); int(last) != len(tt.msgs)-1 {
+				t.Errorf("last offset delta %d", last)
+			}
+			base, maxTS := d.int64(), d.int64()
+			if base != tt.msgs[0].time.UnixMilli() {
+				t.Errorf("base timestamp %d", base)
+			}
+			d.take(8 + 2 + 4) // producer id, epoch, base sequence
+			if n := d.int32(); int(n) != len(tt.msgs) {
+				t.Fatalf("%d records, want %d", n, len(tt.msgs))
+			}
+			var wantMax int64
+			for i, m := range tt.msgs {
+				wantMax = max(wantMax, m.time.UnixMilli())
+				size, n := binary.Varint(d.b)
+				rec := d.take(n + int(size))
+				if d.err != nil {
+					t.Fatalf("record %d: %v", i, d.err)
+				}
+				r := recordReader{b: rec[n+1:]} // after the attributes
+				tsDelta, offDelta := r.varint(), r.varint()
+				key, value, headers := r.bytes(), r.bytes(), r.varint()
+				switch {
+				case r.err:
+					t.Fatalf("record %d is malformed", i)
+				case tsDelta != m.time.UnixMilli()-base || offDelta != int64(i):
+					t.Errorf("record %d: timestamp delta %d, offset delta %d", i, tsDelta, offDelta)
+				case string(key) != tt.key || !bytes.Equal(value, m.value) || headers != 0 || len(r.b) != 0:
+					t.Errorf("record %d: key %q value %q headers %d", i, key, value, headers)
+				}
+			}
+			if maxTS != wantMax {
+				t.Errorf("max timestamp %d, want %d", maxTS, wantMax)
+			}
+			if len(d.b) != 0 {
+				t.Errorf("%d bytes after the records", len(d.b))
+			}
+		})
+	}
+}
+
+// recordReader reads the varint fields of a record.
+type recordReader struct {
+	b   []byte
+	err bool
+}
+
+func (r *recordReader) varint() int64 {
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = true
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+// bytes reads a varint length and that many bytes; -1 is null.
+func (r *recordReader) bytes() []byte {
+	n := r.varint()
+	if n < 0 || n > int64(len(r.b)) {
+		r.err = r.err || n != -1
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func TestKafkaMurmur2(t *testing.T) {
+	// the values of Kafka's own UtilsTest
+	tests := []struct {
+		key  string
+		want int32
+	}{
+		{"21", -973932308},
+		{"foobar", -790332482},
+		{"a-little-bit-long-string", -985981536},
+		{"a-little-bit-longer-string", -1486304829},
+		{"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8", -58897971},
+		{"abc", 479470107},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := kafkaMurmur2([]byte(tt.key)); got != tt.want {
+				t.Errorf("kafkaMurmur2(%q) = %d, want %d", tt.key, got, tt.want)
+			}
+		})
+	}
+}
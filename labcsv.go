@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isCSVPath reports whether -readings-out should be written as lab CSV.
+func isCSVPath(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".csv")
+}
+
+// timedReading is a reading result with the time it was applied.
+type timedReading struct {
+	ReadingResult
+	at time.Time
+}
+
+// labCSVWriter writes reading results in the column layout lab DAQ tools
+// (LabVIEW, DIAdem, DASYLab, Excel) import directly: a header row, an ISO
+// 8601 UTC timestamp with milliseconds, the raw counts and the deltas per
+// channel, then the weight. Numbers use a decimal point and no thousands
+// separator; an invalid reading has NaN as its weight, which LabVIEW reads
+// as NaN, and the reason in the last column.
+type labCSVWriter struct {
+	w   *csv.Writer
+	row []string
+}
+
+func newLabCSVWriter(w io.Writer, units string) (*labCSVWriter, error) {
+	c := &labCSVWriter{w: csv.NewWriter(w)}
+	weight := "Weight"
+	if units != "" {
+		weight += " (" + units + ")"
+	}
+	header := []string{"Timestamp", "Reading"}
+	for _, kind := range []string{"Raw", "Delta"} {
+		for ch := range 4 {
+			header = append(header, "Ch"+strconv.Itoa(ch)+" "+kind)
+		}
+	}
+	header = append(header, weight, "Valid", "Invalid")
+	return c, c.w.Write(header)
+}
+
+func (c *labCSVWriter) write(r timedReading) error {
+	c.row = append(c.row[:0], r.at.UTC().Format("2006-01-02T15:04:05.000Z07:00"), strconv.Itoa(r.Reading))
+	for _, v := range r.ADC {
+		c.row = append(c.row, strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	for _, v := range r.Delta {
+		c.row = append(c.row, strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	weight := r.Weight
+	if !r.Valid {
+		weight = math.NaN()
+	}
+	c.row = append(c.row, strconv.FormatFloat(weight, 'f', -1, 64), strconv.FormatBool(r.Valid), r.Invalid)
+	return c.w.Write(c.row)
+}
+
+// flush writes out buffered rows.
+func (c *labCSVWriter) flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
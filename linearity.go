@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+)
+
+// LinearityInput is the JSON schema for -linearity-file: one reading per known
+// applied load, ideally spanning zero to near capacity.
+type LinearityInput struct {
+	Points []struct {
+		Weight float64    `json:"weight"`
+		ADC    [4]float64 `json:"adc"`
+	} `json:"points"`
+}
+
+// LinearityPoint is the result for one applied load. Error is indication minus
+// load; Deviation is the indication's distance from the best-fit line.
+type LinearityPoint struct {
+	Load       float64 `json:"load"`
+	Indication float64 `json:"indication"`
+	Error      float64 `json:"error"`
+	Deviation  float64 `json:"deviation"`
+	Tolerance  float64 `json:"tolerance"`
+	Pass       bool    `json:"pass"`
+}
+
+// LinearityReport is the JSON schema for the linearity test section. The fit is
+// indication = Offset + Slope*load; MaxDeviation is the largest distance from
+// that line, also given as a percentage of the largest load.
+type LinearityReport struct {
+	Points          []LinearityPoint `json:"points"`
+	Slope           float64          `json:"slope"`
+	Offset          float64          `json:"offset"`
+	MaxError        float64          `json:"max_error"`
+	MaxDeviation    float64          `json:"max_deviation"`
+	MaxDeviationPct float64          `json:"max_deviation_pct"`
+	Pass            bool             `json:"pass"`
+}
+
+// LoadLinearityInput reads and validates a -linearity-file.
+func LoadLinearityInput(path string) (LinearityInput, error) {
+	var in LinearityInput
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return in, err
+	}
+	if err := json.Unmarshal(b, &in); err != nil {
+		return in, err
+	}
+	if len(in.Points) < 3 {
+		return in, fmt.Errorf("need at least 3 points, got %d", len(in.Points))
+	}
+	return in, nil
+}
+
+// LinearityTest computes the indication at each load and checks |error|
+// against tol. When tol is 0 the OIML maximum permissible error for the load
+// (class, e) is used instead.
+func LinearityTest(in LinearityInput, zero, factors [4]float64, tol float64, class string, e float64) (LinearityReport, error) {
+	rep := LinearityReport{Pass: true}
+	n := float64(len(in.Points))
+	var sx, sy, sxx, sxy, maxLoad float64
+	for _, p := range in.Points {
+		ind := ComputeWeight(p.ADC, zero, factors)
+		sx += p.Weight
+		sy += ind
+		sxx += p.Weight * p.Weight
+		sxy += p.Weight * ind
+		maxLoad = math.Max(maxLoad, math.Abs(p.Weight))
+		rep.Points = append(rep.Points, LinearityPoint{Load: p.Weight, Indication: ind, Error: ind - p.Weight})
+	}
+	den := n*sxx - sx*sx
+	if den == 0 {
+		return rep, fmt.Errorf("all points have the same load; cannot fit a line")
+	}
+	rep.Slope = (n*sxy - sx*sy) / den
+	rep.Offset = (sy - rep.Slope*sx) / n
+	for i := range rep.Points {
+		p := &rep.Points[i]
+		p.Deviation = p.Indication - (rep.Offset + rep.Slope*p.Load)
+		p.Tolerance = tol
+		if tol == 0 {
+			mpe, err := MPE(class, p.Load, e)
+			if err != nil {
+				return rep, err
+			}
+			p.Tolerance = mpe
+		}
+		p.Pass = math.Abs(p.Error) <= p.Tolerance
+		if !p.Pass {
+			rep.Pass = false
+		}
+		rep.MaxError = math.Max(rep.MaxError, math.Abs(p.Error))
+		rep.MaxDeviation = math.Max(rep.MaxDeviation, math.Abs(p.Deviation))
+	}
+	if maxLoad > 0 {
+		rep.MaxDeviationPct = rep.MaxDeviation / maxLoad * 100
+	}
+	return rep, nil
+}
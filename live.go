@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"Calibration-Demo/core"
+)
+
+// liveBuckets is the resolution of the latency histogram: one bucket per
+// microsecond up to liveBuckets µs, and one for everything slower.
+const liveBuckets = 10000
+
+// latencyHistogram counts input-to-output latencies in preallocated
+// microsecond buckets, so recording one does not allocate.
+type latencyHistogram struct {
+	counts [liveBuckets + 1]int64
+	n      int64
+	max    time.Duration
+}
+
+func (h *latencyHistogram) add(d time.Duration) {
+	us := min(int(d/time.Microsecond), liveBuckets)
+	h.counts[us]++
+	h.n++
+	h.max = max(h.max, d)
+}
+
+// quantile returns the upper edge of the bucket holding quantile q.
+func (h *latencyHistogram) quantile(q float64) time.Duration {
+	target := int64(math.Ceil(q * float64(h.n)))
+	var seen int64
+	for us, c := range h.counts {
+		seen += c
+		if seen >= max(target, 1) {
+			if us == liveBuckets {
+				return h.max
+			}
+			return time.Duration(us+1) * time.Microsecond
+		}
+	}
+	return h.max
+}
+
+// liveSink is an output of `calibrate live` besides stdout. send is handed
+// every reading (u.valid false for an invalid one, with the reason) and its
+// output line without the newline; it must not block, so a slow consumer
+// never delays weighing. close flushes and reports what was lost.
+type liveSink interface {
+	send(u weightUpdate, line []byte)
+	close()
+}
+
+// liveSinkConfig is what the outputs of a live run share.
+type liveSinkConfig struct {
+	scale, units string
+	nodeRED      bool // -payload node-red
+	decimals     int  // decimals of the printed weight, -1 for the shortest exact
+}
+
+// liveOutputs are the outputs compiled into `calibrate live`, added from init()
+// by their tagged files: each registers its flags and returns its opener,
+// which returns a nil sink when the output was not asked for.
+var liveOutputs []func(fs *flag.FlagSet) func(cfg liveSinkConfig) (liveSink, error)
+
+// registerLiveOutput adds the output name (see liveOutputs).
+func registerLiveOutput(name string, flags func(fs *flag.FlagSet) func(cfg liveSinkConfig) (liveSink, error)) {
+	liveOutputs = append(liveOutputs, flags)
+	registerFeature("live outputs", name)
+}
+
+// parseLiveReading parses the four counts of one input line: numbers
+// separated by commas, spaces or tabs, optionally inside [ ]. It does not
+// allocate.
+func parseLiveReading(line []byte, adc *[4]float64) error {
+	return parseLiveValues(line, adc[:])
+}
+
+// parseLiveValues parses exactly len(vals) counts of one input line into vals,
+// like parseLiveReading: the four counts of each -platforms platform in turn.
+func parseLiveValues(line []byte, vals []float64) error {
+	n := 0
+	for i := 0; i < len(line); {
+		switch line[i] {
+		case ',', ' ', '\t', '\r', '\n', '[', ']':
+			i++
+			continue
+		}
+		j := i
+		for j < len(line) && line[j] != ',' && line[j] != ' ' && line[j] != '\t' &&
+			line[j] != '\r' && line[j] != '\n' && line[j] != ']' {
+			j++
+		}
+		if n == len(vals) {
+			return fmt.Errorf("more than %d values", len(vals))
+		}
+		// a non-escaping string(bytes) of up to 32 bytes is built on the stack
+		v, err := strconv.ParseFloat(string(line[i:j]), 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("value %d: %q is not a finite number", n, line[i:j])
+		}
+		vals[n] = v
+		n++
+		i = j
+	}
+	if n != len(vals) {
+		return fmt.Errorf("%d values, want %d", n, len(vals))
+	}
+	return nil
+}
+
+// runLive implements `calibrate live`: the low-latency path for closed-loop
+// control such as filling. It reads one reading per line from -input and
+// writes its weight as one line as soon as the reading is complete, with the
+// buffers preallocated and no fmt formatting per reading, so a reading costs
+// microseconds and no garbage collection. Readings outside the ADC limits,
+// and malformed lines (reported on stderr), give the line "invalid". With
+// -platforms the line holds a reading of each platform and the weight is
+// their sum (combine.go).
+// Off the hot path, readings also go to the liveOutputs compiled in: -mqtt
+// (optionally as a Home Assistant sensor, hass.go), -ros (ros.go), -kafka
+// (kafka.go), -redis (redis.go) and -esphome (esphome.go).
+func runLive(args []string) int {
+	fs := flag.NewFlagSet("live", flag.ExitOnError)
+	calPath := fs.String("cal", "calibration.json", "calibration to apply")
+	platformsPath := fs.String("platforms", "", "instead of -cal, sum the weights of the platforms in this JSON file into one combined weight; each line then holds the four counts of every platform in turn")
+	storeFlag := fs.String("store", "", "store holding the calibrations of -platforms given by scale (default $CAL_STORE)")
+	storeKey := fs.String("store-key", "", "key of an encrypted -store (default $CAL_STORE_KEY)")
+	tempSpec := fs.String("temp", "", "current temperature in °C, or cmd:<command> printing it: weigh with the zero and factors interpolated between the calibrations of -temp-cals (or the -scale's stored calibrations with an -ambient-temp)")
+	tempCals := fs.String("temp-cals", "", "JSON file listing calibrations taken at different temperatures, for -temp")
+	input := fs.String("input", "-", "readings, one \"a,b,c,d\" (or \"[a, b, c, d]\") per line: a file or FIFO, - for stdin")
+	tare := fs.Float64("tare", 0, "subtract this from every weight")
+	division := fs.Float64("d", 0, "round weights to this display division (0 = print full precision)")
+	hysteresis := fs.Float64("hysteresis", 0, "display hysteresis in weight units: the printed weight only changes once the weight is more than d/2 + hysteresis from it")
+	chanDeadband := fs.String("channel-deadband", "", "per-channel deadband in ADC counts, one for all channels or four comma-separated")
+	decimals := fs.Int("decimals", -1, "decimals to print without -d (-1 = shortest exact)")
+	adcMin := fs.Float64("adc-min", -8388608, "ADC lower limit")
+	adcMax := fs.Float64("adc-max", 8388607, "ADC upper limit")
+	latency := fs.Bool("latency", false, "at the end, print the input-to-output latency (p50, p99, p99.9, max) to stderr")
+	scale := fs.String("scale", "scale", "scale ID, the Home Assistant device name")
+	units := fs.String("units", "", "units of the node-red payload and Home Assistant sensor (default: the calibration's units, else g)")
+	payload := fs.String("payload", "plain", "line and MQTT payload: plain (the weight) or node-red (a JSON object {weight, stable, units, ts})")
+	decimate := fs.Int("decimate", 0, "average every N readings into one output (anti-alias averaging), e.g. 16 to turn 80 SPS into 5 SPS")
+	stableWindow := fs.Int("stable-window", 3, "node-red, ROS 2, Kafka and Redis: a weight is stable when the last this many valid weights agree within -stable-band")
+	stableBand := fs.Float64("stable-band", 0.5, "node-red, ROS 2, Kafka and Redis: stability band, in weight units")
+	var openers []func(cfg liveSinkConfig) (liveSink, error)
+	for _, flags := range liveOutputs {
+		openers = append(openers, flags(fs))
+	}
+	_ = fs.Parse(args)
+
+	if *division < 0 || *adcMin >= *adcMax {
+		fmt.Fprintln(os.Stderr, "error: -d must be >= 0 and -adc-min below -adc-max")
+		return 2
+	}
+	if *payload != "plain" && *payload != "node-red" {
+		fmt.Fprintf(os.Stderr, "error: unknown -payload %q (plain or node-red)\n", *payload)
+		return 2
+	}
+	if *hysteresis < 0 {
+		fmt.Fprintln(os.Stderr, "error: -hysteresis must be >= 0")
+		return 2
+	}
+	if *tempCals != "" && *tempSpec == "" || *tempSpec != "" && *platformsPath != "" {
+		fmt.Fprintln(os.Stderr, "error: -temp-cals needs -temp, and -temp works on -cal, not -platforms")
+		return 2
+	}
+	var bands [4]float64
+	if *chanDeadband != "" {
+		var err error
+		if bands, err = parseChannelBands(*chanDeadband); err != nil {
+			fmt.Fprintf(os.Stderr, "error: -channel-deadband: %v\n", err)
+			return 2
+		}
+	}
+	if *decimate < 0 {
+		fmt.Fprintln(os.Stderr, "error: -decimate must be >= 1")
+		return 2
+	}
+	if *stableWindow < 1 || *stableBand < 0 {
+		fmt.Fprintln(os.Stderr, "error: -stable-window must be >= 1 and -stable-band >= 0")
+		return 2
+	}
+	var platforms []livePlatform
+	var err error
+	if *platformsPath != "" {
+		if platforms, err = LoadPlatforms(*platformsPath, storeSpec(*storeFlag), storeKeySpec(*storeKey)); err != nil {
+			fmt.Fprintf(os.Stderr, "error: -platforms: %v\n", err)
+			return 1
+		}
+	} else {
+		cal, err := loadCalibrationFile(*calPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading calibration: %v\n", err)
+			return 1
+		}
+		p, err := newLivePlatform("", cal)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		if *tempSpec != "" {
+			// the uncertainty stays that of the -cal fit
+			t, err := ReadTemperature(*tempSpec)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: -temp: %v\n", err)
+				return 2
+			}
+			r, err := temperatureCalibration(t, *tempCals, storeSpec(*storeFlag), storeKeySpec(*storeKey), *scale, tempCalChecks{})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: temperature calibrations: %v\n", err)
+				return 1
+			}
+			for _, src := range r.Expired {
+				fmt.Fprintf(os.Stderr, "warning: temperature calibration %s has expired; recertification required\n", src)
+			}
+			p.zero, p.factors = r.Zero, r.Factors
+			if r.Outside {
+				fmt.Fprintf(os.Stderr, "warning: %g °C is outside the calibrated %g..%g °C; weighing with the nearest calibration (%s at %g °C)\n",
+					t, r.Covered[0], r.Covered[1], r.Lower.Source, r.Lower.TemperatureC)
+			}
+		}
+		platforms = []livePlatform{p}
+	}
+	if *units == "" {
+		*units = cmp.Or(platformsUnits(platforms), "g")
+	}
+	var in io.Reader = os.Stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+
+	prec := *decimals
+	if *division > 0 {
+		prec = divisionDecimals(*division)
+	}
+	var sinks []liveSink
+	defer func() {
+		for _, sink := range sinks {
+			sink.close()
+		}
+	}()
+	cfg := liveSinkConfig{scale: *scale, units: *units, nodeRED: *payload == "node-red", decimals: prec}
+	for _, open := range openers {
+		sink, err := open(cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 2
+		}
+		if sink != nil {
+			sinks = append(sinks, sink)
+		}
+	}
+	limits := ADCRangeSummary{Min: *adcMin, Max: *adcMax}
+	var hyst *displayHysteresis
+	if *hysteresis > 0 {
+		hyst = &displayHysteresis{band: *hysteresis, div: *division}
+	}
+	for i := range platforms {
+		if *chanDeadband != "" {
+			platforms[i].deadband = &channelDeadband{bands: bands}
+		}
+		if *decimate > 1 {
+			platforms[i].decim = newDecimator(float64(*decimate), 1, limits.within)
+		}
+	}
+	r := bufio.NewReaderSize(in, 64<<10)
+	out := make([]byte, 0, 128)
+	nodeRED := *payload == "node-red"
+	unitsJSON, _ := json.Marshal(*units)
+	track := weightTracker{filter: 1, window: *stableWindow, band: *stableBand}
+	vals := make([]float64, 4*len(platforms))
+	var hist latencyHistogram
+	lineNo := 0
+	for {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			fmt.Fprintf(os.Stderr, "error: line %d is longer than 64 KB\n", lineNo+1)
+			return 1
+		}
+		if len(line) == 0 && err != nil {
+			if err != io.EOF {
+				fmt.Fprintf(os.Stderr, "error reading input: %v\n", err)
+				return 1
+			}
+			break
+		}
+		start := time.Now()
+		lineNo++
+		out = out[:0]
+		valid := false
+		var w float64
+		perr := parseLiveValues(line, vals)
+		if *decimate > 1 && perr == nil {
+			// the platforms' decimators complete their groups together
+			done := false
+			for i := range platforms {
+				var d decimated
+				if d, done = platforms[i].decim.add([4]float64(vals[4*i:]), readingMeta{}); done {
+					copy(vals[4*i:], d.adc[:])
+				}
+			}
+			if !done {
+				continue
+			}
+		}
+		// the combined weight is valid when every platform's reading is
+		// in range; its uncertainty adds the platforms' in quadrature, as
+		// they are calibrated independently
+		outside := -1
+		uncertainty, uncertaintyOK := 0.0, true
+		if perr != nil {
+			fmt.Fprintf(os.Stderr, "line %d: %v\n", lineNo, perr)
+		} else {
+			for i := range platforms {
+				if !limits.within([4]float64(vals[4*i:])) {
+					outside = i
+					break
+				}
+			}
+		}
+		if perr == nil && outside < 0 {
+			valid = true
+			for i := range platforms {
+				p := &platforms[i]
+				adc := [4]float64(vals[4*i:])
+				if p.deadband != nil {
+					adc = p.deadband.apply(adc)
+				}
+				w += core.Weight(adc, p.zero, p.factors)
+				u, ok := p.uncertainty(adc)
+				uncertainty += u * u
+				uncertaintyOK = uncertaintyOK && ok
+			}
+			uncertainty = math.Sqrt(uncertainty)
+			w -= *tare
+			switch {
+			case hyst != nil:
+				w = hyst.step(w)
+			case *division > 0:
+				w = math.Round(w / *division) * *division
+			}
+			if w == 0 {
+				w = 0 // no -0
+			}
+		}
+		stable := false
+		if valid && (nodeRED || len(sinks) > 0) {
+			_, stable = track.add(w)
+		}
+		switch {
+		case nodeRED:
+			// flat msg.payload for Node-RED flows: weight is null and stable
+			// false for an invalid reading; ts is milliseconds, like Date.now()
+			out = append(out, `{"weight":`...)
+			if valid {
+				out = strconv.AppendFloat(out, w, 'f', prec, 64)
+			} else {
+				out = append(out, "null"...)
+			}
+			out = append(out, `,"stable":`...)
+			out = strconv.AppendBool(out, stable)
+			if valid && uncertaintyOK {
+				out = append(out, `,"uncertainty":`...)
+				out = strconv.AppendFloat(out, uncertainty, 'g', 4, 64)
+			}
+			out = append(out, `,"units":`...)
+			out = append(out, unitsJSON...)
+			out = append(out, `,"ts":`...)
+			out = strconv.AppendInt(out, start.UnixMilli(), 10)
+			out = append(out, '}')
+		case valid:
+			out = strconv.AppendFloat(out, w, 'f', prec, 64)
+		default:
+			out = append(out, "invalid"...)
+		}
+		if len(sinks) > 0 {
+			u := weightUpdate{reading: int64(lineNo), time: start, weight: w, filtered: w, stable: stable, valid: valid}
+			switch {
+			case perr != nil:
+				u.invalid = perr.Error()
+			case !valid:
+				u.invalid = limits.check([4]float64(vals[4*outside:]))
+				if p := platforms[outside]; p.name != "" {
+					u.invalid = p.name + ": " + u.invalid
+				}
+			case uncertaintyOK:
+				u.uncertainty, u.uncertaintyOK = uncertainty, true
+			}
+			for _, sink := range sinks {
+				sink.send(u, out)
+			}
+		}
+		out = append(out, '\n')
+		if _, err := os.Stdout.Write(out); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing output: %v\n", err)
+			return 1
+		}
+		hist.add(time.Since(start))
+	}
+	if *latency && hist.n > 0 {
+		fmt.Fprintf(os.Stderr, "latency over %d reading(s): p50 %s, p99 %s, p99.9 %s, max %s\n",
+			hist.n, hist.quantile(0.5), hist.quantile(0.99), hist.quantile(0.999), hist.max)
+	}
+	return 0
+}
@@ -1,58 +1,425 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/ed25519"
+	"errors"
 	"flag"
 	"fmt"
+	"math"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func main() {
-	calPath := flag.String("cal", "calibration.json", "path to calibration JSON (required)")
-	adcStr := flag.String("adc", "", "comma-separated 4 ADC values to compute weight, e.g. 1020,1018,1005,1009")
-	adcFile := flag.String("adc-file", "", "path to JSON file containing an array of adc readings or single adc")
-	apply := flag.Bool("apply", false, "when set, process ADC inputs; otherwise only run verification")
-	jsonOut := flag.String("json-out", "", "write results to this JSON file")
+	if len(os.Args) > 1 {
+		if run, ok := commands[os.Args[1]]; ok {
+			os.Exit(run(os.Args[2:]))
+		}
+	}
+
+	f := calibrateFlagSet(flag.CommandLine)
 	flag.Parse()
 
-	if calPath == nil || *calPath == "" {
+	if f.calPath == "" {
 		fmt.Fprintln(os.Stderr, "error: -cal is required")
 		flag.Usage()
 		os.Exit(2)
 	}
 
-	dataBytes, err := os.ReadFile(*calPath)
+	// OpenTelemetry spans of the run's stages, exported at the end of a run
+	// that completes
+	tel, err := startTelemetry()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error reading calibration file: %v\n", err)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(2)
 	}
+	ctx, run := tel.start(context.Background(), "calibrate", attr("calibrate.scale", f.scaleID))
+
+	// c is the run: it collects every warning with its stable code, and
+	// the phases after the fit share it
+	c := &calibrateRun{f: f, ctx: ctx, tel: tel}
+
+	calSet, operatorSet := false, false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "cal":
+			calSet = true
+		case "operator":
+			operatorSet = true
+		}
+	})
 
+	// With a store configured and no explicit -cal, apply modes use the
+	// scale's active calibration version.
 	var cal CalibrationData
-	if err := json.Unmarshal(dataBytes, &cal); err != nil {
-		fmt.Fprintf(os.Stderr, "error parsing calibration JSON: %v\n", err)
+	var activeSession *Session
+	_, span := tel.start(ctx, "load calibration")
+	if spec := storeSpec(*f.storeFlag); spec != "" && !calSet {
+		st, err := OpenStore(spec, storeKeySpec(*f.storeKey))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error opening store: %v\n", err)
+			os.Exit(1)
+		}
+		activeSession, err = ActiveSession(st, f.scaleID)
+		st.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading active calibration: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if activeSession != nil {
+		cal = activeSession.Calibration
+		f.calPath = fmt.Sprintf("%s (scale %s v%d)", activeSession.Source, activeSession.Scale, activeSession.Version)
+		fmt.Printf("Using active calibration v%d of scale %s from store (checksum %.12s)\n",
+			activeSession.Version, activeSession.Scale, activeSession.Checksum)
+		if s := activeSession.Result.Stage; s != nil && s.Stage == stageCoarse {
+			fmt.Printf("  provisional: %s\n", *s)
+		}
+	} else {
+		dataBytes, err := os.ReadFile(f.calPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading calibration file: %v\n", err)
+			os.Exit(1)
+		}
+		if cal, err = parseCalibration(f.calPath, dataBytes); err != nil {
+			fmt.Fprintf(os.Stderr, "error parsing calibration: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	span.set(attr("calibrate.from_store", activeSession != nil))
+	span.end()
+
+	// Checkweighing: the limits come from the product catalog in the store
+	var checkweigh *CheckweighReport
+	if f.productID != "" {
+		st := openStoreOrExit(*f.storeFlag, *f.storeKey)
+		if st == nil {
+			os.Exit(2)
+		}
+		products, err := st.Products()
+		st.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading products: %v\n", err)
+			os.Exit(1)
+		}
+		p, err := findProduct(products, f.productID)
+		if err == nil && p.Units != "" && cal.Units != "" && p.Units != cal.Units {
+			err = fmt.Errorf("product %s is in %s but the calibration weighs in %s", p.ID, p.Units, cal.Units)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(2)
+		}
+		of := "readings"
+		if f.dynamic {
+			of = "items"
+		}
+		checkweigh = newCheckweighReport(p, of)
+	}
+
+	// Tilt compensation: applied weights are divided by the cosine of the
+	// tilt of their reading, or of -tilt for readings without one
+	var runTilt *float64
+	if f.tiltSpec != "" {
+		t, err := ReadTiltSource(f.tiltSpec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: -tilt: %v\n", err)
+			os.Exit(2)
+		}
+		runTilt = &t
+	}
+
+	// Decimation averages the readings down to a lower rate, at which they
+	// are then filtered
+	decIn, decOut, err := decimationRatio(f.decimate, f.resampleRate, f.sampleRate)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(2)
+	}
+	rate := f.sampleRate
+	if decIn > 0 {
+		rate *= decOut / decIn
+	}
+
+	// Vibration analysis and notch filtering need the sample rate; the
+	// analysis needs every reading in memory
+	var notches []float64
+	if f.vibration || f.notch != "" {
+		switch {
+		case f.sampleRate <= 0 || math.IsInf(f.sampleRate, 0):
+			err = errors.New("-vibration and -notch need -sample-rate")
+		case f.notchWidth <= 0 || f.vibPeaks < 1 || f.vibSNR <= 0:
+			err = errors.New("-notch-width, -vib-peaks and -vib-snr must be > 0")
+		case f.streamApply && (f.vibration || f.notch == "auto"):
+			err = errors.New("-vibration and -notch auto analyse all readings at once and cannot -stream; give the -notch frequencies")
+		case f.notch != "" && f.notch != "auto":
+			notches, err = parseNotches(f.notch, rate)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	var postScript *PostScript
+	if f.postScriptFile != "" {
+		if postScript, err = LoadPostScript(f.postScriptFile); err != nil {
+			fmt.Fprintf(os.Stderr, "error: -post-script: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	// Webhooks on weighing events, delivered in the background and drained
+	// when the run ends
+	var hooks *hookSinks
+	if path := hooksPath(f.hooksFile); path != "" {
+		if hooks, err = LoadHooks(path); err != nil {
+			fmt.Fprintf(os.Stderr, "error: -hooks: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	hookVersion := 0
+	if activeSession != nil {
+		hookVersion = activeSession.Version
+	}
+	c.event = func(name string, fields map[string]any) {
+		hooks.fire(HookEvent{Event: name, Scale: f.scaleID, Version: hookVersion, Fields: fields})
+	}
+	drainHooks := func() {
+		dctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		hooks.close(dctx)
+	}
+
+	// NaN/Inf anywhere in the calibration would propagate into every factor
+	if err := CheckFinite(cal); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s: %v\n", f.calPath, err)
 		os.Exit(1)
 	}
+	if err := checkStage(cal); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s: %v\n", f.calPath, err)
+		os.Exit(1)
+	}
+	// a coarse calibration has only the zero and center rows: the analyses
+	// of the five placements are skipped; neither it nor a partial one is a
+	// free fit, so the analyses of the fit are skipped for both
+	coarse := cal.Stage == stageCoarse
+	fixed := stageOf(cal) != stageFull
 
-	// read optional ridge regularization and print-normal flags from environment
-	ridge := 0.0
-	if rv := os.Getenv("CAL_RIDGE"); rv != "" {
-		if v, err := strconv.ParseFloat(rv, 64); err == nil {
-			ridge = v
+	// Signature: a detached <cal>.sig travels with the file (and into the store)
+	var calSig *CalSignature
+	if activeSession != nil {
+		calSig = activeSession.Signature
+	} else if sig, err := LoadSignature(f.calPath + ".sig"); err == nil {
+		calSig = &sig
+	}
+	var trusted ed25519.PublicKey
+	if f.requireSigned {
+		if f.trustedKey == "" {
+			f.trustedKey = os.Getenv("CAL_TRUSTED_KEY")
+		}
+		if f.trustedKey == "" {
+			fmt.Fprintln(os.Stderr, "error: -require-signed needs -trusted-key or CAL_TRUSTED_KEY")
+			os.Exit(2)
+		}
+		pub, err := LoadPublicKey(f.trustedKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading trusted key: %v\n", err)
+			os.Exit(1)
+		}
+		if calSig == nil {
+			fmt.Fprintf(os.Stderr, "error: refusing unsigned calibration %s (-require-signed)\n", f.calPath)
+			os.Exit(1)
+		}
+		if err := VerifyCalibration(cal, *calSig, pub); err != nil {
+			fmt.Fprintf(os.Stderr, "error: refusing calibration %s: %v\n", f.calPath, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Calibration signature OK (key %s, signed %s)\n", calSig.KeyID, calSig.SignedAt)
+		trusted = pub
+	}
+
+	// Temperature-indexed calibration: the weighing uses the zero and
+	// factors interpolated to the current temperature; the fit reported and
+	// recorded stays that of the calibration
+	tempReport, tempWarnings := loadTemperature(f, trusted)
+	c.warnings = append(c.warnings, tempWarnings...)
+
+	// Session metadata comes from the flags, optionally completed on the
+	// terminal; a stored calibration keeps the metadata it was recorded with.
+	var sessionMeta *SessionMeta
+	if f.promptMeta || operatorSet || !f.meta.empty() {
+		f.meta.Operator = operatorName(f.operator)
+		if f.promptMeta {
+			if err := PromptSessionMeta(os.Stdin, os.Stderr, f.meta); err != nil {
+				fmt.Fprintf(os.Stderr, "error reading session metadata: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		sessionMeta = f.meta
+	} else if activeSession != nil {
+		sessionMeta = activeSession.Result.Session
+	}
+
+	// Once the store has a reference-weight register, calibrations recorded
+	// in it must name a registered weight.
+	if spec := storeSpec(*f.storeFlag); spec != "" && activeSession == nil {
+		st, err := OpenStore(spec, storeKeySpec(*f.storeKey))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error opening store: %v\n", err)
+			os.Exit(1)
+		}
+		weights, err := st.RefWeights()
+		st.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading reference weights: %v\n", err)
+			os.Exit(1)
+		}
+		rw, rwWarnings, err := CheckReferenceWeight(weights, f.meta.ReferenceWeightID, cal.CalibrationWeight, nowUTC())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(2)
+		}
+		for _, w := range rwWarnings {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+			c.warnings = append(c.warnings, newWarning("reference-weight", f.meta.ReferenceWeightID, "%s", w))
+		}
+		if rw != nil {
+			sessionMeta.ReferenceWeight = rw
 		}
 	}
+
+	// read optional ridge regularization and print-normal flags from environment
+	ridge := envRidge()
 	printNormal := false
 	if pv := os.Getenv("CAL_PRINT_NORMAL"); pv == "1" || strings.ToLower(pv) == "true" {
 		printNormal = true
 	}
 
+	tolProfile, tol, err := f.tolerance()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(2)
+	}
+
+	if f.expiredPolicy != "warn" && f.expiredPolicy != "refuse" {
+		fmt.Fprintf(os.Stderr, "error: -expired-policy must be warn or refuse, got %q\n", f.expiredPolicy)
+		os.Exit(2)
+	}
+
+	if f.totalMode != "auto" && f.totalMode != "manual" {
+		fmt.Fprintf(os.Stderr, "error: -total-mode must be auto or manual, got %q\n", f.totalMode)
+		os.Exit(2)
+	}
+	var manualAccept []int
+	if f.totalAccept != "" {
+		for _, p := range strings.Split(f.totalAccept, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(p))
+			if err != nil || n < 1 {
+				fmt.Fprintf(os.Stderr, "error: invalid -total-accept reading number %q\n", p)
+				os.Exit(2)
+			}
+			manualAccept = append(manualAccept, n)
+		}
+	}
+
+	if f.streamApply && (f.adcFile == "" || f.dynamic) {
+		fmt.Fprintln(os.Stderr, "error: -stream needs -adc-file and cannot be combined with -dynamic")
+		os.Exit(2)
+	}
+	if f.dynTrim < 0 || f.dynTrim >= 0.5 || math.IsNaN(f.dynTrim) {
+		fmt.Fprintln(os.Stderr, "error: -dyn-trim must be >= 0 and < 0.5")
+		os.Exit(2)
+	}
+	if f.pipeDepth < 1 || (f.shedLoad && !f.streamApply) {
+		fmt.Fprintln(os.Stderr, "error: -pipeline-depth must be >= 1, and -shed-load needs -stream")
+		os.Exit(2)
+	}
+
+	if f.displayDiv < 0 {
+		fmt.Fprintln(os.Stderr, "error: -d must be >= 0")
+		os.Exit(2)
+	}
+	if f.zeroBand < 0 {
+		fmt.Fprintln(os.Stderr, "error: -zero-band must be >= 0")
+		os.Exit(2)
+	}
+	var hyst *displayHysteresis
+	if f.hysteresis < 0 {
+		fmt.Fprintln(os.Stderr, "error: -hysteresis must be >= 0")
+		os.Exit(2)
+	} else if f.hysteresis > 0 {
+		hyst = &displayHysteresis{band: f.hysteresis, div: f.displayDiv}
+	}
+	var deadband *channelDeadband
+	if f.chanDeadband != "" {
+		bands, err := parseChannelBands(f.chanDeadband)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: -channel-deadband: %v\n", err)
+			os.Exit(2)
+		}
+		deadband = &channelDeadband{bands: bands}
+	}
+	if f.displayDiv > 0 {
+		if k := f.verifInterval / f.displayDiv; math.Abs(k-math.Round(k)) > 1e-9 || k < 1 {
+			fmt.Fprintf(os.Stderr, "warning: e = %g is not a whole multiple of d = %g\n", f.verifInterval, f.displayDiv)
+			c.warnings = append(c.warnings, newWarning("division-mismatch", "", "e = %g is not a whole multiple of d = %g", f.verifInterval, f.displayDiv))
+		}
+	}
+
+	var eccInput *EccentricityInput
+	if f.eccFile != "" {
+		in, err := LoadEccentricityInput(f.eccFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading eccentricity file: %v\n", err)
+			os.Exit(1)
+		}
+		eccInput = &in
+	}
+
+	var linInput *LinearityInput
+	if f.linFile != "" {
+		in, err := LoadLinearityInput(f.linFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading linearity file: %v\n", err)
+			os.Exit(1)
+		}
+		linInput = &in
+	}
+
+	var repInput *RepeatabilityInput
+	if f.repeatFile != "" {
+		in, err := LoadRepeatabilityInput(f.repeatFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading repeatability file: %v\n", err)
+			os.Exit(1)
+		}
+		repInput = &in
+	}
+
+	var zeroSamples [][4]float64
+	if f.zeroCapture != "" {
+		var err error
+		zeroSamples, err = LoadReadings(f.zeroCapture)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading zero capture: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	// Parse ADC input (single or array) early so flags are validated but we only process when -apply is set
 	var adcInput [4]float64
 	haveADC := false
-	var manyReadings [][]float64
-	if *adcStr != "" {
-		parts := strings.Split(*adcStr, ",")
+	var manyReadings [][4]float64
+	var adcExpected []*float64
+	var adcTilt []*float64
+	var stream *readingStream
+	if f.adcStr != "" {
+		parts := strings.Split(f.adcStr, ",")
 		if len(parts) != 4 {
 			fmt.Fprintln(os.Stderr, "error: -adc must have 4 comma-separated values")
 			os.Exit(2)
@@ -65,81 +432,162 @@ func main() {
 			}
 			adcInput[i] = v
 		}
+		if err := checkReadingFinite(adcInput); err != nil {
+			fmt.Fprintf(os.Stderr, "error: -adc %v\n", err)
+			os.Exit(2)
+		}
 		haveADC = true
-	} else if *adcFile != "" {
-		b, err := os.ReadFile(*adcFile)
+	} else if f.adcFile != "" && f.streamApply {
+		// readings are decoded as they are applied
+		stream, err = openReadingStream(f.adcFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error parsing adc file: %v\n", err)
+			os.Exit(1)
+		}
+		defer stream.Close()
+		haveADC, f.apply = true, true
+	} else if f.adcFile != "" {
+		_, span := tel.start(ctx, "read readings")
+		b, unmap, err := mapFile(f.adcFile)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error reading adc file: %v\n", err)
 			os.Exit(1)
 		}
-		// try single object {"adc": [..]}
-		var single struct {
-			ADC [4]float64 `json:"adc"`
+		doc, err := parseADCDocument(f.adcFile, b)
+		_ = unmap()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error parsing adc file: %v\n", err)
+			os.Exit(1)
 		}
-		if err := json.Unmarshal(b, &single); err == nil && (single.ADC != [4]float64{}) {
-			adcInput = single.ADC
-			haveADC = true
-		} else {
-			// try raw array of arrays
-			var many [][]float64
-			if err := json.Unmarshal(b, &many); err == nil && len(many) > 0 {
-				manyReadings = many
-				// use first as adcInput
-				if len(many[0]) != 4 {
-					fmt.Fprintln(os.Stderr, "error: each adc reading must have 4 values")
-					os.Exit(2)
-				}
-				for i := 0; i < 4; i++ {
-					adcInput[i] = many[0][i]
-				}
-				haveADC = true
-			} else {
-				// try object {"adc": [[..],[..]]}
-				var objMany struct {
-					ADC [][]float64 `json:"adc"`
-				}
-				if err := json.Unmarshal(b, &objMany); err == nil && len(objMany.ADC) > 0 {
-					manyReadings = objMany.ADC
-					if len(objMany.ADC[0]) != 4 {
-						fmt.Fprintln(os.Stderr, "error: each adc reading must have 4 values")
-						os.Exit(2)
-					}
-					for i := 0; i < 4; i++ {
-						adcInput[i] = objMany.ADC[0][i]
-					}
-					haveADC = true
-				} else {
-					fmt.Fprintf(os.Stderr, "error parsing adc file: unsupported format\n")
-					os.Exit(1)
-				}
-			}
+		adcInput, haveADC = doc.Rows[0], true
+		if !doc.Single {
+			manyReadings = doc.Rows
 		}
+		if doc.HasExpected() {
+			adcExpected = doc.Expected
+		}
+		adcTilt = doc.Tilt
 		// If adc-file parsed successfully, auto-enable apply
 		if haveADC {
-			*apply = true
+			f.apply = true
+		}
+		span.set(attr("calibrate.readings", len(doc.Rows)))
+		span.end()
+	}
+
+	// Validity period: the store's recording time stands in for a missing calibrated_at
+	var recorded time.Time
+	if activeSession != nil {
+		recorded = activeSession.Time
+	}
+	expiry, hasExpiry, err := CalibrationExpiry(cal, recorded)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	expired := false
+	if hasExpiry {
+		days := daysUntil(expiry, nowUTC())
+		switch {
+		case days < 0:
+			expired = true
+			fmt.Fprintf(os.Stderr, "WARNING: calibration expired on %s (%d days ago); recertification required\n", expiry.Format("2006-01-02"), -days)
+			c.warnings = append(c.warnings, newWarning("calibration-expired", "", "expired on %s (%d days ago)", expiry.Format("2006-01-02"), -days))
+			c.event(eventExpired, map[string]any{"expiry": expiry.Format("2006-01-02"), "days_expired": -days, "policy": f.expiredPolicy})
+			if f.expiredPolicy == "refuse" && f.apply && haveADC {
+				fmt.Fprintln(os.Stderr, "error: refusing to apply an expired calibration (-expired-policy refuse)")
+				drainHooks()
+				os.Exit(3)
+			}
+		case days <= f.remindDays:
+			fmt.Fprintf(os.Stderr, "reminder: calibration expires on %s (in %d days)\n", expiry.Format("2006-01-02"), days)
+			c.warnings = append(c.warnings, newWarning("calibration-expiring", "", "expires on %s (in %d days)", expiry.Format("2006-01-02"), days))
 		}
 	}
 
+	// Swapped channels: the on_cell rows peak on a permutation of the channels
+	var swap *ChannelSwapReport
+	if r, ok := DetectChannelSwap(cal); ok && !coarse {
+		swap = &r
+		fmt.Fprintf(os.Stderr, "WARNING: swapped channels suspected (%s)\n", r.Describe())
+		c.warnings = append(c.warnings, newWarning("channel-swap", "", "%s", r.Describe()))
+		if f.fixMapping {
+			cal = FixChannelMapping(cal, r)
+			swap.Fixed = true
+			fmt.Fprintln(os.Stderr, "  relabeled the on_cell rows to match their channels (-fix-mapping); if the cells are wired to the wrong ADC inputs instead, fix the wiring or cell_positions")
+		} else {
+			fmt.Fprintln(os.Stderr, "  rerun with -fix-mapping to relabel the rows, or check the cell wiring")
+		}
+	}
+
+	// Sanity-check the input before solving
+	var sanity []Warning
+	if !coarse {
+		sanity = CheckCalibrationData(cal, f.adcMin, f.adcMax)
+	}
+	for _, w := range sanity {
+		fmt.Fprintf(os.Stderr, "warning %s\n", w)
+	}
+	c.warnings = append(c.warnings, sanity...)
+
+	_, span = tel.start(ctx, "solve", attr("calibrate.ridge", ridge))
 	factors, A, b, err := ComputeFactors(cal, ridge)
+	// A singular or ill-conditioned fit is explained in terms of the rows
+	// (unless they overflow, where the diagnosis is meaningless too)
+	var collinearity *CollinearityReport
+	if diag := DiagnoseCollinearity(cal); !fixed && diag.finite() && (err != nil || diag.Condition > collinearCondition) {
+		collinearity = &diag
+		fmt.Fprintf(os.Stderr, "WARNING: calibration rows are (nearly) linearly dependent: rank %d of 4, condition number %.3g\n", diag.Rank, diag.Condition)
+		for _, p := range diag.Correlated {
+			fmt.Fprintf(os.Stderr, "  %s and %s correlate %.4f\n", p.RowA, p.RowB, p.Correlation)
+		}
+		for _, r := range diag.Rows {
+			fmt.Fprintf(os.Stderr, "  %-9s independence %.3g\n", r.Row, r.Independence)
+		}
+		fmt.Fprintf(os.Stderr, "  suggestion: redo the %s placement\n", diag.Redo)
+		c.warnings = append(c.warnings, newWarning("ill-conditioned", diag.Redo, "%s", diag.Summary()))
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "calculation error: %v\n", err)
 		os.Exit(1)
 	}
+	var crossCheckRes *CrossCheck
+	if f.crossCheck && fixed {
+		fmt.Fprintln(os.Stderr, "note: -cross-check skipped: "+stageSkipped(cal, "free fit to cross-check"))
+	} else if f.crossCheck {
+		cc, err := CrossCheckFactors(cal, factors, ridge, f.crossCheckTol)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cross-check error: %v\n", err)
+			os.Exit(1)
+		}
+		crossCheckRes = &cc
+		fmt.Printf("Cross-check (normal equations vs QR): max relative difference %.3g (tolerance %g)\n", cc.MaxRelDiff, cc.Tolerance)
+		if !cc.Agree {
+			fmt.Fprintf(os.Stderr, "error: the solvers disagree: normal equations %s, QR %s\n", formatVector(factors), formatVector(cc.QRFactors))
+			os.Exit(1)
+		}
+	}
+	for _, w := range CheckFactors(cal, factors) {
+		fmt.Fprintf(os.Stderr, "warning %s\n", w)
+		c.warnings = append(c.warnings, w)
+	}
+	span.end()
+	tel.countSolve(nil)
 	if printNormal {
 		fmt.Println("Normal matrix A:")
 		for i := 0; i < 4; i++ {
-			fmt.Println(A[i])
+			fmt.Println(formatVector(A[i]))
 		}
 		fmt.Println("Right-hand side b:")
-		fmt.Println(b)
+		fmt.Println(formatVector(b))
 	}
 
 	// Header
 	fmt.Printf("Calibration weight W = %g\n", cal.CalibrationWeight)
-	fmt.Println("Zero reference (adc):", cal.Zero)
+	fmt.Println("Zero reference (adc):", formatVector(cal.Zero))
 	fmt.Printf("Computed factors f0..f3 (weight per ADC count):\n")
 	for i, f := range factors {
-		fmt.Printf("  f%d = %.10g\n", i, f)
+		fmt.Printf("  f%d = %s\n", i, formatFixed(f, 10))
 	}
 
 	// Verification using calibration rows (no extra file):
@@ -150,6 +598,9 @@ func main() {
 		{cal.OnCell3[0], cal.OnCell3[1], cal.OnCell3[2], cal.OnCell3[3]},
 		{cal.OnCenter[0], cal.OnCenter[1], cal.OnCenter[2], cal.OnCenter[3]},
 	}
+	if coarse {
+		calibRows = calibRows[4:]
+	}
 	fmt.Println("\nVerification using calibration ADC rows:")
 	for idx, row := range calibRows {
 		var adr [4]float64
@@ -166,121 +617,342 @@ func main() {
 		for i := 0; i < 4; i++ {
 			weight += contrib[i]
 		}
-		fmt.Printf("Row %d ADC=%v\n", idx+1, adr)
-		fmt.Printf("  Delta: %v\n", delta)
+		fmt.Printf("Row %d ADC=%s\n", idx+1, formatVector(adr))
+		fmt.Printf("  Delta: %s\n", formatVector(delta))
 		// print Contrib with two decimals
 		fmt.Printf("  Contrib: [%.2f %.2f %.2f %.2f]\n", contrib[0], contrib[1], contrib[2], contrib[3])
 		fmt.Printf("  Estimated weight = %.2f (expected %.2f)\n\n", weight, cal.CalibrationWeight)
 	}
 
 	// Compute residuals and an "error determinant" metric: det(A) * residualVariance
-	// residualVariance = RSS / (m - p) where m=5 rows, p=4 parameters
-	m := len(calibRows)
-	var rss float64
-	for _, row := range calibRows {
-		var adr [4]float64
-		for i := 0; i < 4; i++ {
-			adr[i] = row[i]
-		}
-		est := 0.0
-		for i := 0; i < 4; i++ {
-			est += factors[i] * (adr[i] - cal.Zero[i])
-		}
-		resid := cal.CalibrationWeight - est
-		rss += resid * resid
-	}
-	df := float64(m - 4)
-	var residualVar float64
-	if df > 0 {
-		residualVar = rss / df
-	} else {
-		residualVar = rss
-	}
-	detA := det4x4(A)
-	errorDet := detA * residualVar
+	rss, residualVar, detA, errorDet := FitStats(cal, factors, A)
+	df := float64(max(len(calibRows)-4, 0))
 	fmt.Printf("Residual variance = %.6g (RSS=%.6g, df=%v)\n", residualVar, rss, int(df))
 	fmt.Printf("det(A) = %.6g\n", detA)
 	fmt.Printf("error determinant (det(A) * residualVariance) = %.6g\n", errorDet)
 
-	// Prepare output buffer and write header
-	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("Calibration weight W = %g\n", cal.CalibrationWeight))
-	sb.WriteString(fmt.Sprintf("Zero reference (adc): %v\n", cal.Zero))
-	sb.WriteString("Computed factors f0..f3 (weight per ADC count):\n")
-	for i, f := range factors {
-		sb.WriteString(fmt.Sprintf("  f%d = %.10g\n", i, f))
-	}
-
-	// Process ADC input(s) only if -apply is set
-	if *apply && haveADC {
-		if len(manyReadings) > 0 {
-			for idx, row := range manyReadings {
-				if len(row) != 4 {
-					continue
-				}
-				var adr [4]float64
-				for i := 0; i < 4; i++ {
-					adr[i] = row[i]
-				}
-				var delta [4]float64
-				var contrib [4]float64
-				for i := 0; i < 4; i++ {
-					delta[i] = adr[i] - cal.Zero[i]
-					contrib[i] = factors[i] * delta[i]
-				}
-				weight := 0.0
-				for i := 0; i < 4; i++ {
-					weight += contrib[i]
-				}
-				fmt.Printf("Reading %d: ADC=%v\n", idx+1, adr)
-				fmt.Printf("  Delta: %v\n", delta)
-				// print Contrib with two decimals
-				fmt.Printf("  Contrib: [%.2f %.2f %.2f %.2f]\n", contrib[0], contrib[1], contrib[2], contrib[3])
-				fmt.Printf("  Estimated weight = %.2f\n", weight)
-				sb.WriteString(fmt.Sprintf("\nReading %d: ADC=%v\n", idx+1, adr))
-				sb.WriteString(fmt.Sprintf("  Delta: %v\n", delta))
-				sb.WriteString(fmt.Sprintf("  Contrib: [%.2f %.2f %.2f %.2f]\n", contrib[0], contrib[1], contrib[2], contrib[3]))
-				sb.WriteString(fmt.Sprintf("  Estimated weight = %.2f\n", weight))
-			}
-		} else {
-			var delta [4]float64
-			var contrib [4]float64
-			for i := 0; i < 4; i++ {
-				delta[i] = adcInput[i] - cal.Zero[i]
-				contrib[i] = factors[i] * delta[i]
-			}
-			weight := 0.0
-			for i := 0; i < 4; i++ {
-				weight += contrib[i]
-			}
-			fmt.Printf("Input ADC: %v\n", adcInput)
-			fmt.Printf("  Delta: %v\n", delta)
-			fmt.Printf("  Contrib: [%.2f %.2f %.2f %.2f]\n", contrib[0], contrib[1], contrib[2], contrib[3])
-			fmt.Printf("  Estimated weight = %.2f (same units as calibration weight)\n", weight)
-			sb.WriteString(fmt.Sprintf("Input ADC: %v\n", adcInput))
-			sb.WriteString(fmt.Sprintf("  Delta: %v\n", delta))
-			sb.WriteString(fmt.Sprintf("  Contrib: [%.2f %.2f %.2f %.2f]\n", contrib[0], contrib[1], contrib[2], contrib[3]))
-			sb.WriteString(fmt.Sprintf("  Estimated weight = %.2f (same units as calibration weight)\n", weight))
+	// Pass/fail: the configured tolerances replace the residual-variance default
+	calOK := residualVar < calibrationOKVar
+	var tolResult *ToleranceResult
+	if !tol.empty() && coarse {
+		fmt.Fprintln(os.Stderr, "note: tolerances not evaluated: "+stageSkipped(cal, "placements to evaluate"))
+	} else if !tol.empty() {
+		r := EvaluateTolerance(cal, factors, rss, tol)
+		r.Profile = tolProfile
+		tolResult, calOK = &r, r.Pass
+		verdict := "PASS"
+		if !r.Pass {
+			verdict = "FAIL (" + strings.Join(r.Failures, "; ") + ")"
+		}
+		label := "Tolerance"
+		if r.Profile != "" {
+			label += " (" + r.Profile + ")"
+		}
+		fmt.Printf("%s: largest row error %.4g (%.4g%%), quality score %.1f: %s\n", label, r.MaxAbsError, r.MaxPctError, r.Score, verdict)
+		if !r.Pass {
+			c.warnings = append(c.warnings, newWarning("out-of-tolerance", r.Profile, "%s", strings.Join(r.Failures, "; ")))
 		}
 	}
 
-	// If no JSON output is requested, write the human-readable output.txt
-	if *jsonOut == "" {
-		_ = os.WriteFile("output.txt", []byte(sb.String()), 0644)
+	// The phases of the run share the calibration, its fit and the inputs
+	c.cal, c.active, c.calSig = cal, activeSession, calSig
+	c.factors, c.A, c.ridge, c.df = factors, A, ridge, int(df)
+	c.coarse, c.fixed = coarse, fixed
+	c.weighZero, c.weighFactors = cal.Zero, factors
+	c.adcInput, c.haveADC, c.manyReadings = adcInput, haveADC, manyReadings
+	c.adcExpected, c.adcTilt, c.stream, c.runTilt = adcExpected, adcTilt, stream, runTilt
+	c.postScript, c.deadband, c.hyst = postScript, deadband, hyst
+	c.decIn, c.decOut, c.rate, c.notches = decIn, decOut, rate, notches
+	c.manualAccept, c.zeroSamples = manualAccept, zeroSamples
+	c.eccInput, c.linInput, c.repInput = eccInput, linInput, repInput
+	c.res = CalibrationResult{
+		Factors:       factors,
+		ResidualVar:   residualVar,
+		RSS:           rss,
+		DetA:          detA,
+		ErrorDet:      errorDet,
+		CalibrationW:  cal.CalibrationWeight,
+		CalibrationOK: calOK,
+		CrossCheck:    crossCheckRes,
+		Tolerance:     tolResult,
+		Expired:       expired,
+		Checkweigh:    checkweigh,
+		Temperature:   tempReport,
+		Session:       sessionMeta,
+		Sanity:        sanity,
+		ChannelSwap:   swap,
+		Collinearity:  collinearity,
+	}
+	if hasExpiry {
+		c.res.Expiry = expiry.Format("2006-01-02")
 	}
 
-	// If requested, write a JSON summary (and skip text output when set)
-	if *jsonOut != "" {
-		res := CalibrationResult{
-			Factors:       factors,
-			ResidualVar:   residualVar,
-			RSS:           rss,
-			DetA:          detA,
-			ErrorDet:      errorDet,
-			CalibrationW:  cal.CalibrationWeight,
-			CalibrationOK: residualVar < 1e-6,
-		}
-		out, _ := json.MarshalIndent(res, "", "  ")
-		_ = os.WriteFile(*jsonOut, out, 0644)
+	c.reportHeader()
+	c.useTemperature()
+	defer c.loadTotalizer()()
+	if stream != nil {
+		// A stream may be a long batch: on SIGTERM/SIGINT stop reading,
+		// but finish the report, the readings file and the store batch
+		// for the readings already applied.
+		var stop context.CancelFunc
+		c.interrupted, stop = shutdownContext()
+		defer stop()
+	}
+	c.weigh()
+	c.weighDynamic()
+	c.report()
+	res := c.result()
+	c.recordSession(res)
+	c.writeOutputs(res)
+
+	run.set(attr("calibrate.calibration_ok", calOK), attr("calibrate.applied", c.applied))
+	run.end()
+	tel.shutdown()
+	drainHooks()
+
+	if tolResult != nil && !tolResult.Pass {
+		os.Exit(exitOutOfTolerance)
+	}
+}
+
+// calibrateFlags are the flags of a calibrate run, the default command.
+type calibrateFlags struct {
+	calPath             string
+	adcStr              string
+	adcFile             string
+	streamApply         bool
+	pipeDepth           int
+	shedLoad            bool
+	pipeStats           bool
+	readingsOut         string
+	apply               bool
+	jsonOut             string
+	xlsxOut             string
+	protoOut            string
+	totalFile           string
+	totalMode           string
+	totalAccept         string
+	totalMin            float64
+	totalReset          bool
+	stableWindow        int
+	stableBand          float64
+	adcMin              float64
+	adcMax              float64
+	deadRatio           float64
+	deadMinMove         float64
+	offCenterMax        float64
+	colMin              float64
+	eccFile             string
+	accClass            string
+	verifInterval       float64
+	zeroBand            float64
+	hysteresis          float64
+	chanDeadband        string
+	displayDiv          float64
+	linFile             string
+	linTol              float64
+	accuracyTol         float64
+	repeatFile          string
+	uspTol              float64
+	zeroCapture         string
+	tiltSpec            string
+	tiltMax             float64
+	tempSpec            string
+	tempCals            string
+	sampleRate          float64
+	decimate            int
+	resampleRate        float64
+	vibration           bool
+	notch               string
+	notchWidth          float64
+	vibMinFreq          float64
+	vibPeaks            int
+	vibSNR              float64
+	dynamic             bool
+	dynTrigger          float64
+	dynTrim             float64
+	dynMinSamples       int
+	postScriptFile      string
+	hooksFile           string
+	productID           string
+	storeFlag, storeKey *string
+	scaleID             string
+	expiredPolicy       string
+	remindDays          int
+	auditLog            string
+	operator            string
+	requireSigned       bool
+	trustedKey          string
+	certOut             string
+	noiseRatio          float64
+	meta                *SessionMeta
+	tolerance           func() (string, Tolerance, error)
+	fixMapping          bool
+	balanceAlpha        float64
+	trimReport          bool
+	trimOhms            float64
+	crossCheck          bool
+	crossCheckTol       float64
+	promptMeta          bool
+}
+
+// calibrateFlagSet registers the calibrate flags on fs.
+func calibrateFlagSet(fs *flag.FlagSet) *calibrateFlags {
+	f := &calibrateFlags{}
+	fs.StringVar(&f.calPath, "cal", "calibration.json", "path to calibration JSON (required)")
+	fs.StringVar(&f.adcStr, "adc", "", "comma-separated 4 ADC values to compute weight, e.g. 1020,1018,1005,1009")
+	fs.StringVar(&f.adcFile, "adc-file", "", "path to JSON file containing an array of adc readings or single adc")
+	fs.BoolVar(&f.streamApply, "stream", false, "read the -adc-file readings one at a time and write the report as they are applied, in constant memory (no cell health checks or -dynamic)")
+	fs.IntVar(&f.pipeDepth, "pipeline-depth", 1024, "with -stream, readings queued between the decode, apply and -readings-out stages")
+	fs.BoolVar(&f.shedLoad, "shed-load", false, "with -stream, drop readings the apply stage cannot keep up with instead of slowing the input (for live sources)")
+	fs.BoolVar(&f.pipeStats, "pipeline-stats", false, "print the queue metrics of the -stream pipeline stages to stderr")
+	fs.StringVar(&f.readingsOut, "readings-out", "", "write each applied reading's result to this file as one JSON line, as it is produced (a .csv file gets lab DAQ columns instead)")
+	fs.BoolVar(&f.apply, "apply", false, "when set, process ADC inputs; otherwise only run verification")
+	fs.StringVar(&f.jsonOut, "json-out", "", "write results to this JSON file")
+	fs.StringVar(&f.xlsxOut, "xlsx-out", "", "write an Excel workbook (inputs, factors and diagnostics, verification, readings) to this file")
+	fs.StringVar(&f.protoOut, "proto-out", "", "write results to this file as a protobuf CalibrationResult (proto/calibration.proto)")
+	fs.StringVar(&f.totalFile, "total-file", "", "persist the accumulation register (totalizer) in this JSON file; enables totalizing in apply mode")
+	fs.StringVar(&f.totalMode, "total-mode", "auto", "totalizer accept trigger: auto (stable weight at or above -total-min) or manual (-total-accept)")
+	fs.StringVar(&f.totalAccept, "total-accept", "", "comma-separated reading numbers to accept in manual totalizer mode, e.g. 3,7")
+	fs.Float64Var(&f.totalMin, "total-min", 1, "minimum weight the totalizer accepts; the load must drop below it before the next auto accept")
+	fs.BoolVar(&f.totalReset, "total-reset", false, "clear the totalizer before processing readings")
+	fs.IntVar(&f.stableWindow, "stable-window", 3, "number of consecutive readings that must agree for a weight to count as stable")
+	fs.Float64Var(&f.stableBand, "stable-band", 0.5, "maximum spread (weight units) of the readings in a stable window")
+	fs.Float64Var(&f.adcMin, "adc-min", -8388608, "lowest plausible ADC count; readings at or below it are underloaded and marked invalid")
+	fs.Float64Var(&f.adcMax, "adc-max", 8388607, "ADC saturation count; readings at or above it are overloaded and marked invalid")
+	fs.Float64Var(&f.deadRatio, "dead-ratio", 0.05, "flag a cell as dead when its delta span is below this fraction of the other cells' median span")
+	fs.Float64Var(&f.deadMinMove, "dead-min-move", 20, "minimum median span (ADC counts) of the other cells before dead-cell detection applies")
+	fs.Float64Var(&f.offCenterMax, "off-center-max", 0.5, "warn when the center of load is farther from the platform center than this fraction of the distance to the outermost cell (needs cell_positions)")
+	fs.Float64Var(&f.colMin, "col-min", 1, "minimum weight for which the center of load is computed")
+	fs.StringVar(&f.eccFile, "ecc-file", "", "run an OIML-style eccentricity test on the readings in this JSON file (test_weight, center, quadrants)")
+	fs.StringVar(&f.accClass, "class", "III", "accuracy class for maximum permissible errors: I, II, III or IIII")
+	fs.Float64Var(&f.verifInterval, "e", 1, "verification scale interval e, in weight units")
+	fs.Float64Var(&f.zeroBand, "zero-band", 0, "zero dead band: displayed weights within ±zero-band of zero show as exactly 0 (raw values stay in -json-out)")
+	fs.Float64Var(&f.hysteresis, "hysteresis", 0, "display hysteresis in weight units: the displayed weight only changes once the weight is more than d/2 + hysteresis from it, so it does not flicker between divisions")
+	fs.StringVar(&f.chanDeadband, "channel-deadband", "", "per-channel deadband in ADC counts, one for all channels or four comma-separated: a channel's counts are held until they move more than its band")
+	fs.Float64Var(&f.displayDiv, "d", 0, "display division d: applied weights are shown rounded to multiples of d (0 = no rounding); raw values stay in -json-out")
+	fs.StringVar(&f.linFile, "linearity-file", "", "run a linearity test on the known-load readings in this JSON file ({\"points\": [{\"weight\": w, \"adc\": [..]}]})")
+	fs.Float64Var(&f.linTol, "linearity-tol", 0, "linearity tolerance on |indication - load| in weight units; 0 uses the MPE of -class/-e")
+	fs.Float64Var(&f.accuracyTol, "accuracy-tol", 0, "tolerance on |weight - expected| for -adc-file readings with an \"expected\" weight, in weight units; 0 uses the MPE of -class/-e")
+	fs.StringVar(&f.repeatFile, "repeat-file", "", "run a repeatability test on repeated placements in this JSON file (test_weight, readings)")
+	fs.Float64Var(&f.uspTol, "minweight-tol", 0.001, "relative repeatability tolerance for the minimum weight (USP <41>: 0.001 = 0.10%)")
+	fs.StringVar(&f.zeroCapture, "zero-capture", "", "estimate per-channel noise floor and SNR from this zero-load capture (same formats as -adc-file)")
+	fs.StringVar(&f.tiltSpec, "tilt", "", "platform tilt for tilt compensation: an angle or pitch,roll in degrees, or cmd:<command> printing them from the IMU; readings with their own \"tilt\" use that")
+	fs.Float64Var(&f.tiltMax, "tilt-max", 5, "warn about readings tilted more than this many degrees")
+	fs.StringVar(&f.tempSpec, "temp", "", "current temperature in °C, or cmd:<command> printing it: weigh with the zero and factors interpolated between the calibrations of -temp-cals (or the -scale's stored calibrations with an -ambient-temp)")
+	fs.StringVar(&f.tempCals, "temp-cals", "", "JSON file listing calibrations taken at different temperatures, {\"calibrations\": [{\"temperature_c\": t, \"cal\": file}]}, for -temp")
+	fs.Float64Var(&f.sampleRate, "sample-rate", 0, "ADC sample rate in Hz, for -resample-rate, -vibration and -notch")
+	fs.IntVar(&f.decimate, "decimate", 0, "average every N readings into one before they are filtered, applied and output")
+	fs.Float64Var(&f.resampleRate, "resample-rate", 0, "average the readings down to this rate in Hz (below -sample-rate) before they are filtered, applied and output")
+	fs.BoolVar(&f.vibration, "vibration", false, "report the vibration spectrum of the applied readings: the dominant frequencies of the weight signal (needs -sample-rate)")
+	fs.StringVar(&f.notch, "notch", "", "suppress vibration before weight estimation with notch filters at these comma-separated frequencies in Hz, or auto for the dominant ones -vibration finds (needs -sample-rate)")
+	fs.Float64Var(&f.notchWidth, "notch-width", 1, "width in Hz of each -notch band")
+	fs.Float64Var(&f.vibMinFreq, "vib-min-freq", 1, "ignore frequencies below this many Hz (load changes) in the vibration spectrum")
+	fs.IntVar(&f.vibPeaks, "vib-peaks", 3, "report, and with -notch auto suppress, at most this many dominant frequencies")
+	fs.Float64Var(&f.vibSNR, "vib-snr", 6, "a dominant frequency stands this many times above the median amplitude of the spectrum")
+	fs.BoolVar(&f.dynamic, "dynamic", false, "dynamic (in-motion) weighing: detect items crossing the platform in the -adc-file stream and weigh each from its plateau")
+	fs.Float64Var(&f.dynTrigger, "dyn-trigger", 5, "weight at which an item is considered on the platform in -dynamic mode")
+	fs.Float64Var(&f.dynTrim, "dyn-trim", 0.2, "fraction of each item window dropped at both edges (ramps) before plateau fitting, 0 <= trim < 0.5")
+	fs.IntVar(&f.dynMinSamples, "dyn-min-samples", 3, "plateau readings needed for more than low confidence in -dynamic mode")
+	fs.StringVar(&f.postScriptFile, "post-script", "", "run each reading's result through this script (derived fields, custom rounding, filtering) before it is output; see README")
+	fs.StringVar(&f.hooksFile, "hooks", "", "call the webhooks of this JSON file on weighing events: weight accepted, under/over, calibration expired (default $CAL_HOOKS)")
+	fs.StringVar(&f.productID, "product", "", "checkweighing: classify each applied weight (each item with -dynamic) as under, accept or over the tolerance band of this product in the store's catalog")
+	f.storeFlag, f.storeKey = storeFlags(fs)
+	fs.StringVar(&f.scaleID, "scale", "default", "scale ID under which sessions are recorded in the store")
+	fs.StringVar(&f.expiredPolicy, "expired-policy", "warn", "what to do when the calibration's validity period has ended: warn or refuse (refuse blocks apply mode)")
+	fs.IntVar(&f.remindDays, "remind-days", 14, "remind about recertification when the calibration expires within this many days")
+	fs.StringVar(&f.auditLog, "audit-log", "", "append calibration-affecting operations to this audit log (default $CAL_AUDIT_LOG)")
+	fs.StringVar(&f.operator, "operator", "", "operator name for the audit log (default $CAL_OPERATOR, then the login name)")
+	fs.BoolVar(&f.requireSigned, "require-signed", false, "refuse calibrations that are not signed by the -trusted-key")
+	fs.StringVar(&f.trustedKey, "trusted-key", "", "trusted Ed25519 public key (PEM) for -require-signed (default $CAL_TRUSTED_KEY)")
+	fs.StringVar(&f.certOut, "cert-out", "", "write a plain-text calibration certificate including all test results to this file")
+	fs.Float64Var(&f.noiseRatio, "noise-ratio", 10, "flag a cell as noisy when its reading-to-reading noise exceeds this multiple of the other cells' median")
+	f.meta = sessionMetaFlags(fs)
+	f.tolerance = toleranceFlags(fs)
+	fs.BoolVar(&f.fixMapping, "fix-mapping", false, "when the on_cell rows peak on a permutation of the channels, relabel the rows to match before fitting")
+	fs.Float64Var(&f.balanceAlpha, "balance-alpha", 0.05, "significance level of the corner balance test (equal factors)")
+	fs.BoolVar(&f.trimReport, "trim", false, "recommend corner trims (digital percentages and series excitation resistors) that equalize the corner sensitivities")
+	fs.Float64Var(&f.trimOhms, "trim-ohms", 350, "bridge input resistance of one load cell in ohms, for sizing the -trim series resistors")
+	fs.BoolVar(&f.crossCheck, "cross-check", false, "refit with an independent QR solver and fail when its factors disagree with the normal equations")
+	fs.Float64Var(&f.crossCheckTol, "cross-check-tol", 1e-6, "largest allowed factor difference between the solvers in -cross-check, relative to the largest factor")
+	fs.BoolVar(&f.promptMeta, "prompt", false, "ask for the session metadata (operator, location, ambient conditions, reference weight) on the terminal")
+	return f
+}
+
+// calibrateRun is what the phases of a calibrate run share once main has
+// read the inputs and fitted the calibration: the weighing, the dynamic
+// weighing, the report and its outputs.
+type calibrateRun struct {
+	f   *calibrateFlags
+	ctx context.Context
+	tel *telemetry
+
+	cal     CalibrationData
+	active  *Session // the store's active calibration in use, or nil
+	calSig  *CalSignature
+	factors [4]float64
+	A       [4][4]float64
+	ridge   float64
+	df      int
+	// coarse has no placements to analyse; neither it nor a partial
+	// calibration (fixed) is a free fit
+	coarse, fixed bool
+	// the zero and factors the readings are weighed with, those of the
+	// calibration or interpolated to -temp
+	weighZero, weighFactors [4]float64
+
+	// the readings to weigh: a lone -adc, the rows of -adc-file, or a -stream
+	adcInput     [4]float64
+	haveADC      bool
+	manyReadings [][4]float64
+	adcExpected  []*float64
+	adcTilt      []*float64
+	stream       *readingStream
+	interrupted  context.Context // cancelled when a -stream is to stop
+	runTilt      *float64
+	postScript   *PostScript
+	deadband     *channelDeadband
+	hyst         *displayHysteresis
+	decIn        float64
+	decOut       float64
+	rate         float64
+	notches      []float64
+	manualAccept []int
+	zeroSamples  [][4]float64
+	eccInput     *EccentricityInput
+	linInput     *LinearityInput
+	repInput     *RepeatabilityInput
+
+	event func(name string, fields map[string]any)
+
+	applied  bool // readings were weighed
+	w        weighing
+	res      CalibrationResult
+	sb       reportBuffer
+	warnings []Warning
+}
+
+// emit prints a line to stdout and appends the same text to the output.txt buffer.
+func emit(sb *reportBuffer, format string, args ...any) {
+	line := fmt.Sprintf(format, args...)
+	fmt.Print(line)
+	sb.WriteString(line)
+}
+
+// unitSuffix renders an optional weight unit as " g" (or "" when unset).
+func unitSuffix(units string) string {
+	if units == "" {
+		return ""
+	}
+	return " " + units
+}
+
+// envRidge returns the ridge regularization from $CAL_RIDGE: 0 when unset or
+// not a finite, non-negative number.
+func envRidge() float64 {
+	v, err := strconv.ParseFloat(os.Getenv("CAL_RIDGE"), 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) || v < 0 {
+		return 0
 	}
+	return v
 }
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// liveMetrics counts the readings of the StreamWeights streams per scale for
+// /metrics. Streams of the same scale add up; the weight is the last valid
+// one of any of them.
+type liveMetrics struct {
+	mu     sync.Mutex
+	scales map[string]*scaleMetrics
+}
+
+type scaleMetrics struct {
+	weight    float64
+	hasWeight bool
+	readings  int64
+	dropped   int64
+	streams   int
+}
+
+func newLiveMetrics() *liveMetrics {
+	return &liveMetrics{scales: map[string]*scaleMetrics{}}
+}
+
+// stream registers a stream of scale and returns its per-reading callback
+// and the function ending it.
+func (m *liveMetrics) stream(scale string) (record func(u weightUpdate), end func()) {
+	m.mu.Lock()
+	sm := m.scales[scale]
+	if sm == nil {
+		sm = &scaleMetrics{}
+		m.scales[scale] = sm
+	}
+	sm.streams++
+	m.mu.Unlock()
+	record = func(u weightUpdate) {
+		m.mu.Lock()
+		sm.readings++
+		if u.valid {
+			sm.weight, sm.hasWeight = u.weight, true
+		} else {
+			sm.dropped++
+		}
+		m.mu.Unlock()
+	}
+	end = func() {
+		m.mu.Lock()
+		sm.streams--
+		m.mu.Unlock()
+	}
+	return record, end
+}
+
+// promWriter writes the Prometheus text exposition format: each metric
+// family is a # HELP and # TYPE line followed by its samples.
+type promWriter struct {
+	w io.Writer
+}
+
+func (p promWriter) family(name, typ, help string) {
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a sample of the scale ("" for none).
+func (p promWriter) sample(name, scale string, v float64) {
+	if scale == "" {
+		p.labeled(name, v)
+		return
+	}
+	p.labeled(name, v, "scale", scale)
+}
+
+// labeled writes a sample with label name/value pairs.
+func (p promWriter) labeled(name string, v float64, labels ...string) {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+promEscaper.Replace(labels[i+1])+`"`)
+	}
+	if len(pairs) > 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(p.w, "%s %s\n", name, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metrics serves GET /metrics: the live stream metrics, the active
+// calibration of every scale in the store and the request counters, in the
+// Prometheus text format. Like the API it needs a token (a read-only one is
+// enough); give it to Prometheus with authorization.credentials.
+func (s *calServer) metrics(w http.ResponseWriter, r *http.Request, st Store, _ *apiToken) {
+	sessions, err := st.Sessions("")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "reading sessions: %v", err)
+		return
+	}
+	var scales []string
+	for _, sess := range sessions {
+		if !slices.Contains(scales, sess.Scale) {
+			scales = append(scales, sess.Scale)
+		}
+	}
+	slices.Sort(scales)
+	active := map[string]*Session{}
+	for _, scale := range scales {
+		if sess, err := ActiveSession(st, scale); err == nil && sess != nil {
+			active[scale] = sess
+		}
+	}
+	checks, err := st.Checks("")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "reading checks: %v", err)
+		return
+	}
+	// the last zero and span check of each scale; checks are chronological
+	lastCheck := map[[2]string]CheckRecord{}
+	var checkKeys [][2]string
+	for _, c := range checks {
+		key := [2]string{c.Scale, c.Check}
+		if _, ok := lastCheck[key]; !ok {
+			checkKeys = append(checkKeys, key)
+		}
+		lastCheck[key] = c
+	}
+	slices.SortFunc(checkKeys, func(a, b [2]string) int { return strings.Compare(a[0]+"\x00"+a[1], b[0]+"\x00"+b[1]) })
+
+	// built in memory, so a slow scraper does not hold up the streams
+	var buf bytes.Buffer
+	p := promWriter{&buf}
+	now := time.Now()
+	p.family("calibrate_calibration_version", "gauge", "Active calibration version of the scale.")
+	for _, scale := range scales {
+		if sess := active[scale]; sess != nil {
+			p.sample("calibrate_calibration_version", scale, float64(sess.Version))
+		}
+	}
+	p.family("calibrate_calibration_age_seconds", "gauge", "Time since the active calibration was recorded.")
+	for _, scale := range scales {
+		if sess := active[scale]; sess != nil {
+			p.sample("calibrate_calibration_age_seconds", scale, now.Sub(sess.Time).Seconds())
+		}
+	}
+	p.family("calibrate_calibration_quality_score", "gauge", "Grade score (0-100) of the active calibration.")
+	for _, scale := range scales {
+		if sess := active[scale]; sess != nil && sess.Result.Grade != nil {
+			p.sample("calibrate_calibration_quality_score", scale, sess.Result.Grade.Score)
+		}
+	}
+	p.family("calibrate_calibration_residual_variance", "gauge", "Residual variance of the active calibration's fit.")
+	for _, scale := range scales {
+		if sess := active[scale]; sess != nil {
+			p.sample("calibrate_calibration_residual_variance", scale, sess.Result.ResidualVar)
+		}
+	}
+	p.family("calibrate_check_deviation", "gauge", "Measured minus expected weight of the scale's last zero or span check.")
+	for _, key := range checkKeys {
+		if c := lastCheck[key]; c.Error == "" {
+			p.labeled("calibrate_check_deviation", c.Measured-c.Expected, "scale", key[0], "check", key[1])
+		}
+	}
+	p.family("calibrate_check_pass", "gauge", "1 when the scale's last zero or span check passed, else 0.")
+	for _, key := range checkKeys {
+		pass := 0.0
+		if lastCheck[key].Pass {
+			pass = 1
+		}
+		p.labeled("calibrate_check_pass", pass, "scale", key[0], "check", key[1])
+	}
+	p.family("calibrate_zero_drift_counts", "gauge", "Drift of each channel from the calibration zero at the scale's last zero check, in ADC counts.")
+	for _, key := range checkKeys {
+		if c := lastCheck[key]; c.Drift != nil {
+			for ch, d := range c.Drift {
+				p.labeled("calibrate_zero_drift_counts", d, "scale", key[0], "channel", strconv.Itoa(ch))
+			}
+		}
+	}
+
+	s.live.mu.Lock()
+	live := make([]string, 0, len(s.live.scales))
+	for scale := range s.live.scales {
+		live = append(live, scale)
+	}
+	slices.Sort(live)
+	p.family("calibrate_weight", "gauge", "Last valid weight of the scale's live streams.")
+	for _, scale := range live {
+		if sm := s.live.scales[scale]; sm.hasWeight {
+			p.sample("calibrate_weight", scale, sm.weight)
+		}
+	}
+	p.family("calibrate_readings_total", "counter", "Readings processed by the scale's live streams.")
+	for _, scale := range live {
+		p.sample("calibrate_readings_total", scale, float64(s.live.scales[scale].readings))
+	}
+	p.family("calibrate_readings_dropped_total", "counter", "Readings dropped as invalid (unparsable or outside the ADC range).")
+	for _, scale := range live {
+		p.sample("calibrate_readings_dropped_total", scale, float64(s.live.scales[scale].dropped))
+	}
+	p.family("calibrate_streams", "gauge", "Open StreamWeights streams of the scale.")
+	for _, scale := range live {
+		p.sample("calibrate_streams", scale, float64(s.live.scales[scale].streams))
+	}
+	s.live.mu.Unlock()
+
+	p.family("calibrate_http_requests_total", "counter", "API requests handled.")
+	p.sample("calibrate_http_requests_total", "", float64(s.requests.Load()))
+	p.family("calibrate_http_changes_total", "counter", "API requests that changed the store.")
+	p.sample("calibrate_http_changes_total", "", float64(s.changes.Load()))
+	p.family("calibrate_http_rejected_total", "counter", "API requests rejected over the rate limit or the pending limit.")
+	p.sample("calibrate_http_rejected_total", "", float64(s.limited.Load()))
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// calMigrations upgrades a calibration document from the version it is keyed
+// by to the next one, returning a description of each change.
+var calMigrations = map[int]func(doc map[string]json.RawMessage) []string{
+	1: migrateV1toV2,
+}
+
+// calKeyOrder is the key order of migrated files; other keys follow sorted.
+var calKeyOrder = []string{"schema_version", "calibration_weight", "units", "calibrated_at", "valid_days", "readings", "cell_positions", "electrical", "stage", "cell_replacement"}
+
+// migrateV1toV2 moves the six measurement rows under "readings".
+func migrateV1toV2(doc map[string]json.RawMessage) []string {
+	changes := []string{"+ schema_version: 2"}
+	var readings bytes.Buffer
+	readings.WriteByte('{')
+	for i, m := range [][2]string{
+		{"zero", "zero"}, {"on_cell_0", "cell_0"}, {"on_cell_1", "cell_1"},
+		{"on_cell_2", "cell_2"}, {"on_cell_3", "cell_3"}, {"on_center", "center"},
+	} {
+		v, ok := doc[m[0]]
+		if !ok {
+			v = json.RawMessage("[0, 0, 0, 0]")
+			changes = append(changes, fmt.Sprintf("+ readings.%s: %s (missing in v1, read as zeros)", m[1], v))
+		} else {
+			changes = append(changes, fmt.Sprintf("~ %s -> readings.%s", m[0], m[1]))
+		}
+		if i > 0 {
+			readings.WriteByte(',')
+		}
+		fmt.Fprintf(&readings, "%q:%s", m[1], v)
+		delete(doc, m[0])
+	}
+	readings.WriteByte('}')
+	doc["readings"] = readings.Bytes()
+	doc["schema_version"] = json.RawMessage("2")
+	return changes
+}
+
+// writeCalObject writes the keys of doc present in order as an indented JSON
+// object, nesting objects and keeping arrays on one line like hand-written
+// calibration files ("zero": [1000, 1000, 1000, 1000]).
+func writeCalObject(out *bytes.Buffer, doc map[string]json.RawMessage, order []string, indent string) error {
+	out.WriteString("{\n")
+	first := true
+	for _, k := range order {
+		v, ok := doc[k]
+		if !ok {
+			continue
+		}
+		if !first {
+			out.WriteString(",\n")
+		}
+		first = false
+		fmt.Fprintf(out, "%s%q: ", indent, k)
+		var nested map[string]json.RawMessage
+		if t := bytes.TrimSpace(v); len(t) > 0 && t[0] == '{' {
+			var keys []string
+			dec := json.NewDecoder(bytes.NewReader(t))
+			if err := dec.Decode(&nested); err != nil {
+				return err
+			}
+			// keep the nested key order as written
+			dec = json.NewDecoder(bytes.NewReader(t))
+			_, _ = dec.Token()
+			for dec.More() {
+				tok, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				keys = append(keys, tok.(string))
+				var skip json.RawMessage
+				if err := dec.Decode(&skip); err != nil {
+					return err
+				}
+			}
+			if err := writeCalObject(out, nested, keys, indent+"  "); err != nil {
+				return err
+			}
+			continue
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, v); err != nil {
+			return err
+		}
+		inString, escaped := false, false
+		for _, c := range compact.Bytes() {
+			out.WriteByte(c)
+			switch {
+			case escaped:
+				escaped = false
+			case inString && c == '\\':
+				escaped = true
+			case c == '"':
+				inString = !inString
+			case c == ',' && !inString:
+				out.WriteByte(' ')
+			}
+		}
+	}
+	fmt.Fprintf(out, "\n%s}", indent[2:])
+	return nil
+}
+
+// calDocVersion returns the schema version of a calibration document.
+func calDocVersion(doc map[string]json.RawMessage) (int, error) {
+	raw, ok := doc["schema_version"]
+	if !ok {
+		return 1, nil
+	}
+	v, err := strconv.Atoi(string(raw))
+	if err != nil || v < 1 {
+		return 0, fmt.Errorf("invalid schema_version %s", raw)
+	}
+	return v, nil
+}
+
+// errNotCalibration marks JSON files that are not calibration files.
+var errNotCalibration = errors.New("not a calibration file")
+
+// MigrateCalibration upgrades the calibration file contents in b to schema
+// version to. It returns the new contents (nil when b is already at or past
+// that version), the version b had and the list of changes. The result is
+// checked to decode to the same calibration as b.
+func MigrateCalibration(b []byte, to int) ([]byte, int, []string, error) {
+	if t := bytes.TrimSpace(b); len(t) > 0 && t[0] != '{' {
+		return nil, 0, nil, errNotCalibration
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, 0, nil, err
+	}
+	if _, ok := doc["calibration_weight"]; !ok {
+		return nil, 0, nil, errNotCalibration
+	}
+	from, err := calDocVersion(doc)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if from >= to {
+		return nil, from, nil, nil
+	}
+	var before CalibrationData
+	if err := json.Unmarshal(b, &before); err != nil {
+		return nil, from, nil, err
+	}
+	var changes []string
+	for v := from; v < to; v++ {
+		step, ok := calMigrations[v]
+		if !ok {
+			return nil, from, nil, fmt.Errorf("no migration from schema version %d", v)
+		}
+		changes = append(changes, step(doc)...)
+	}
+
+	var rest []string
+	for k := range doc {
+		if !containsString(calKeyOrder, k) {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+	var out bytes.Buffer
+	if err := writeCalObject(&out, doc, append(append([]string(nil), calKeyOrder...), rest...), "  "); err != nil {
+		return nil, from, nil, err
+	}
+	out.WriteByte('\n')
+
+	var after CalibrationData
+	if err := json.Unmarshal(out.Bytes(), &after); err != nil {
+		return nil, from, nil, fmt.Errorf("migrated file does not load: %w", err)
+	}
+	if CalibrationChecksum(after) != CalibrationChecksum(before) {
+		return nil, from, nil, errors.New("migrated file would change the calibration")
+	}
+	return out.Bytes(), from, changes, nil
+}
+
+// runMigrate implements `calibrate migrate`: upgrade calibration files (or
+// every calibration file in the given directories) to a newer schema version.
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	to := fs.Int("to", calSchemaVersion, "target schema version")
+	dryRun := fs.Bool("dry-run", false, "show the changes per file without writing")
+	noBackup := fs.Bool("no-backup", false, "do not keep the original as <file>.bak")
+	_ = fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: calibrate migrate [-to N] [-dry-run] [-no-backup] FILE|DIR ...")
+		return 2
+	}
+	if *to < 2 || *to > calSchemaVersion {
+		fmt.Fprintf(os.Stderr, "error: -to must be between 2 and %d\n", calSchemaVersion)
+		return 2
+	}
+	type target struct {
+		path     string
+		explicit bool
+	}
+	var targets []target
+	for _, arg := range fs.Args() {
+		info, err := os.Stat(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		if !info.IsDir() {
+			targets = append(targets, target{arg, true})
+			continue
+		}
+		paths, _ := filepath.Glob(filepath.Join(arg, "*.json"))
+		for _, p := range paths {
+			targets = append(targets, target{p, false})
+		}
+	}
+
+	verb := "Migrated"
+	if *dryRun {
+		verb = "Would migrate"
+	}
+	migrated, current, failed := 0, 0, 0
+	for _, t := range targets {
+		b, err := os.ReadFile(t.path)
+		var out []byte
+		var from int
+		var changes []string
+		if err == nil {
+			out, from, changes, err = MigrateCalibration(b, *to)
+		}
+		if errors.Is(err, errNotCalibration) && !t.explicit {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: error: %v\n", t.path, err)
+			failed++
+			continue
+		}
+		if out == nil {
+			fmt.Printf("%s: already v%d\n", t.path, from)
+			current++
+			continue
+		}
+		var cal CalibrationData
+		_ = json.Unmarshal(out, &cal)
+		fmt.Printf("%s: v%d -> v%d (calibration unchanged, sha256 %.12s)\n", t.path, from, *to, CalibrationChecksum(cal))
+		for _, c := range changes {
+			fmt.Printf("    %s\n", c)
+		}
+		if !*dryRun {
+			if !*noBackup {
+				if err := writeFileAtomic(t.path+".bak", b, 0644); err != nil {
+					fmt.Fprintf(os.Stderr, "%s: error writing backup: %v\n", t.path, err)
+					failed++
+					continue
+				}
+			}
+			if err := writeFileAtomic(t.path, out, 0644); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: error: %v\n", t.path, err)
+				failed++
+				continue
+			}
+		}
+		migrated++
+	}
+	fmt.Printf("%s %d file(s); %d already current, %d failed\n", verb, migrated, current, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
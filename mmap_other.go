@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// mapFile reads the file at path where memory mapping is unavailable; unmap
+// is a no-op.
+func mapFile(path string) (data []byte, unmap func() error, err error) {
+	data, err = os.ReadFile(path)
+	return data, func() error { return nil }, err
+}
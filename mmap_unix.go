@@ -0,0 +1,34 @@
+//go:build unix
+
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// mapFile returns the contents of the file at path mapped read-only into
+// memory, so a large capture is parsed straight from the page cache instead
+// of being copied onto the heap, and the function that unmaps it. The data
+// must not be used after unmapping, nor the file truncated while mapped.
+// Pipes, devices and empty files, which cannot be mapped, are read instead.
+func mapFile(path string) (data []byte, unmap func() error, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	noop := func() error { return nil }
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if size := fi.Size(); fi.Mode().IsRegular() && size > 0 && int64(int(size)) == size {
+		if data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED); err == nil {
+			return data, func() error { return syscall.Munmap(data) }, nil
+		}
+	}
+	data, err = io.ReadAll(f)
+	return data, noop, err
+}
@@ -0,0 +1,345 @@
+//go:build mqtt || hass || full
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	mqttAlerts = func(spec string) (func(payload []byte) error, error) {
+		if _, err := parseMQTTTarget(spec); err != nil {
+			return nil, err
+		}
+		return func(payload []byte) error { return MQTTPublish(spec, payload) }, nil
+	}
+	registerFeature("alerts", "mqtt")
+	registerLiveOutput("mqtt", func(fs *flag.FlagSet) func(cfg liveSinkConfig) (liveSink, error) {
+		spec := fs.String("mqtt", "", "also publish the weight to mqtt://[user:pass@]host[:port]/state/topic")
+		interval := fs.Duration("mqtt-interval", time.Second, "publish the latest weight at most this often")
+		var announce func(cfg liveSinkConfig, mqtt bool) (mqttAnnouncer, error)
+		if mqttDiscovery != nil {
+			announce = mqttDiscovery(fs)
+		}
+		return func(cfg liveSinkConfig) (liveSink, error) {
+			var ha mqttAnnouncer
+			if announce != nil {
+				var err error
+				if ha, err = announce(cfg, *spec != ""); err != nil {
+					return nil, err
+				}
+			}
+			if *spec == "" {
+				return nil, nil
+			}
+			if *interval <= 0 || *interval > 30*time.Second {
+				return nil, errors.New("-mqtt-interval must be in (0, 30s]")
+			}
+			pub, err := newMQTTWeightPublisher(*spec, *interval, ha)
+			if err != nil {
+				return nil, fmt.Errorf("-mqtt: %v", err)
+			}
+			return pub, nil
+		}
+	})
+}
+
+// mqttDiscovery, set by hass.go, registers the flags announcing a -mqtt weight
+// to a home automation system and returns the announcer they ask for (nil
+// for none); mqtt tells whether -mqtt was given.
+var mqttDiscovery func(fs *flag.FlagSet) func(cfg liveSinkConfig, mqtt bool) (mqttAnnouncer, error)
+
+// mqttAnnouncer describes the weight sensor in a retained message published
+// on every connect, for discovery (haDiscovery).
+type mqttAnnouncer interface {
+	config(stateTopic, availTopic string) (topic string, payload []byte)
+}
+
+// mqttTarget is a broker and topic parsed from
+// "mqtt://[user:password@]host[:port]/topic/levels".
+type mqttTarget struct {
+	addr     string
+	topic    string
+	user     string
+	password string
+}
+
+func parseMQTTTarget(spec string) (mqttTarget, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return mqttTarget{}, err
+	}
+	if u.Scheme != "mqtt" || u.Host == "" {
+		return mqttTarget{}, fmt.Errorf("want mqtt://host[:port]/topic, got %q", spec)
+	}
+	t := mqttTarget{addr: u.Host, topic: strings.TrimPrefix(u.Path, "/")}
+	if u.Port() == "" {
+		t.addr = net.JoinHostPort(u.Hostname(), "1883")
+	}
+	if t.topic == "" {
+		return mqttTarget{}, fmt.Errorf("%s: missing topic", spec)
+	}
+	if u.User != nil {
+		t.user = u.User.Username()
+		t.password, _ = u.User.Password()
+	}
+	return t, nil
+}
+
+// mqttString encodes s as an MQTT length-prefixed UTF-8 string.
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+// mqttPacket frames body with the fixed header byte and the variable-length
+// remaining-length field.
+func mqttPacket(header byte, body []byte) []byte {
+	out := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(out, body...)
+}
+
+// MQTTPublish connects to the broker, publishes payload to the topic at QoS 0
+// and disconnects. It speaks plain MQTT 3.1.1 over TCP, enough for alerts
+// without a client library.
+func MQTTPublish(spec string, payload []byte) error {
+	t, err := parseMQTTTarget(spec)
+	if err != nil {
+		return err
+	}
+	conn, err := mqttConnect(t, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := mqttWritePublish(conn, t.topic, payload, false); err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte{0xe0, 0})
+	return err
+}
+
+// mqttWill is the last-will message the broker publishes (retained) when the
+// connection drops without a DISCONNECT.
+type mqttWill struct {
+	topic   string
+	payload []byte
+}
+
+// mqttConnect opens a session with the broker of t.
+func mqttConnect(t mqttTarget, will *mqttWill) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", t.addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	var flags byte = 0x02 // clean session
+	connect := append(mqttString("MQTT"), 4, 0, 0, 60)
+	connect = append(connect, mqttString(fmt.Sprintf("calibrate-%d", os.Getpid()))...)
+	if will != nil {
+		flags |= 0x04 | 0x20 // will, retained, QoS 0
+		connect = append(connect, mqttString(will.topic)...)
+		connect = append(connect, mqttString(string(will.payload))...)
+	}
+	if t.user != "" {
+		flags |= 0x80
+		connect = append(connect, mqttString(t.user)...)
+		if t.password != "" {
+			flags |= 0x40
+			connect = append(connect, mqttString(t.password)...)
+		}
+	}
+	connect[7] = flags
+	if _, err := conn.Write(mqttPacket(0x10, connect)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt connect: %w", err)
+	}
+	if ack[0] != 0x20 {
+		conn.Close()
+		return nil, errors.New("mqtt connect: unexpected reply from broker")
+	}
+	if ack[3] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt connect refused (code %d)", ack[3])
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// mqttWritePublish sends a QoS 0 PUBLISH, with the retain flag when retain.
+func mqttWritePublish(conn net.Conn, topic string, payload []byte, retain bool) error {
+	var header byte = 0x30
+	if retain {
+		header |= 0x01
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := conn.Write(mqttPacket(header, append(mqttString(topic), payload...)))
+	return err
+}
+
+// mqttWeightPublisher publishes the latest weight to an MQTT topic at most
+// once per interval, over one connection, from its own goroutine: the caller
+// only hands over the value, so a slow or absent broker never delays
+// weighing. Weights in between are superseded, not queued. The connection is
+// re-established with backoff; "online"/"offline" is kept (retained) on
+// <topic>/availability, "offline" by the broker's last will if the process
+// dies.
+type mqttWeightPublisher struct {
+	target   mqttTarget
+	ha       mqttAnnouncer
+	interval time.Duration
+
+	mu      sync.Mutex
+	latest  []byte
+	changed bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newMQTTWeightPublisher(spec string, interval time.Duration, ha mqttAnnouncer) (*mqttWeightPublisher, error) {
+	t, err := parseMQTTTarget(spec)
+	if err != nil {
+		return nil, err
+	}
+	p := &mqttWeightPublisher{target: t, ha: ha, interval: interval, stop: make(chan struct{}), done: make(chan struct{})}
+	go p.run()
+	return p, nil
+}
+
+// set replaces the value to publish. It does not allocate once the buffer
+// has grown to the value's size.
+func (p *mqttWeightPublisher) set(value []byte) {
+	p.mu.Lock()
+	p.latest = append(p.latest[:0], value...)
+	p.changed = true
+	p.mu.Unlock()
+}
+
+// send publishes the line of a valid reading.
+func (p *mqttWeightPublisher) send(u weightUpdate, line []byte) {
+	if u.valid {
+		p.set(line)
+	}
+}
+
+func (p *mqttWeightPublisher) availTopic() string { return p.target.topic + "/availability" }
+
+// connect opens the session and announces the sensor.
+func (p *mqttWeightPublisher) connect() (net.Conn, error) {
+	conn, err := mqttConnect(p.target, &mqttWill{topic: p.availTopic(), payload: []byte("offline")})
+	if err != nil {
+		return nil, err
+	}
+	if p.ha != nil {
+		topic, cfg := p.ha.config(p.target.topic, p.availTopic())
+		err = mqttWritePublish(conn, topic, cfg, true)
+	}
+	if err == nil {
+		err = mqttWritePublish(conn, p.availTopic(), []byte("online"), true)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// publish sends the latest value if it changed, or with force regardless.
+func (p *mqttWeightPublisher) publish(conn net.Conn, force bool) error {
+	p.mu.Lock()
+	if !p.changed && !force || p.latest == nil {
+		p.mu.Unlock()
+		return nil
+	}
+	value := append([]byte(nil), p.latest...)
+	p.changed = false
+	p.mu.Unlock()
+	return mqttWritePublish(conn, p.target.topic, value, false)
+}
+
+func (p *mqttWeightPublisher) run() {
+	defer close(p.done)
+	var conn net.Conn
+	backoff, retryAt := time.Duration(0), time.Time{}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	idle := 0
+	for {
+		select {
+		case <-p.stop:
+			if conn != nil {
+				_ = p.publish(conn, false)
+				_ = mqttWritePublish(conn, p.availTopic(), []byte("offline"), true)
+				_, _ = conn.Write([]byte{0xe0, 0})
+				conn.Close()
+			}
+			return
+		case <-ticker.C:
+		}
+		if conn == nil {
+			if time.Now().Before(retryAt) {
+				continue
+			}
+			c, err := p.connect()
+			if err != nil {
+				backoff = min(max(2*backoff, outboxMinBackoff), outboxMaxBackoff)
+				retryAt = time.Now().Add(backoff)
+				log.Printf("warning: mqtt %s: %v; retrying in %s", p.target.addr, err, backoff)
+				continue
+			}
+			if backoff > 0 {
+				log.Printf("mqtt %s: connected again", p.target.addr)
+			}
+			conn, backoff = c, 0
+		}
+		// republish an unchanged weight now and then, which also keeps the
+		// session (60s keep-alive) open
+		idle++
+		force := time.Duration(idle)*p.interval >= 30*time.Second
+		if force {
+			idle = 0
+		}
+		if err := p.publish(conn, force); err != nil {
+			log.Printf("warning: mqtt %s: %v; reconnecting", p.target.addr, err)
+			conn.Close()
+			conn = nil
+			p.mu.Lock()
+			p.changed = true
+			p.mu.Unlock()
+		}
+	}
+}
+
+// close publishes the last value, marks the sensor offline and disconnects.
+func (p *mqttWeightPublisher) close() {
+	close(p.stop)
+	<-p.done
+}
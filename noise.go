@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// ChannelNoise is the zero-load noise estimate for one channel.
+//
+// Sigma is the standard deviation of the capture about its own mean and RMS
+// the root-mean-square deviation from the calibration zero (so it also
+// includes zero drift). ENOB is the effective resolution in bits of the ADC
+// range over Sigma (never below the quantization noise of an ideal
+// converter). SNRdB compares the channel's calibration signal (its on_cell
+// delta) with Sigma. The Weight fields scale counts by the factor.
+type ChannelNoise struct {
+	Channel     int     `json:"channel"`
+	Mean        float64 `json:"mean"`
+	Sigma       float64 `json:"sigma"`
+	RMS         float64 `json:"rms"`
+	PeakToPeak  float64 `json:"peak_to_peak"`
+	ENOB        float64 `json:"enob_bits"`
+	SNRdB       float64 `json:"snr_db"`
+	SigmaWeight float64 `json:"sigma_weight"`
+	RMSWeight   float64 `json:"rms_weight"`
+}
+
+// NoiseReport is the JSON schema for the per-channel noise floor diagnostics.
+// WeightSigma is the resulting effective weight resolution at 1 sigma; it is
+// compared with Division, the display division (or e) requested for the scale.
+type NoiseReport struct {
+	Samples      int            `json:"samples"`
+	Channels     []ChannelNoise `json:"channels"`
+	WeightSigma  float64        `json:"weight_sigma"`
+	Division     float64        `json:"division"`
+	ResolutionOK bool           `json:"resolution_ok"`
+}
+
+// EstimateNoise analyses a zero-load capture. adcRange is the full ADC span
+// in counts used for the effective resolution.
+func EstimateNoise(capture [][4]float64, cal CalibrationData, factors [4]float64, adcRange float64) (NoiseReport, error) {
+	if len(capture) < 2 {
+		return NoiseReport{}, fmt.Errorf("need at least 2 zero-load samples, got %d", len(capture))
+	}
+	onCell := [4][4]float64{cal.OnCell0, cal.OnCell1, cal.OnCell2, cal.OnCell3}
+	rep := NoiseReport{Samples: len(capture)}
+	n := float64(len(capture))
+	for ch := 0; ch < 4; ch++ {
+		c := ChannelNoise{Channel: ch}
+		lo, hi := math.Inf(1), math.Inf(-1)
+		for _, r := range capture {
+			c.Mean += r[ch] / n
+			lo = math.Min(lo, r[ch])
+			hi = math.Max(hi, r[ch])
+		}
+		var ss, sz float64
+		for _, r := range capture {
+			ss += (r[ch] - c.Mean) * (r[ch] - c.Mean)
+			sz += (r[ch] - cal.Zero[ch]) * (r[ch] - cal.Zero[ch])
+		}
+		c.Sigma = math.Sqrt(ss / (n - 1))
+		c.RMS = math.Sqrt(sz / n)
+		c.PeakToPeak = hi - lo
+		// an ideal converter still has quantization noise of 1/sqrt(12) counts
+		sig := math.Max(c.Sigma, 1/math.Sqrt(12))
+		c.ENOB = math.Log2(adcRange / sig)
+		c.SNRdB = 20 * math.Log10(math.Abs(onCell[ch][ch]-cal.Zero[ch])/sig)
+		c.SigmaWeight = c.Sigma * math.Abs(factors[ch])
+		c.RMSWeight = c.RMS * math.Abs(factors[ch])
+		rep.Channels = append(rep.Channels, c)
+	}
+	return rep, nil
+}
+
+// WeightResolution combines the per-channel noise into the 1-sigma noise of
+// the computed weight, assuming independent channels:
+//
+//	sigma_W = sqrt(sum_j (f_j * sigma_j)^2)
+func WeightResolution(rep NoiseReport) float64 {
+	ss := 0.0
+	for _, c := range rep.Channels {
+		ss += c.SigmaWeight * c.SigmaWeight
+	}
+	return math.Sqrt(ss)
+}
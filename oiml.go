@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// mpeBands lists, per OIML R76 accuracy class, the upper load limits (in
+// verification scale intervals e) of the 0.5e, 1e and 1.5e maximum
+// permissible error bands for initial verification.
+var mpeBands = map[string][3]float64{
+	"I":    {50000, 200000, math.Inf(1)},
+	"II":   {5000, 20000, 100000},
+	"III":  {500, 2000, 10000},
+	"IIII": {50, 200, 1000},
+}
+
+// MPE returns the maximum permissible error (in weight units) for a load on a
+// scale of the given accuracy class and verification scale interval e. Loads
+// beyond the last band of the class are out of range for that class.
+func MPE(class string, load, e float64) (float64, error) {
+	bands, ok := mpeBands[strings.ToUpper(class)]
+	if !ok {
+		return 0, fmt.Errorf("unknown accuracy class %q (want I, II, III or IIII)", class)
+	}
+	if e <= 0 {
+		return 0, fmt.Errorf("verification interval e must be > 0, got %g", e)
+	}
+	n := math.Abs(load) / e
+	switch {
+	case n <= bands[0]:
+		return 0.5 * e, nil
+	case n <= bands[1]:
+		return 1.0 * e, nil
+	case n <= bands[2]:
+		return 1.5 * e, nil
+	}
+	return 0, fmt.Errorf("load %g is %.0fe, beyond the %.0fe range of class %s", load, n, bands[2], strings.ToUpper(class))
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// apiOperation documents one route of the calibration API for the OpenAPI
+// document. Request and the response values are zero values of the body
+// types (nil for no body); their schemas are generated from the Go types, so
+// the document follows the JSON the server actually writes.
+type apiOperation struct {
+	Method, Path, ID, Summary string
+	Write                     bool
+	Public                    bool              // no token needed, not rate limited
+	Query                     map[string]string // query parameter -> description
+	Request                   any
+	Responses                 map[int]apiResponse
+}
+
+type apiResponse struct {
+	Description string
+	Body        any
+}
+
+// ScaleSummary is one scale in the API's scale listing.
+type ScaleSummary struct {
+	Scale    string `json:"scale"`
+	Versions int    `json:"versions"`
+	Active   int    `json:"active"`
+}
+
+// activateResponse is the body of a successful activation.
+type activateResponse struct {
+	Active   int `json:"active"`
+	Previous int `json:"previous"`
+}
+
+// apiOperations lists the routes of calServer.routes.
+var apiOperations = []apiOperation{
+	{Method: "GET", Path: "/healthz", ID: "healthz", Summary: "Liveness probe: the server is up", Public: true,
+		Responses: map[int]apiResponse{200: {"Serving", healthStatus{}}}},
+	{Method: "GET", Path: "/readyz", ID: "readyz", Summary: "Readiness probe: the store opens and the request queue has room", Public: true,
+		Responses: map[int]apiResponse{200: {"Ready", healthStatus{}}, 503: {"Not ready, with the reason", healthStatus{}}}},
+	{Method: "GET", Path: "/metrics", ID: "metrics",
+		Summary:   "Prometheus metrics: live weight, readings and drops per scale from the StreamWeights streams, age, grade and fit of the active calibrations, last check results and zero drift, request counters",
+		Responses: map[int]apiResponse{200: {"The metrics in the Prometheus text format (text/plain; version=0.0.4)", nil}}},
+	{Method: "GET", Path: "/api/scales", ID: "listScales", Summary: "List the scales in the store with their version counts and active version",
+		Responses: map[int]apiResponse{200: {"The scales, sorted by name", []ScaleSummary{}}}},
+	{Method: "GET", Path: "/api/scales/{scale}/calibrations", ID: "listCalibrations", Summary: "List the calibration versions of a scale",
+		Responses: map[int]apiResponse{200: {"The versions, oldest first", []VersionSummary{}}}},
+	{Method: "POST", Path: "/api/scales/{scale}/calibrations", ID: "uploadCalibration", Write: true,
+		Summary: "Fit a calibration and record it as the next version of the scale (calibrate); the body may also be a bare calibration file",
+		Query:   map[string]string{"activate": "false to record the version without making it active"},
+		Request: uploadRequest{},
+		Responses: map[int]apiResponse{
+			201: {"Recorded as a new version", Session{}},
+			200: {"Identical to an existing version, which was reused", Session{}},
+			400: {"Invalid calibration JSON", apiError{}},
+			422: {"The signature does not verify with the server's trusted key, the calibration cannot be fitted, or its reference weight is unusable", apiError{}},
+		}},
+	{Method: "GET", Path: "/api/scales/{scale}/calibrations/{version}", ID: "getCalibration", Summary: "Get a calibration version with its result",
+		Responses: map[int]apiResponse{200: {"The version", Session{}}, 404: {"No such version", apiError{}}}},
+	{Method: "POST", Path: "/api/scales/{scale}/weigh", ID: "weigh",
+		Summary: "Weigh readings with the active calibration of the scale (nothing is recorded); the body may be any adc file: {\"adc\": [a, b, c, d]}, [[a, b, c, d], ...] or {\"adc\": [[...], ...]}",
+		Query:   map[string]string{"version": "weigh with this calibration version instead of the active one", "tare": "subtract this weight from every reading"},
+		Request: weighRequest{},
+		Responses: map[int]apiResponse{
+			200: {"The weighed readings, with the ADC range check and the batch summary", weighResponse{}},
+			400: {"Invalid adc JSON, version or tare", apiError{}},
+			404: {"No such version, or no active calibration", apiError{}},
+			422: {"A reading is not finite", apiError{}},
+		}},
+	{Method: "POST", Path: "/api/scales/{scale}/calibrations/{version}/activate", ID: "activateCalibration", Write: true,
+		Summary:   "Make a version the active one (a rollback when it is older)",
+		Responses: map[int]apiResponse{200: {"The new and previous active versions", activateResponse{}}, 404: {"No such version", apiError{}}}},
+	{Method: "DELETE", Path: "/api/scales/{scale}/calibrations/{version}", ID: "deleteCalibration", Write: true,
+		Summary: "Delete a version that is not active",
+		Responses: map[int]apiResponse{204: {"Deleted", nil}, 404: {"No such version", apiError{}},
+			409: {"The version is active", apiError{}}}},
+}
+
+// jsonSchemas generates JSON schemas for Go types, following encoding/json:
+// named structs become definitions in defs, referenced by name under ref
+// ("#/components/schemas/" in OpenAPI, "#/$defs/" in a JSON Schema
+// document), fixed-size arrays get their length, omitempty fields are
+// optional.
+type jsonSchemas struct {
+	ref  string
+	defs map[string]any
+}
+
+func newJSONSchemas(ref string) jsonSchemas {
+	return jsonSchemas{ref: ref, defs: map[string]any{}}
+}
+
+func (c jsonSchemas) schema(t reflect.Type) map[string]any {
+	switch t {
+	case reflect.TypeFor[time.Time]():
+		return map[string]any{"type": "string", "format": "date-time"}
+	case reflect.TypeFor[json.RawMessage]():
+		return map[string]any{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return c.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": c.schema(t.Elem())}
+	case reflect.Array:
+		return map[string]any{"type": "array", "items": c.schema(t.Elem()), "minItems": t.Len(), "maxItems": t.Len()}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": c.schema(t.Elem())}
+	case reflect.Struct:
+		name := t.Name()
+		if name == "" {
+			return c.object(t)
+		}
+		name = strings.ToUpper(name[:1]) + name[1:]
+		if _, ok := c.defs[name]; !ok {
+			c.defs[name] = nil // placeholder for recursive types
+			c.defs[name] = c.object(t)
+		}
+		return map[string]any{"$ref": c.ref + name}
+	}
+	return map[string]any{}
+}
+
+// object is the schema of a struct's JSON object.
+func (c jsonSchemas) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	required := []string{}
+	var fields func(t reflect.Type)
+	fields = func(t reflect.Type) {
+		for i := range t.NumField() {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" || !f.IsExported() && !f.Anonymous {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				fields(f.Type) // embedded fields are promoted
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = c.schema(f.Type)
+			if !strings.Contains(opts, "omitempty") && !strings.Contains(opts, "omitzero") && f.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+	}
+	fields(t)
+	s := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		sort.Strings(required)
+		s["required"] = required
+	}
+	return s
+}
+
+// openAPIDocument returns the OpenAPI 3 document of the calibration API.
+func openAPIDocument() map[string]any {
+	schemas := newJSONSchemas("#/components/schemas/")
+	paths := map[string]map[string]any{}
+	for _, op := range apiOperations {
+		params := []any{}
+		for _, name := range []string{"scale", "version"} {
+			if strings.Contains(op.Path, "{"+name+"}") {
+				p := map[string]any{"name": name, "in": "path", "required": true, "schema": map[string]any{"type": "string"}}
+				if name == "version" {
+					p["description"] = "version number, optionally prefixed with v (3 or v3)"
+				}
+				params = append(params, p)
+			}
+		}
+		for name, desc := range op.Query {
+			params = append(params, map[string]any{"name": name, "in": "query", "description": desc, "schema": map[string]any{"type": "string"}})
+		}
+		responses := map[string]any{}
+		if !op.Public {
+			responses["401"] = map[string]any{"description": "Missing or invalid API token", "content": jsonContent(schemas.schema(reflect.TypeFor[apiError]()))}
+			responses["429"] = map[string]any{"description": "Rate limit exceeded; see Retry-After", "content": jsonContent(schemas.schema(reflect.TypeFor[apiError]()))}
+			responses["503"] = map[string]any{"description": "Too many requests pending; see Retry-After", "content": jsonContent(schemas.schema(reflect.TypeFor[apiError]()))}
+		}
+		if op.Write {
+			responses["403"] = map[string]any{"description": "The token is read-only", "content": jsonContent(schemas.schema(reflect.TypeFor[apiError]()))}
+		}
+		for status, r := range op.Responses {
+			resp := map[string]any{"description": r.Description}
+			if r.Body != nil {
+				resp["content"] = jsonContent(schemas.schema(reflect.TypeOf(r.Body)))
+			}
+			responses[fmt.Sprint(status)] = resp
+		}
+		o := map[string]any{"operationId": op.ID, "summary": op.Summary, "parameters": params, "responses": responses}
+		if op.Public {
+			o["security"] = []any{}
+		}
+		if op.Request != nil {
+			o["requestBody"] = map[string]any{"required": true, "content": jsonContent(schemas.schema(reflect.TypeOf(op.Request)))}
+		}
+		if paths[op.Path] == nil {
+			paths[op.Path] = map[string]any{}
+		}
+		paths[op.Path][strings.ToLower(op.Method)] = o
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "Calibration API",
+			"version":     currentBuild().Version,
+			"description": "The calibration store of `calibrate serve`: scales, calibration versions, upload (fit and record), activation and deletion, and health probes. Every API request needs a bearer token; read-only tokens may only list and fetch.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas":         schemas.defs,
+			"securitySchemes": map[string]any{"bearer": map[string]any{"type": "http", "scheme": "bearer"}},
+		},
+		"security": []any{map[string]any{"bearer": []any{}}},
+	}
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+// serveOpenAPI serves the OpenAPI document, without authentication so SDK
+// generators can fetch it.
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, openAPIDocument())
+}
+
+// runOpenAPI implements `calibrate openapi`: print the OpenAPI document of
+// the serve API, for client SDK generators.
+func runOpenAPI(args []string) int {
+	fs := flag.NewFlagSet("openapi", flag.ExitOnError)
+	out := fs.String("o", "", "write the document to this file instead of stdout")
+	_ = fs.Parse(args)
+
+	doc, _ := json.MarshalIndent(openAPIDocument(), "", "  ")
+	doc = append(doc, '\n')
+	if *out == "" {
+		os.Stdout.Write(doc)
+		return 0
+	}
+	if err := writeFileAtomic(*out, doc, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	return 0
+}
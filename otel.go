@@ -0,0 +1,505 @@
+//go:build otel || full
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// telemetry exports OpenTelemetry spans and counters over OTLP/HTTP with the
+// JSON encoding (no SDK): every OpenTelemetry collector accepts it on port
+// 4318. It is configured by the standard environment variables:
+//
+//	OTEL_EXPORTER_OTLP_ENDPOINT          base URL, e.g. http://collector:4318
+//	OTEL_EXPORTER_OTLP_TRACES_ENDPOINT   full URL for spans (default <base>/v1/traces)
+//	OTEL_EXPORTER_OTLP_METRICS_ENDPOINT  full URL for metrics (default <base>/v1/metrics)
+//	OTEL_EXPORTER_OTLP_HEADERS           k=v,k2=v2 sent with every export
+//	OTEL_SERVICE_NAME                    service.name (default calibrate)
+//	OTEL_RESOURCE_ATTRIBUTES             more resource attributes, k=v,k2=v2
+//	OTEL_METRIC_EXPORT_INTERVAL          milliseconds between metric exports (default 60000)
+//	OTEL_SDK_DISABLED                    true turns telemetry off
+//
+// A nil *telemetry is valid and records nothing, so call sites need no
+// checks. Spans are buffered and exported in the background every 5s; a
+// full buffer or a failed export drops them rather than slow the caller.
+type telemetry struct {
+	traces, metrics string
+	headers         map[string]string
+	resource        []otelAttr
+	client          *http.Client
+	began           time.Time
+
+	mu       sync.Mutex
+	spans    []otlpSpan
+	dropped  int64
+	counters map[string]*otelCounter
+	failing  bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func init() { registerFeature("telemetry", "otel") }
+
+// otelMaxSpans bounds the spans buffered between exports.
+const otelMaxSpans = 4096
+
+// otelAttr is a span, counter or resource attribute; the value is a string,
+// bool, int, int64 or float64.
+type otelAttr struct {
+	key   string
+	value any
+}
+
+func attr(key string, value any) otelAttr { return otelAttr{key, value} }
+
+// startTelemetry returns the exporter configured by the environment, or nil
+// when no OTLP endpoint is set.
+func startTelemetry() (*telemetry, error) {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return nil, nil
+	}
+	base := strings.TrimSuffix(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "/")
+	t := &telemetry{traces: os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"), metrics: os.Getenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT"),
+		headers: map[string]string{}, client: &http.Client{Timeout: 10 * time.Second}, began: time.Now(),
+		counters: map[string]*otelCounter{}, stop: make(chan struct{}), done: make(chan struct{})}
+	if base != "" {
+		t.traces = cmp.Or(t.traces, base+"/v1/traces")
+		t.metrics = cmp.Or(t.metrics, base+"/v1/metrics")
+	}
+	if t.traces == "" && t.metrics == "" {
+		return nil, nil
+	}
+	if p := os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"); p != "" && p != "http/json" {
+		return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_PROTOCOL=%s: only http/json is supported", p)
+	}
+	headers, err := otelKeyValues("OTEL_EXPORTER_OTLP_HEADERS")
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range headers {
+		t.headers[kv[0]] = kv[1]
+	}
+	resource, err := otelKeyValues("OTEL_RESOURCE_ATTRIBUTES")
+	if err != nil {
+		return nil, err
+	}
+	t.resource = []otelAttr{attr("service.name", cmp.Or(os.Getenv("OTEL_SERVICE_NAME"), "calibrate")),
+		attr("service.version", currentBuild().Version), attr("telemetry.sdk.language", "go")}
+	for _, kv := range resource {
+		if kv[0] != "service.name" || os.Getenv("OTEL_SERVICE_NAME") == "" {
+			t.resource = append(t.resource, attr(kv[0], kv[1]))
+		}
+	}
+	interval := 60 * time.Second
+	if v := os.Getenv("OTEL_METRIC_EXPORT_INTERVAL"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			return nil, fmt.Errorf("OTEL_METRIC_EXPORT_INTERVAL=%s: want milliseconds > 0", v)
+		}
+		interval = time.Duration(ms) * time.Millisecond
+	}
+	go t.run(interval)
+	return t, nil
+}
+
+// otelKeyValues parses a k=v,k2=v2 list with URL-encoded values.
+func otelKeyValues(env string) ([][2]string, error) {
+	var out [][2]string
+	for _, item := range strings.Split(os.Getenv(env), ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(item, "=")
+		value, err := url.PathUnescape(strings.TrimSpace(v))
+		if !ok || strings.TrimSpace(k) == "" || err != nil {
+			return nil, fmt.Errorf("%s: bad entry %q (want key=value)", env, item)
+		}
+		out = append(out, [2]string{strings.TrimSpace(k), value})
+	}
+	return out, nil
+}
+
+func (t *telemetry) run(interval time.Duration) {
+	defer close(t.done)
+	spans, metrics := time.NewTicker(5*time.Second), time.NewTicker(interval)
+	defer spans.Stop()
+	defer metrics.Stop()
+	for {
+		select {
+		case <-spans.C:
+			t.exportSpans()
+		case <-metrics.C:
+			t.exportMetrics()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// shutdown exports what is left. It warns about spans that were dropped.
+func (t *telemetry) shutdown() {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	<-t.done
+	t.exportSpans()
+	t.exportMetrics()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.dropped > 0 {
+		log.Printf("warning: opentelemetry: %d span(s) not exported", t.dropped)
+	}
+}
+
+// spanContext identifies a span, for its children.
+type spanContext struct {
+	trace [16]byte
+	span  [8]byte
+}
+
+type spanContextKey struct{}
+
+// otelSpan is a span being recorded.
+type otelSpan struct {
+	t      *telemetry
+	sc     spanContext
+	parent [8]byte
+	name   string
+	kind   int
+	start  time.Time
+	attrs  []otelAttr
+	err    string
+}
+
+// OTLP span kinds.
+const (
+	spanInternal = 1
+	spanServer   = 2
+)
+
+// start begins a span, the child of the one in ctx (if any), and returns the
+// context carrying it.
+func (t *telemetry) start(ctx context.Context, name string, attrs ...otelAttr) (context.Context, *otelSpan) {
+	return t.startKind(ctx, name, spanInternal, attrs...)
+}
+
+func (t *telemetry) startKind(ctx context.Context, name string, kind int, attrs ...otelAttr) (context.Context, *otelSpan) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &otelSpan{t: t, name: name, kind: kind, start: time.Now(), attrs: attrs}
+	if parent, ok := ctx.Value(spanContextKey{}).(spanContext); ok {
+		s.sc.trace, s.parent = parent.trace, parent.span
+	} else {
+		rand.Read(s.sc.trace[:])
+	}
+	rand.Read(s.sc.span[:])
+	return context.WithValue(ctx, spanContextKey{}, s.sc), s
+}
+
+// withTraceparent returns ctx with the remote parent of a W3C traceparent
+// header, so a server span joins the caller's trace.
+func withTraceparent(ctx context.Context, header string) context.Context {
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return ctx
+	}
+	var sc spanContext
+	trace, err1 := hex.DecodeString(parts[1])
+	span, err2 := hex.DecodeString(parts[2])
+	if err1 != nil || err2 != nil || len(trace) != 16 || len(span) != 8 {
+		return ctx
+	}
+	copy(sc.trace[:], trace)
+	copy(sc.span[:], span)
+	if sc.trace == ([16]byte{}) || sc.span == ([8]byte{}) {
+		return ctx
+	}
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+func (s *otelSpan) set(attrs ...otelAttr) {
+	if s != nil {
+		s.attrs = append(s.attrs, attrs...)
+	}
+}
+
+// fail marks the span as failed with err.
+func (s *otelSpan) fail(err error) {
+	if s != nil && err != nil {
+		s.err = err.Error()
+	}
+}
+
+// end finishes the span and queues it for export.
+func (s *otelSpan) end() {
+	if s == nil {
+		return
+	}
+	sp := otlpSpan{TraceID: hex.EncodeToString(s.sc.trace[:]), SpanID: hex.EncodeToString(s.sc.span[:]), Name: s.name, Kind: s.kind,
+		Start: strconv.FormatInt(s.start.UnixNano(), 10), End: strconv.FormatInt(time.Now().UnixNano(), 10), Attributes: otlpAttrs(s.attrs)}
+	if s.parent != ([8]byte{}) {
+		sp.Parent = hex.EncodeToString(s.parent[:])
+	}
+	if s.err != "" {
+		sp.Status = &otlpStatus{Code: 2, Message: s.err}
+	}
+	t := s.t
+	t.mu.Lock()
+	if len(t.spans) < otelMaxSpans {
+		t.spans = append(t.spans, sp)
+	} else {
+		t.dropped++
+	}
+	t.mu.Unlock()
+}
+
+// otelCounter is a monotonic counter with one value per attribute set.
+type otelCounter struct {
+	unit, description string
+	points            map[string]*otelPoint
+}
+
+type otelPoint struct {
+	attrs []otelAttr
+	value int64
+}
+
+// count adds n to the counter name for the attributes.
+func (t *telemetry) count(name, unit, description string, n int64, attrs ...otelAttr) {
+	if t == nil {
+		return
+	}
+	key := fmt.Sprint(attrs)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.counters[name]
+	if c == nil {
+		c = &otelCounter{unit: unit, description: description, points: map[string]*otelPoint{}}
+		t.counters[name] = c
+	}
+	p := c.points[key]
+	if p == nil {
+		p = &otelPoint{attrs: attrs}
+		c.points[key] = p
+	}
+	p.value += n
+}
+
+// countSolve counts a fit of the factors by its outcome.
+func (t *telemetry) countSolve(err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	t.count("calibrate.solves", "{solve}", "Fits of the calibration factors, by outcome", 1, attr("outcome", outcome))
+}
+
+// countReadings counts n applied readings, valid or invalid.
+func (t *telemetry) countReadings(valid bool, n int64) {
+	if n > 0 {
+		t.count("calibrate.readings", "{reading}", "Readings applied, valid or invalid", n, attr("valid", valid))
+	}
+}
+
+// The OTLP JSON encoding: IDs in hex, 64-bit integers as strings.
+type otlpSpan struct {
+	TraceID    string      `json:"traceId"`
+	SpanID     string      `json:"spanId"`
+	Parent     string      `json:"parentSpanId,omitempty"`
+	Name       string      `json:"name"`
+	Kind       int         `json:"kind"`
+	Start      string      `json:"startTimeUnixNano"`
+	End        string      `json:"endTimeUnixNano"`
+	Attributes []any       `json:"attributes,omitempty"`
+	Status     *otlpStatus `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func otlpAttrs(attrs []otelAttr) []any {
+	out := make([]any, 0, len(attrs))
+	for _, a := range attrs {
+		var v map[string]any
+		switch x := a.value.(type) {
+		case bool:
+			v = map[string]any{"boolValue": x}
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(x)}
+		case int64:
+			v = map[string]any{"intValue": strconv.FormatInt(x, 10)}
+		case float64:
+			v = map[string]any{"doubleValue": x}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(x)}
+		}
+		out = append(out, map[string]any{"key": a.key, "value": v})
+	}
+	return out
+}
+
+func (t *telemetry) scope() map[string]any {
+	return map[string]any{"name": "Calibration-Demo", "version": currentBuild().Version}
+}
+
+func (t *telemetry) exportSpans() {
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+	if len(spans) == 0 || t.traces == "" {
+		return
+	}
+	body := map[string]any{"resourceSpans": []any{map[string]any{
+		"resource":   map[string]any{"attributes": otlpAttrs(t.resource)},
+		"scopeSpans": []any{map[string]any{"scope": t.scope(), "spans": spans}},
+	}}}
+	if !t.post(t.traces, body) {
+		t.mu.Lock()
+		t.dropped += int64(len(spans))
+		t.mu.Unlock()
+	}
+}
+
+func (t *telemetry) exportMetrics() {
+	if t.metrics == "" {
+		return
+	}
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	start := strconv.FormatInt(t.began.UnixNano(), 10)
+	t.mu.Lock()
+	names := make([]string, 0, len(t.counters))
+	for name := range t.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var metrics []any
+	for _, name := range names {
+		c := t.counters[name]
+		var points []any
+		for _, p := range c.points {
+			points = append(points, map[string]any{"attributes": otlpAttrs(p.attrs), "startTimeUnixNano": start,
+				"timeUnixNano": now, "asInt": strconv.FormatInt(p.value, 10)})
+		}
+		metrics = append(metrics, map[string]any{"name": name, "unit": c.unit, "description": c.description,
+			"sum": map[string]any{"aggregationTemporality": 2, "isMonotonic": true, "dataPoints": points}})
+	}
+	t.mu.Unlock()
+	if len(metrics) == 0 {
+		return
+	}
+	t.post(t.metrics, map[string]any{"resourceMetrics": []any{map[string]any{
+		"resource":     map[string]any{"attributes": otlpAttrs(t.resource)},
+		"scopeMetrics": []any{map[string]any{"scope": t.scope(), "metrics": metrics}},
+	}}})
+}
+
+// post sends one export request. A failure is logged when exports start
+// failing and when they work again, not on every attempt.
+func (t *telemetry) post(endpoint string, body any) bool {
+	b, _ := json.Marshal(body)
+	err := func() error {
+		req, err := http.NewRequest("POST", endpoint, bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range t.headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := t.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return errors.New(resp.Status)
+		}
+		return nil
+	}()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case err != nil && !t.failing:
+		log.Printf("warning: opentelemetry export to %s: %v", endpoint, err)
+	case err == nil && t.failing:
+		log.Printf("opentelemetry: exporting to %s again", endpoint)
+	}
+	t.failing = err != nil
+	return err == nil
+}
+
+// statusRecorder keeps the status code of a response for the server span.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the Flusher of the stream.
+func (w *statusRecorder) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// traceHTTP wraps the API with a server span per request, named by its
+// route, and counts the requests by route and status.
+func (t *telemetry) traceHTTP(mux *http.ServeMux) http.Handler {
+	if t == nil {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the pattern ("GET /api/scales/{scale}/calibrations") names the span
+		_, route := mux.Handler(r)
+		route = cmp.Or(route, r.Method+" (unmatched)")
+		ctx := withTraceparent(r.Context(), r.Header.Get("Traceparent"))
+		ctx, span := t.startKind(ctx, route, spanServer, attr("http.request.method", r.Method), attr("http.route", route),
+			attr("url.path", r.URL.Path), attr("client.address", remoteHost(r)))
+		rec := &statusRecorder{ResponseWriter: w}
+		mux.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.set(attr("http.response.status_code", rec.status))
+		if status := rec.Header().Get("Grpc-Status"); status != "" {
+			span.set(attr("rpc.grpc.status_code", status))
+		}
+		if rec.status >= 500 {
+			span.fail(errors.New(http.StatusText(rec.status)))
+		}
+		span.end()
+		t.count("calibrate.http.requests", "{request}", "API requests handled, by route and status", 1,
+			attr("http.route", route), attr("http.response.status_code", rec.status))
+	})
+}
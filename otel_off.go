@@ -0,0 +1,50 @@
+//go:build !otel && !full
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Without the otel tag, telemetry is the nil exporter of otel.go: the call
+// sites stay as they are and record nothing.
+
+type telemetry struct{}
+
+type otelAttr struct{}
+
+func attr(string, any) otelAttr { return otelAttr{} }
+
+type otelSpan struct{}
+
+// startTelemetry warns when the environment asks for an export this build
+// cannot do.
+func startTelemetry() (*telemetry, error) {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return nil, nil
+	}
+	for _, env := range []string{"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "OTEL_EXPORTER_OTLP_METRICS_ENDPOINT"} {
+		if os.Getenv(env) != "" {
+			log.Printf("warning: %v", notBuiltIn(env, "otel"))
+			break
+		}
+	}
+	return nil, nil
+}
+
+func (t *telemetry) start(ctx context.Context, _ string, _ ...otelAttr) (context.Context, *otelSpan) {
+	return ctx, nil
+}
+
+func (t *telemetry) countSolve(error)                          {}
+func (t *telemetry) countReadings(bool, int64)                 {}
+func (t *telemetry) shutdown()                                 {}
+func (t *telemetry) traceHTTP(mux *http.ServeMux) http.Handler { return mux }
+
+func (s *otelSpan) set(...otelAttr) {}
+func (s *otelSpan) fail(error)      {}
+func (s *otelSpan) end()            {}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Retry delays of an outbox: doubled after each failed delivery, from
+// outboxMinBackoff up to outboxMaxBackoff.
+const (
+	outboxMinBackoff = time.Second
+	outboxMaxBackoff = 5 * time.Minute
+)
+
+// SinkHealth is the delivery state of one remote output (webhook, MQTT).
+type SinkHealth struct {
+	Sink        string    `json:"sink"`
+	Healthy     bool      `json:"healthy"`
+	Queued      int       `json:"queued"`
+	Delivered   int64     `json:"delivered"`
+	Dropped     int64     `json:"dropped"`
+	Failures    int       `json:"consecutive_failures"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastSuccess time.Time `json:"last_success,omitzero"`
+}
+
+// outbox delivers payloads to one remote output from a bounded queue, in
+// order, in the background: a failed delivery stays at the head of the queue
+// and is retried with exponential backoff, so a broker or endpoint that is
+// down for a while delays records instead of losing them. When the queue is
+// full the oldest record is dropped (and counted). Health changes are logged.
+type outbox struct {
+	name    string
+	deliver func([]byte) error
+	limit   int
+
+	mu     sync.Mutex
+	queue  [][]byte
+	health SinkHealth
+	wake   chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// newOutbox starts the delivery goroutine of an outbox holding up to limit
+// records.
+func newOutbox(name string, limit int, deliver func([]byte) error) *outbox {
+	o := &outbox{name: name, deliver: deliver, limit: max(limit, 1),
+		health: SinkHealth{Sink: name, Healthy: true},
+		wake:   make(chan struct{}, 1), stop: make(chan struct{}), done: make(chan struct{})}
+	go o.run()
+	return o
+}
+
+// enqueue queues payload for delivery.
+func (o *outbox) enqueue(payload []byte) {
+	o.mu.Lock()
+	if len(o.queue) >= o.limit {
+		o.queue = o.queue[1:]
+		o.health.Dropped++
+		log.Printf("warning: %s: queue full (%d), dropped the oldest record", o.name, o.limit)
+	}
+	o.queue = append(o.queue, payload)
+	o.mu.Unlock()
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *outbox) run() {
+	defer close(o.done)
+	backoff := time.Duration(0)
+	for {
+		var retry <-chan time.Time
+		if backoff > 0 {
+			retry = time.After(backoff)
+		}
+		select {
+		case <-o.stop:
+			return
+		case <-o.wake:
+			if backoff > 0 {
+				continue // still backing off
+			}
+		case <-retry:
+		}
+		if o.flush() {
+			backoff = 0
+		} else {
+			backoff = min(max(2*backoff, outboxMinBackoff), outboxMaxBackoff)
+		}
+	}
+}
+
+// flush delivers the queued records in order until the queue is empty
+// (true) or a delivery fails (false).
+func (o *outbox) flush() bool {
+	for {
+		o.mu.Lock()
+		if len(o.queue) == 0 {
+			o.mu.Unlock()
+			return true
+		}
+		payload, dropped := o.queue[0], o.health.Dropped
+		o.mu.Unlock()
+		err := o.deliver(payload)
+		o.mu.Lock()
+		if err != nil {
+			o.health.Failures++
+			o.health.LastError = err.Error()
+			if o.health.Healthy {
+				log.Printf("warning: %s: %v; retrying with backoff (%d queued)", o.name, err, len(o.queue))
+			}
+			o.health.Healthy = false
+			o.mu.Unlock()
+			return false
+		}
+		// unless enqueue has dropped it meanwhile, payload is still the head
+		if o.health.Dropped == dropped {
+			o.queue = o.queue[1:]
+		}
+		if !o.health.Healthy {
+			log.Printf("%s: delivering again after %d failure(s)", o.name, o.health.Failures)
+		}
+		o.health.Delivered++
+		o.health.Healthy, o.health.Failures, o.health.LastSuccess = true, 0, time.Now().UTC()
+		o.mu.Unlock()
+	}
+}
+
+// Health returns the current delivery state.
+func (o *outbox) Health() SinkHealth {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	h := o.health
+	h.Queued = len(o.queue)
+	return h
+}
+
+// close stops the background retries and makes a last delivery attempt of
+// the queue until ctx is done, returning the number of records left
+// undelivered.
+func (o *outbox) close(ctx context.Context) int {
+	close(o.stop)
+	<-o.done
+	for ctx.Err() == nil && !o.flush() {
+		select {
+		case <-ctx.Done():
+		case <-time.After(outboxMinBackoff):
+		}
+	}
+	return o.Health().Queued
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ElectricalParams describes the measuring chain behind the ADC counts, so
+// the fitted factors can be read as load cell sensitivities. The ADC is taken
+// as bipolar: at gain 1 its codes span -adc_ref_v..+adc_ref_v over 2^adc_bits
+// counts (for an HX711 give AVDD/2). CellCapacity is the rated load of one
+// cell in the unit of calibration_weight; RatedOutput, when known, is each
+// cell's datasheet (or certificate) sensitivity in mV/V at that load.
+type ElectricalParams struct {
+	ExcitationV  float64     `json:"excitation_v"`
+	ADCRefV      float64     `json:"adc_ref_v"`
+	ADCBits      int         `json:"adc_bits"`
+	Gain         float64     `json:"gain,omitempty"`
+	CellCapacity float64     `json:"cell_capacity"`
+	RatedOutput  *[4]float64 `json:"rated_output_mv_v,omitempty"`
+	// Tolerance is the relative deviation from the datasheet value or from
+	// the other cells beyond which a cell is flagged (default 0.05).
+	Tolerance float64 `json:"tolerance,omitempty"`
+}
+
+const defaultSensitivityTol = 0.05
+
+// CellSensitivity is one cell's fitted sensitivity in physical units:
+// counts and input microvolts per unit weight, and the mV/V it would put
+// out at its rated capacity. FamilyDeviation is relative to the median of
+// the four cells, DatasheetDeviation to its rated output.
+type CellSensitivity struct {
+	Cell               int      `json:"cell"`
+	CountsPerUnit      float64  `json:"counts_per_unit"`
+	MicrovoltsPerUnit  float64  `json:"uv_per_unit"`
+	MVPerV             float64  `json:"mv_v"`
+	FamilyDeviation    float64  `json:"family_deviation"`
+	Datasheet          *float64 `json:"datasheet_mv_v,omitempty"`
+	DatasheetDeviation *float64 `json:"datasheet_deviation,omitempty"`
+	OutOfFamily        bool     `json:"out_of_family"`
+	OffDatasheet       bool     `json:"off_datasheet"`
+}
+
+// PhysicalReport converts the factors to physical sensitivities with the
+// calibration's electrical parameters.
+type PhysicalReport struct {
+	LSBMicrovolts float64           `json:"lsb_uv"`
+	FamilyMedian  float64           `json:"family_median_mv_v"`
+	Tolerance     float64           `json:"tolerance"`
+	Cells         []CellSensitivity `json:"cells"`
+}
+
+// PhysicalSensitivity converts factors (weight per count) to per-cell
+// sensitivities. A load W over cell i alone gives W/|f_i| counts, i.e.
+// W/|f_i| * LSB volts at the bridge output with LSB = adc_ref_v /
+// (gain * 2^(adc_bits-1)); dividing by the excitation gives mV/V, reported
+// at the cell's rated capacity.
+func PhysicalSensitivity(factors [4]float64, p ElectricalParams) (PhysicalReport, error) {
+	var rep PhysicalReport
+	gain := p.Gain
+	if gain == 0 {
+		gain = 1
+	}
+	tol := p.Tolerance
+	if tol == 0 {
+		tol = defaultSensitivityTol
+	}
+	switch {
+	case p.ExcitationV <= 0:
+		return rep, errors.New("excitation_v must be > 0")
+	case p.ADCRefV <= 0:
+		return rep, errors.New("adc_ref_v must be > 0")
+	case p.ADCBits < 2 || p.ADCBits > 32:
+		return rep, fmt.Errorf("adc_bits %d is not between 2 and 32", p.ADCBits)
+	case gain < 0:
+		return rep, errors.New("gain must be > 0")
+	case p.CellCapacity <= 0:
+		return rep, errors.New("cell_capacity must be > 0")
+	case tol < 0:
+		return rep, errors.New("tolerance must be >= 0")
+	}
+	lsb := p.ADCRefV / (gain * math.Ldexp(1, p.ADCBits-1))
+	rep.LSBMicrovolts, rep.Tolerance = lsb*1e6, tol
+
+	mvv := make([]float64, 4)
+	for i, f := range factors {
+		if f == 0 {
+			return rep, fmt.Errorf("factor f%d is 0", i)
+		}
+		c := CellSensitivity{Cell: i, CountsPerUnit: 1 / math.Abs(f)}
+		c.MicrovoltsPerUnit = c.CountsPerUnit * lsb * 1e6
+		c.MVPerV = c.MicrovoltsPerUnit * p.CellCapacity / 1e3 / p.ExcitationV
+		mvv[i] = c.MVPerV
+		rep.Cells = append(rep.Cells, c)
+	}
+	sort.Float64s(mvv)
+	rep.FamilyMedian = (mvv[1] + mvv[2]) / 2
+	for i := range rep.Cells {
+		c := &rep.Cells[i]
+		c.FamilyDeviation = c.MVPerV/rep.FamilyMedian - 1
+		c.OutOfFamily = math.Abs(c.FamilyDeviation) > tol
+		if p.RatedOutput != nil && p.RatedOutput[i] > 0 {
+			rated := p.RatedOutput[i]
+			dev := c.MVPerV/rated - 1
+			c.Datasheet, c.DatasheetDeviation = &rated, &dev
+			c.OffDatasheet = math.Abs(dev) > tol
+		}
+	}
+	return rep, nil
+}
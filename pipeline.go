@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// StageStats are the metrics of one pipeline queue: items sent in and taken
+// out, items dropped because the queue was full, the deepest the queue got,
+// and how long the producer waited on a full queue.
+type StageStats struct {
+	Name     string  `json:"name"`
+	In       int64   `json:"in"`
+	Out      int64   `json:"out"`
+	Dropped  int64   `json:"dropped"`
+	MaxDepth int     `json:"max_depth"`
+	Capacity int     `json:"capacity"`
+	Blocked  float64 `json:"blocked_seconds"`
+}
+
+func (s StageStats) String() string {
+	return fmt.Sprintf("%s: %d in, %d out, %d dropped, max depth %d/%d, producer blocked %.3fs",
+		s.Name, s.In, s.Out, s.Dropped, s.MaxDepth, s.Capacity, s.Blocked)
+}
+
+// pipe is a bounded queue between two pipeline stages. A full pipe makes the
+// producer wait (backpressure), or, when it sheds load, drops the item
+// instead, so a slow consumer never makes memory grow.
+type pipe[T any] struct {
+	ch    chan T
+	shed  bool
+	done  chan struct{}
+	mu    sync.Mutex
+	stats StageStats
+}
+
+// newPipe returns a pipe holding up to depth items.
+func newPipe[T any](name string, depth int, shed bool) *pipe[T] {
+	return &pipe[T]{ch: make(chan T, depth), shed: shed, done: make(chan struct{}),
+		stats: StageStats{Name: name, Capacity: depth}}
+}
+
+// send queues v, or drops it when the pipe sheds load and is full. It
+// reports false when the consumer has stopped and the producer should stop
+// too.
+func (p *pipe[T]) send(v T) bool {
+	p.mu.Lock()
+	p.stats.In++
+	if d := len(p.ch) + 1; d > p.stats.MaxDepth {
+		p.stats.MaxDepth = min(d, cap(p.ch))
+	}
+	p.mu.Unlock()
+	select {
+	case p.ch <- v:
+		return true
+	case <-p.done:
+		return false
+	default:
+	}
+	if p.shed {
+		p.mu.Lock()
+		p.stats.Dropped++
+		p.mu.Unlock()
+		return true
+	}
+	start := time.Now()
+	defer func() {
+		p.mu.Lock()
+		p.stats.Blocked += time.Since(start).Seconds()
+		p.mu.Unlock()
+	}()
+	select {
+	case p.ch <- v:
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+// recv takes the next item; ok is false once the producer has closed the
+// pipe and it is empty.
+func (p *pipe[T]) recv() (v T, ok bool) {
+	v, ok = <-p.ch
+	if ok {
+		p.mu.Lock()
+		p.stats.Out++
+		p.mu.Unlock()
+	}
+	return v, ok
+}
+
+// recvBatch takes the next item and whatever else is queued, up to max
+// items, into buf[:0]; ok is false once the pipe is closed and empty.
+func (p *pipe[T]) recvBatch(buf []T, max int) (batch []T, ok bool) {
+	v, ok := p.recv()
+	if !ok {
+		return buf[:0], false
+	}
+	batch = append(buf[:0], v)
+	for len(batch) < max && len(p.ch) > 0 {
+		if v, ok = p.recv(); !ok {
+			break
+		}
+		batch = append(batch, v)
+	}
+	return batch, true
+}
+
+// close is called by the producer after its last send.
+func (p *pipe[T]) close() { close(p.ch) }
+
+// stop is called by a consumer that gives up early, so a waiting producer
+// returns.
+func (p *pipe[T]) stop() { close(p.done) }
+
+// Stats returns the metrics so far.
+func (p *pipe[T]) Stats() StageStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+// Product is an entry of the product catalog: the target weight of one SKU
+// and the tolerance band a checkweigher accepts around it.
+type Product struct {
+	ID     string  `json:"id"`
+	Name   string  `json:"name,omitempty"`
+	Target float64 `json:"target"`
+	Units  string  `json:"units,omitempty"`
+	// Under and Over are how far below and above the target a weight may
+	// be and still be accepted.
+	Under float64 `json:"tol_under"`
+	Over  float64 `json:"tol_over"`
+}
+
+// Checkweighing zones.
+const (
+	classUnder  = "under"
+	classAccept = "accept"
+	classOver   = "over"
+)
+
+// Classify returns the checkweighing zone of weight w: under below
+// target - tol_under, over above target + tol_over, accept in between
+// (limits included).
+func (p Product) Classify(w float64) string {
+	switch {
+	case w < p.Target-p.Under:
+		return classUnder
+	case w > p.Target+p.Over:
+		return classOver
+	}
+	return classAccept
+}
+
+// findProduct returns the catalog entry id, listing the known IDs when
+// there is none.
+func findProduct(products []Product, id string) (Product, error) {
+	var ids []string
+	for _, p := range products {
+		if p.ID == id {
+			return p, nil
+		}
+		ids = append(ids, p.ID)
+	}
+	if len(ids) == 0 {
+		return Product{}, fmt.Errorf("product %q is not in the catalog (the catalog is empty; add products with `calibrate product add`)", id)
+	}
+	return Product{}, fmt.Errorf("product %q is not in the catalog (known: %s)", id, strings.Join(ids, ", "))
+}
+
+// CheckweighReport is the checkweighing section of apply mode: how many
+// weights (readings, or items with -dynamic) fell in each zone of the
+// product's band, and their mean.
+type CheckweighReport struct {
+	Product Product `json:"product"`
+	Lower   float64 `json:"lower_limit"`
+	Upper   float64 `json:"upper_limit"`
+	Of      string  `json:"of"`
+	Under   int     `json:"under"`
+	Accept  int     `json:"accept"`
+	Over    int     `json:"over"`
+	Mean    float64 `json:"mean,omitempty"`
+	// Giveaway is the mean excess over the target of the accepted weights.
+	Giveaway float64 `json:"giveaway,omitempty"`
+	sum      float64
+	excess   float64
+}
+
+func newCheckweighReport(p Product, of string) *CheckweighReport {
+	return &CheckweighReport{Product: p, Lower: p.Target - p.Under, Upper: p.Target + p.Over, Of: of}
+}
+
+// add classifies w, counts it and returns its zone.
+func (r *CheckweighReport) add(w float64) string {
+	class := r.Product.Classify(w)
+	switch class {
+	case classUnder:
+		r.Under++
+	case classOver:
+		r.Over++
+	default:
+		r.Accept++
+		r.excess += w - r.Product.Target
+	}
+	r.sum += w
+	if n := r.Under + r.Accept + r.Over; n > 0 {
+		r.Mean = r.sum / float64(n)
+	}
+	if r.Accept > 0 {
+		r.Giveaway = r.excess / float64(r.Accept)
+	}
+	return class
+}
+
+// runProduct implements `calibrate product add|list`: maintain the product
+// catalog in the store.
+func runProduct(args []string) int {
+	if len(args) == 0 || (args[0] != "add" && args[0] != "list") {
+		fmt.Fprintln(os.Stderr, "usage: calibrate product add|list [-store SPEC] ...")
+		return 2
+	}
+	fs := flag.NewFlagSet("product "+args[0], flag.ExitOnError)
+	storeFlag, storeKey := storeFlags(fs)
+	id := fs.String("id", "", "add: product ID or SKU (required)")
+	name := fs.String("name", "", "add: product description")
+	target := fs.Float64("target", 0, "add: target weight (required)")
+	units := fs.String("units", "", "add: unit of the target weight and tolerances")
+	tol := fs.Float64("tol", 0, "add: symmetric tolerance, sets both -tol-under and -tol-over")
+	under := fs.Float64("tol-under", 0, "add: how far below the target a weight is still accepted")
+	over := fs.Float64("tol-over", 0, "add: how far above the target a weight is still accepted")
+	asJSON := fs.Bool("json", false, "list: print the catalog as JSON")
+	_ = fs.Parse(args[1:])
+
+	st := openStoreOrExit(*storeFlag, *storeKey)
+	if st == nil {
+		return 1
+	}
+	defer st.Close()
+
+	if args[0] == "add" {
+		set := map[string]bool{}
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if set["tol"] && (set["tol-under"] || set["tol-over"]) {
+			fmt.Fprintln(os.Stderr, "error: give either -tol or -tol-under/-tol-over")
+			return 2
+		}
+		if set["tol"] {
+			*under, *over = *tol, *tol
+		}
+		switch {
+		case *id == "" || *target <= 0 || math.IsInf(*target, 0):
+			fmt.Fprintln(os.Stderr, "error: -id and -target (> 0) are required")
+			return 2
+		case *under < 0 || *over < 0 || math.IsNaN(*under) || math.IsNaN(*over):
+			fmt.Fprintln(os.Stderr, "error: tolerances must be >= 0")
+			return 2
+		case *under == 0 && *over == 0:
+			fmt.Fprintln(os.Stderr, "error: give the tolerance band with -tol or -tol-under/-tol-over")
+			return 2
+		}
+		p := Product{ID: *id, Name: *name, Target: *target, Units: *units, Under: *under, Over: *over}
+		if err := st.SaveProduct(&p); err != nil {
+			fmt.Fprintf(os.Stderr, "error saving product: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Saved product %s: target %g%s, accept %g..%g\n", p.ID, p.Target, unitSuffix(p.Units), p.Target-p.Under, p.Target+p.Over)
+		return 0
+	}
+
+	products, err := st.Products()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading products: %v\n", err)
+		return 1
+	}
+	if *asJSON {
+		if products == nil {
+			products = []Product{}
+		}
+		out, _ := json.MarshalIndent(products, "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+	fmt.Printf("Products (%d):\n", len(products))
+	for _, p := range products {
+		fmt.Printf("  %-16s %10g%-3s -%-8g +%-8g accept %g..%g  %s\n",
+			p.ID, p.Target, p.Units, p.Under, p.Over, p.Target-p.Under, p.Target+p.Over, p.Name)
+	}
+	return 0
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCalibrationProtoRoundTrip(t *testing.T) {
+	base := exactCalibration(1, [4]float64{0.004, 0.0045, 0.0055, 0.006}, 500)
+	rated := [4]float64{2, 2.01, 1.99, 2}
+	positions := [4][2]float64{{0, 0}, {1, 0}, {1, 1}, {0, 1}}
+	tests := []struct {
+		name   string
+		modify func(*CalibrationData)
+	}{
+		{"plain", func(*CalibrationData) {}},
+		{"units and dates", func(c *CalibrationData) {
+			c.Units, c.CalibratedAt, c.ValidDays = "kg", "2026-01-31", 180
+		}},
+		{"cell positions", func(c *CalibrationData) { c.CellPositions = &positions }},
+		{"electrical", func(c *CalibrationData) {
+			c.Electrical = &ElectricalParams{ExcitationV: 5, ADCRefV: 2.5, ADCBits: 24, Gain: 128,
+				CellCapacity: 50, RatedOutput: &rated, Tolerance: 0.02}
+		}},
+		{"partial", func(c *CalibrationData) {
+			c.Stage = "partial"
+			c.Replacement = &CellReplacement{Cell: 2, Factors: [4]float64{0.004, 0.0045, 0, 0.006}, FromVersion: 3}
+		}},
+		{"negative and zero values", func(c *CalibrationData) {
+			c.Zero = [4]float64{-8388608, 0, 8388607, -1}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cal := base
+			tt.modify(&cal)
+			got, err := UnmarshalCalibrationProto(MarshalCalibrationProto(cal))
+			if err != nil {
+				t.Fatalf("UnmarshalCalibrationProto: %v", err)
+			}
+			if !reflect.DeepEqual(got, cal) {
+				t.Errorf("round trip = %+v, want %+v", got, cal)
+			}
+		})
+	}
+}
+
+func TestCalibrationProtoErrors(t *testing.T) {
+	good := MarshalCalibrationProto(exactCalibration(1, [4]float64{0.005, 0.005, 0.005, 0.005}, 100))
+	var short protoEncoder
+	short.doubles(2, []float64{1, 2, 3})
+	tests := []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{"truncated", good[:len(good)-3], "truncated"},
+		{"missing rows", nil, "zero has 0 values"},
+		{"short row", short.b, "zero has 3 values"},
+		{"bad key", []byte{0x80}, "bad field key"},
+		{"wrong wire type", []byte{0x08, 0x01}, "wire type 0, want 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := UnmarshalCalibrationProto(tt.b)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("UnmarshalCalibrationProto error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestResultProtoRoundTrip(t *testing.T) {
+	cal := exactCalibration(2, [4]float64{0.004, 0.0045, 0.0055, 0.006}, 500)
+	fitted, err := FitCalibration(cal, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := ApplyReadings([][]float64{cal.Zero[:], cal.OnCenter[:], {1e9, 0, 0, 0}}, cal.Zero, fitted.Factors,
+		ApplyOptions{Tare: 1, Division: 0.5, Filter: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	center, off, tilt := [2]float64{0.5, -0.25}, 0.1, 0.3
+	tests := []struct {
+		name string
+		res  CalibrationResult
+	}{
+		{"empty", CalibrationResult{}},
+		{"fit", fitted},
+		{"warnings", CalibrationResult{Factors: fitted.Factors, Warnings: []Warning{
+			newWarning("duplicate-row", "on_cell_0", "row %d", 1), {Code: "CAL-W099", Check: "unknown", Message: "kept as is"},
+		}}},
+		{"readings", CalibrationResult{Factors: fitted.Factors, Readings: applied.Readings}},
+		{"reading extras", CalibrationResult{Readings: []ReadingResult{{
+			Reading: 1, Valid: true, CenterOfLoad: &center, OffCenter: &off, Class: "accept", Tilt: &tilt,
+		}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := MarshalResultProto(tt.res)
+			if err != nil {
+				t.Fatalf("MarshalResultProto: %v", err)
+			}
+			got, err := UnmarshalResultProto(b)
+			if err != nil {
+				t.Fatalf("UnmarshalResultProto: %v", err)
+			}
+			// compared as -json-out, which is what the message carries
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(tt.res)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("round trip =\n%s\nwant\n%s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// RetentionPolicy bounds what the store keeps. Zero means keep everything.
+type RetentionPolicy struct {
+	// KeepVersions is the number of most recent calibration versions kept
+	// per scale; the active version is always kept as well.
+	KeepVersions int
+	// KeepDays is the age in days after which applied-batch summaries go.
+	KeepDays int
+}
+
+func (p RetentionPolicy) empty() bool { return p.KeepVersions <= 0 && p.KeepDays <= 0 }
+
+// retentionFlags registers -keep-versions and -keep-days on fs. Unset flags
+// fall back to $CAL_KEEP_VERSIONS and $CAL_KEEP_DAYS when the returned
+// function resolves the policy after parsing.
+func retentionFlags(fs *flag.FlagSet) func() (RetentionPolicy, error) {
+	versions := fs.Int("keep-versions", 0, "keep this many most recent calibration versions per scale (default $CAL_KEEP_VERSIONS, 0 = all)")
+	days := fs.Int("keep-days", 0, "keep applied-batch summaries for this many days (default $CAL_KEEP_DAYS, 0 = all)")
+	return func() (RetentionPolicy, error) {
+		p := RetentionPolicy{KeepVersions: *versions, KeepDays: *days}
+		for _, f := range []struct {
+			env string
+			dst *int
+		}{{"CAL_KEEP_VERSIONS", &p.KeepVersions}, {"CAL_KEEP_DAYS", &p.KeepDays}} {
+			if *f.dst != 0 {
+				continue
+			}
+			if v := os.Getenv(f.env); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return p, fmt.Errorf("invalid $%s %q", f.env, v)
+				}
+				*f.dst = n
+			}
+		}
+		if p.KeepVersions < 0 || p.KeepDays < 0 {
+			return p, fmt.Errorf("retention limits must not be negative")
+		}
+		return p, nil
+	}
+}
+
+// PruneResult lists what a prune removed (or would remove).
+type PruneResult struct {
+	Versions []Session
+	Batches  int
+}
+
+// PruneStore applies the policy to st. With dryRun nothing is deleted.
+// Removed calibration versions are recorded in the audit log at auditLog.
+func PruneStore(st Store, p RetentionPolicy, now time.Time, dryRun bool, auditLog, operator string) (PruneResult, error) {
+	var res PruneResult
+	if p.KeepVersions > 0 {
+		all, err := st.Sessions("")
+		if err != nil {
+			return res, err
+		}
+		byScale := map[string][]Session{}
+		var scales []string
+		for _, s := range all {
+			if _, ok := byScale[s.Scale]; !ok {
+				scales = append(scales, s.Scale)
+			}
+			byScale[s.Scale] = append(byScale[s.Scale], s)
+		}
+		sort.Strings(scales)
+		for _, scale := range scales {
+			sessions := byScale[scale]
+			if len(sessions) <= p.KeepVersions {
+				continue
+			}
+			active, err := st.Active(scale)
+			if err != nil {
+				return res, err
+			}
+			sort.Slice(sessions, func(i, j int) bool { return sessions[i].Version > sessions[j].Version })
+			for _, s := range sessions[p.KeepVersions:] {
+				if s.Version == active {
+					continue
+				}
+				if !dryRun {
+					if err := st.DeleteSession(scale, s.Version); err != nil {
+						return res, err
+					}
+					detail := fmt.Sprintf("pruned v%d (keeping the last %d versions)", s.Version, p.KeepVersions)
+					if err := AppendAudit(auditLog, "prune", operator, scale, detail, auditSnapshot(&s), nil); err != nil {
+						fmt.Fprintf(os.Stderr, "warning: audit log: %v\n", err)
+					}
+				}
+				res.Versions = append(res.Versions, s)
+			}
+		}
+	}
+	if p.KeepDays > 0 {
+		before := now.AddDate(0, 0, -p.KeepDays)
+		if dryRun {
+			batches, err := st.Batches("")
+			if err != nil {
+				return res, err
+			}
+			for _, b := range batches {
+				if b.Time.Before(before) {
+					res.Batches++
+				}
+			}
+			return res, nil
+		}
+		n, err := st.DeleteBatches(before)
+		if err != nil {
+			return res, err
+		}
+		res.Batches = n
+	}
+	return res, nil
+}
+
+// runPrune implements `calibrate prune`: enforce the retention policy once.
+func runPrune(args []string) int {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	storeFlag, storeKey := storeFlags(fs)
+	policy := retentionFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "list what would be removed without removing it")
+	auditLog := fs.String("audit-log", "", "record removed calibrations in this audit log (default $CAL_AUDIT_LOG)")
+	operator := fs.String("operator", "", "operator recorded in the audit log (default $CAL_OPERATOR or login name)")
+	_ = fs.Parse(args)
+
+	p, err := policy()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+	if p.empty() {
+		fmt.Fprintln(os.Stderr, "error: no retention configured (use -keep-versions/-keep-days or CAL_KEEP_VERSIONS/CAL_KEEP_DAYS)")
+		return 2
+	}
+	st := openStoreOrExit(*storeFlag, *storeKey)
+	if st == nil {
+		return 1
+	}
+	defer st.Close()
+	res, err := PruneStore(st, p, time.Now().UTC(), *dryRun, auditPath(*auditLog), operatorName(*operator))
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	for _, s := range res.Versions {
+		fmt.Printf("%s %s v%d (%s, sha256 %.12s)\n", verb, s.Scale, s.Version, s.Time.Format("2006-01-02"), s.Checksum)
+	}
+	fmt.Printf("%s %d calibration versions and %d batch summaries\n", verb, len(res.Versions), res.Batches)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error pruning store: %v\n", err)
+		return 1
+	}
+	return 0
+}
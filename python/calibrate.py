@@ -0,0 +1,96 @@
+"""The calibrate solver from Python, through the C shared library.
+
+Build the library next to this file first:
+
+    go build -buildmode=c-shared -o python/libcalibrate.so ./python
+
+(libcalibrate.dylib on macOS, calibrate.dll on Windows), or point
+CALIBRATE_LIB at it. Arguments are sequences of floats: lists, tuples or
+NumPy arrays.
+
+    >>> import calibrate
+    >>> f = calibrate.compute_factors(rows, zero, 1000.0)
+    >>> calibrate.compute_weight(adc, zero, f)
+"""
+
+import ctypes
+import os
+import sys
+
+__all__ = ["compute_factors", "compute_weight", "compute_weights", "SolverError"]
+
+PLACEMENTS = 5
+
+
+class SolverError(ValueError):
+    """The normal equations are singular or the factors are not finite."""
+
+
+def _load():
+    path = os.environ.get("CALIBRATE_LIB")
+    if not path:
+        name = {"darwin": "libcalibrate.dylib", "win32": "calibrate.dll"}.get(sys.platform, "libcalibrate.so")
+        path = os.path.join(os.path.dirname(os.path.abspath(__file__)), name)
+    lib = ctypes.CDLL(path)
+    p = ctypes.POINTER(ctypes.c_double)
+    lib.compute_factors.argtypes = [p, p, ctypes.c_double, ctypes.c_double, p]
+    lib.compute_factors.restype = ctypes.c_int
+    lib.compute_weight.argtypes = [p, p, p]
+    lib.compute_weight.restype = ctypes.c_double
+    lib.compute_weights.argtypes = [p, ctypes.c_size_t, p, p, p]
+    lib.compute_weights.restype = None
+    return lib
+
+
+_lib = _load()
+
+
+def _array(values, n, what):
+    values = [float(v) for v in values]
+    if len(values) != n:
+        raise ValueError("%s: want %d values, got %d" % (what, n, len(values)))
+    return (ctypes.c_double * n)(*values)
+
+
+def _rows(rows, what):
+    flat = []
+    for i, row in enumerate(rows):
+        flat.extend(_array(row, 4, "%s[%d]" % (what, i)))
+    return flat
+
+
+def compute_factors(rows, zero, weight, ridge=0.0):
+    """Fit the factors (weight per count) of the four channels.
+
+    rows are the readings of the five placements: the weight on cells 0-3,
+    then on the center. zero is the reading of the empty platform, weight
+    the calibration weight. ridge > 0 stabilizes an ill-conditioned fit,
+    like CAL_RIDGE in the CLI.
+    """
+    flat = _rows(rows, "rows")
+    if len(flat) != 4 * PLACEMENTS:
+        raise ValueError("rows: want %d placements, got %d" % (PLACEMENTS, len(flat) // 4))
+    factors = (ctypes.c_double * 4)()
+    status = _lib.compute_factors(
+        _array(flat, 4 * PLACEMENTS, "rows"), _array(zero, 4, "zero"), float(weight), float(ridge), factors
+    )
+    if status != 0:
+        raise SolverError("could not solve normal equations")
+    return list(factors)
+
+
+def compute_weight(adc, zero, factors):
+    """The weight of one 4-channel reading."""
+    return _lib.compute_weight(_array(adc, 4, "adc"), _array(zero, 4, "zero"), _array(factors, 4, "factors"))
+
+
+def compute_weights(readings, zero, factors):
+    """The weight of each 4-channel reading, as a list."""
+    flat = _rows(readings, "readings")
+    n = len(flat) // 4
+    out = (ctypes.c_double * n)()
+    if n:
+        _lib.compute_weights(
+            _array(flat, 4 * n, "readings"), n, _array(zero, 4, "zero"), _array(factors, 4, "factors"), out
+        )
+    return list(out)
@@ -0,0 +1,79 @@
+//go:build cgo
+
+// Command python is the calibration solver as a C shared library, for the
+// ctypes wrapper calibrate.py next to it: built with
+//
+//	go build -buildmode=c-shared -o python/libcalibrate.so ./python
+//
+// it exports the core arithmetic of the calibrate tool, so a notebook fits
+// and weighs with the production solver rather than a reimplementation:
+//
+//	int compute_factors(const double *rows, const double *zero, double weight,
+//	    double ridge, double *factors)
+//	    fits the factors of the five placement rows (cells 0-3, then center;
+//	    20 doubles, row-major) into factors[4]; it returns 0, or 1 when the
+//	    system is singular or the solution is not finite
+//	double compute_weight(const double *adc, const double *zero,
+//	    const double *factors)
+//	    returns the weight of one reading
+//	void compute_weights(const double *readings, size_t n, const double *zero,
+//	    const double *factors, double *out)
+//	    writes the weight of each of n readings (4n doubles) to out[n]
+//
+// The library keeps no state and the functions are safe to call
+// concurrently. Sanity checks and the other diagnostics stay in the CLI.
+package main
+
+// #include <stddef.h>
+import "C"
+
+import (
+	"math"
+	"unsafe"
+
+	"Calibration-Demo/core"
+)
+
+func doubles(p *C.double, n int) []float64 {
+	return unsafe.Slice((*float64)(unsafe.Pointer(p)), n)
+}
+
+func vec4(p *C.double) [4]float64 {
+	return [4]float64(doubles(p, 4))
+}
+
+//export compute_factors
+func compute_factors(rows, zero *C.double, weight, ridge C.double, factors *C.double) C.int {
+	var r [core.Placements][4]float64
+	in := doubles(rows, 4*core.Placements)
+	for i := range r {
+		r[i] = [4]float64(in[4*i:])
+	}
+	f, err := core.Factors(r, vec4(zero), float64(weight), float64(ridge))
+	if err != nil {
+		return 1
+	}
+	for _, v := range f {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return 1
+		}
+	}
+	copy(doubles(factors, 4), f[:])
+	return 0
+}
+
+//export compute_weight
+func compute_weight(adc, zero, factors *C.double) C.double {
+	return C.double(core.Weight(vec4(adc), vec4(zero), vec4(factors)))
+}
+
+//export compute_weights
+func compute_weights(readings *C.double, n C.size_t, zero, factors, out *C.double) {
+	if n == 0 {
+		return
+	}
+	in := unsafe.Slice((*[4]float64)(unsafe.Pointer(readings)), int(n))
+	core.Weights(doubles(out, int(n)), in, vec4(zero), vec4(factors))
+}
+
+func main() {}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// LoadReadings reads a capture file holding 4-channel readings, in any of the
+// adc file formats (see parseADCDocument).
+func LoadReadings(path string) ([][4]float64, error) {
+	b, unmap, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer unmap()
+	return parseReadings(path, b)
+}
+
+// ReadReadingsSource loads readings from a capture file or, for
+// "cmd:<command>", from the stdout of a command that samples the scale.
+func ReadReadingsSource(spec string) ([][4]float64, error) {
+	cmdline, ok := strings.CutPrefix(spec, "cmd:")
+	if !ok {
+		return LoadReadings(spec)
+	}
+	args := strings.Fields(cmdline)
+	if len(args) == 0 {
+		return nil, errors.New("empty readings command")
+	}
+	out, err := exec.Command(args[0], args[1:]...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("readings command failed: %w", err)
+	}
+	return parseReadings(spec, out)
+}
+
+func parseReadings(name string, b []byte) ([][4]float64, error) {
+	doc, err := parseADCDocument(name, b)
+	return doc.Rows, err
+}
+
+// ADCDocument is a parsed adc file. Expected holds, per reading, the known
+// weight on the platform when the reading gives one ({"adc": [..],
+// "expected": w}), else nil; Tilt likewise the platform tilt in degrees
+// ("tilt": angle or [pitch, roll], see parseTiltJSON).
+type ADCDocument struct {
+	Rows     [][4]float64
+	Expected []*float64
+	Tilt     []*float64
+	// Single is set for {"adc": [a, b, c, d]}, a file with one reading.
+	Single bool
+}
+
+// HasExpected reports whether any reading carries an expected weight.
+func (d ADCDocument) HasExpected() bool {
+	for _, e := range d.Expected {
+		if e != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// UnmarshalJSON reads the documents accepted as adc files and checks that
+// every reading has four values, reporting the JSON pointer of a bad one.
+func (d *ADCDocument) UnmarshalJSON(b []byte) error {
+	var rows []json.RawMessage
+	prefix := ""
+	switch b[0] {
+	case '[':
+		if err := json.Unmarshal(b, &rows); err != nil {
+			return err
+		}
+	case '{':
+		var obj struct {
+			ADC json.RawMessage `json:"adc"`
+		}
+		if err := json.Unmarshal(b, &obj); err != nil {
+			return err
+		}
+		adc := bytes.TrimLeft(obj.ADC, " \t\r\n")
+		if len(adc) == 0 {
+			return fieldErrorf("/adc", "missing \"adc\"")
+		}
+		if adc[0] != '[' {
+			return fieldErrorf("/adc", "\"adc\" must be a reading [a, b, c, d] or a list of readings")
+		}
+		if err := json.Unmarshal(adc, &rows); err != nil {
+			return fieldErrorf("/adc", "\"adc\": %v", err)
+		}
+		prefix = "/adc"
+		// {"adc": [a, b, c, d]} is a single reading
+		if len(rows) > 0 && strings.IndexByte("[{", bytes.TrimLeft(rows[0], " \t\r\n")[0]) < 0 {
+			d.Single = true
+			rows = []json.RawMessage{b}
+		}
+	default:
+		return errors.New("want {\"adc\": [a, b, c, d]}, [[..], ..] or {\"adc\": [[..], ..]}")
+	}
+	if len(rows) == 0 {
+		return fieldErrorf(prefix, "no readings")
+	}
+	d.Rows = make([][4]float64, 0, len(rows))
+	d.Expected = make([]*float64, 0, len(rows))
+	d.Tilt = make([]*float64, 0, len(rows))
+	for i, raw := range rows {
+		at, what := fmt.Sprintf("%s/%d", prefix, i), fmt.Sprintf("reading %d", i+1)
+		if d.Single {
+			at, what = "", "the reading"
+		}
+		row, meta, err := parseADCReading(raw, at, what)
+		if err != nil {
+			return err
+		}
+		d.Rows = append(d.Rows, row)
+		d.Expected = append(d.Expected, meta.Expected)
+		d.Tilt = append(d.Tilt, meta.Tilt)
+	}
+	return nil
+}
+
+// readingMeta is what a reading object gives besides its ADC values.
+type readingMeta struct {
+	Expected *float64
+	Tilt     *float64
+}
+
+// parseADCReading decodes one reading, [a, b, c, d] or {"adc": [a, b, c, d],
+// "expected": w, "tilt": t}, found at pointer at.
+func parseADCReading(raw json.RawMessage, at, what string) ([4]float64, readingMeta, error) {
+	var row [4]float64
+	// pointerOf extends at to the value a type error in raw is about
+	pointerOf := func(raw json.RawMessage, at string, err error) string {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			sub, _ := jsonValueBefore(raw, typeErr.Offset)
+			at += sub
+		}
+		return at
+	}
+	var meta readingMeta
+	if raw[0] == '{' {
+		var obj struct {
+			ADC      json.RawMessage `json:"adc"`
+			Expected *float64        `json:"expected"`
+			Tilt     json.RawMessage `json:"tilt"`
+		}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			p := pointerOf(raw, at, err)
+			if strings.HasPrefix(p, at+"/expected") {
+				return row, meta, fieldErrorf(p, "%s: \"expected\" must be a number", what)
+			}
+			return row, meta, fieldErrorf(p, "%s: \"adc\" must be an array of 4 numbers", what)
+		}
+		if len(obj.ADC) == 0 {
+			return row, meta, fieldErrorf(at+"/adc", "%s has no \"adc\"", what)
+		}
+		if len(obj.Tilt) > 0 {
+			t, err := parseTiltJSON(obj.Tilt)
+			if err != nil {
+				return row, meta, fieldErrorf(at+"/tilt", "%s: \"tilt\": %v", what, err)
+			}
+			meta.Tilt = &t
+		}
+		raw, at, meta.Expected = obj.ADC, at+"/adc", obj.Expected
+	}
+	var r []float64
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return row, meta, fieldErrorf(pointerOf(raw, at, err), "%s must be an array of 4 numbers", what)
+	}
+	if len(r) != 4 {
+		return row, meta, fieldErrorf(at, "%s has %d values, want 4", what, len(r))
+	}
+	copy(row[:], r)
+	return row, meta, nil
+}
+
+// parseADCDocument parses an adc file: {"adc": [a, b, c, d]} for one reading,
+// or [[..], ..] or {"adc": [[..], ..]} for several, where each reading may
+// also be {"adc": [a, b, c, d], "expected": w}. Errors locate the problem in
+// name (see JSONError).
+func parseADCDocument(name string, b []byte) (ADCDocument, error) {
+	var d ADCDocument
+	if err := decodeJSON(name, b, &d); err != nil {
+		return ADCDocument{}, err
+	}
+	return d, nil
+}
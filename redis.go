@@ -0,0 +1,276 @@
+//go:build redis || full
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerLiveOutput("redis", func(fs *flag.FlagSet) func(cfg liveSinkConfig) (liveSink, error) {
+		spec := fs.String("redis", "", "also send every weight to Redis at redis://[:password@]host[:port][/db]")
+		channel := fs.String("redis-channel", "weights:{scale}", "Redis channel to PUBLISH each weight to (\"\" = none)")
+		key := fs.String("redis-key", "weight:{scale}", "Redis key holding the latest weight (\"\" = none)")
+		ttl := fs.Duration("redis-ttl", 0, "expire the latest-weight key this long after the last weight (0 = never)")
+		return func(cfg liveSinkConfig) (liveSink, error) {
+			if *spec == "" {
+				return nil, nil
+			}
+			p, err := newRedisPublisher(*spec, *channel, *key, *ttl, cfg.scale, cfg.units)
+			if err != nil {
+				return nil, fmt.Errorf("-redis: %v", err)
+			}
+			return redisSink{p}, nil
+		}
+	})
+}
+
+// redisSink sends the valid readings of `calibrate live`.
+type redisSink struct{ p *redisPublisher }
+
+func (s redisSink) send(u weightUpdate, _ []byte) {
+	if u.valid {
+		s.p.send(u)
+	}
+}
+
+func (s redisSink) close() {
+	if lost := s.p.close(); lost > 0 {
+		fmt.Fprintf(os.Stderr, "warning: %d weight(s) not sent to Redis\n", lost)
+	}
+}
+
+// redisPublisher sends weight updates to Redis (RESP2 over TCP, no client
+// library) from its own goroutine: each update is PUBLISHed to a channel,
+// and the latest one is SET on a key, so a dashboard gets the current weight
+// with one GET. Updates queued meanwhile go out as one pipeline. The queue
+// sheds load, so weighing never waits on Redis.
+type redisPublisher struct {
+	addr           string
+	user, password string
+	db             int
+	channel, key   string
+	ttl            time.Duration
+	scale, units   string
+	queue          *pipe[weightUpdate]
+	done           chan struct{}
+	lost           int64
+
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// newRedisPublisher parses redis://[[user]:password@]host[:port][/db].
+// {scale} in the channel and key is replaced by the scale ID.
+func newRedisPublisher(spec, channel, key string, ttl time.Duration, scale, units string) (*redisPublisher, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("want redis://[:password@]host[:port][/db], got %q", spec)
+	}
+	p := &redisPublisher{addr: u.Host, scale: scale, units: units, ttl: ttl,
+		channel: strings.ReplaceAll(channel, "{scale}", scale), key: strings.ReplaceAll(key, "{scale}", scale),
+		queue: newPipe[weightUpdate]("live→redis", 4096, true), done: make(chan struct{})}
+	if u.Port() == "" {
+		p.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		p.user = u.User.Username()
+		p.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if p.db, err = strconv.Atoi(db); err != nil || p.db < 0 {
+			return nil, fmt.Errorf("bad database number %q", db)
+		}
+	}
+	if p.channel == "" && p.key == "" {
+		return nil, errors.New("neither a channel nor a key to write")
+	}
+	go p.run()
+	return p, nil
+}
+
+// send queues an update without blocking.
+func (p *redisPublisher) send(u weightUpdate) { p.queue.send(u) }
+
+// close sends what is queued and disconnects. It returns the number of
+// updates that were not sent.
+func (p *redisPublisher) close() int64 {
+	p.queue.close()
+	<-p.done
+	return p.lost + p.queue.Stats().Dropped
+}
+
+func (p *redisPublisher) run() {
+	defer close(p.done)
+	backoff, retryAt := time.Duration(0), time.Time{}
+	var updates []weightUpdate
+	for {
+		var ok bool
+		if updates, ok = p.queue.recvBatch(updates, 500); !ok {
+			break
+		}
+		if p.conn == nil && time.Now().Before(retryAt) {
+			p.lost += int64(len(updates))
+			continue
+		}
+		err := p.write(updates)
+		if err == nil {
+			if backoff > 0 {
+				log.Printf("redis %s: connected again", p.addr)
+			}
+			backoff = 0
+			continue
+		}
+		p.lost += int64(len(updates))
+		if p.conn != nil {
+			p.conn.Close()
+			p.conn = nil
+		}
+		backoff = min(max(2*backoff, outboxMinBackoff), outboxMaxBackoff)
+		retryAt = time.Now().Add(backoff)
+		log.Printf("warning: redis %s: %v; retrying in %s", p.addr, err, backoff)
+	}
+	if p.conn != nil {
+		_ = p.do([][]string{{"QUIT"}})
+		p.conn.Close()
+	}
+}
+
+// write publishes the updates and sets the key to the last one.
+func (p *redisPublisher) write(updates []weightUpdate) error {
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	var cmds [][]string
+	var last []byte
+	for _, u := range updates {
+		last = u.json(p.scale, p.units)
+		if p.channel != "" {
+			cmds = append(cmds, []string{"PUBLISH", p.channel, string(last)})
+		}
+	}
+	if p.key != "" {
+		set := []string{"SET", p.key, string(last)}
+		if p.ttl > 0 {
+			set = append(set, "PX", strconv.FormatInt(p.ttl.Milliseconds(), 10))
+		}
+		cmds = append(cmds, set)
+	}
+	return p.do(cmds)
+}
+
+func (p *redisPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	p.conn, p.r = conn, bufio.NewReader(conn)
+	var cmds [][]string
+	switch {
+	case p.user != "" && p.password != "":
+		cmds = append(cmds, []string{"AUTH", p.user, p.password})
+	case p.password != "":
+		cmds = append(cmds, []string{"AUTH", p.password})
+	}
+	if p.db != 0 {
+		cmds = append(cmds, []string{"SELECT", strconv.Itoa(p.db)})
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	return p.do(cmds)
+}
+
+// do pipelines the commands and reads their replies; the first error reply
+// is returned.
+func (p *redisPublisher) do(cmds [][]string) error {
+	var b []byte
+	for _, args := range cmds {
+		b = append(b, '*')
+		b = strconv.AppendInt(b, int64(len(args)), 10)
+		b = append(b, "\r\n"...)
+		for _, a := range args {
+			b = append(b, '$')
+			b = strconv.AppendInt(b, int64(len(a)), 10)
+			b = append(b, "\r\n"...)
+			b = append(b, a...)
+			b = append(b, "\r\n"...)
+		}
+	}
+	_ = p.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := p.conn.Write(b); err != nil {
+		return err
+	}
+	var first error
+	for _, args := range cmds {
+		if err := readRedisReply(p.r); err != nil {
+			var re redisError
+			if !errors.As(err, &re) {
+				return err
+			}
+			if first == nil {
+				first = fmt.Errorf("%s: %w", args[0], err)
+			}
+		}
+	}
+	return first
+}
+
+// redisError is an error reply.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// readRedisReply reads and discards one reply, returning an error reply as a
+// redisError.
+func readRedisReply(r *bufio.Reader) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return nil
+	case '-':
+		return redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return err
+		}
+		_, err = io.CopyN(io.Discard, r, int64(n)+2)
+		return err
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return err
+		}
+		for range n {
+			if err := readRedisReply(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unexpected reply %q", line)
+}
@@ -0,0 +1,219 @@
+//go:build redis || full
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadRedisReply(t *testing.T) {
+	tests := []struct {
+		name     string
+		reply    string
+		wantErr  string // "" for none
+		redisErr bool
+	}{
+		{name: "status", reply: "+OK\r\n"},
+		{name: "integer", reply: ":3\r\n"},
+		{name: "bulk", reply: "$5\r\nhello\r\n"},
+		{name: "bulk with CRLF", reply: "$4\r\na\r\nb\r\n"},
+		{name: "null bulk", reply: "$-1\r\n"},
+		{name: "array", reply: "*3\r\n:1\r\n$1\r\nx\r\n*1\r\n+OK\r\n"},
+		{name: "null array", reply: "*-1\r\n"},
+		{name: "error", reply: "-NOAUTH Authentication required.\r\n", wantErr: "NOAUTH Authentication required.", redisErr: true},
+		{name: "error in array", reply: "*2\r\n+OK\r\n-ERR x\r\n", wantErr: "ERR x", redisErr: true},
+		{name: "unknown type", reply: "?\r\n", wantErr: "unexpected reply"},
+		{name: "empty line", reply: "\r\n", wantErr: "empty reply"},
+		{name: "truncated bulk", reply: "$5\r\nhel", wantErr: "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantErr == "" {
+				// a following reply checks that exactly one was consumed
+				r := bufio.NewReader(strings.NewReader(tt.reply + "+NEXT\r\n"))
+				if err := readRedisReply(r); err != nil {
+					t.Fatalf("readRedisReply: %v", err)
+				}
+				if next, _ := r.ReadString('\n'); next != "+NEXT\r\n" {
+					t.Errorf("next reply %q", next)
+				}
+				return
+			}
+			err := readRedisReply(bufio.NewReader(strings.NewReader(tt.reply)))
+			var re redisError
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) || errors.As(err, &re) != tt.redisErr {
+				t.Fatalf("error = %v (%T), want %q", err, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// readRESPCommand reads one command array as a Redis server would.
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	var n int
+	if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		var size int
+		if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+			return nil, err
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		if string(b[size:]) != "\r\n" {
+			return nil, fmt.Errorf("argument %d is not followed by CRLF", i)
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func TestRedisPublisher(t *testing.T) {
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	updates := []weightUpdate{
+		{reading: 1, time: at, weight: 10.5, filtered: 10.5, valid: true, version: 2},
+		{reading: 2, time: at.Add(time.Second), invalid: "adc out of range", version: 2},
+		{reading: 3, time: at.Add(2 * time.Second), weight: 10.25, filtered: 10.375, stable: true, valid: true, version: 2},
+	}
+	tests := []struct {
+		name         string
+		userinfo     string
+		db           string
+		channel, key string
+		ttl          time.Duration
+		setup        [][]string // commands sent on connecting
+		px           string
+	}{
+		{name: "channel and key", channel: "weights/{scale}", key: "weight:{scale}"},
+		{name: "channel only", channel: "w"},
+		{name: "key with ttl", key: "k", ttl: 1500 * time.Millisecond, px: "1500"},
+		{name: "password", userinfo: ":s3cret@", key: "k", setup: [][]string{{"AUTH", "s3cret"}}},
+		{name: "user and database", userinfo: "plant:s3cret@", db: "/2", key: "k",
+			setup: [][]string{{"AUTH", "plant", "s3cret"}, {"SELECT", "2"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Skip(err)
+			}
+			defer ln.Close()
+			done := make(chan [][]string, 1)
+			go func() {
+				var cmds [][]string
+				defer func() { done <- cmds }()
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					args, err := readRESPCommand(r)
+					if err != nil {
+						return
+					}
+					cmds = append(cmds, args)
+					reply := "+OK\r\n"
+					if args[0] == "PUBLISH" {
+						reply = ":0\r\n"
+					}
+					conn.Write([]byte(reply))
+				}
+			}()
+
+			p, err := newRedisPublisher("redis://"+tt.userinfo+ln.Addr().String()+tt.db, tt.channel, tt.key, tt.ttl, "line1", "kg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, u := range updates {
+				p.send(u)
+			}
+			if lost := p.close(); lost != 0 {
+				t.Fatalf("%d updates lost", lost)
+			}
+			cmds := <-done
+
+			if len(cmds) <= len(tt.setup) || len(tt.setup) > 0 && !reflect.DeepEqual(cmds[:len(tt.setup)], tt.setup) {
+				t.Fatalf("commands %q, want them to start with %q", cmds, tt.setup)
+			}
+			cmds = cmds[len(tt.setup):]
+			if last := cmds[len(cmds)-1]; last[0] != "QUIT" {
+				t.Errorf("last command %q, want QUIT", last)
+			}
+			var published []weightJSON
+			var set []string
+			for _, c := range cmds[:len(cmds)-1] {
+				switch c[0] {
+				case "PUBLISH":
+					var j weightJSON
+					if c[1] != strings.ReplaceAll(tt.channel, "{scale}", "line1") || json.Unmarshal([]byte(c[2]), &j) != nil {
+						t.Fatalf("bad PUBLISH %q", c)
+					}
+					published = append(published, j)
+				case "SET":
+					set = c
+				default:
+					t.Fatalf("unexpected command %q", c)
+				}
+			}
+			if tt.channel != "" {
+				if len(published) != len(updates) {
+					t.Fatalf("%d updates published, want %d", len(published), len(updates))
+				}
+				for k, j := range published {
+					if j.Reading != updates[k].reading || j.Weight != updates[k].weight || j.Scale != "line1" || j.Units != "kg" {
+						t.Errorf("update %d published as %+v", k, j)
+					}
+				}
+			}
+			if tt.key == "" {
+				if set != nil {
+					t.Errorf("SET %q without a key", set)
+				}
+				return
+			}
+			want := []string{"SET", strings.ReplaceAll(tt.key, "{scale}", "line1"), string(updates[len(updates)-1].json("line1", "kg"))}
+			if tt.px != "" {
+				want = append(want, "PX", tt.px)
+			}
+			if !reflect.DeepEqual(set, want) {
+				t.Errorf("last SET %q, want %q", set, want)
+			}
+		})
+	}
+}
+
+func TestRedisPublisherSpec(t *testing.T) {
+	tests := []struct {
+		spec, want string
+	}{
+		{"http://host", "want redis://"},
+		{"redis:///0", "want redis://"},
+		{"redis://host/x", "bad database number"},
+		{"redis://host/-1", "bad database number"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			if _, err := newRedisPublisher(tt.spec, "c", "k", 0, "line1", "kg"); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+	if _, err := newRedisPublisher("redis://host", "", "", 0, "line1", "kg"); err == nil {
+		t.Error("no channel and no key was accepted")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// ReferenceWeight is a registered test weight with its calibration
+// certificate, for traceability of the calibrations performed with it.
+type ReferenceWeight struct {
+	ID          string  `json:"id"`
+	Nominal     float64 `json:"nominal"`
+	Units       string  `json:"units,omitempty"`
+	Class       string  `json:"class,omitempty"`
+	Certificate string  `json:"certificate"`
+	CertExpiry  string  `json:"cert_expiry,omitempty"`
+	Lab         string  `json:"lab,omitempty"`
+}
+
+// certExpired reports whether the weight's certificate has expired at now.
+// Weights without an expiry never expire.
+func (w ReferenceWeight) certExpired(now time.Time) (bool, error) {
+	if w.CertExpiry == "" {
+		return false, nil
+	}
+	t, err := parseCalDate(w.CertExpiry)
+	if err != nil {
+		return false, fmt.Errorf("reference weight %s: invalid cert_expiry %q", w.ID, w.CertExpiry)
+	}
+	return now.After(t), nil
+}
+
+// CheckReferenceWeight resolves the reference weight a calibration names
+// against the register. Once any weight is registered every calibration must
+// name one of them. It returns the weight (nil when the register is empty)
+// and warnings for an expired certificate or a nominal mass that differs from
+// the calibration weight.
+func CheckReferenceWeight(weights []ReferenceWeight, id string, calWeight float64, now time.Time) (*ReferenceWeight, []string, error) {
+	if len(weights) == 0 {
+		return nil, nil, nil
+	}
+	var ids []string
+	for i := range weights {
+		if weights[i].ID != id {
+			ids = append(ids, weights[i].ID)
+			continue
+		}
+		w := weights[i]
+		var warnings []string
+		expired, err := w.certExpired(now)
+		if err != nil {
+			return nil, nil, err
+		}
+		if expired {
+			warnings = append(warnings, fmt.Sprintf("certificate %s of reference weight %s expired on %s", w.Certificate, w.ID, w.CertExpiry))
+		}
+		if calWeight != 0 && math.Abs(w.Nominal-calWeight) > 1e-6*math.Abs(w.Nominal) {
+			warnings = append(warnings, fmt.Sprintf("reference weight %s is nominally %g%s but the calibration weight is %g", w.ID, w.Nominal, unitSuffix(w.Units), calWeight))
+		}
+		return &w, warnings, nil
+	}
+	if id == "" {
+		return nil, nil, fmt.Errorf("the calibration must name its reference weight with -ref-weight (registered: %s)", strings.Join(ids, ", "))
+	}
+	return nil, nil, fmt.Errorf("reference weight %q is not registered (registered: %s)", id, strings.Join(ids, ", "))
+}
+
+// runRefWeight implements `calibrate refweight add|list`: maintain the
+// reference-weight register in the store.
+func runRefWeight(args []string) int {
+	if len(args) == 0 || (args[0] != "add" && args[0] != "list") {
+		fmt.Fprintln(os.Stderr, "usage: calibrate refweight add|list [-store SPEC] ...")
+		return 2
+	}
+	fs := flag.NewFlagSet("refweight "+args[0], flag.ExitOnError)
+	storeFlag, storeKey := storeFlags(fs)
+	id := fs.String("id", "", "add: reference weight ID (required)")
+	nominal := fs.Float64("nominal", 0, "add: nominal mass (required)")
+	units := fs.String("units", "", "add: unit of the nominal mass")
+	class := fs.String("class", "", "add: OIML accuracy class of the weight, e.g. F1 or M1")
+	cert := fs.String("cert", "", "add: calibration certificate number (required)")
+	expiry := fs.String("cert-expiry", "", "add: certificate expiry date (YYYY-MM-DD)")
+	lab := fs.String("lab", "", "add: laboratory that issued the certificate")
+	asJSON := fs.Bool("json", false, "list: print the register as JSON")
+	_ = fs.Parse(args[1:])
+
+	st := openStoreOrExit(*storeFlag, *storeKey)
+	if st == nil {
+		return 1
+	}
+	defer st.Close()
+
+	if args[0] == "add" {
+		if *id == "" || *nominal <= 0 || *cert == "" {
+			fmt.Fprintln(os.Stderr, "error: -id, -nominal and -cert are required")
+			return 2
+		}
+		if *expiry != "" {
+			if _, err := parseCalDate(*expiry); err != nil {
+				fmt.Fprintf(os.Stderr, "error: invalid -cert-expiry %q\n", *expiry)
+				return 2
+			}
+		}
+		w := ReferenceWeight{ID: *id, Nominal: *nominal, Units: *units, Class: *class, Certificate: *cert, CertExpiry: *expiry, Lab: *lab}
+		if err := st.SaveRefWeight(&w); err != nil {
+			fmt.Fprintf(os.Stderr, "error saving reference weight: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Registered reference weight %s (%g%s, certificate %s)\n", w.ID, w.Nominal, unitSuffix(w.Units), w.Certificate)
+		return 0
+	}
+
+	weights, err := st.RefWeights()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading reference weights: %v\n", err)
+		return 1
+	}
+	if *asJSON {
+		if weights == nil {
+			weights = []ReferenceWeight{}
+		}
+		out, _ := json.MarshalIndent(weights, "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+	now := time.Now().UTC()
+	fmt.Printf("Reference weights (%d):\n", len(weights))
+	for _, w := range weights {
+		status := "ok"
+		if expired, err := w.certExpired(now); err != nil {
+			status = err.Error()
+		} else if expired {
+			status = "CERTIFICATE EXPIRED"
+		}
+		fmt.Printf("  %-12s %10g%-3s class %-3s certificate %-16s expires %-10s  %s\n",
+			w.ID, w.Nominal, w.Units, w.Class, w.Certificate, w.CertExpiry, status)
+	}
+	return 0
+}
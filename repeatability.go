@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+)
+
+// RepeatabilityInput is the JSON schema for -repeat-file: repeated placements
+// of the same test weight, one reading per placement.
+type RepeatabilityInput struct {
+	TestWeight float64      `json:"test_weight"`
+	Readings   [][4]float64 `json:"readings"`
+}
+
+// RepeatabilityReport is the JSON schema for the repeatability test section.
+// StdDev is the sample standard deviation of the indications; Range is their
+// max-min spread, which OIML R76 requires to stay within the absolute MPE.
+type RepeatabilityReport struct {
+	TestWeight  float64   `json:"test_weight"`
+	Indications []float64 `json:"indications"`
+	Mean        float64   `json:"mean"`
+	StdDev      float64   `json:"std_dev"`
+	Range       float64   `json:"range"`
+	MeanError   float64   `json:"mean_error"`
+	MPE         float64   `json:"mpe"`
+	Pass        bool      `json:"pass"`
+}
+
+// LoadRepeatabilityInput reads and validates a -repeat-file.
+func LoadRepeatabilityInput(path string) (RepeatabilityInput, error) {
+	var in RepeatabilityInput
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return in, err
+	}
+	if err := json.Unmarshal(b, &in); err != nil {
+		return in, err
+	}
+	if in.TestWeight <= 0 {
+		return in, fmt.Errorf("test_weight must be > 0")
+	}
+	if len(in.Readings) < 2 {
+		return in, fmt.Errorf("need at least 2 readings, got %d", len(in.Readings))
+	}
+	return in, nil
+}
+
+// RepeatabilityTest computes the spread of the repeated indications and checks
+// the range against the MPE of the test weight for the class and e.
+func RepeatabilityTest(in RepeatabilityInput, zero, factors [4]float64, class string, e float64) (RepeatabilityReport, error) {
+	mpe, err := MPE(class, in.TestWeight, e)
+	if err != nil {
+		return RepeatabilityReport{}, err
+	}
+	rep := RepeatabilityReport{TestWeight: in.TestWeight, MPE: mpe}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, r := range in.Readings {
+		ind := ComputeWeight(r, zero, factors)
+		rep.Indications = append(rep.Indications, ind)
+		rep.Mean += ind
+		lo = math.Min(lo, ind)
+		hi = math.Max(hi, ind)
+	}
+	n := float64(len(in.Readings))
+	rep.Mean /= n
+	ss := 0.0
+	for _, ind := range rep.Indications {
+		ss += (ind - rep.Mean) * (ind - rep.Mean)
+	}
+	rep.StdDev = math.Sqrt(ss / (n - 1))
+	rep.Range = hi - lo
+	rep.MeanError = rep.Mean - in.TestWeight
+	rep.Pass = rep.Range <= mpe
+	return rep, nil
+}
+
+// MinWeightReport is the JSON schema for the USP <41> style minimum weight.
+// StdDevUsed is the repeatability standard deviation after applying the floor
+// of 0.41 times the readability; MinimumWeight = k * StdDevUsed / Tolerance.
+type MinWeightReport struct {
+	StdDev        float64 `json:"std_dev"`
+	Readability   float64 `json:"readability"`
+	StdDevUsed    float64 `json:"std_dev_used"`
+	Tolerance     float64 `json:"tolerance"`
+	CoverageK     float64 `json:"coverage_k"`
+	MinimumWeight float64 `json:"minimum_weight"`
+}
+
+// MinimumWeight determines the smallest net sample weight whose relative
+// repeatability (k*s/m) stays within tol, following USP <41>: k = 2, tol =
+// 0.10 %, and s is not taken below 0.41 times the scale readability.
+func MinimumWeight(stdDev, readability, tol float64) (MinWeightReport, error) {
+	if tol <= 0 {
+		return MinWeightReport{}, fmt.Errorf("minimum-weight tolerance must be > 0, got %g", tol)
+	}
+	rep := MinWeightReport{StdDev: stdDev, Readability: readability, Tolerance: tol, CoverageK: 2}
+	rep.StdDevUsed = math.Max(stdDev, 0.41*readability)
+	rep.MinimumWeight = rep.CoverageK * rep.StdDevUsed / tol
+	return rep, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+)
+
+// CellReplacement names the cell refitted by a partial calibration and the
+// factors it kept for the other three (its own entry is ignored), taken from
+// the calibration the replacement was made against.
+type CellReplacement struct {
+	Cell        int        `json:"cell"`
+	Factors     [4]float64 `json:"kept_factors"`
+	FromVersion int        `json:"from_version,omitempty"`
+}
+
+// partialFactors computes the factors of a partial calibration: the kept
+// factors for the other cells and, for the replaced cell k, the least-squares
+// fit of W = sum f_j d_j over its corner row and the center row, solved for
+// f_k alone.
+func partialFactors(cal CalibrationData) ([4]float64, error) {
+	k := cal.Replacement.Cell
+	factors := cal.Replacement.Factors
+	num, den := 0.0, 0.0
+	for _, row := range [][4]float64{calRows(cal)[k], cal.OnCenter} {
+		r := cal.CalibrationWeight
+		for ch := range row {
+			if ch != k {
+				r -= factors[ch] * (row[ch] - cal.Zero[ch])
+			}
+		}
+		d := row[k] - cal.Zero[k]
+		num += r * d
+		den += d * d
+	}
+	if den == 0 {
+		return factors, fmt.Errorf("partial calibration: the loads do not move channel %d", k)
+	}
+	factors[k] = num / den
+	return factors, nil
+}
+
+// partialStage is the stage of a partial calibration: the largest row error,
+// as for a full fit, but only the replaced cell's corner and the center were
+// measured; the other rows are carried over from the earlier calibration.
+func partialStage(cal CalibrationData, factors [4]float64) StageInfo {
+	s := fullStage(cal, factors)
+	s.Stage = stagePartial
+	s.Basis = fmt.Sprintf("cell %d refitted from its corner and the center, the other factors kept", cal.Replacement.Cell)
+	if v := cal.Replacement.FromVersion; v > 0 {
+		s.Basis += fmt.Sprintf(" from v%d", v)
+	}
+	s.Basis += "; the other corners were not re-measured"
+	return s
+}
+
+// replacedCalibration builds the calibration data of a partial refit of cell
+// k against prev: the new zero, corner and center rows as measured, and the
+// other corner rows carried over from prev, rescaled to the new weight and
+// with channel k scaled by the change of its factor so they stay consistent
+// with the new cell.
+func replacedCalibration(prev CalibrationData, oldFactors [4]float64, k int, weight float64, zero, corner, center [4]float64) (CalibrationData, [4]float64, error) {
+	cal := prev
+	cal.Stage, cal.CalibrationWeight, cal.Zero, cal.OnCenter = stagePartial, weight, zero, center
+	cal.Replacement = &CellReplacement{Cell: k, Factors: oldFactors}
+	rows := []*[4]float64{&cal.OnCell0, &cal.OnCell1, &cal.OnCell2, &cal.OnCell3}
+	*rows[k] = corner
+	factors, err := partialFactors(cal)
+	if err != nil {
+		return cal, factors, err
+	}
+	if prev.CalibrationWeight == 0 || factors[k] == 0 {
+		return cal, factors, errors.New("partial calibration: cannot carry the other corners over")
+	}
+	scale := weight / prev.CalibrationWeight
+	old := calRows(prev)
+	for i, row := range rows {
+		if i == k {
+			continue
+		}
+		for ch := range row {
+			d := (old[i][ch] - prev.Zero[ch]) * scale
+			if ch == k {
+				d *= oldFactors[k] / factors[k]
+			}
+			row[ch] = zero[ch] + d
+		}
+	}
+	return cal, factors, nil
+}
+
+// ReplaceCellReport is the result of `calibrate replace-cell`.
+type ReplaceCellReport struct {
+	Scale     string     `json:"scale"`
+	From      int        `json:"from_version"`
+	Version   int        `json:"version"`
+	Cell      int        `json:"cell"`
+	OldFactor float64    `json:"old_factor"`
+	NewFactor float64    `json:"new_factor"`
+	Change    float64    `json:"change_pct"`
+	Factors   [4]float64 `json:"factors"`
+	// Residuals are the weight errors of the two measured rows, corner then
+	// center: with one unknown fitted to both, their spread shows how well
+	// the kept factors still fit.
+	Residuals [2]float64 `json:"residuals"`
+	Stage     StageInfo  `json:"stage"`
+}
+
+// runReplaceCell implements `calibrate replace-cell`: after one load cell of
+// a scale was replaced, refit that cell's factor from a new zero, the weight
+// over its corner and the weight at the center, keeping the factors of the
+// other three from the active calibration, and record the result as the
+// scale's next version.
+func runReplaceCell(args []string) int {
+	fs := flag.NewFlagSet("replace-cell", flag.ExitOnError)
+	storeFlag, storeKey := storeFlags(fs)
+	scale := fs.String("scale", "", "scale whose cell was replaced (required)")
+	cell := fs.Int("cell", -1, "channel of the replaced cell, 0-3 (required)")
+	weight := fs.Float64("weight", 0, "the known weight (default the calibration weight of the active calibration)")
+	zeroADC := fs.String("zero", "", "reading of the empty platform, as comma-separated ADC counts")
+	zeroSrc := fs.String("zero-source", "", "readings of the empty platform: capture file or cmd:<command>; several readings are averaged")
+	cornerADC := fs.String("corner", "", "reading with -weight over the replaced cell, as comma-separated ADC counts")
+	cornerSrc := fs.String("corner-source", "", "readings with -weight over the replaced cell: capture file or cmd:<command>")
+	centerADC := fs.String("center", "", "reading with -weight at the center, as comma-separated ADC counts")
+	centerSrc := fs.String("center-source", "", "readings with -weight at the center: capture file or cmd:<command>")
+	operator := fs.String("operator", "", "operator name for the audit log (default $CAL_OPERATOR, then the login name)")
+	auditLog := fs.String("audit-log", "", "append the calibration to this audit log (default $CAL_AUDIT_LOG)")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	_ = fs.Parse(args)
+
+	if *scale == "" {
+		fmt.Fprintln(os.Stderr, "error: -scale is required")
+		return 2
+	}
+	if *cell < 0 || *cell > 3 {
+		fmt.Fprintln(os.Stderr, "error: -cell must be 0-3")
+		return 2
+	}
+	if *weight < 0 || math.IsInf(*weight, 0) || math.IsNaN(*weight) {
+		fmt.Fprintln(os.Stderr, "error: -weight must be > 0")
+		return 2
+	}
+	zero, zeroFrom, err := capturedReading("zero", *zeroADC, *zeroSrc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+	corner, cornerFrom, err := capturedReading("corner", *cornerADC, *cornerSrc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+	center, centerFrom, err := capturedReading("center", *centerADC, *centerSrc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+
+	st := openStoreOrExit(*storeFlag, *storeKey)
+	if st == nil {
+		return 1
+	}
+	defer st.Close()
+	active, err := ActiveSession(st, *scale)
+	if err == nil && active == nil {
+		err = fmt.Errorf("scale %q has no active calibration", *scale)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	if active.Calibration.Stage == stageCoarse {
+		fmt.Fprintf(os.Stderr, "error: v%d is a coarse calibration and has no corner rows to keep; run the full calibration\n", active.Version)
+		return 3
+	}
+	if *weight == 0 {
+		*weight = active.Calibration.CalibrationWeight
+	}
+
+	k := *cell
+	cal, factors, err := replacedCalibration(active.Calibration, active.Result.Factors, k, *weight, zero, corner, center)
+	if err == nil {
+		cal.Replacement.FromVersion = active.Version
+		cal.CalibratedAt = nowUTC().Format("2006-01-02")
+	}
+	var res CalibrationResult
+	if err == nil {
+		res, err = FitCalibration(cal, 0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	rep := ReplaceCellReport{Scale: *scale, From: active.Version, Cell: k, OldFactor: active.Result.Factors[k],
+		NewFactor: factors[k], Factors: res.Factors, Stage: *res.Stage}
+	if rep.OldFactor != 0 {
+		rep.Change = 100 * (rep.NewFactor/rep.OldFactor - 1)
+	}
+	for i, row := range [][4]float64{corner, center} {
+		rep.Residuals[i] = ComputeWeight(row, zero, res.Factors) - *weight
+	}
+
+	source := fmt.Sprintf("replace-cell %d of v%d: zero %s, corner %s, center %s", k, active.Version, zeroFrom, cornerFrom, centerFrom)
+	sess := &Session{Scale: *scale, Time: nowUTC(), Source: source, Calibration: cal, Result: res}
+	_, version, err := RecordSession(st, sess)
+	if err == nil {
+		after, _ := ActiveSession(st, *scale)
+		err = AppendAudit(auditPath(*auditLog), "calibrate", operatorName(*operator), *scale,
+			fmt.Sprintf("cell %d replaced, partial calibration as v%d", k, version), auditSnapshot(active), auditSnapshot(after))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error writing store: %v\n", err)
+		return 1
+	}
+	rep.Version = version
+
+	if *asJSON {
+		out, _ := json.MarshalIndent(rep, "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+	units := unitSuffix(active.Calibration.Units)
+	fmt.Printf("Cell %d of scale %s replaced (calibration v%d, W = %g%s):\n", k, rep.Scale, rep.From, *weight, units)
+	fmt.Printf("  f%d: %s -> %s (%+.2f%%); the other factors kept\n", k, formatFixed(rep.OldFactor, 10),
+		formatFixed(rep.NewFactor, 10), rep.Change)
+	fmt.Printf("  residuals: corner %+.4f%s, center %+.4f%s\n", rep.Residuals[0], units, rep.Residuals[1], units)
+	fmt.Printf("  %s\n", rep.Stage)
+	fmt.Printf("Recorded scale %s v%d (active). Reduced confidence: the other three factors and corners were not\n", rep.Scale, version)
+	fmt.Printf("re-measured; a drifted or damaged neighbour goes unnoticed until the next full calibration.\n")
+	return 0
+}
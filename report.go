@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// reportHeader starts the report of a calibrate run with the fitted
+// factors. A -stream report is spilled to output.txt (or nowhere with
+// -json-out) as it grows.
+func (c *calibrateRun) reportHeader() {
+	if c.stream != nil {
+		out := "output.txt"
+		if c.f.jsonOut != "" {
+			out = ""
+		}
+		c.sb.streamTo(out)
+	}
+	c.sb.WriteString(fmt.Sprintf("Calibration weight W = %g\n", c.cal.CalibrationWeight))
+	c.sb.WriteString(fmt.Sprintf("Zero reference (adc): %s\n", formatVector(c.cal.Zero)))
+	c.sb.WriteString("Computed factors f0..f3 (weight per ADC count):\n")
+	for i, v := range c.factors {
+		c.sb.WriteString(fmt.Sprintf("  f%d = %s\n", i, formatFixed(v, 10)))
+	}
+}
+
+// report writes the sections following the weighing: its summaries, the
+// tests of the scale, the session, the analyses of the fit, the grade and
+// the warnings.
+func (c *calibrateRun) report() {
+	c.reportSummaries()
+	c.reportTests()
+	if c.res.Session != nil {
+		emit(&c.sb, "\nSession:\n")
+		for _, l := range c.res.Session.Lines() {
+			emit(&c.sb, "  %s: %s\n", l[0], l[1])
+		}
+	}
+	c.reportFit()
+	c.reportGrade()
+	if len(c.warnings) > 0 {
+		emit(&c.sb, "\nWarnings (%d):\n", len(c.warnings))
+		for _, w := range c.warnings {
+			emit(&c.sb, "  %s\n", w)
+		}
+	}
+}
+
+// reportSummaries writes the tilt, checkweighing, totalizer and noise
+// summaries, saving the totalizer.
+func (c *calibrateRun) reportSummaries() {
+	f, sb := c.f, &c.sb
+	if ts := c.res.Tilt; ts != nil {
+		emit(sb, "\nTilt compensation: %d reading(s) corrected, max tilt %.2f°", ts.Readings, ts.Max)
+		if len(ts.Beyond) > 0 {
+			emit(sb, "; %d beyond %g°: %v", len(ts.Beyond), ts.Limit, ts.Beyond)
+		}
+		emit(sb, "\n")
+	}
+
+	// Checkweighing summary over the classified readings or items
+	if cw := c.res.Checkweigh; cw != nil && c.applied {
+		p := cw.Product
+		name := ""
+		if p.Name != "" {
+			name = fmt.Sprintf(" %q", p.Name)
+		}
+		emit(sb, "\nCheckweighing (product %s%s, target %g%s, accept %g..%g), %d %s:\n",
+			p.ID, name, p.Target, unitSuffix(p.Units), cw.Lower, cw.Upper, cw.Under+cw.Accept+cw.Over, cw.Of)
+		emit(sb, "  under %d, accept %d, over %d", cw.Under, cw.Accept, cw.Over)
+		if cw.Under+cw.Accept+cw.Over > 0 {
+			emit(sb, "; mean %.4f", cw.Mean)
+		}
+		if cw.Accept > 0 {
+			emit(sb, ", giveaway %+.4f per accepted", cw.Giveaway)
+		}
+		emit(sb, "\n")
+	} else {
+		c.res.Checkweigh = nil
+	}
+
+	if ts, tot := c.w.totSummary, c.w.tot; ts != nil {
+		if err := SaveTotalizer(f.totalFile, tot); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing totalizer file: %v\n", err)
+			os.Exit(1)
+		}
+		ts.Total = tot.Total
+		ts.Count = tot.Count
+		c.res.Totalizer = ts
+		emit(sb, "\nTotalizer (%s): accepted %d this run (%.2f), total = %.2f over %d weighments\n",
+			ts.Mode, len(ts.Accepted), ts.RunTotal, tot.Total, tot.Count)
+	}
+
+	// Noise floor diagnostics from a zero-load capture
+	if rep := c.res.Noise; rep != nil {
+		emit(sb, "\nNoise floor (zero-load capture, %d samples):\n", rep.Samples)
+		emit(sb, "  %-4s %10s %8s %8s %8s %7s %8s %12s %12s\n", "ch", "mean", "sigma", "rms", "p-p", "ENOB", "SNR dB", "sigma (wt)", "rms (wt)")
+		for _, ch := range rep.Channels {
+			emit(sb, "  %-4d %10.2f %8.3f %8.3f %8.1f %7.2f %8.1f %12.4g %12.4g\n",
+				ch.Channel, ch.Mean, ch.Sigma, ch.RMS, ch.PeakToPeak, ch.ENOB, ch.SNRdB, ch.SigmaWeight, ch.RMSWeight)
+		}
+		rep.WeightSigma = WeightResolution(*rep)
+		rep.Division = f.displayDiv
+		if rep.Division == 0 {
+			rep.Division = f.verifInterval
+		}
+		rep.ResolutionOK = rep.WeightSigma <= rep.Division
+		emit(sb, "  Effective weight resolution: ±%.4g%s at 1σ (±%.4g at 2σ)\n", rep.WeightSigma, unitSuffix(c.cal.Units), 2*rep.WeightSigma)
+		if !rep.ResolutionOK {
+			emit(sb, "  WARNING: effective resolution ±%.4g is worse than the display division %g\n", rep.WeightSigma, rep.Division)
+			c.warnings = append(c.warnings, newWarning("resolution-exceeds-division", "", "effective resolution ±%.4g is worse than the display division %g", rep.WeightSigma, rep.Division))
+		}
+	}
+}
+
+// reportTests runs the eccentricity, linearity and repeatability tests
+// given, with the minimum weight from the repeatability.
+func (c *calibrateRun) reportTests() {
+	f, sb := c.f, &c.sb
+	if c.eccInput != nil {
+		rep, err := EccentricityTest(*c.eccInput, c.weighZero, c.weighFactors, f.accClass, f.verifInterval)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "eccentricity test error: %v\n", err)
+			os.Exit(1)
+		}
+		c.res.Eccentricity = &rep
+		emit(sb, "\nEccentricity test (class %s, e = %g, test weight %g, MPE = ±%g):\n", rep.Class, rep.E, rep.TestWeight, rep.MPE)
+		for _, p := range rep.Positions {
+			verdict := "PASS"
+			if !p.Pass {
+				verdict = "FAIL"
+			}
+			emit(sb, "  %-10s indication %.4f  error %+.4f  eccentricity %+.4f  %s\n", p.Position, p.Indication, p.Error, p.Eccentricity, verdict)
+		}
+		verdict := "PASS"
+		if !rep.Pass {
+			verdict = "FAIL"
+		}
+		emit(sb, "  Result: %s (max |error| %.4f)\n", verdict, rep.MaxError)
+	}
+
+	if c.linInput != nil {
+		rep, err := LinearityTest(*c.linInput, c.weighZero, c.weighFactors, f.linTol, f.accClass, f.verifInterval)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "linearity test error: %v\n", err)
+			os.Exit(1)
+		}
+		c.res.Linearity = &rep
+		emit(sb, "\nLinearity test (fit: indication = %.6g + %.6g * load):\n", rep.Offset, rep.Slope)
+		emit(sb, "  %12s %12s %10s %10s %10s\n", "load", "indication", "error", "deviation", "tolerance")
+		for _, p := range rep.Points {
+			verdict := "PASS"
+			if !p.Pass {
+				verdict = "FAIL"
+			}
+			emit(sb, "  %12.4f %12.4f %+10.4f %+10.4f %10.4f  %s\n", p.Load, p.Indication, p.Error, p.Deviation, p.Tolerance, verdict)
+		}
+		verdict := "PASS"
+		if !rep.Pass {
+			verdict = "FAIL"
+		}
+		emit(sb, "  Result: %s (max |error| %.4f, max deviation from line %.4f = %.3f%% of max load)\n",
+			verdict, rep.MaxError, rep.MaxDeviation, rep.MaxDeviationPct)
+	}
+
+	if c.repInput != nil {
+		rep, err := RepeatabilityTest(*c.repInput, c.weighZero, c.weighFactors, f.accClass, f.verifInterval)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "repeatability test error: %v\n", err)
+			os.Exit(1)
+		}
+		c.res.Repeatability = &rep
+		verdict := "PASS"
+		if !rep.Pass {
+			verdict = "FAIL"
+		}
+		emit(sb, "\nRepeatability test (%d placements of %g):\n", len(rep.Indications), rep.TestWeight)
+		emit(sb, "  mean %.4f  std dev %.4f  range %.4f  mean error %+.4f\n", rep.Mean, rep.StdDev, rep.Range, rep.MeanError)
+		emit(sb, "  Result: %s (range vs MPE ±%g)\n", verdict, rep.MPE)
+
+		// minimum weight from the repeatability at this (ideally low) load;
+		// readability is the display division, or e when no -d is set
+		readability := f.displayDiv
+		if readability == 0 {
+			readability = f.verifInterval
+		}
+		mw, err := MinimumWeight(rep.StdDev, readability, f.uspTol)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "minimum weight error: %v\n", err)
+			os.Exit(1)
+		}
+		c.res.MinimumWeight = &mw
+		emit(sb, "  Minimum weight (USP <41>, %g x s / %g%%): %.4f (s = %.4f", mw.CoverageK, mw.Tolerance*100, mw.MinimumWeight, mw.StdDevUsed)
+		if mw.StdDevUsed > mw.StdDev {
+			emit(sb, ", floored at 0.41 x readability %g", readability)
+		}
+		emit(sb, ")\n")
+	}
+}
+
+// reportFit writes the analyses of the fitted factors: row influence,
+// corner balance, corner trim and the cell sensitivities.
+func (c *calibrateRun) reportFit() {
+	f, sb, cal, factors := c.f, &c.sb, c.cal, c.factors
+	if !c.fixed {
+		rep := RowInfluenceAnalysis(cal, factors, c.ridge)
+		c.res.Influence = &rep
+		emit(sb, "\nRow influence (change of f0..f3 when the row is left out of the fit):\n")
+		for _, r := range rep.Rows {
+			if r.Singular {
+				emit(sb, "  %-9s (the other rows are singular)\n", r.Row)
+				continue
+			}
+			emit(sb, "  %-9s %+9.3f%% %+9.3f%% %+9.3f%% %+9.3f%%   max %.3g%%\n", r.Row,
+				100*r.Change[0]/factors[0], 100*r.Change[1]/factors[1], 100*r.Change[2]/factors[2], 100*r.Change[3]/factors[3], 100*r.MaxChange)
+		}
+		for _, r := range rep.Influential() {
+			c.warnings = append(c.warnings, newWarning("influential-row", r.Row, "the calibration hinges on this placement: %s", r.Describe()))
+		}
+	}
+
+	// Corner balance: are the factors distinguishable given their covariance?
+	if c.w.covErr == nil {
+		t := TestCornerBalance(cal, factors, c.w.factorCov, c.df, f.balanceAlpha)
+		c.res.Balance = &t
+		emit(sb, "\nCorner balance test: %s\n", t.Describe())
+		if t.Imbalanced {
+			c.warnings = append(c.warnings, newWarning("corner-imbalance", "", "%s; check the mechanics (level, stops, mounting) and corner loading", t.Describe()))
+		}
+	}
+
+	// Corner trim recommendations for summing the cells in a junction box
+	if f.trimReport {
+		if f.trimOhms <= 0 {
+			fmt.Fprintln(os.Stderr, "error: -trim-ohms must be > 0")
+			os.Exit(2)
+		}
+		rep, err := CornerTrimAnalysis(factors, cal.CellPositions, f.trimOhms)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "corner trim error: %v\n", err)
+			os.Exit(1)
+		}
+		c.res.Trim = &rep
+		emit(sb, "\nCorner trim (to cell %d, the least sensitive; bridge %g ohm):\n", rep.Reference, rep.BridgeOhms)
+		emit(sb, "  %-4s %-18s %11s %13s %12s %12s\n", "cell", "position", "sensitivity", "corner error", "trim", "series R")
+		for _, corner := range rep.Corners {
+			where := "-"
+			if corner.Position != nil {
+				where = fmt.Sprintf("(%g, %g)", corner.Position[0], corner.Position[1])
+			}
+			emit(sb, "  %-4d %-18s %11.4f %+12.2f%% %+11.2f%% %8.1f ohm\n", corner.Cell, where, corner.Sensitivity, corner.CornerError, corner.TrimPct, corner.SeriesOhms)
+		}
+		emit(sb, "  Untrimmed, a load over a corner reads up to %.2f%% off; apply either the digital trims or the resistors, then recalibrate.\n", rep.MaxCornerError)
+	}
+
+	// Cell sensitivities in mV/V from the electrical parameters
+	if cal.Electrical != nil {
+		rep, err := PhysicalSensitivity(factors, *cal.Electrical)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: electrical: %v\n", err)
+			os.Exit(1)
+		}
+		c.res.Physical = &rep
+		emit(sb, "\nCell sensitivity (LSB %.4g uV; family median %.4f mV/V, tolerance %.3g%%):\n", rep.LSBMicrovolts, rep.FamilyMedian, 100*rep.Tolerance)
+		emit(sb, "  %-4s %12s %12s %10s %10s %10s %10s\n", "cell", "counts/unit", "uV/unit", "mV/V", "vs family", "datasheet", "vs sheet")
+		for _, cell := range rep.Cells {
+			sheet, dev := "-", "-"
+			if cell.Datasheet != nil {
+				sheet, dev = fmt.Sprintf("%.4f", *cell.Datasheet), fmt.Sprintf("%+.2f%%", 100**cell.DatasheetDeviation)
+			}
+			emit(sb, "  %-4d %12.4g %12.4g %10.4f %+9.2f%% %10s %10s\n", cell.Cell, cell.CountsPerUnit, cell.MicrovoltsPerUnit, cell.MVPerV, 100*cell.FamilyDeviation, sheet, dev)
+			if cell.OutOfFamily {
+				c.warnings = append(c.warnings, newWarning("cell-out-of-family", fmt.Sprintf("cell %d", cell.Cell),
+					"%.4f mV/V is %+.1f%% from the median of the cells (%.4f mV/V); check the cell, its cable and the junction box", cell.MVPerV, 100*cell.FamilyDeviation, rep.FamilyMedian))
+			}
+			if cell.OffDatasheet {
+				c.warnings = append(c.warnings, newWarning("cell-off-datasheet", fmt.Sprintf("cell %d", cell.Cell),
+					"%.4f mV/V is %+.1f%% from the rated output %.4f mV/V; check the electrical parameters, excitation losses and the cell", cell.MVPerV, 100**cell.DatasheetDeviation, *cell.Datasheet))
+			}
+		}
+	}
+}
+
+// reportGrade grades a full calibration; a coarse or partial one reports
+// its stage instead.
+func (c *calibrateRun) reportGrade() {
+	var stage StageInfo
+	switch {
+	case c.coarse:
+		stage = coarseStage(c.factors, nil, defaultCornerTol)
+		if c.active != nil && c.active.Result.Stage != nil {
+			stage = *c.active.Result.Stage
+		}
+		emit(&c.sb, "\nStage: %s\n  provisional: no grade until the full calibration\n", stage)
+	case c.fixed:
+		stage = partialStage(c.cal, c.factors)
+		emit(&c.sb, "\nStage: %s\n  no grade: the other corners were not re-measured\n", stage)
+	default:
+		g := GradeCalibration(c.cal, c.factors, c.res.RSS, c.res.Noise)
+		c.res.Grade, stage = &g, fullStage(c.cal, c.factors)
+		emit(&c.sb, "\nGrade: %s (%.1f/100)\n", g.Letter, g.Score)
+		for _, p := range g.Penalties {
+			emit(&c.sb, "  %-15s %5.1f  %s\n", p.Aspect, -p.Points, p.Reason)
+		}
+		emit(&c.sb, "Stage: %s\n", stage)
+	}
+	c.res.Stage = &stage
+}
+
+// result completes the result of the run with its warnings and, when
+// readings were weighed, their results.
+func (c *calibrateRun) result() CalibrationResult {
+	res := c.res
+	res.Warnings = c.warnings
+	if c.applied {
+		res.ADCRange = c.w.rangeSummary
+		res.CellHealth = c.w.cellHealth
+		res.Readings = c.w.results
+	}
+	// A NaN/Inf that got this far must not reach the store or output files
+	if path, v, bad := nonFiniteField(res); bad {
+		fmt.Fprintf(os.Stderr, "error: result field %s is %s; no results written\n", path, v)
+		os.Exit(1)
+	}
+	return res
+}
+
+// recordSession persists the session (and the applied batch) when a store
+// is configured.
+func (c *calibrateRun) recordSession(res CalibrationResult) {
+	f := c.f
+	spec := storeSpec(*f.storeFlag)
+	if spec == "" {
+		return
+	}
+	_, span := c.tel.start(c.ctx, "record")
+	st, err := OpenStore(spec, storeKeySpec(*f.storeKey))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error opening store: %v\n", err)
+		os.Exit(1)
+	}
+	stored := res
+	stored.Readings = nil
+	sess := &Session{Scale: f.scaleID, Time: nowUTC(), Source: f.calPath, Calibration: c.cal, Result: stored, Signature: c.calSig}
+	if c.active != nil {
+		sess.Source = c.active.Source
+	}
+	before, err := ActiveSession(st, f.scaleID)
+	var sessionID int64
+	var version int
+	if err == nil {
+		sessionID, version, err = RecordSession(st, sess)
+	}
+	if err == nil && (before == nil || before.Version != version) {
+		// a new version, or an existing one re-activated by recalibrating with its input
+		op := "calibrate"
+		if sess.ID != sessionID {
+			op = "activate"
+		}
+		after, _ := ActiveSession(st, f.scaleID)
+		err = AppendAudit(auditPath(f.auditLog), op, operatorName(f.operator), f.scaleID,
+			fmt.Sprintf("%s as v%d", f.calPath, version), auditSnapshot(before), auditSnapshot(after))
+	}
+	if err == nil && c.applied {
+		summary := c.w.batch.summary(c.w.totSummary)
+		summary.SessionID, summary.Scale, summary.Time = sessionID, f.scaleID, nowUTC()
+		err = st.SaveBatch(&summary)
+	}
+	if cerr := st.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error writing store: %v\n", err)
+		os.Exit(1)
+	}
+	span.set(attr("calibrate.version", version))
+	span.end()
+	emit(&c.sb, "\nRecorded in store %s as session #%d, scale %s v%d (active)\n", spec, sessionID, f.scaleID, version)
+	if !c.fixed && before != nil && stageOf(before.Calibration) != stageFull && before.Version != version {
+		emit(&c.sb, "  replaces the %s calibration v%d\n", stageOf(before.Calibration), before.Version)
+	}
+}
+
+// writeOutputs writes the certificate, output.txt or -json-out, and the
+// protobuf and xlsx outputs requested.
+func (c *calibrateRun) writeOutputs(res CalibrationResult) {
+	f := c.f
+	_, span := c.tel.start(c.ctx, "write outputs")
+
+	if f.certOut != "" {
+		if err := WriteCertificate(f.certOut, f.calPath, res); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing certificate: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// If no JSON output is requested, write the human-readable output.txt
+	if f.jsonOut == "" {
+		_ = c.sb.save("output.txt")
+	}
+
+	// If requested, write a JSON summary (and skip text output when set)
+	if f.jsonOut != "" {
+		out, err := json.MarshalIndent(res, "", "  ")
+		if err == nil {
+			err = writeFileAtomic(f.jsonOut, append(out, '\n'), 0644)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error writing JSON output: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if f.protoOut != "" {
+		out, err := MarshalResultProto(res)
+		if err == nil {
+			err = writeFileAtomic(f.protoOut, out, 0644)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error writing protobuf output: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if f.xlsxOut != "" {
+		if err := WriteXLSX(f.xlsxOut, c.cal, res); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing xlsx output: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	span.end()
+}
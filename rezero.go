@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+)
+
+// RezeroReport is the result of `calibrate rezero`: the zero of the scale's
+// calibration before and after, each channel's shift in counts and in weight
+// (factor times shift), and the weight the whole shift amounts to, i.e. what
+// the empty platform read before the re-zero.
+type RezeroReport struct {
+	Scale       string     `json:"scale"`
+	From        int        `json:"from_version"`
+	Version     int        `json:"version"`
+	OldZero     [4]float64 `json:"old_zero"`
+	NewZero     [4]float64 `json:"new_zero"`
+	Shift       [4]float64 `json:"shift"`
+	ShiftWeight [4]float64 `json:"shift_weight"`
+	WeightShift float64    `json:"weight_shift"`
+	Readings    int        `json:"readings"`
+	Source      string     `json:"source"`
+}
+
+// rezeroCalibration moves the zero of cal to zero. The loaded rows move by
+// the same amount, so their deltas, and with them the fitted factors, stay as
+// they were.
+func rezeroCalibration(cal CalibrationData, zero [4]float64) CalibrationData {
+	var shift [4]float64
+	for ch := range shift {
+		shift[ch] = zero[ch] - cal.Zero[ch]
+	}
+	rows := []*[4]float64{&cal.OnCenter}
+	if cal.Stage != stageCoarse {
+		rows = append(rows, &cal.OnCell0, &cal.OnCell1, &cal.OnCell2, &cal.OnCell3)
+	}
+	for _, row := range rows {
+		for ch := range row {
+			row[ch] += shift[ch]
+		}
+	}
+	cal.Zero = zero
+	return cal
+}
+
+// runRezero implements `calibrate rezero`: capture a new zero for the active
+// calibration of a scale, keep its factors and record the result as the next
+// version, reporting how far the zero moved.
+func runRezero(args []string) int {
+	fs := flag.NewFlagSet("rezero", flag.ExitOnError)
+	c := newCheckFlags(fs, "of the empty platform")
+	maxShift := fs.Float64("max-shift", 0, "refuse when the zero moved by more than this weight (0 = no limit)")
+	auditLog := fs.String("audit-log", "", "append the change to this audit log (default $CAL_AUDIT_LOG)")
+	_ = fs.Parse(args)
+
+	if *maxShift < 0 {
+		fmt.Fprintln(os.Stderr, "error: -max-shift must be >= 0")
+		return 2
+	}
+	readings, source, err := c.readings()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+	st, active, code := activeForCheck(c)
+	if st == nil {
+		return code
+	}
+	defer st.Close()
+
+	rep := RezeroReport{Scale: active.Scale, From: active.Version, OldZero: active.Calibration.Zero,
+		Readings: len(readings), Source: source}
+	for _, r := range readings {
+		for ch := range rep.NewZero {
+			rep.NewZero[ch] += r[ch] / float64(len(readings))
+		}
+	}
+	for ch := range rep.Shift {
+		rep.Shift[ch] = rep.NewZero[ch] - rep.OldZero[ch]
+		rep.ShiftWeight[ch] = active.Result.Factors[ch] * rep.Shift[ch]
+		rep.WeightShift += rep.ShiftWeight[ch]
+	}
+	if *maxShift > 0 && math.Abs(rep.WeightShift) > *maxShift {
+		fmt.Fprintf(os.Stderr, "error: the zero moved by %+.4f, more than -max-shift %g; check the platform (debris, a load left on it, a damaged cell) or recalibrate\n",
+			rep.WeightShift, *maxShift)
+		return 3
+	}
+
+	cal := rezeroCalibration(active.Calibration, rep.NewZero)
+	res := active.Result
+	res.Readings = nil
+	sess := &Session{Scale: active.Scale, Time: nowUTC(), Source: fmt.Sprintf("rezero of v%d: %s", active.Version, source),
+		Calibration: cal, Result: res}
+	_, version, err := RecordSession(st, sess)
+	if err == nil {
+		after, _ := ActiveSession(st, active.Scale)
+		err = AppendAudit(auditPath(*auditLog), "rezero", operatorName(*c.operator), active.Scale,
+			fmt.Sprintf("zero of v%d moved by %+.6g as v%d", active.Version, rep.WeightShift, version), auditSnapshot(active), auditSnapshot(after))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error writing store: %v\n", err)
+		return 1
+	}
+	rep.Version = version
+
+	if *c.asJSON {
+		out, _ := json.MarshalIndent(rep, "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+	fmt.Printf("Re-zero of scale %s (calibration v%d, %d reading(s) from %s):\n", rep.Scale, rep.From, rep.Readings, rep.Source)
+	for ch := range rep.Shift {
+		fmt.Printf("  ch%d: %12.2f -> %12.2f  %+10.2f counts (%+.4f in weight)\n", ch, rep.OldZero[ch], rep.NewZero[ch], rep.Shift[ch], rep.ShiftWeight[ch])
+	}
+	fmt.Printf("The zero moved by %+.4f in weight; factors unchanged.\n", rep.WeightShift)
+	fmt.Printf("Recorded scale %s v%d (active).\n", rep.Scale, version)
+	if active.Signature != nil {
+		fmt.Fprintf(os.Stderr, "note: the signature of v%d does not cover the new zero; sign the new version again where signatures are required\n", active.Version)
+	}
+	return 0
+}
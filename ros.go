@@ -0,0 +1,274 @@
+//go:build ros || full
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerLiveOutput("ros", func(fs *flag.FlagSet) func(cfg liveSinkConfig) (liveSink, error) {
+		endpoint := fs.String("ros", "", "also publish every weight to ROS 2 through the rosbridge server at ws://host[:port]")
+		topic := fs.String("ros-topic", "/scale/weight", "ROS 2 topic of the calibrate_msgs/msg/WeightStamped messages")
+		frame := fs.String("ros-frame", "scale", "header.frame_id of the ROS 2 messages")
+		return func(cfg liveSinkConfig) (liveSink, error) {
+			if *endpoint == "" {
+				return nil, nil
+			}
+			p, err := newROSPublisher(*endpoint, *topic, *frame, cfg.units)
+			if err != nil {
+				return nil, fmt.Errorf("-ros: %v", err)
+			}
+			return rosSink{p}, nil
+		}
+	})
+}
+
+// rosSink publishes the valid readings of `calibrate live`.
+type rosSink struct{ p *rosPublisher }
+
+func (s rosSink) send(u weightUpdate, _ []byte) {
+	if !u.valid {
+		return
+	}
+	w := rosWeight{time: u.time, weight: u.weight, stable: u.stable, uncertainty: -1}
+	if u.uncertaintyOK {
+		w.uncertainty = u.uncertainty
+	}
+	s.p.send(w)
+}
+
+func (s rosSink) close() {
+	if lost := s.p.close(); lost > 0 {
+		fmt.Fprintf(os.Stderr, "warning: %d weight(s) not published to ROS 2\n", lost)
+	}
+}
+
+// ROS 2 weights go through rosbridge (rosbridge_suite's JSON protocol over a
+// WebSocket, port 9090 by default), the usual way for a non-ROS process to
+// publish into a ROS graph: no DDS stack is linked in. The message type is
+// calibrate_msgs/msg/WeightStamped from ros/calibrate_msgs, which must be
+// built in the workspace rosbridge runs in.
+
+const rosWeightType = "calibrate_msgs/msg/WeightStamped"
+
+// rosWeight is one weight to publish.
+type rosWeight struct {
+	time        time.Time
+	weight      float64
+	stable      bool
+	uncertainty float64
+}
+
+// rosStamp is builtin_interfaces/msg/Time.
+type rosStamp struct {
+	Sec     int64 `json:"sec"`
+	Nanosec int64 `json:"nanosec"`
+}
+
+type rosHeader struct {
+	Stamp   rosStamp `json:"stamp"`
+	FrameID string   `json:"frame_id"`
+}
+
+// rosWeightStamped is calibrate_msgs/msg/WeightStamped.
+type rosWeightStamped struct {
+	Header rosHeader `json:"header"`
+	Weight float64   `json:"weight"`
+	Stable bool      `json:"stable"`
+	Units  string    `json:"units"`
+	// Uncertainty is -1 when unknown.
+	Uncertainty float64 `json:"uncertainty"`
+}
+
+// rosPublisher publishes every weight handed to send on a ROS 2 topic from
+// its own goroutine. The queue between them sheds load, so weighing never
+// waits on the network; weights that did not fit, or came while rosbridge
+// was unreachable, are counted as dropped.
+type rosPublisher struct {
+	endpoint     *url.URL
+	topic, frame string
+	units        string
+	queue        *pipe[rosWeight]
+	done         chan struct{}
+	lost         int64 // weights taken from the queue but not delivered
+}
+
+func newROSPublisher(endpoint, topic, frame, units string) (*rosPublisher, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" || u.Host == "" {
+		return nil, fmt.Errorf("want ws://host[:port] of a rosbridge server, got %q", endpoint)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "9090")
+	}
+	if !strings.HasPrefix(topic, "/") {
+		return nil, fmt.Errorf("topic %q must be absolute (start with /)", topic)
+	}
+	p := &rosPublisher{endpoint: u, topic: topic, frame: frame, units: units,
+		queue: newPipe[rosWeight]("live→ros", 256, true), done: make(chan struct{})}
+	go p.run()
+	return p, nil
+}
+
+// send queues a weight without blocking.
+func (p *rosPublisher) send(w rosWeight) { p.queue.send(w) }
+
+func (p *rosPublisher) run() {
+	defer close(p.done)
+	var ws *wsConn
+	backoff, retryAt := time.Duration(0), time.Time{}
+	for {
+		w, ok := p.queue.recv()
+		if !ok {
+			break
+		}
+		if ws == nil {
+			if time.Now().Before(retryAt) {
+				p.lost++
+				continue
+			}
+			c, err := p.connect()
+			if err != nil {
+				p.lost++
+				backoff = min(max(2*backoff, outboxMinBackoff), outboxMaxBackoff)
+				retryAt = time.Now().Add(backoff)
+				log.Printf("warning: rosbridge %s: %v; retrying in %s", p.endpoint.Host, err, backoff)
+				continue
+			}
+			if backoff > 0 {
+				log.Printf("rosbridge %s: connected again", p.endpoint.Host)
+			}
+			ws, backoff = c, 0
+		}
+		msg := rosWeightStamped{
+			Header: rosHeader{Stamp: rosStamp{Sec: w.time.Unix(), Nanosec: int64(w.time.Nanosecond())}, FrameID: p.frame},
+			Weight: w.weight, Stable: w.stable, Units: p.units, Uncertainty: w.uncertainty,
+		}
+		if err := ws.writeJSON(map[string]any{"op": "publish", "topic": p.topic, "msg": msg}); err != nil {
+			p.lost++
+			log.Printf("warning: rosbridge %s: %v; reconnecting", p.endpoint.Host, err)
+			ws.Close()
+			ws = nil
+		}
+	}
+	if ws != nil {
+		_ = ws.writeJSON(map[string]any{"op": "unadvertise", "topic": p.topic})
+		ws.Close()
+	}
+}
+
+// connect opens the WebSocket and advertises the topic.
+func (p *rosPublisher) connect() (*wsConn, error) {
+	ws, err := dialWebSocket(p.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if err := ws.writeJSON(map[string]any{"op": "advertise", "topic": p.topic, "type": rosWeightType}); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// close publishes what is queued and disconnects. It returns the number of
+// weights that were not published.
+func (p *rosPublisher) close() int64 {
+	p.queue.close()
+	<-p.done
+	return p.lost + p.queue.Stats().Dropped
+}
+
+// wsConn is the client end of a WebSocket (RFC 6455) that only sends text
+// messages; whatever the server sends is discarded.
+type wsConn struct {
+	net.Conn
+	frame []byte
+}
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func dialWebSocket(u *url.URL) (*wsConn, error) {
+	conn, err := net.DialTimeout("tcp", u.Host, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [16]byte
+	_, _ = rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n",
+		u.RequestURI(), u.Host, key)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + wsGUID))
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		conn.Close()
+		return nil, fmt.Errorf("WebSocket handshake refused: %s", resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	go io.Copy(io.Discard, br) // status messages; ends when the connection closes
+	return &wsConn{Conn: conn}, nil
+}
+
+// writeJSON sends v as one masked text frame.
+func (c *wsConn) writeJSON(v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f := c.frame[:0]
+	f = append(f, 0x81) // FIN, text
+	switch n := len(payload); {
+	case n < 126:
+		f = append(f, 0x80|byte(n))
+	case n <= 0xffff:
+		f = append(f, 0x80|126)
+		f = binary.BigEndian.AppendUint16(f, uint16(n))
+	default:
+		f = append(f, 0x80|127)
+		f = binary.BigEndian.AppendUint64(f, uint64(n))
+	}
+	var mask [4]byte
+	_, _ = rand.Read(mask[:])
+	f = append(f, mask[:]...)
+	for i, b := range payload {
+		f = append(f, b^mask[i%4])
+	}
+	c.frame = f
+	_ = c.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err = c.Write(f)
+	return err
+}
+
+// Close sends a close frame and closes the connection.
+func (c *wsConn) Close() error {
+	_, _ = c.Write([]byte{0x88, 0x80, 0, 0, 0, 0})
+	return c.Conn.Close()
+}
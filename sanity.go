@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// calRowNames are the JSON names of the five measurement rows, in fit order.
+var calRowNames = [5]string{"on_cell_0", "on_cell_1", "on_cell_2", "on_cell_3", "on_center"}
+
+// calRows returns the five measurement rows in fit order.
+func calRows(cal CalibrationData) [5][4]float64 {
+	return [5][4]float64{cal.OnCell0, cal.OnCell1, cal.OnCell2, cal.OnCell3, cal.OnCenter}
+}
+
+// channelPolarity returns the sign each channel moves with load, taken from
+// the center row (0 for a channel that did not move).
+func channelPolarity(cal CalibrationData) [4]float64 {
+	var p [4]float64
+	for ch := range p {
+		switch d := cal.OnCenter[ch] - cal.Zero[ch]; {
+		case d > 0:
+			p[ch] = 1
+		case d < 0:
+			p[ch] = -1
+		}
+	}
+	return p
+}
+
+// dominantChannels returns, for each on_cell_X row, the channel with the
+// largest delta after polarity correction (absolute delta for flat channels).
+func dominantChannels(cal CalibrationData) [4]int {
+	pol := channelPolarity(cal)
+	rows := calRows(cal)
+	var dom [4]int
+	for cell := range dom {
+		best, bestDelta := -1, math.Inf(-1)
+		for ch, v := range rows[cell] {
+			d := v - cal.Zero[ch]
+			if pol[ch] != 0 {
+				d *= pol[ch]
+			} else {
+				d = math.Abs(d)
+			}
+			if d > bestDelta {
+				best, bestDelta = ch, d
+			}
+		}
+		dom[cell] = best
+	}
+	return dom
+}
+
+// duplicateRowFrac is how close (relative to the largest delta in the file)
+// two rows must be on every channel to be reported as duplicates.
+const duplicateRowFrac = 0.01
+
+// CheckCalibrationData validates calibration input before fitting, returning
+// one Warning (subject: the row) per violation:
+//
+//	weight-not-positive  calibration_weight must be > 0
+//	zero-out-of-range    a zero count at or beyond the ADC limits
+//	row-out-of-range     a loaded count at or beyond the ADC limits (saturated)
+//	flat-channel         a channel that does not move with the center load
+//	negative-delta       on_cell_X moved channel X against its polarity
+//	dominant-channel     the largest (polarity-corrected) delta of on_cell_X is
+//	                     not on channel X
+//	duplicate-row        two rows (zero included) are identical or differ on
+//	                     every channel by at most duplicateRowFrac of the
+//	                     largest delta, typically a copy-paste error
+//
+// The polarity of each channel is the direction it moves under the center load,
+// so cells wired with inverted signal are not reported.
+func CheckCalibrationData(cal CalibrationData, adcMin, adcMax float64) []Warning {
+	var out []Warning
+	add := func(check, row, format string, args ...any) {
+		out = append(out, newWarning(check, row, format, args...))
+	}
+	if !(cal.CalibrationWeight > 0) {
+		add("weight-not-positive", "", "calibration_weight is %g; it must be greater than 0", cal.CalibrationWeight)
+	}
+	for ch, z := range cal.Zero {
+		if z <= adcMin || z >= adcMax {
+			add("zero-out-of-range", "zero", "channel %d reads %g, outside the ADC range (%g, %g)", ch, z, adcMin, adcMax)
+		}
+	}
+	rows := calRows(cal)
+	for i, row := range rows {
+		for ch, v := range row {
+			if v <= adcMin || v >= adcMax {
+				add("row-out-of-range", calRowNames[i], "channel %d reads %g, outside the ADC range (%g, %g)", ch, v, adcMin, adcMax)
+			}
+		}
+	}
+	pol := channelPolarity(cal)
+	for ch, p := range pol {
+		if p == 0 {
+			add("flat-channel", "on_center", "channel %d did not move with the center load", ch)
+		}
+	}
+	dom := dominantChannels(cal)
+	for cell := 0; cell < 4; cell++ {
+		row, best := rows[cell], dom[cell]
+		own := row[cell] - cal.Zero[cell]
+		if pol[cell] != 0 && own*pol[cell] <= 0 {
+			add("negative-delta", calRowNames[cell], "channel %d moved %+g counts, against its polarity under the center load", cell, own)
+		}
+		if best != cell {
+			add("dominant-channel", calRowNames[cell], "largest delta is on channel %d (%g counts), not channel %d (%g counts)",
+				best, row[best]-cal.Zero[best], cell, own)
+		}
+	}
+	all := append([][4]float64{cal.Zero}, rows[:]...)
+	names := append([]string{"zero"}, calRowNames[:]...)
+	scale := 0.0
+	for _, row := range rows {
+		for ch, v := range row {
+			scale = math.Max(scale, math.Abs(v-cal.Zero[ch]))
+		}
+	}
+	for i := range all {
+		for j := i + 1; j < len(all); j++ {
+			dist := 0.0
+			for ch := range all[i] {
+				dist = math.Max(dist, math.Abs(all[i][ch]-all[j][ch]))
+			}
+			switch {
+			case dist == 0:
+				add("duplicate-row", names[j], "identical to %s", names[i])
+			case dist <= duplicateRowFrac*scale:
+				add("duplicate-row", names[j], "within %g counts of %s on every channel (largest delta %g)", dist, names[i], scale)
+			}
+		}
+	}
+	return out
+}
+
+// CheckFactors warns about factors whose sign is opposite to their channel's
+// load response (negative-factor): loading that cell would lower the weight,
+// which points at an unstable fit rather than at the mechanics.
+func CheckFactors(cal CalibrationData, factors [4]float64) []Warning {
+	var out []Warning
+	for ch, p := range channelPolarity(cal) {
+		if factors[ch]*p < 0 {
+			out = append(out, newWarning("negative-factor", fmt.Sprintf("f%d", ch),
+				"%s has the opposite sign of channel %d's response to load; loading that cell lowers the weight", formatFixed(factors[ch], 10), ch))
+		}
+	}
+	return out
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// calSchemaVersion is the newest calibration file layout this tool reads and
+// the one `calibrate migrate` writes.
+//
+//	v1 (no schema_version): zero, on_cell_0..on_cell_3 and on_center at the top level
+//	v2: "schema_version": 2 with the six rows under "readings"
+//	    (zero, cell_0..cell_3, center)
+//
+// Both decode to the same CalibrationData, which always encodes as v1, so
+// checksums and signatures do not depend on the file layout.
+const calSchemaVersion = 2
+
+// calReadings is the v2 "readings" object, in row order.
+type calReadings struct {
+	Zero   [4]float64 `json:"zero"`
+	Cell0  [4]float64 `json:"cell_0"`
+	Cell1  [4]float64 `json:"cell_1"`
+	Cell2  [4]float64 `json:"cell_2"`
+	Cell3  [4]float64 `json:"cell_3"`
+	Center [4]float64 `json:"center"`
+}
+
+// UnmarshalJSON reads every supported schema version.
+func (c *CalibrationData) UnmarshalJSON(b []byte) error {
+	type v1 CalibrationData
+	var aux struct {
+		v1
+		SchemaVersion int          `json:"schema_version"`
+		Readings      *calReadings `json:"readings"`
+	}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	switch {
+	case aux.SchemaVersion > calSchemaVersion:
+		return fieldErrorf("/schema_version", "schema_version %d is newer than this tool supports (%d)", aux.SchemaVersion, calSchemaVersion)
+	case aux.SchemaVersion >= 2:
+		if aux.Readings == nil {
+			return fieldErrorf("/readings", "schema_version %d needs a \"readings\" object", aux.SchemaVersion)
+		}
+		r := aux.Readings
+		aux.Zero, aux.OnCell0, aux.OnCell1, aux.OnCell2, aux.OnCell3, aux.OnCenter = r.Zero, r.Cell0, r.Cell1, r.Cell2, r.Cell3, r.Center
+	case aux.Readings != nil:
+		return fieldErrorf("/readings", "\"readings\" needs \"schema_version\": 2 (see calibrate migrate)")
+	}
+	*c = CalibrationData(aux.v1)
+	return nil
+}
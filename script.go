@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PostScript is a -post-script file: site-specific post-processing of each
+// reading's result before it is output. A script is a list of statements, one
+// per line ('#' starts a comment):
+//
+//	name = expr    set a field of the result, or a derived field
+//	keep expr      drop the reading from the outputs unless expr is true
+//
+// Expressions use Go syntax over the result's JSON fields (weight, reading,
+// valid, class, adc[0], ...), the fields set by earlier lines, numbers,
+// strings, true, false and nil (an unset optional field), with the builtins
+// of scriptFuncs. Of the result's own fields only weight, display_weight and
+// class can be set; any other name becomes a derived field.
+type PostScript struct {
+	path  string
+	stmts []scriptStmt
+}
+
+type scriptStmt struct {
+	line   int
+	target string // "" for keep
+	expr   ast.Expr
+}
+
+// scriptWritable are the result fields a script may set.
+var scriptWritable = []string{"weight", "display_weight", "class"}
+
+// scriptFuncs are the builtins of post-script expressions; the arity is
+// checked at load time.
+var scriptFuncs = map[string]struct {
+	min, max int
+	fn       func(args []any) (any, error)
+}{
+	"abs":  {1, 1, num1(math.Abs)},
+	"sqrt": {1, 1, num1(math.Sqrt)},
+	// round, floor and ceil take an optional step: round(weight, 0.05)
+	"round": {1, 2, stepped(math.Round)},
+	"floor": {1, 2, stepped(math.Floor)},
+	"ceil":  {1, 2, stepped(math.Ceil)},
+	"min":   {2, -1, extremum(math.Min)},
+	"max":   {2, -1, extremum(math.Max)},
+	// format(x, decimals) gives x as a string with a fixed number of decimals
+	"format": {2, 2, func(args []any) (any, error) {
+		x, d, err := twoNums(args)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.FormatFloat(x, 'f', int(d), 64), nil
+	}},
+	// cond(c, a, b) is a if c is true, else b
+	"cond": {3, 3, func(args []any) (any, error) {
+		c, ok := args[0].(bool)
+		if !ok {
+			return nil, fmt.Errorf("cond: condition is %s, not a bool", scriptType(args[0]))
+		}
+		if c {
+			return args[1], nil
+		}
+		return args[2], nil
+	}},
+}
+
+func num1(f func(float64) float64) func([]any) (any, error) {
+	return func(args []any) (any, error) {
+		x, ok := args[0].(float64)
+		if !ok {
+			return nil, fmt.Errorf("argument is %s, not a number", scriptType(args[0]))
+		}
+		return f(x), nil
+	}
+}
+
+func stepped(f func(float64) float64) func([]any) (any, error) {
+	return func(args []any) (any, error) {
+		if len(args) == 1 {
+			return num1(f)(args)
+		}
+		x, step, err := twoNums(args)
+		if err != nil {
+			return nil, err
+		}
+		if step <= 0 {
+			return nil, fmt.Errorf("step must be > 0")
+		}
+		return f(x/step) * step, nil
+	}
+}
+
+func extremum(f func(a, b float64) float64) func([]any) (any, error) {
+	return func(args []any) (any, error) {
+		out := math.NaN()
+		for i, a := range args {
+			x, ok := a.(float64)
+			if !ok {
+				return nil, fmt.Errorf("argument %d is %s, not a number", i+1, scriptType(a))
+			}
+			if i == 0 {
+				out = x
+			}
+			out = f(out, x)
+		}
+		return out, nil
+	}
+}
+
+func twoNums(args []any) (float64, float64, error) {
+	x, ok1 := args[0].(float64)
+	y, ok2 := args[1].(float64)
+	if !ok1 || !ok2 {
+		return 0, 0, fmt.Errorf("arguments are %s and %s, not numbers", scriptType(args[0]), scriptType(args[1]))
+	}
+	return x, y, nil
+}
+
+// scriptType names the type of a value in error messages.
+func scriptType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case float64:
+		return "a number"
+	case bool:
+		return "a bool"
+	case string:
+		return "a string"
+	case []any:
+		return "a list"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// resultFields are the JSON names of the ReadingResult fields.
+func resultFields() map[string]bool {
+	names := map[string]bool{}
+	t := reflect.TypeOf(ReadingResult{})
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// LoadPostScript parses a -post-script file. Syntax errors, unknown names and
+// functions, and assignments to read-only fields are reported with the line.
+func LoadPostScript(path string) (*PostScript, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ps := &PostScript{path: path}
+	known := resultFields()
+	delete(known, "fields")
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if i := strings.Index(line, "#"); i >= 0 && !strings.Contains(line[:i], `"`) {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+		st := scriptStmt{line: n}
+		src := line
+		if rest, ok := strings.CutPrefix(line, "keep "); ok {
+			src = rest
+		} else {
+			target, rest, ok := strings.Cut(line, "=")
+			target = strings.TrimSpace(target)
+			if !ok || strings.HasPrefix(rest, "=") || !token.IsIdentifier(target) {
+				return nil, fmt.Errorf("%s:%d: expected `name = expr` or `keep expr`", path, n)
+			}
+			if known[target] && !containsString(scriptWritable, target) {
+				return nil, fmt.Errorf("%s:%d: %s is read-only (a script can set %s, or derived fields)", path, n, target, strings.Join(scriptWritable, ", "))
+			}
+			st.target, src = target, rest
+		}
+		if st.expr, err = parser.ParseExpr(src); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		if err := checkScriptExpr(st.expr, known); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		if st.target != "" {
+			known[st.target] = true
+		}
+		ps.stmts = append(ps.stmts, st)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(ps.stmts) == 0 {
+		return nil, fmt.Errorf("%s: no statements", path)
+	}
+	return ps, nil
+}
+
+// checkScriptExpr accepts only the constructs eval implements.
+func checkScriptExpr(e ast.Expr, known map[string]bool) error {
+	var err error
+	ast.Inspect(e, func(n ast.Node) bool {
+		if err != nil {
+			return false
+		}
+		switch n := n.(type) {
+		case nil, *ast.BinaryExpr, *ast.UnaryExpr, *ast.ParenExpr, *ast.IndexExpr:
+		case *ast.BasicLit:
+			if n.Kind != token.INT && n.Kind != token.FLOAT && n.Kind != token.STRING {
+				err = fmt.Errorf("unsupported literal %s", n.Value)
+			}
+		case *ast.Ident:
+			if !known[n.Name] && n.Name != "true" && n.Name != "false" && n.Name != "nil" {
+				err = fmt.Errorf("unknown name %q", n.Name)
+			}
+		case *ast.CallExpr:
+			name := types.ExprString(n.Fun)
+			f, ok := scriptFuncs[name]
+			switch {
+			case !ok:
+				err = fmt.Errorf("unknown function %s", name)
+			case len(n.Args) < f.min || (f.max >= 0 && len(n.Args) > f.max):
+				err = fmt.Errorf("%s: wrong number of arguments (%d)", name, len(n.Args))
+			}
+			for _, a := range n.Args {
+				if err == nil {
+					err = checkScriptExpr(a, known)
+				}
+			}
+			return false
+		default:
+			if e, ok := n.(ast.Expr); ok {
+				err = fmt.Errorf("unsupported expression %s", types.ExprString(e))
+			} else {
+				err = fmt.Errorf("unsupported expression %T", n)
+			}
+		}
+		return true
+	})
+	return err
+}
+
+// Apply runs the script on rr. It reports whether the reading is kept;
+// derived fields go to rr.Fields.
+func (ps *PostScript) Apply(rr *ReadingResult) (bool, error) {
+	b, err := json.Marshal(rr)
+	if err != nil {
+		return false, err
+	}
+	env := map[string]any{}
+	if err := json.Unmarshal(b, &env); err != nil {
+		return false, err
+	}
+	for name := range resultFieldNames {
+		if _, ok := env[name]; !ok {
+			env[name] = nil
+		}
+	}
+	for _, st := range ps.stmts {
+		v, err := evalScript(st.expr, env)
+		if err != nil {
+			return false, fmt.Errorf("%s:%d: %v", ps.path, st.line, err)
+		}
+		if st.target == "" {
+			keep, ok := v.(bool)
+			if !ok {
+				return false, fmt.Errorf("%s:%d: keep needs a bool, got %s", ps.path, st.line, scriptType(v))
+			}
+			if !keep {
+				return false, nil
+			}
+			continue
+		}
+		switch st.target {
+		case "weight", "display_weight":
+			x, ok := v.(float64)
+			if !ok {
+				return false, fmt.Errorf("%s:%d: %s must be a number, got %s", ps.path, st.line, st.target, scriptType(v))
+			}
+			if st.target == "weight" {
+				rr.Weight = x
+			} else {
+				rr.Display = &x
+			}
+		case "class":
+			s, ok := v.(string)
+			if !ok {
+				return false, fmt.Errorf("%s:%d: class must be a string, got %s", ps.path, st.line, scriptType(v))
+			}
+			rr.Class = s
+		default:
+			if rr.Fields == nil {
+				rr.Fields = map[string]any{}
+			}
+			rr.Fields[st.target] = v
+		}
+		env[st.target] = v
+	}
+	return true, nil
+}
+
+var resultFieldNames = resultFields()
+
+// evalScript evaluates a checked expression against env.
+func evalScript(e ast.Expr, env map[string]any) (any, error) {
+	switch e := e.(type) {
+	case *ast.ParenExpr:
+		return evalScript(e.X, env)
+	case *ast.BasicLit:
+		if e.Kind == token.STRING {
+			return strconv.Unquote(e.Value)
+		}
+		return strconv.ParseFloat(e.Value, 64)
+	case *ast.Ident:
+		switch e.Name {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "nil":
+			return nil, nil
+		}
+		return env[e.Name], nil
+	case *ast.IndexExpr:
+		x, err := evalScript(e.X, env)
+		if err != nil {
+			return nil, err
+		}
+		i, err := evalScript(e.Index, env)
+		if err != nil {
+			return nil, err
+		}
+		list, ok := x.([]any)
+		idx, isNum := i.(float64)
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("cannot index %s", scriptType(x))
+		case !isNum || idx != math.Trunc(idx) || idx < 0 || int(idx) >= len(list):
+			return nil, fmt.Errorf("index %v out of range (%d elements)", i, len(list))
+		}
+		return list[int(idx)], nil
+	case *ast.CallExpr:
+		name := e.Fun.(*ast.Ident).Name
+		args := make([]any, len(e.Args))
+		for i, a := range e.Args {
+			v, err := evalScript(a, env)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = v
+		}
+		v, err := scriptFuncs[name].fn(args)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		return v, nil
+	case *ast.UnaryExpr:
+		x, err := evalScript(e.X, env)
+		if err != nil {
+			return nil, err
+		}
+		switch v := x.(type) {
+		case float64:
+			switch e.Op {
+			case token.SUB:
+				return -v, nil
+			case token.ADD:
+				return v, nil
+			}
+		case bool:
+			if e.Op == token.NOT {
+				return !v, nil
+			}
+		}
+		return nil, fmt.Errorf("operator %s not defined on %s", e.Op, scriptType(x))
+	case *ast.BinaryExpr:
+		return evalBinary(e, env)
+	}
+	return nil, fmt.Errorf("unsupported expression %T", e)
+}
+
+func evalBinary(e *ast.BinaryExpr, env map[string]any) (any, error) {
+	x, err := evalScript(e.X, env)
+	if err != nil {
+		return nil, err
+	}
+	// && and || short-circuit, so `valid && weight > 0` is safe
+	if e.Op == token.LAND || e.Op == token.LOR {
+		a, ok := x.(bool)
+		if !ok {
+			return nil, fmt.Errorf("operator %s not defined on %s", e.Op, scriptType(x))
+		}
+		if a == (e.Op == token.LOR) {
+			return a, nil
+		}
+		y, err := evalScript(e.Y, env)
+		if err != nil {
+			return nil, err
+		}
+		if b, ok := y.(bool); ok {
+			return b, nil
+		}
+		return nil, fmt.Errorf("operator %s not defined on %s", e.Op, scriptType(y))
+	}
+	y, err := evalScript(e.Y, env)
+	if err != nil {
+		return nil, err
+	}
+	switch e.Op {
+	case token.EQL, token.NEQ:
+		eq := reflect.DeepEqual(x, y)
+		return eq == (e.Op == token.EQL), nil
+	}
+	if a, ok := x.(float64); ok {
+		if b, ok := y.(float64); ok {
+			switch e.Op {
+			case token.ADD:
+				return a + b, nil
+			case token.SUB:
+				return a - b, nil
+			case token.MUL:
+				return a * b, nil
+			case token.QUO:
+				return a / b, nil
+			case token.REM:
+				return math.Mod(a, b), nil
+			case token.LSS:
+				return a < b, nil
+			case token.LEQ:
+				return a <= b, nil
+			case token.GTR:
+				return a > b, nil
+			case token.GEQ:
+				return a >= b, nil
+			}
+		}
+	}
+	if a, ok := x.(string); ok {
+		if b, ok := y.(string); ok {
+			switch e.Op {
+			case token.ADD:
+				return a + b, nil
+			case token.LSS:
+				return a < b, nil
+			case token.LEQ:
+				return a <= b, nil
+			case token.GTR:
+				return a > b, nil
+			case token.GEQ:
+				return a >= b, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("operator %s not defined on %s and %s", e.Op, scriptType(x), scriptType(y))
+}
+
+// scriptFieldList formats the derived fields of a result for the text report.
+func scriptFieldList(fields map[string]any) string {
+	names := make([]string, 0, len(fields))
+	for k := range fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, k := range names {
+		b, _ := json.Marshal(fields[k])
+		parts[i] = k + "=" + string(b)
+	}
+	return strings.Join(parts, ", ")
+}
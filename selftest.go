@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"sort"
+)
+
+// SelfTestStats summarizes relative errors over the synthetic runs.
+type SelfTestStats struct {
+	Mean float64 `json:"mean"`
+	RMS  float64 `json:"rms"`
+	P95  float64 `json:"p95"`
+	Max  float64 `json:"max"`
+}
+
+func selfTestStats(v []float64) SelfTestStats {
+	if len(v) == 0 {
+		return SelfTestStats{}
+	}
+	s := append([]float64(nil), v...)
+	sort.Float64s(s)
+	var st SelfTestStats
+	for _, x := range s {
+		st.Mean += x / float64(len(s))
+		st.RMS += x * x / float64(len(s))
+	}
+	st.RMS = math.Sqrt(st.RMS)
+	st.P95 = s[int(math.Ceil(0.95*float64(len(s))))-1]
+	st.Max = s[len(s)-1]
+	return st
+}
+
+// SelfTestReport is the result of `calibrate selftest`.
+type SelfTestReport struct {
+	Runs            int           `json:"runs"`
+	Seed            uint64        `json:"seed"`
+	Noise           float64       `json:"noise_counts"`
+	FailedFits      int           `json:"failed_fits"`
+	FactorError     SelfTestStats `json:"factor_error"`
+	WeightError     SelfTestStats `json:"weight_error"`
+	CrossCheckMax   float64       `json:"cross_check_max"`
+	SanityWarnings  int           `json:"sanity_warnings"`
+	RoundTripErrors int           `json:"round_trip_errors"`
+	Tolerance       float64       `json:"tolerance"`
+	Pass            bool          `json:"pass"`
+}
+
+// synthCalibration builds a calibration from ground-truth factors: each
+// placement spreads the weight w over the cells by load shares (0.7 on the
+// loaded cell and 0.1 on the others, 0.25 each for the center, jittered by
+// up to ±20%), the ADC deltas follow as share * w / f, and every count gets
+// Gaussian noise of the given sigma.
+func synthCalibration(r *rand.Rand, truth [4]float64, w, noise float64) CalibrationData {
+	cal := CalibrationData{CalibrationWeight: w}
+	for ch := range cal.Zero {
+		cal.Zero[ch] = math.Round(r.Float64()*200000 - 100000)
+	}
+	row := func(shares [4]float64) [4]float64 {
+		sum := 0.0
+		for i := range shares {
+			shares[i] *= 1 + 0.4*(r.Float64()-0.5)
+			sum += shares[i]
+		}
+		var out [4]float64
+		for ch := range out {
+			out[ch] = cal.Zero[ch] + shares[ch]/sum*w/truth[ch] + noise*r.NormFloat64()
+		}
+		return out
+	}
+	onCell := func(k int) [4]float64 {
+		s := [4]float64{0.1, 0.1, 0.1, 0.1}
+		s[k] = 0.7
+		return row(s)
+	}
+	cal.OnCell0, cal.OnCell1, cal.OnCell2, cal.OnCell3 = onCell(0), onCell(1), onCell(2), onCell(3)
+	cal.OnCenter = row([4]float64{0.25, 0.25, 0.25, 0.25})
+	for ch := range cal.Zero {
+		cal.Zero[ch] += noise * r.NormFloat64()
+	}
+	return cal
+}
+
+// selfTestRun is one synthetic calibration of the self-test: the drawn
+// ground truth and test load, and what the pipeline made of them.
+type selfTestRun struct {
+	truth [4]float64
+	cal   CalibrationData
+
+	roundTripErr bool
+	sanity       int
+	failed       bool
+	crossCheck   float64
+	factorErr    [4]float64
+	weightErr    float64
+}
+
+// selfTestBlock is the number of runs drawn, checked and reduced at a time,
+// which bounds the memory of long self-tests.
+const selfTestBlock = 4096
+
+// RunSelfTest generates runs random ground-truth factor sets (0.001 to 0.01
+// weight per count, corners within ±20% of each other, random polarity),
+// synthesizes calibration data with the given ADC noise, and checks the whole
+// pipeline on it: JSON round trip, input sanity checks, fit, solver
+// cross-check and the weight of a random test load against the truth. It
+// passes when the 95th percentile of the relative weight error is within tol
+// and no fit or round trip fails.
+//
+// The runs are spread over workers goroutines. Each draws from its own
+// generator, seeded from seed and the run's index, so the report is the same
+// for any number of workers.
+func RunSelfTest(runs int, seed uint64, noise, tol float64, workers int) SelfTestReport {
+	rep := SelfTestReport{Runs: runs, Seed: seed, Noise: noise, Tolerance: tol}
+	var factorErr, weightErr []float64
+	block := make([]selfTestRun, min(runs, selfTestBlock))
+	for done := 0; done < runs; done += len(block) {
+		block = block[:min(runs-done, len(block))]
+		parallelFor(len(block), workers, func(k int) {
+			r := selfTestRand(seed, done+k)
+			block[k] = drawSelfTestRun(r, noise)
+			block[k].check(r)
+		})
+		for _, run := range block {
+			if run.roundTripErr {
+				rep.RoundTripErrors++
+			}
+			rep.SanityWarnings += run.sanity
+			if run.failed {
+				rep.FailedFits++
+				continue
+			}
+			rep.CrossCheckMax = math.Max(rep.CrossCheckMax, run.crossCheck)
+			factorErr = append(factorErr, run.factorErr[:]...)
+			weightErr = append(weightErr, run.weightErr)
+		}
+	}
+	rep.FactorError = selfTestStats(factorErr)
+	rep.WeightError = selfTestStats(weightErr)
+	rep.Pass = rep.FailedFits == 0 && rep.RoundTripErrors == 0 && rep.WeightError.P95 <= tol
+	return rep
+}
+
+// selfTestRand returns the generator of run n. Run 0 draws the sequence of
+// the self-test before it ran in parallel.
+func selfTestRand(seed uint64, n int) *rand.Rand {
+	return rand.New(rand.NewPCG(seed, seed^0x9e3779b97f4a7c15^uint64(n)))
+}
+
+// drawSelfTestRun draws the ground truth and calibration data of one run.
+func drawSelfTestRun(r *rand.Rand, noise float64) selfTestRun {
+	var run selfTestRun
+	base := 0.001 + 0.009*r.Float64()
+	for ch := range run.truth {
+		run.truth[ch] = base * (0.8 + 0.4*r.Float64())
+		if r.IntN(8) == 0 {
+			run.truth[ch] = -run.truth[ch] // inverted signal wiring
+		}
+	}
+	w := math.Round(10 + 990*r.Float64())
+	run.cal = synthCalibration(r, run.truth, w, noise)
+	return run
+}
+
+// check runs the pipeline on the drawn calibration and records the errors.
+// A fit that succeeds is checked on a test load drawn from r.
+func (run *selfTestRun) check(r *rand.Rand) {
+	cal := run.cal
+	b, err := json.Marshal(cal)
+	var back CalibrationData
+	if err == nil {
+		err = json.Unmarshal(b, &back)
+	}
+	run.roundTripErr = err != nil || back != cal
+	run.sanity = len(CheckCalibrationData(cal, -8388608, 8388607))
+
+	factors, _, _, err := ComputeFactors(cal, 0)
+	if err != nil {
+		run.failed = true
+		return
+	}
+	if c, err := CrossCheckFactors(cal, factors, 0, math.Inf(1)); err == nil {
+		run.crossCheck = c.MaxRelDiff
+	}
+	for ch, f := range run.truth {
+		run.factorErr[ch] = math.Abs(factors[ch]-f) / math.Abs(f)
+	}
+	// a test load of random size and position, without noise
+	var adc [4]float64
+	load, shares, sum := cal.CalibrationWeight*(0.1+1.9*r.Float64()), [4]float64{}, 0.0
+	for ch := range shares {
+		shares[ch] = 0.05 + r.Float64()
+		sum += shares[ch]
+	}
+	for ch := range adc {
+		adc[ch] = cal.Zero[ch] + shares[ch]/sum*load/run.truth[ch]
+	}
+	run.weightErr = math.Abs(ComputeWeight(adc, cal.Zero, factors)-load) / load
+}
+
+// runSelfTest implements `calibrate selftest`.
+func runSelfTest(args []string) int {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	runs := fs.Int("n", 1000, "number of synthetic calibrations")
+	seed := fs.Uint64("seed", 1, "random seed (the same seed gives the same runs)")
+	noise := fs.Float64("noise", 1, "Gaussian ADC noise added to every count, 1 sigma in counts")
+	tol := fs.Float64("tol", 0.001, "largest allowed 95th percentile of the relative weight error")
+	workers := workersFlag(fs)
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	_ = fs.Parse(args)
+
+	if *runs < 1 || *noise < 0 || *tol <= 0 || *workers < 0 {
+		fmt.Fprintln(os.Stderr, "error: -n must be >= 1, -noise >= 0, -tol > 0 and -workers >= 0")
+		return 2
+	}
+	rep := RunSelfTest(*runs, *seed, *noise, *tol, *workers)
+	if *asJSON {
+		out, _ := json.MarshalIndent(rep, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		line := func(name string, s SelfTestStats) {
+			fmt.Printf("  %-26s mean %.3g  rms %.3g  p95 %.3g  max %.3g\n", name, s.Mean, s.RMS, s.P95, s.Max)
+		}
+		fmt.Printf("Self-test: %d synthetic calibrations (seed %d, ADC noise %g counts)\n", rep.Runs, rep.Seed, rep.Noise)
+		line("factor error (relative):", rep.FactorError)
+		line("weight error (relative):", rep.WeightError)
+		fmt.Printf("  failed fits: %d, JSON round-trip errors: %d, sanity warnings: %d\n", rep.FailedFits, rep.RoundTripErrors, rep.SanityWarnings)
+		fmt.Printf("  solver cross-check: max relative difference %.3g\n", rep.CrossCheckMax)
+		verdict := "PASS"
+		if !rep.Pass {
+			verdict = "FAIL"
+		}
+		fmt.Printf("Result: %s (p95 weight error %.3g, tolerance %g)\n", verdict, rep.WeightError.P95, rep.Tolerance)
+	}
+	if !rep.Pass {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,708 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() { registerFeature("api", "rest") }
+
+// apiToken is one API credential. Read-only tokens may list, fetch and weigh
+// only.
+type apiToken struct {
+	token    string
+	name     string
+	readOnly bool
+}
+
+// loadAPITokens reads a token file: one "<token> <name> [read-only]" per line,
+// blank lines and # comments ignored. The name is recorded as the operator in
+// the audit log.
+func loadAPITokens(path string) ([]apiToken, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []apiToken
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 || (len(fields) == 3 && fields[2] != "read-only") {
+			return nil, fmt.Errorf("%s:%d: want \"<token> <name> [read-only]\"", path, n)
+		}
+		out = append(out, apiToken{token: fields[0], name: fields[1], readOnly: len(fields) == 3})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%s: no tokens", path)
+	}
+	return out, nil
+}
+
+// calServer serves the calibration store over HTTP. The store is opened per
+// request (and requests are serialized) so CLI runs against the same store
+// are seen immediately and file-locking backends are not held open.
+type calServer struct {
+	storeSpec string
+	storeKey  string
+	tokens    []apiToken
+	auditLog  string
+	fits      *fitCache
+	mu        sync.Mutex
+	limiter   *rateLimiter
+	// liveSource feeds the StreamWeights gRPC streams; quit ends them when
+	// the server shuts down.
+	liveSource string
+	quit       context.Context
+	live       *liveMetrics
+	tel        *telemetry
+	// trusted verifies the signatures of uploads; without it signed uploads
+	// are refused.
+	trusted ed25519.PublicKey
+	// pending bounds the requests admitted at once (running or waiting for
+	// mu).
+	pending chan struct{}
+	// requests and changes count the handled requests, and limited the
+	// rejected ones, for the shutdown summary.
+	requests, changes, limited atomic.Int64
+}
+
+// VersionSummary is one calibration version in API listings.
+type VersionSummary struct {
+	ID            int64      `json:"id"`
+	Version       int        `json:"version"`
+	Checksum      string     `json:"checksum"`
+	Time          time.Time  `json:"time"`
+	Source        string     `json:"source"`
+	Factors       [4]float64 `json:"factors"`
+	ResidualVar   float64    `json:"residual_variance"`
+	CalibrationOK bool       `json:"calibration_ok"`
+	Signed        bool       `json:"signed"`
+	Active        bool       `json:"active"`
+	// Stage is the calibration's stage and expected error, when recorded.
+	Stage *StageInfo `json:"stage,omitempty"`
+}
+
+// apiError is the JSON body of error responses.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	out, _ := json.MarshalIndent(v, "", "  ")
+	w.Write(append(out, '\n'))
+}
+
+func writeError(w http.ResponseWriter, status int, format string, args ...any) {
+	writeJSON(w, status, apiError{Error: fmt.Sprintf(format, args...)})
+}
+
+// lookupToken returns the token r carries, or nil.
+func (s *calServer) lookupToken(r *http.Request) *apiToken {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok {
+		for i := range s.tokens {
+			if subtle.ConstantTimeCompare([]byte(given), []byte(s.tokens[i].token)) == 1 {
+				return &s.tokens[i]
+			}
+		}
+	}
+	return nil
+}
+
+// authorize returns the caller's token, or nil after writing 401/403.
+func (s *calServer) authorize(w http.ResponseWriter, r *http.Request, write bool) *apiToken {
+	if tok := s.lookupToken(r); tok != nil {
+		if write && tok.readOnly {
+			writeError(w, http.StatusForbidden, "token %q is read-only", tok.name)
+			return nil
+		}
+		return tok
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="calibrate"`)
+	writeError(w, http.StatusUnauthorized, "missing or invalid API token")
+	return nil
+}
+
+// handle wraps an API handler with rate limiting, authorization and a store
+// opened for the duration of the request. Clients are limited by token, and
+// requests without a valid token by address, so failed guesses are limited
+// too. Requests wait their turn for the store in a queue of -max-pending; a
+// full queue is answered with 503 rather than piling up goroutines.
+func (s *calServer) handle(write bool, h func(w http.ResponseWriter, r *http.Request, st Store, tok *apiToken)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := "address " + remoteHost(r)
+		if tok := s.lookupToken(r); tok != nil {
+			client = "token " + tok.name
+		}
+		if !s.limiter.limit(w, client) {
+			s.limited.Add(1)
+			return
+		}
+		tok := s.authorize(w, r, write)
+		if tok == nil {
+			return
+		}
+		select {
+		case s.pending <- struct{}{}:
+			defer func() { <-s.pending }()
+		default:
+			s.limited.Add(1)
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, "server busy: %d requests already waiting", cap(s.pending))
+			return
+		}
+		s.requests.Add(1)
+		if write {
+			s.changes.Add(1)
+		}
+		// the span includes the wait for the store
+		_, span := s.tel.start(r.Context(), "open store")
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		st, err := OpenStore(s.storeSpec, s.storeKey)
+		span.fail(err)
+		span.end()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "opening store: %v", err)
+			return
+		}
+		defer st.Close()
+		h(w, r, st, tok)
+	}
+}
+
+// pathVersion parses the {version} path value, writing 400 when invalid.
+func pathVersion(w http.ResponseWriter, r *http.Request) (int, bool) {
+	v, err := strconv.Atoi(strings.TrimPrefix(r.PathValue("version"), "v"))
+	if err != nil || v < 1 {
+		writeError(w, http.StatusBadRequest, "invalid version %q", r.PathValue("version"))
+		return 0, false
+	}
+	return v, true
+}
+
+// findVersion returns the stored version of scale, writing 404 when missing.
+func findVersion(w http.ResponseWriter, st Store, scale string, version int) (*Session, bool) {
+	sessions, err := st.Sessions(scale)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "reading sessions: %v", err)
+		return nil, false
+	}
+	for i := range sessions {
+		if sessions[i].Version == version {
+			return &sessions[i], true
+		}
+	}
+	writeError(w, http.StatusNotFound, "scale %q has no version %d", scale, version)
+	return nil, false
+}
+
+func (s *calServer) listScales(w http.ResponseWriter, r *http.Request, st Store, _ *apiToken) {
+	sessions, err := st.Sessions("")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "reading sessions: %v", err)
+		return
+	}
+	counts := map[string]int{}
+	for _, sess := range sessions {
+		counts[sess.Scale]++
+	}
+	out := []ScaleSummary{}
+	for name, n := range counts {
+		active, _ := st.Active(name)
+		out = append(out, ScaleSummary{Scale: name, Versions: n, Active: active})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Scale < out[j].Scale })
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *calServer) listVersions(w http.ResponseWriter, r *http.Request, st Store, _ *apiToken) {
+	scale := r.PathValue("scale")
+	sessions, err := st.Sessions(scale)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "reading sessions: %v", err)
+		return
+	}
+	active, _ := st.Active(scale)
+	out := []VersionSummary{}
+	for _, sess := range sessions {
+		out = append(out, VersionSummary{ID: sess.ID, Version: sess.Version, Checksum: sess.Checksum, Time: sess.Time,
+			Source: sess.Source, Factors: sess.Result.Factors, ResidualVar: sess.Result.ResidualVar,
+			CalibrationOK: sess.Result.CalibrationOK, Signed: sess.Signature != nil, Active: sess.Version == active,
+			Stage: sess.Result.Stage})
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *calServer) getVersion(w http.ResponseWriter, r *http.Request, st Store, _ *apiToken) {
+	version, ok := pathVersion(w, r)
+	if !ok {
+		return
+	}
+	if sess, ok := findVersion(w, st, r.PathValue("scale"), version); ok {
+		writeJSON(w, http.StatusOK, sess)
+	}
+}
+
+// uploadRequest is the body of an upload: the calibration input, an optional
+// Ed25519 signature over it (verified with the server's -trusted-key) and
+// optional session metadata.
+type uploadRequest struct {
+	Calibration *CalibrationData `json:"calibration"`
+	Signature   *CalSignature    `json:"signature,omitempty"`
+	Session     *SessionMeta     `json:"session,omitempty"`
+}
+
+// upload records a calibration as the next version of the scale and makes it
+// active, unless ?activate=false is given.
+func (s *calServer) upload(w http.ResponseWriter, r *http.Request, st Store, tok *apiToken) {
+	scale := r.PathValue("scale")
+	if err := checkScaleID(scale); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "reading body: %v", err)
+		return
+	}
+	var req uploadRequest
+	if err := json.Unmarshal(body, &req); err != nil || req.Calibration == nil {
+		// also accept a bare calibration file
+		req = uploadRequest{Calibration: new(CalibrationData)}
+		if err := json.Unmarshal(body, req.Calibration); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid calibration JSON: %v", err)
+			return
+		}
+	}
+	if req.Signature != nil {
+		if s.trusted == nil {
+			writeError(w, http.StatusUnprocessableEntity, "signature cannot be verified: the server has no -trusted-key")
+			return
+		}
+		if err := VerifyCalibration(*req.Calibration, *req.Signature, s.trusted); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, "signature: %v", err)
+			return
+		}
+	}
+	_, span := s.tel.start(r.Context(), "solve", attr("calibrate.scale", scale))
+	res, err := s.fits.fit(*req.Calibration, envRidge())
+	span.fail(err)
+	span.end()
+	s.tel.countSolve(err)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "calculation error: %v", err)
+		return
+	}
+	if req.Calibration.Stage == stageCoarse {
+		// the corner error of a coarse calibration, from the scale's last full one
+		if sessions, err := st.Sessions(scale); err == nil {
+			if full := lastFullSession(sessions); full != nil {
+				stage := coarseStage(res.Factors, full, defaultCornerTol)
+				res.Stage = &stage
+			}
+		}
+	}
+	if req.Session != nil {
+		if req.Session.Operator == "" {
+			req.Session.Operator = tok.name
+		}
+		res.Session = req.Session
+	}
+	weights, err := st.RefWeights()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "reading reference weights: %v", err)
+		return
+	}
+	refID := ""
+	if req.Session != nil {
+		refID = req.Session.ReferenceWeightID
+	}
+	rw, warnings, err := CheckReferenceWeight(weights, refID, req.Calibration.CalibrationWeight, time.Now().UTC())
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "%v", err)
+		return
+	}
+	for _, msg := range warnings {
+		w.Header().Add("Warning", fmt.Sprintf("199 calibrate %q", msg))
+	}
+	if rw != nil {
+		res.Session.ReferenceWeight = rw
+	}
+	before, err := ActiveSession(st, scale)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "reading active version: %v", err)
+		return
+	}
+	sess := &Session{Scale: scale, Time: time.Now().UTC(), Source: "api:" + tok.name,
+		Calibration: *req.Calibration, Result: res, Signature: req.Signature}
+	_, span = s.tel.start(r.Context(), "record", attr("calibrate.scale", scale))
+	id, version, err := RecordSession(st, sess)
+	if err == nil && r.URL.Query().Get("activate") == "false" && before != nil {
+		err = st.SetActive(scale, before.Version)
+	}
+	span.set(attr("calibrate.version", version))
+	span.fail(err)
+	span.end()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "writing store: %v", err)
+		return
+	}
+	after, _ := ActiveSession(st, scale)
+	status := http.StatusCreated
+	if sess.ID != id {
+		status = http.StatusOK // identical input: the existing version was reused
+	}
+	if err := AppendAudit(s.auditLog, "calibrate", tok.name, scale, fmt.Sprintf("uploaded via API as v%d", version),
+		auditSnapshot(before), auditSnapshot(after)); err != nil {
+		log.Printf("audit log: %v", err)
+	}
+	stored, _ := findVersion(w, st, scale, version)
+	if stored != nil {
+		writeJSON(w, status, stored)
+	}
+}
+
+// weighResponse is the body of a weighing: the readings weighed with a
+// calibration version, as in apply mode's -json-out.
+type weighResponse struct {
+	Scale   string `json:"scale"`
+	Version int    `json:"version"`
+	ApplyResult
+}
+
+// weighRequest documents the body of a weighing; any adc file is accepted.
+type weighRequest struct {
+	ADC [][4]float64 `json:"adc"`
+}
+
+// weigh converts the posted readings with the active calibration of the
+// scale, or with ?version. Nothing is recorded.
+func (s *calServer) weigh(w http.ResponseWriter, r *http.Request, st Store, _ *apiToken) {
+	scale := r.PathValue("scale")
+	q := r.URL.Query()
+	var opt ApplyOptions
+	if v := q.Get("tare"); v != "" {
+		tare, err := strconv.ParseFloat(v, 64)
+		if err != nil || nonFinite(tare) != "" {
+			writeError(w, http.StatusBadRequest, "invalid tare %q", v)
+			return
+		}
+		opt.Tare = tare
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "reading body: %v", err)
+		return
+	}
+	doc, err := parseADCDocument("body", body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	var sess *Session
+	if v := q.Get("version"); v != "" {
+		version, err := strconv.Atoi(strings.TrimPrefix(v, "v"))
+		if err != nil || version < 1 {
+			writeError(w, http.StatusBadRequest, "invalid version %q", v)
+			return
+		}
+		var ok bool
+		if sess, ok = findVersion(w, st, scale, version); !ok {
+			return
+		}
+	} else {
+		if sess, err = ActiveSession(st, scale); err != nil {
+			writeError(w, http.StatusInternalServerError, "reading active version: %v", err)
+			return
+		}
+		if sess == nil {
+			writeError(w, http.StatusNotFound, "scale %q has no active calibration", scale)
+			return
+		}
+	}
+	rows := make([][]float64, len(doc.Rows))
+	for i := range doc.Rows {
+		rows[i] = doc.Rows[i][:]
+	}
+	res, err := ApplyReadings(rows, sess.Calibration.Zero, sess.Result.Factors, opt)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "%v", err)
+		return
+	}
+	s.tel.countReadings(true, int64(res.Batch.Valid))
+	s.tel.countReadings(false, int64(res.Batch.Invalid))
+	writeJSON(w, http.StatusOK, weighResponse{Scale: scale, Version: sess.Version, ApplyResult: res})
+}
+
+func (s *calServer) activate(w http.ResponseWriter, r *http.Request, st Store, tok *apiToken) {
+	scale := r.PathValue("scale")
+	if err := checkScaleID(scale); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	version, ok := pathVersion(w, r)
+	if !ok {
+		return
+	}
+	target, ok := findVersion(w, st, scale, version)
+	if !ok {
+		return
+	}
+	before, _ := ActiveSession(st, scale)
+	if err := st.SetActive(scale, version); err != nil {
+		writeError(w, http.StatusInternalServerError, "setting active version: %v", err)
+		return
+	}
+	prev, op := 0, "activate"
+	if before != nil {
+		prev = before.Version
+	}
+	if version < prev {
+		op = "rollback"
+	}
+	if err := AppendAudit(s.auditLog, op, tok.name, scale, fmt.Sprintf("active version v%d to v%d via API", prev, version),
+		auditSnapshot(before), auditSnapshot(target)); err != nil {
+		log.Printf("audit log: %v", err)
+	}
+	writeJSON(w, http.StatusOK, activateResponse{Active: version, Previous: prev})
+}
+
+// deleteVersion removes a calibration version. The active version cannot be
+// deleted; activate another one first.
+func (s *calServer) deleteVersion(w http.ResponseWriter, r *http.Request, st Store, tok *apiToken) {
+	scale := r.PathValue("scale")
+	version, ok := pathVersion(w, r)
+	if !ok {
+		return
+	}
+	target, ok := findVersion(w, st, scale, version)
+	if !ok {
+		return
+	}
+	if active, _ := st.Active(scale); active == version {
+		writeError(w, http.StatusConflict, "v%d is the active version of %q; activate another version first", version, scale)
+		return
+	}
+	if err := st.DeleteSession(scale, version); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errNoSession) {
+			status = http.StatusNotFound
+		}
+		writeError(w, status, "deleting version: %v", err)
+		return
+	}
+	if err := AppendAudit(s.auditLog, "delete", tok.name, scale, fmt.Sprintf("deleted v%d via API", version),
+		auditSnapshot(target), nil); err != nil {
+		log.Printf("audit log: %v", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// healthStatus is the body of the health endpoints.
+type healthStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// healthz is the liveness probe: the process is up and serving.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, healthStatus{Status: "ok"})
+}
+
+// readyz is the readiness probe: the store opens and the request queue is
+// not full. A request holding the store shows it is working, so the probe
+// does not wait for it.
+func (s *calServer) readyz(w http.ResponseWriter, r *http.Request) {
+	if len(s.pending) == cap(s.pending) {
+		writeJSON(w, http.StatusServiceUnavailable, healthStatus{Status: "busy", Error: fmt.Sprintf("%d requests waiting", cap(s.pending))})
+		return
+	}
+	if s.mu.TryLock() {
+		st, err := OpenStore(s.storeSpec, s.storeKey)
+		if err == nil {
+			st.Close()
+		}
+		s.mu.Unlock()
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, healthStatus{Status: "unavailable", Error: fmt.Sprintf("opening store: %v", err)})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, healthStatus{Status: "ok"})
+}
+
+// routes returns the API handler. apiOperations documents the routes. The
+// probes and the metrics scrape are not traced.
+func (s *calServer) routes() http.Handler {
+	outer := http.NewServeMux()
+	outer.HandleFunc("GET /healthz", healthz)
+	outer.HandleFunc("GET /readyz", s.readyz)
+	outer.HandleFunc("GET /metrics", s.handle(false, s.metrics))
+	mux := http.NewServeMux()
+	outer.Handle("/", s.tel.traceHTTP(mux))
+	mux.HandleFunc("GET /api/openapi.json", serveOpenAPI)
+	mux.HandleFunc("POST /calibrate.v1.Weights/StreamWeights", s.streamWeights)
+	mux.HandleFunc("GET /api/scales", s.handle(false, s.listScales))
+	mux.HandleFunc("GET /api/scales/{scale}/calibrations", s.handle(false, s.listVersions))
+	mux.HandleFunc("POST /api/scales/{scale}/calibrations", s.handle(true, s.upload))
+	mux.HandleFunc("GET /api/scales/{scale}/calibrations/{version}", s.handle(false, s.getVersion))
+	mux.HandleFunc("POST /api/scales/{scale}/weigh", s.handle(false, s.weigh))
+	mux.HandleFunc("POST /api/scales/{scale}/calibrations/{version}/activate", s.handle(true, s.activate))
+	mux.HandleFunc("DELETE /api/scales/{scale}/calibrations/{version}", s.handle(true, s.deleteVersion))
+	return outer
+}
+
+// pprofRoutes returns the net/http/pprof handlers, for the -pprof listener.
+func pprofRoutes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// runServe implements `calibrate serve`: the REST API over the calibration
+// store for device-management tools without filesystem access. Every flag
+// can also be set as CAL_<FLAG> for containers.
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	storeFlag, storeKey := storeFlags(fs)
+	listen := fs.String("listen", ":8080", "address to listen on")
+	tokensPath := fs.String("tokens", "", "API token file, lines of \"<token> <name> [read-only]\" (default $CAL_API_TOKENS)")
+	auditLog := fs.String("audit-log", "", "append API changes to this audit log (default $CAL_AUDIT_LOG)")
+	trustedKey := fs.String("trusted-key", "", "Ed25519 public key (PEM) verifying the signatures of uploads; signed uploads are refused without it")
+	fitCacheSize := fs.Int("fit-cache", 256, "remember the fits of this many distinct calibrations, so re-uploads skip the solve (0 = off)")
+	rate := fs.Float64("rate", 10, "requests per second allowed per client, by token (or by address without a valid token); 0 = no limit")
+	burst := fs.Int("burst", 20, "requests a client may make at once before -rate applies")
+	maxPending := fs.Int("max-pending", 64, "requests admitted at once; more are rejected with 503 until the queue drains")
+	liveSource := fs.String("live-source", "", "readings for the StreamWeights gRPC stream, one per line: a file or FIFO, or cmd:<command>; {scale} is replaced by the requested scale")
+	drain := fs.Duration("drain-timeout", 30*time.Second, "on SIGTERM/SIGINT, how long to wait for in-flight requests to finish")
+	pprofAddr := fs.String("pprof", "", "serve the Go profiling endpoints (/debug/pprof/) on this separate address, e.g. localhost:6060")
+	logFormat := fs.String("log-format", "text", "text (timestamped lines on stderr), json (one JSON object per line on stdout), syslog or journald (-tags syslog)")
+	_ = fs.Parse(args)
+	if err := envFlags(fs, map[string]string{"tokens": "CAL_API_TOKENS"}); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+	if err := setLogFormat(*logFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+	tel, err := startTelemetry()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+	defer tel.shutdown()
+
+	spec := storeSpec(*storeFlag)
+	if spec == "" {
+		fmt.Fprintln(os.Stderr, "error: no store configured (use -store or CAL_STORE)")
+		return 2
+	}
+	path := *tokensPath
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "error: the API needs a token file (use -tokens or CAL_API_TOKENS)")
+		return 2
+	}
+	if *rate < 0 || *burst < 1 || *maxPending < 1 {
+		fmt.Fprintln(os.Stderr, "error: -rate must be >= 0, -burst and -max-pending >= 1")
+		return 2
+	}
+	tokens, err := loadAPITokens(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading tokens: %v\n", err)
+		return 1
+	}
+	var trusted ed25519.PublicKey
+	if *trustedKey != "" {
+		if trusted, err = LoadPublicKey(*trustedKey); err != nil {
+			fmt.Fprintf(os.Stderr, "error reading trusted key: %v\n", err)
+			return 1
+		}
+	}
+	ctx, stop := shutdownContext()
+	defer stop()
+	srv := &calServer{storeSpec: spec, storeKey: storeKeySpec(*storeKey), tokens: tokens, auditLog: auditPath(*auditLog),
+		fits: newFitCache(*fitCacheSize), limiter: newRateLimiter(*rate, *burst), pending: make(chan struct{}, *maxPending),
+		liveSource: *liveSource, quit: ctx, live: newLiveMetrics(), tel: tel, trusted: trusted}
+	// fail early on a bad store spec or key
+	st, err := OpenStore(srv.storeSpec, srv.storeKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error opening store: %v\n", err)
+		return 1
+	}
+	st.Close()
+
+	// gRPC clients speak HTTP/2 without TLS (h2c) on the same listener
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	servers := []*http.Server{{Addr: *listen, Handler: srv.routes(), ReadHeaderTimeout: 10 * time.Second, Protocols: &protocols}}
+	if *pprofAddr != "" {
+		// unauthenticated, so kept off the API listener
+		servers = append(servers, &http.Server{Addr: *pprofAddr, Handler: pprofRoutes(), ReadHeaderTimeout: 10 * time.Second})
+		log.Printf("serving pprof on %s", *pprofAddr)
+	}
+	log.Printf("serving calibration API for %s on %s (%d tokens)", spec, *listen, len(tokens))
+	errc := make(chan error, len(servers))
+	for _, hs := range servers {
+		go func() {
+			if err := hs.ListenAndServe(); err != http.ErrServerClosed {
+				errc <- fmt.Errorf("%s: %w", hs.Addr, err)
+			}
+		}()
+	}
+	code := 0
+	select {
+	case err := <-errc:
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		code = 1
+	case <-ctx.Done():
+		log.Printf("shutting down: finishing in-flight requests (up to %s)", *drain)
+	}
+	// Shutdown stops accepting connections and waits for the running
+	// handlers, whose store writes complete before they return.
+	dctx, cancel := context.WithTimeout(context.Background(), *drain)
+	defer cancel()
+	for _, hs := range servers {
+		if err := hs.Shutdown(dctx); err != nil {
+			log.Printf("shutdown %s: %v", hs.Addr, err)
+			code = 1
+		}
+	}
+	if code == 0 {
+		log.Printf("stopped cleanly: served %d request(s), %d change(s), rejected %d over the limits", srv.requests.Load(), srv.changes.Load(), srv.limited.Load())
+	}
+	return code
+}
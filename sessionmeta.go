@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// SessionMeta records who performed a calibration session, where, under which
+// ambient conditions and with which reference weight. It travels with the
+// result into -json-out, the store, certificates and audit snapshots.
+type SessionMeta struct {
+	Operator          string   `json:"operator,omitempty"`
+	OperatorID        string   `json:"operator_id,omitempty"`
+	Location          string   `json:"location,omitempty"`
+	TemperatureC      *float64 `json:"temperature_c,omitempty"`
+	HumidityPct       *float64 `json:"humidity_pct,omitempty"`
+	PressureHPa       *float64 `json:"pressure_hpa,omitempty"`
+	ReferenceWeightID string   `json:"reference_weight_id,omitempty"`
+	Notes             string   `json:"notes,omitempty"`
+	// ReferenceWeight is the register entry of the reference weight at the
+	// time of calibration, when the store has a reference-weight register.
+	ReferenceWeight *ReferenceWeight `json:"reference_weight,omitempty"`
+}
+
+// empty reports whether no field besides the operator name is set.
+func (m *SessionMeta) empty() bool {
+	return m.OperatorID == "" && m.Location == "" && m.TemperatureC == nil && m.HumidityPct == nil &&
+		m.PressureHPa == nil && m.ReferenceWeightID == "" && m.Notes == ""
+}
+
+// Ambient formats the ambient conditions that were recorded, e.g.
+// "21.5 °C, 45 %RH" ("" when none were).
+func (m *SessionMeta) Ambient() string {
+	var parts []string
+	if m.TemperatureC != nil {
+		parts = append(parts, fmt.Sprintf("%g °C", *m.TemperatureC))
+	}
+	if m.HumidityPct != nil {
+		parts = append(parts, fmt.Sprintf("%g %%RH", *m.HumidityPct))
+	}
+	if m.PressureHPa != nil {
+		parts = append(parts, fmt.Sprintf("%g hPa", *m.PressureHPa))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Lines returns the recorded fields as "Label: value" pairs in a fixed order.
+func (m *SessionMeta) Lines() [][2]string {
+	var out [][2]string
+	add := func(label, v string) {
+		if v != "" {
+			out = append(out, [2]string{label, v})
+		}
+	}
+	op := m.Operator
+	if m.OperatorID != "" {
+		op = strings.TrimSpace(fmt.Sprintf("%s (ID %s)", m.Operator, m.OperatorID))
+	}
+	add("Operator", op)
+	add("Location", m.Location)
+	add("Ambient", m.Ambient())
+	ref := m.ReferenceWeightID
+	if w := m.ReferenceWeight; w != nil {
+		ref = fmt.Sprintf("%s (%g%s, certificate %s", w.ID, w.Nominal, unitSuffix(w.Units), w.Certificate)
+		if w.CertExpiry != "" {
+			ref += ", valid until " + w.CertExpiry
+		}
+		ref += ")"
+	}
+	add("Reference weight", ref)
+	add("Notes", m.Notes)
+	return out
+}
+
+// floatFlag returns a flag.Func setter storing the parsed value in *dst.
+func floatFlag(dst **float64) func(string) error {
+	return func(s string) error {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		*dst = &v
+		return nil
+	}
+}
+
+// sessionMetaFlags registers the session metadata flags on fs. The operator
+// name comes from the existing -operator flag.
+func sessionMetaFlags(fs *flag.FlagSet) *SessionMeta {
+	m := &SessionMeta{}
+	fs.StringVar(&m.OperatorID, "operator-id", "", "operator ID or badge number recorded with the session")
+	fs.StringVar(&m.Location, "location", "", "where the calibration was performed")
+	fs.Func("ambient-temp", "ambient temperature during calibration, °C", floatFlag(&m.TemperatureC))
+	fs.Func("ambient-humidity", "relative humidity during calibration, %", floatFlag(&m.HumidityPct))
+	fs.Func("ambient-pressure", "air pressure during calibration, hPa", floatFlag(&m.PressureHPa))
+	fs.StringVar(&m.ReferenceWeightID, "ref-weight", "", "ID of the reference weight used")
+	fs.StringVar(&m.Notes, "session-notes", "", "free-text notes recorded with the session")
+	return m
+}
+
+// PromptSessionMeta asks for each metadata field on out and reads the answers
+// from in, one line each; an empty answer keeps the value shown in brackets.
+func PromptSessionMeta(in io.Reader, out io.Writer, m *SessionMeta) error {
+	r := bufio.NewReader(in)
+	ask := func(label, cur string) (string, error) {
+		fmt.Fprintf(out, "%s [%s]: ", label, cur)
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return cur, err
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			return line, nil
+		}
+		return cur, nil
+	}
+	askFloat := func(label string, dst **float64) error {
+		cur := ""
+		if *dst != nil {
+			cur = strconv.FormatFloat(**dst, 'g', -1, 64)
+		}
+		for {
+			s, err := ask(label, cur)
+			if err != nil || s == cur {
+				return err
+			}
+			if err := floatFlag(dst)(s); err == nil {
+				return nil
+			}
+			fmt.Fprintf(out, "  not a number: %q\n", s)
+		}
+	}
+	var err error
+	for _, f := range []struct {
+		label string
+		dst   *string
+	}{
+		{"Operator name", &m.Operator},
+		{"Operator ID", &m.OperatorID},
+		{"Location", &m.Location},
+	} {
+		if *f.dst, err = ask(f.label, *f.dst); err != nil {
+			return err
+		}
+	}
+	for _, f := range []struct {
+		label string
+		dst   **float64
+	}{
+		{"Ambient temperature (°C)", &m.TemperatureC},
+		{"Relative humidity (%)", &m.HumidityPct},
+		{"Air pressure (hPa)", &m.PressureHPa},
+	} {
+		if err := askFloat(f.label, f.dst); err != nil {
+			return err
+		}
+	}
+	if m.ReferenceWeightID, err = ask("Reference weight ID", m.ReferenceWeightID); err != nil {
+		return err
+	}
+	m.Notes, err = ask("Notes", m.Notes)
+	return err
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// shutdownContext returns a context that is cancelled on SIGINT or SIGTERM,
+// for the long-running modes to finish their in-flight work, flush their
+// outputs and exit cleanly. stop restores the default handling, after which
+// a signal kills the process as usual.
+func shutdownContext() (ctx context.Context, stop context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// CalSignature is a detached Ed25519 signature of a calibration, stored next
+// to the file as <file>.sig. The signed message is the calibration's canonical
+// JSON encoding (the same bytes CalibrationChecksum hashes), so a signature
+// stays valid when the calibration is re-serialized into a store or bundle.
+type CalSignature struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"key_id"`
+	Checksum  string `json:"checksum"`
+	Signature string `json:"signature"`
+	SignedAt  string `json:"signed_at"`
+	Signer    string `json:"signer,omitempty"`
+}
+
+func canonicalCalibration(cal CalibrationData) []byte {
+	b, _ := json.Marshal(cal)
+	return b
+}
+
+// keyID returns a short fingerprint of a public key.
+func keyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// SignCalibration signs cal with priv.
+func SignCalibration(cal CalibrationData, priv ed25519.PrivateKey, signer string) CalSignature {
+	return CalSignature{
+		Algorithm: "ed25519",
+		KeyID:     keyID(priv.Public().(ed25519.PublicKey)),
+		Checksum:  CalibrationChecksum(cal),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(priv, canonicalCalibration(cal))),
+		SignedAt:  time.Now().UTC().Format(time.RFC3339),
+		Signer:    signer,
+	}
+}
+
+// VerifyCalibration checks sig against cal and the trusted public key.
+func VerifyCalibration(cal CalibrationData, sig CalSignature, pub ed25519.PublicKey) error {
+	if sig.Algorithm != "ed25519" {
+		return fmt.Errorf("unsupported signature algorithm %q", sig.Algorithm)
+	}
+	if sig.KeyID != keyID(pub) {
+		return fmt.Errorf("signed by key %s, not by the trusted key %s", sig.KeyID, keyID(pub))
+	}
+	raw, err := base64.StdEncoding.DecodeString(sig.Signature)
+	if err != nil {
+		return fmt.Errorf("malformed signature: %w", err)
+	}
+	if !ed25519.Verify(pub, canonicalCalibration(cal), raw) {
+		return errors.New("signature does not match: the calibration was modified after signing")
+	}
+	return nil
+}
+
+// LoadSignature reads a detached signature file.
+func LoadSignature(path string) (CalSignature, error) {
+	var sig CalSignature
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return sig, err
+	}
+	return sig, json.Unmarshal(b, &sig)
+}
+
+// LoadPublicKey reads a PEM "PUBLIC KEY" (PKIX) Ed25519 key.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s: no PEM PUBLIC KEY block", path)
+	}
+	k, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := k.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return pub, nil
+}
+
+// LoadPrivateKey reads a PEM "PRIVATE KEY" (PKCS #8) Ed25519 key.
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: no PEM PRIVATE KEY block", path)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return priv, nil
+}
+
+// loadCalibrationFile reads and parses a calibration file: JSON, or protobuf
+// for *.pb and *.binpb.
+func loadCalibrationFile(path string) (CalibrationData, error) {
+	var cal CalibrationData
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cal, err
+	}
+	return parseCalibration(path, b)
+}
+
+// parseCalibration decodes the calibration file at path read as b.
+func parseCalibration(path string, b []byte) (CalibrationData, error) {
+	if isProtoPath(path) {
+		cal, err := UnmarshalCalibrationProto(b)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", path, err)
+		}
+		return cal, err
+	}
+	var cal CalibrationData
+	return cal, decodeJSON(path, b, &cal)
+}
+
+// runKeygen implements `calibrate keygen`: create an Ed25519 key pair.
+func runKeygen(args []string) int {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := fs.String("out", "calibration-signing", "file name prefix; writes <out>.key (private) and <out>.pub (public)")
+	_ = fs.Parse(args)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error generating key: %v\n", err)
+		return 1
+	}
+	privDER, _ := x509.MarshalPKCS8PrivateKey(priv)
+	pubDER, _ := x509.MarshalPKIXPublicKey(pub)
+	if err := os.WriteFile(*out+".key", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing private key: %v\n", err)
+		return 1
+	}
+	if err := os.WriteFile(*out+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing public key: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Wrote %s.key and %s.pub (key id %s)\n", *out, *out, keyID(pub))
+	return 0
+}
+
+// runSign implements `calibrate sign`: write a detached signature of a calibration file.
+func runSign(args []string) int {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	calPath := fs.String("cal", "calibration.json", "calibration JSON to sign")
+	keyPath := fs.String("key", "", "Ed25519 private key (PEM, from keygen) (required)")
+	signer := fs.String("signer", "", "name of the signing lab or person, recorded in the signature")
+	out := fs.String("o", "", "signature file (default <cal>.sig)")
+	_ = fs.Parse(args)
+
+	if *keyPath == "" {
+		fmt.Fprintln(os.Stderr, "error: -key is required")
+		return 2
+	}
+	priv, err := LoadPrivateKey(*keyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading key: %v\n", err)
+		return 1
+	}
+	cal, err := loadCalibrationFile(*calPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading calibration: %v\n", err)
+		return 1
+	}
+	if *out == "" {
+		*out = *calPath + ".sig"
+	}
+	b, _ := json.MarshalIndent(SignCalibration(cal, priv, *signer), "", "  ")
+	if err := writeFileAtomic(*out, append(b, '\n'), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing signature: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Signed %s -> %s\n", *calPath, *out)
+	return 0
+}
+
+// runVerify implements `calibrate verify`: check a calibration file's signature.
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	calPath := fs.String("cal", "calibration.json", "calibration JSON to verify")
+	pubPath := fs.String("pub", "", "trusted Ed25519 public key (PEM) (default $CAL_TRUSTED_KEY)")
+	sigPath := fs.String("sig", "", "signature file (default <cal>.sig)")
+	_ = fs.Parse(args)
+
+	if *pubPath == "" {
+		*pubPath = os.Getenv("CAL_TRUSTED_KEY")
+	}
+	if *pubPath == "" {
+		fmt.Fprintln(os.Stderr, "error: -pub is required")
+		return 2
+	}
+	if *sigPath == "" {
+		*sigPath = *calPath + ".sig"
+	}
+	if err := verifyCalibrationFile(*calPath, *sigPath, *pubPath); err != nil {
+		fmt.Fprintf(os.Stderr, "INVALID: %v\n", err)
+		return 1
+	}
+	fmt.Printf("OK: %s is signed by the trusted key\n", *calPath)
+	return 0
+}
+
+// verifyCalibrationFile verifies the calibration at calPath against the
+// detached signature at sigPath and the public key at pubPath.
+func verifyCalibrationFile(calPath, sigPath, pubPath string) error {
+	pub, err := LoadPublicKey(pubPath)
+	if err != nil {
+		return err
+	}
+	cal, err := loadCalibrationFile(calPath)
+	if err != nil {
+		return err
+	}
+	sig, err := LoadSignature(sigPath)
+	if err != nil {
+		return fmt.Errorf("no usable signature: %w", err)
+	}
+	return VerifyCalibration(cal, sig, pub)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+)
+
+// Calibration stages. A coarse calibration is a single-point span: the zero
+// and one centered load (on_center), giving the four cells the same factor,
+// W / (sum of the center deltas). It is exact for centered loads and usable
+// at once; the full calibration fits the five placements and replaces it
+// later. A partial calibration refits one replaced cell (see
+// replacecell.go). Calibrations without a stage are full ones.
+const (
+	stageCoarse  = "coarse"
+	stagePartial = "partial"
+	stageFull    = "full"
+)
+
+// defaultCornerTol is the corner error assumed for a coarse calibration of a
+// scale that has never been fully calibrated, in percent.
+const defaultCornerTol = 2.0
+
+// StageInfo records the stage of a calibration and the error expected from
+// it: for a full fit the largest error of the five placements, for a coarse
+// one the error of a load over a corner, estimated from the scale's last full
+// calibration or assumed.
+type StageInfo struct {
+	Stage         string  `json:"stage"`
+	ExpectedError float64 `json:"expected_error_pct"`
+	Basis         string  `json:"basis"`
+}
+
+func (s StageInfo) String() string {
+	return fmt.Sprintf("%s stage, expected error ±%.3g%% (%s)", s.Stage, s.ExpectedError, s.Basis)
+}
+
+// stageOf returns the stage of cal.
+func stageOf(cal CalibrationData) string {
+	if cal.Stage == "" {
+		return stageFull
+	}
+	return cal.Stage
+}
+
+// coarseFactors computes the single-point factors of a coarse calibration.
+func coarseFactors(cal CalibrationData) ([4]float64, error) {
+	var factors [4]float64
+	sum := 0.0
+	for ch := range cal.Zero {
+		sum += cal.OnCenter[ch] - cal.Zero[ch]
+	}
+	if sum == 0 {
+		return factors, errors.New("coarse calibration: the center load does not move the channels")
+	}
+	for ch := range factors {
+		factors[ch] = cal.CalibrationWeight / sum
+	}
+	return factors, nil
+}
+
+// fullStage is the stage of a full fit: the largest row error relative to
+// the calibration weight.
+func fullStage(cal CalibrationData, factors [4]float64) StageInfo {
+	s := StageInfo{Stage: stageFull, Basis: "largest error of the five placements"}
+	if w := cal.CalibrationWeight; w != 0 {
+		for _, row := range calRows(cal) {
+			s.ExpectedError = math.Max(s.ExpectedError, 100*math.Abs(w-ComputeWeight(row, cal.Zero, factors))/math.Abs(w))
+		}
+	}
+	return s
+}
+
+// coarseStage is the stage of a coarse calibration. With the factors g of a
+// full calibration of the same scale, a load over corner i reads f/g_i of the
+// true weight, so the expected error is the largest |f/g_i - 1|; without one,
+// cornerTol is assumed.
+func coarseStage(factors [4]float64, full *Session, cornerTol float64) StageInfo {
+	s := StageInfo{Stage: stageCoarse, ExpectedError: cornerTol,
+		Basis: "assumed corner error; centered loads are exact"}
+	if full == nil {
+		return s
+	}
+	s.ExpectedError = 0
+	for ch, g := range full.Result.Factors {
+		if g != 0 {
+			s.ExpectedError = math.Max(s.ExpectedError, 100*math.Abs(factors[ch]/g-1))
+		}
+	}
+	s.Basis = fmt.Sprintf("corner loads, from the factors of full calibration v%d; centered loads are exact", full.Version)
+	return s
+}
+
+// lastFullSession returns the newest full calibration among sessions, or nil.
+func lastFullSession(sessions []Session) *Session {
+	for i := len(sessions) - 1; i >= 0; i-- {
+		if stageOf(sessions[i].Calibration) == stageFull {
+			return &sessions[i]
+		}
+	}
+	return nil
+}
+
+// runCoarse implements `calibrate coarse`: a single-point span calibration
+// from the zero and one centered load, recorded as the scale's active
+// (provisional) version until the full calibration replaces it.
+func runCoarse(args []string) int {
+	fs := flag.NewFlagSet("coarse", flag.ExitOnError)
+	storeFlag, storeKey := storeFlags(fs)
+	scale := fs.String("scale", "", "scale to calibrate (required with a store)")
+	weight := fs.Float64("weight", 0, "the known weight placed at the center (required)")
+	units := fs.String("units", "", "weight unit, e.g. kg")
+	zeroADC := fs.String("zero", "", "reading of the empty platform, as comma-separated ADC counts")
+	zeroSrc := fs.String("zero-source", "", "readings of the empty platform: capture file or cmd:<command>; several readings are averaged")
+	spanADC := fs.String("span", "", "reading with -weight at the center, as comma-separated ADC counts")
+	spanSrc := fs.String("span-source", "", "readings with -weight at the center: capture file or cmd:<command>")
+	cornerTol := fs.Float64("corner-tol", defaultCornerTol, "corner error in percent to assume when the scale has no full calibration yet")
+	out := fs.String("o", "", "also write the coarse calibration file here")
+	operator := fs.String("operator", "", "operator name for the audit log (default $CAL_OPERATOR, then the login name)")
+	auditLog := fs.String("audit-log", "", "append the calibration to this audit log (default $CAL_AUDIT_LOG)")
+	_ = fs.Parse(args)
+
+	if *weight <= 0 || math.IsInf(*weight, 0) {
+		fmt.Fprintln(os.Stderr, "error: -weight must be > 0")
+		return 2
+	}
+	spec := storeSpec(*storeFlag)
+	if spec == "" && *out == "" {
+		fmt.Fprintln(os.Stderr, "error: give a store (-store or CAL_STORE) and -scale, or -o")
+		return 2
+	}
+	if spec != "" && *scale == "" {
+		fmt.Fprintln(os.Stderr, "error: -scale is required")
+		return 2
+	}
+	zero, zeroFrom, err := capturedReading("zero", *zeroADC, *zeroSrc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+	center, spanFrom, err := capturedReading("span", *spanADC, *spanSrc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+	cal := CalibrationData{Stage: stageCoarse, CalibrationWeight: *weight, Units: *units, Zero: zero, OnCenter: center,
+		CalibratedAt: nowUTC().Format("2006-01-02")}
+	res, err := FitCalibration(cal, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+
+	var full *Session
+	var st Store
+	if spec != "" {
+		if st = openStoreOrExit(*storeFlag, *storeKey); st == nil {
+			return 1
+		}
+		defer st.Close()
+		sessions, err := st.Sessions(*scale)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading sessions: %v\n", err)
+			return 1
+		}
+		full = lastFullSession(sessions)
+	}
+	stage := coarseStage(res.Factors, full, *cornerTol)
+	res.Stage = &stage
+
+	fmt.Printf("Coarse calibration: W = %g%s, zero %s (%s), span %s (%s)\n", *weight, unitSuffix(*units),
+		formatVector(zero), zeroFrom, formatVector(center), spanFrom)
+	fmt.Printf("  provisional factor f = %s for all four cells\n", formatFixed(res.Factors[0], 10))
+	fmt.Printf("  %s\n", stage)
+	if *out != "" {
+		doc, _ := json.MarshalIndent(cal, "", "  ")
+		if err := writeFileAtomic(*out, append(doc, '\n'), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Wrote %s\n", *out)
+	}
+	if st == nil {
+		return 0
+	}
+	before, _ := ActiveSession(st, *scale)
+	source := "coarse: zero " + zeroFrom + ", span " + spanFrom
+	sess := &Session{Scale: *scale, Time: nowUTC(), Source: source, Calibration: cal, Result: res}
+	_, version, err := RecordSession(st, sess)
+	if err == nil {
+		after, _ := ActiveSession(st, *scale)
+		err = AppendAudit(auditPath(*auditLog), "calibrate", operatorName(*operator), *scale,
+			fmt.Sprintf("coarse calibration as v%d", version), auditSnapshot(before), auditSnapshot(after))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error writing store: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Recorded scale %s v%d (active, provisional); run the full calibration with -store and -scale %s to replace it\n", *scale, version, *scale)
+	return 0
+}
+
+// capturedReading returns the reading given as a list or the mean of a source,
+// and where it came from.
+func capturedReading(what, list, source string) ([4]float64, string, error) {
+	switch {
+	case list != "" && source != "":
+		return [4]float64{}, "", fmt.Errorf("give either -%s or -%s-source, not both", what, what)
+	case list != "":
+		adc, err := parseADCList(list)
+		if err != nil {
+			return adc, "", fmt.Errorf("-%s: %w", what, err)
+		}
+		return adc, "-" + what, nil
+	case source != "":
+		readings, err := ReadReadingsSource(source)
+		if err != nil {
+			return [4]float64{}, "", err
+		}
+		if len(readings) == 0 {
+			return [4]float64{}, "", fmt.Errorf("-%s-source: no readings", what)
+		}
+		var mean [4]float64
+		for i, r := range readings {
+			if err := checkReadingFinite(r); err != nil {
+				return mean, "", fmt.Errorf("-%s-source: reading %d: %w", what, i+1, err)
+			}
+			for ch := range mean {
+				mean[ch] += r[ch] / float64(len(readings))
+			}
+		}
+		return mean, fmt.Sprintf("%s, %d readings", source, len(readings)), nil
+	}
+	return [4]float64{}, "", fmt.Errorf("give the %s reading with -%s or -%s-source", what, what, what)
+}
+
+// validStages lists the values of the calibration's "stage".
+var validStages = []string{"", stageCoarse, stagePartial, stageFull}
+
+// checkStage validates the stage of cal: a partial calibration names the
+// replaced cell, and only a partial one does.
+func checkStage(cal CalibrationData) error {
+	switch {
+	case !slices.Contains(validStages, cal.Stage):
+		return fmt.Errorf("unknown stage %q (%s, %s or %s)", cal.Stage, stageCoarse, stagePartial, stageFull)
+	case cal.Stage == stagePartial && cal.Replacement == nil:
+		return errors.New("a partial calibration needs cell_replacement")
+	case cal.Stage == stagePartial && (cal.Replacement.Cell < 0 || cal.Replacement.Cell > 3):
+		return fmt.Errorf("cell_replacement.cell %d is not a channel (0-3)", cal.Replacement.Cell)
+	case cal.Stage != stagePartial && cal.Replacement != nil:
+		return errors.New("cell_replacement needs \"stage\": \"partial\"")
+	}
+	return nil
+}
+
+// stageSkipped notes an analysis a coarse or partial calibration has no
+// data for.
+func stageSkipped(cal CalibrationData, what string) string {
+	return stageOf(cal) + " calibration: no " + what + " (needs the full calibration)"
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Session is one recorded calibration version of a scale: the calibration
+// input and the factors and diagnostics computed from it. Versions count up
+// from 1 per scale; Checksum is the SHA-256 of the calibration input.
+// Per-reading results are not kept.
+type Session struct {
+	ID          int64             `json:"id"`
+	Scale       string            `json:"scale"`
+	Version     int               `json:"version"`
+	Checksum    string            `json:"checksum"`
+	Time        time.Time         `json:"time"`
+	Source      string            `json:"source"`
+	Calibration CalibrationData   `json:"calibration"`
+	Result      CalibrationResult `json:"result"`
+	Signature   *CalSignature     `json:"signature,omitempty"`
+	// Sealed holds the encrypted calibration, result and signature when the
+	// store is encrypted; it is only ever non-empty inside a backend.
+	Sealed string `json:"sealed,omitempty"`
+}
+
+// BatchSummary summarizes one apply run against a recorded session.
+type BatchSummary struct {
+	ID            int64     `json:"id"`
+	SessionID     int64     `json:"session_id"`
+	Scale         string    `json:"scale"`
+	Time          time.Time `json:"time"`
+	Readings      int       `json:"readings"`
+	Valid         int       `json:"valid"`
+	Invalid       int       `json:"invalid"`
+	MeanWeight    float64   `json:"mean_weight"`
+	MinWeight     float64   `json:"min_weight"`
+	MaxWeight     float64   `json:"max_weight"`
+	Accepted      int       `json:"accepted"`
+	AcceptedTotal float64   `json:"accepted_total"`
+}
+
+// CheckRecord is a routine verification (verify-span, verify-zero) of a scale
+// against the calibration version it was made with. Readings is the number of
+// readings averaged and Source where they came from. A zero check also keeps
+// each channel's drift from the calibration zero, in counts.
+type CheckRecord struct {
+	ID int64 `json:"id"`
+	CheckResult
+	SessionID int64       `json:"session_id,omitempty"`
+	Operator  string      `json:"operator,omitempty"`
+	Source    string      `json:"source,omitempty"`
+	Readings  int         `json:"readings"`
+	Drift     *[4]float64 `json:"channel_drift,omitempty"`
+	// DriftTol is the per-channel drift limit in counts, when one was set.
+	DriftTol float64 `json:"channel_drift_tol,omitempty"`
+}
+
+// Store persists calibration sessions, applied-batch summaries, verification
+// checks and the scale registry. Sessions and Batches return records of one scale (all scales when
+// scale is "") ordered by ID, which is also chronological. Sessions are
+// append-only; the active pointer names the version of each scale that apply
+// modes use (0 when none is set). DeleteSession removes one version (returning
+// errNoSession when it does not exist); batch summaries recorded against it
+// are kept. Neither its ID nor its version number is given out again:
+// LastVersion returns the highest version ever saved for a scale, deleted ones
+// included. DeleteBatches removes the batch summaries recorded before the
+// given time and returns how many it removed. SaveCheck and Checks append and
+// list verification checks like batches. SaveScale inserts or replaces a registry
+// entry by ID; Scales returns the registry ordered by ID. SaveRefWeight and
+// RefWeights do the same for the reference-weight register, SaveProduct and
+// Products for the product catalog.
+type Store interface {
+	SaveSession(s *Session) error
+	Sessions(scale string) ([]Session, error)
+	DeleteSession(scale string, version int) error
+	LastVersion(scale string) (int, error)
+	SaveBatch(b *BatchSummary) error
+	Batches(scale string) ([]BatchSummary, error)
+	DeleteBatches(before time.Time) (int, error)
+	SaveCheck(c *CheckRecord) error
+	Checks(scale string) ([]CheckRecord, error)
+	SetActive(scale string, version int) error
+	Active(scale string) (int, error)
+	SaveScale(sc *ScaleInfo) error
+	Scales() ([]ScaleInfo, error)
+	SaveRefWeight(w *ReferenceWeight) error
+	RefWeights() ([]ReferenceWeight, error)
+	SaveProduct(p *Product) error
+	Products() ([]Product, error)
+	Close() error
+}
+
+// errNoSession is returned by DeleteSession for an unknown version.
+var errNoSession = errors.New("no such calibration version")
+
+// storeBackends maps a backend name to its opener. Backends that need
+// third-party drivers add themselves from files behind build tags.
+var storeBackends = map[string]func(path string) (Store, error){
+	"json": openJSONStore,
+}
+
+// OpenStore opens a store from a "backend:path" spec such as
+// "json:calstore.json" or "sqlite:cal.db". A spec without a backend prefix is
+// a path for the json backend. keySpec, when not empty, names the key that
+// encrypts calibrations at rest (see LoadStoreKey).
+func OpenStore(spec, keySpec string) (Store, error) {
+	st, err := openBackend(spec)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := withEncryption(st, keySpec)
+	if err != nil {
+		st.Close()
+		return nil, fmt.Errorf("store key: %w", err)
+	}
+	return sealed, nil
+}
+
+// openBackend opens the backend named by spec without the encryption layer,
+// so sealed sessions are returned as stored.
+func openBackend(spec string) (Store, error) {
+	backend, path := "json", spec
+	if i := strings.IndexByte(spec, ':'); i > 0 {
+		backend, path = spec[:i], spec[i+1:]
+	}
+	open, ok := storeBackends[backend]
+	if !ok {
+		var names []string
+		for n := range storeBackends {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("store backend %q is not available in this build (have %s)", backend, strings.Join(names, ", "))
+	}
+	if path == "" {
+		return nil, fmt.Errorf("store spec %q has no path", spec)
+	}
+	return open(path)
+}
+
+// storeFlags registers the -store and -store-key flags shared by the commands
+// that open the calibration store.
+func storeFlags(fs *flag.FlagSet) (spec, key *string) {
+	spec = fs.String("store", "", "calibration store, e.g. json:calstore.json, sqlite:cal.db or bolt:cal.bolt (default $CAL_STORE)")
+	key = fs.String("store-key", "", "AES-256 key file, or cmd:<kms helper>, encrypting calibrations at rest (default $CAL_STORE_KEY)")
+	return spec, key
+}
+
+// storeSpec returns the -store flag value, falling back to $CAL_STORE.
+func storeSpec(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	return os.Getenv("CAL_STORE")
+}
+
+// RecordSession stores s as the next version of its scale, unless a version
+// with the same calibration checksum exists, in which case that version is
+// reused. Either way the version becomes the active one. It returns the
+// session ID and version the run belongs to.
+func RecordSession(st Store, s *Session) (int64, int, error) {
+	prev, err := st.Sessions(s.Scale)
+	if err != nil {
+		return 0, 0, err
+	}
+	s.Checksum = CalibrationChecksum(s.Calibration)
+	id, version := int64(0), 0
+	for _, p := range prev {
+		if p.Checksum == s.Checksum {
+			id, version = p.ID, p.Version
+		}
+	}
+	if id == 0 {
+		last, err := st.LastVersion(s.Scale)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, p := range prev {
+			last = max(last, p.Version)
+		}
+		s.Version = last + 1
+		if err := st.SaveSession(s); err != nil {
+			return 0, 0, err
+		}
+		id, version = s.ID, s.Version
+	}
+	if err := st.SetActive(s.Scale, version); err != nil {
+		return 0, 0, err
+	}
+	return id, version, nil
+}
+
+// ActiveSession returns the active version of scale, or nil when none is set.
+func ActiveSession(st Store, scale string) (*Session, error) {
+	version, err := st.Active(scale)
+	if err != nil || version == 0 {
+		return nil, err
+	}
+	sessions, err := st.Sessions(scale)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		if sessions[i].Version == version {
+			return &sessions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("active version %d of scale %q not found", version, scale)
+}
+
+// CalibrationChecksum returns the hex SHA-256 of the calibration's canonical
+// JSON encoding (struct field order).
+func CalibrationChecksum(cal CalibrationData) string {
+	b, _ := json.Marshal(cal)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// batchTally builds the batch summary of an apply run one reading at a time,
+// so a streamed run needs no list of its results.
+type batchTally struct {
+	b   BatchSummary
+	sum float64
+}
+
+func (t *batchTally) add(rr ReadingResult) {
+	b := &t.b
+	b.Readings++
+	if !rr.Valid {
+		b.Invalid++
+		return
+	}
+	if b.Valid == 0 || rr.Weight < b.MinWeight {
+		b.MinWeight = rr.Weight
+	}
+	if b.Valid == 0 || rr.Weight > b.MaxWeight {
+		b.MaxWeight = rr.Weight
+	}
+	b.Valid++
+	t.sum += rr.Weight
+}
+
+// summary returns the batch summary of the readings added so far.
+func (t *batchTally) summary(tot *TotalizerSummary) BatchSummary {
+	b := t.b
+	if b.Valid > 0 {
+		b.MeanWeight = t.sum / float64(b.Valid)
+	}
+	if tot != nil {
+		b.Accepted = len(tot.Accepted)
+		b.AcceptedTotal = tot.RunTotal
+	}
+	return b
+}
@@ -0,0 +1,299 @@
+//go:build bolt || full
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func init() {
+	storeBackends["bolt"] = openBoltStore
+}
+
+var (
+	boltSessions = []byte("sessions")
+	boltVersions = []byte("session_versions")
+	boltBatches  = []byte("batches")
+	boltChecks   = []byte("checks")
+	boltActive   = []byte("active")
+	boltScales   = []byte("scales")
+	boltWeights  = []byte("ref_weights")
+	boltProducts = []byte("products")
+)
+
+// boltStore keeps sessions, batches and checks as JSON values in bbolt buckets,
+// keyed by big-endian IDs so cursor order is ID order; registry entries and
+// reference weights are keyed by their IDs, the highest version saved of each
+// scale by the scale. A single file with copy-on-write pages suits
+// read-mostly flash storage.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (Store, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltSessions, boltVersions, boltBatches, boltChecks, boltActive, boltScales, boltWeights, boltProducts} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func boltKey(id int64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(id))
+	return k
+}
+
+// put assigns the bucket's next sequence number through setID and stores v under it.
+func (s *boltStore) put(bucket []byte, setID func(int64), v any) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		setID(int64(seq))
+		val, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return b.Put(boltKey(int64(seq)), val)
+	})
+}
+
+// each decodes every value of bucket in key order, calling fn with each raw value.
+func (s *boltStore) each(bucket []byte, fn func(v []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(_, v []byte) error { return fn(v) })
+	})
+}
+
+func (s *boltStore) SaveSession(sess *Session) error {
+	if err := s.put(boltSessions, func(id int64) { sess.ID = id }, sess); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltVersions)
+		if v := b.Get([]byte(sess.Scale)); v != nil && int(binary.BigEndian.Uint64(v)) >= sess.Version {
+			return nil
+		}
+		return b.Put([]byte(sess.Scale), boltKey(int64(sess.Version)))
+	})
+}
+
+// LastVersion also reads the sessions, for versions saved before the
+// session_versions bucket existed.
+func (s *boltStore) LastVersion(scale string) (int, error) {
+	last := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltVersions).Get([]byte(scale)); v != nil {
+			last = int(binary.BigEndian.Uint64(v))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	sessions, err := s.Sessions(scale)
+	for _, sess := range sessions {
+		last = max(last, sess.Version)
+	}
+	return last, err
+}
+
+func (s *boltStore) Sessions(scale string) ([]Session, error) {
+	var out []Session
+	err := s.each(boltSessions, func(v []byte) error {
+		var sess Session
+		if err := json.Unmarshal(v, &sess); err != nil {
+			return err
+		}
+		if scale == "" || sess.Scale == scale {
+			out = append(out, sess)
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (s *boltStore) DeleteSession(scale string, version int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltSessions).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var sess Session
+			if err := json.Unmarshal(v, &sess); err != nil {
+				return err
+			}
+			if sess.Scale == scale && sess.Version == version {
+				return c.Delete()
+			}
+		}
+		return errNoSession
+	})
+}
+
+func (s *boltStore) SaveBatch(b *BatchSummary) error {
+	return s.put(boltBatches, func(id int64) { b.ID = id }, b)
+}
+
+func (s *boltStore) Batches(scale string) ([]BatchSummary, error) {
+	var out []BatchSummary
+	err := s.each(boltBatches, func(v []byte) error {
+		var b BatchSummary
+		if err := json.Unmarshal(v, &b); err != nil {
+			return err
+		}
+		if scale == "" || b.Scale == scale {
+			out = append(out, b)
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (s *boltStore) DeleteBatches(before time.Time) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBatches).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var b BatchSummary
+			if err := json.Unmarshal(v, &b); err != nil {
+				return err
+			}
+			if b.Time.Before(before) {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+				n++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *boltStore) SaveCheck(c *CheckRecord) error {
+	return s.put(boltChecks, func(id int64) { c.ID = id }, c)
+}
+
+func (s *boltStore) Checks(scale string) ([]CheckRecord, error) {
+	var out []CheckRecord
+	err := s.each(boltChecks, func(v []byte) error {
+		var c CheckRecord
+		if err := json.Unmarshal(v, &c); err != nil {
+			return err
+		}
+		if scale == "" || c.Scale == scale {
+			out = append(out, c)
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (s *boltStore) SetActive(scale string, version int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltActive).Put([]byte(scale), boltKey(int64(version)))
+	})
+}
+
+func (s *boltStore) Active(scale string) (int, error) {
+	var version int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltActive).Get([]byte(scale)); len(v) == 8 {
+			version = int(binary.BigEndian.Uint64(v))
+		}
+		return nil
+	})
+	return version, err
+}
+
+func (s *boltStore) SaveScale(sc *ScaleInfo) error {
+	val, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltScales).Put([]byte(sc.ID), val)
+	})
+}
+
+func (s *boltStore) Scales() ([]ScaleInfo, error) {
+	var out []ScaleInfo
+	err := s.each(boltScales, func(v []byte) error {
+		var sc ScaleInfo
+		if err := json.Unmarshal(v, &sc); err != nil {
+			return err
+		}
+		out = append(out, sc)
+		return nil
+	})
+	return out, err
+}
+
+func (s *boltStore) SaveRefWeight(w *ReferenceWeight) error {
+	val, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltWeights).Put([]byte(w.ID), val)
+	})
+}
+
+func (s *boltStore) RefWeights() ([]ReferenceWeight, error) {
+	var out []ReferenceWeight
+	err := s.each(boltWeights, func(v []byte) error {
+		var w ReferenceWeight
+		if err := json.Unmarshal(v, &w); err != nil {
+			return err
+		}
+		out = append(out, w)
+		return nil
+	})
+	return out, err
+}
+
+func (s *boltStore) SaveProduct(p *Product) error {
+	val, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltProducts).Put([]byte(p.ID), val)
+	})
+}
+
+func (s *boltStore) Products() ([]Product, error) {
+	var out []Product
+	err := s.each(boltProducts, func(v []byte) error {
+		var p Product
+		if err := json.Unmarshal(v, &p); err != nil {
+			return err
+		}
+		out = append(out, p)
+		return nil
+	})
+	return out, err
+}
+
+func (s *boltStore) Close() error { return s.db.Close() }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// sealedStore encrypts the calibration, result and signature of every session
+// with AES-256-GCM before handing it to the backend, so calibration constants
+// are protected at rest. The scale, version and checksum stay in clear text
+// (and are bound to the ciphertext as additional data) so listings and
+// version bookkeeping keep working. Without a key it still refuses to return
+// sealed sessions instead of handing out empty calibrations.
+type sealedStore struct {
+	Store
+	aead cipher.AEAD
+}
+
+type sealedPayload struct {
+	Calibration CalibrationData   `json:"calibration"`
+	Result      CalibrationResult `json:"result"`
+	Signature   *CalSignature     `json:"signature,omitempty"`
+}
+
+func sealedAAD(s *Session) []byte {
+	return []byte(fmt.Sprintf("%s/%d/%s", s.Scale, s.Version, s.Checksum))
+}
+
+func (s *sealedStore) SaveSession(sess *Session) error {
+	// a session sealed elsewhere (a sync pull) is stored as it came
+	if s.aead == nil || sess.Sealed != "" {
+		return s.Store.SaveSession(sess)
+	}
+	plain, err := json.Marshal(sealedPayload{sess.Calibration, sess.Result, sess.Signature})
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	c := *sess
+	c.Calibration, c.Result, c.Signature = CalibrationData{}, CalibrationResult{}, nil
+	c.Sealed = base64.StdEncoding.EncodeToString(s.aead.Seal(nonce, nonce, plain, sealedAAD(sess)))
+	err = s.Store.SaveSession(&c)
+	sess.ID = c.ID
+	return err
+}
+
+func (s *sealedStore) Sessions(scale string) ([]Session, error) {
+	sessions, err := s.Store.Sessions(scale)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		sess := &sessions[i]
+		if sess.Sealed == "" {
+			continue
+		}
+		if s.aead == nil {
+			return nil, errors.New("the store holds encrypted calibrations; provide the key with -store-key or CAL_STORE_KEY")
+		}
+		raw, err := base64.StdEncoding.DecodeString(sess.Sealed)
+		if err != nil || len(raw) < s.aead.NonceSize() {
+			return nil, fmt.Errorf("session #%d: malformed ciphertext", sess.ID)
+		}
+		n := s.aead.NonceSize()
+		plain, err := s.aead.Open(nil, raw[:n], raw[n:], sealedAAD(sess))
+		if err != nil {
+			return nil, fmt.Errorf("session #%d: cannot decrypt (wrong key or tampered record)", sess.ID)
+		}
+		var p sealedPayload
+		if err := json.Unmarshal(plain, &p); err != nil {
+			return nil, fmt.Errorf("session #%d: %w", sess.ID, err)
+		}
+		sess.Calibration, sess.Result, sess.Signature, sess.Sealed = p.Calibration, p.Result, p.Signature, ""
+	}
+	return sessions, nil
+}
+
+// storeKeySpec returns the -store-key flag value, falling back to $CAL_STORE_KEY.
+func storeKeySpec(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	return os.Getenv("CAL_STORE_KEY")
+}
+
+// LoadStoreKey resolves a key spec to a 32-byte AES-256 key. The spec is a
+// key file path, or "cmd:<command>" to run a KMS helper that prints the key on
+// stdout. The key material may be 32 raw bytes, 64 hex digits or base64.
+func LoadStoreKey(spec string) ([]byte, error) {
+	var material []byte
+	if cmdline, ok := strings.CutPrefix(spec, "cmd:"); ok {
+		args := strings.Fields(cmdline)
+		if len(args) == 0 {
+			return nil, errors.New("empty key command")
+		}
+		out, err := exec.Command(args[0], args[1:]...).Output()
+		if err != nil {
+			return nil, fmt.Errorf("key command failed: %w", err)
+		}
+		material = out
+	} else {
+		b, err := os.ReadFile(spec)
+		if err != nil {
+			return nil, err
+		}
+		material = b
+	}
+	if len(material) == 32 {
+		return material, nil
+	}
+	text := strings.TrimSpace(string(material))
+	if k, err := hex.DecodeString(text); err == nil && len(k) == 32 {
+		return k, nil
+	}
+	if k, err := base64.StdEncoding.DecodeString(text); err == nil && len(k) == 32 {
+		return k, nil
+	}
+	return nil, errors.New("store key must be 32 raw bytes, 64 hex digits or base64 of 32 bytes")
+}
+
+// withEncryption wraps st so sessions are sealed with the key named by keySpec
+// (no encryption when keySpec is empty).
+func withEncryption(st Store, keySpec string) (Store, error) {
+	s := &sealedStore{Store: st}
+	if keySpec == "" {
+		return s, nil
+	}
+	key, err := LoadStoreKey(keySpec)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if s.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
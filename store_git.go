@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	storeBackends["git"] = openGitStore
+}
+
+// gitStore keeps every record as a JSON file in a local git repository and
+// commits each change, so the history, diffs and replication of git come for
+// free. Layout:
+//
+//	sessions/<scale>/v<version>.json   one file per calibration version
+//	batches/<id>.json                  applied-batch summaries
+//	checks/<id>.json                   verification checks
+//	registry/<scale>.json              scale registry entries
+//	refweights/<id>.json               reference weights
+//	products/<id>.json                 product catalog
+//	active.json                        active version per scale
+//
+// New calibration versions are tagged <scale>/v<version>, the scale escaped
+// as in the path; a version whose tag git refuses is not recorded. Tags stay
+// when a version is deleted, and so do the session IDs in the history, so
+// neither is given out again. When $CAL_GIT_REMOTE names a remote, every
+// commit is pushed there (with tags); push failures are reported but do not
+// fail the write. The repository is created on first use and locked
+// (.git/calibrate.lock) from open to Close. It needs the git command; no Go dependencies.
+type gitStore struct {
+	dir    string
+	remote string
+	ident  []string
+	unlock func()
+}
+
+func openGitStore(path string) (Store, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, errors.New("git backend needs the git command")
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	s := &gitStore{dir: path, remote: os.Getenv("CAL_GIT_REMOTE")}
+	if _, err := os.Stat(filepath.Join(path, ".git")); errors.Is(err, os.ErrNotExist) {
+		if _, err := s.git("init", "-q"); err != nil {
+			return nil, err
+		}
+	}
+	unlock, err := lockFile(filepath.Join(path, ".git", "calibrate"))
+	if err != nil {
+		return nil, err
+	}
+	s.unlock = unlock
+	if name, _ := s.git("config", "user.name"); strings.TrimSpace(name) == "" {
+		s.ident = []string{"-c", "user.name=" + operatorName(""), "-c", "user.email=calibrate@localhost"}
+	}
+	return s, nil
+}
+
+func (s *gitStore) git(args ...string) (string, error) {
+	cmd := exec.Command("git", append(s.ident, args...)...)
+	cmd.Dir = s.dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// commit writes v as JSON to the repository path rel and commits it with msg,
+// tagging the commit when tag is not empty. A tag that cannot be created
+// undoes the commit, so the record is not there without its tag.
+func (s *gitStore) commit(rel string, v any, msg, tag string) error {
+	if tag != "" {
+		if _, err := s.git("check-ref-format", "refs/tags/"+tag); err != nil {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	full := filepath.Join(s.dir, rel)
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(full, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	if _, err := s.git("add", "--", rel); err != nil {
+		return err
+	}
+	if _, err := s.git("commit", "-q", "-m", msg, "--", rel); err != nil {
+		return err
+	}
+	if tag != "" {
+		if _, err := s.git("tag", "-a", "-m", msg, tag); err != nil {
+			s.undoCommit(rel)
+			return err
+		}
+	}
+	s.push()
+	return nil
+}
+
+// undoCommit drops the last commit, which added or changed rel only.
+func (s *gitStore) undoCommit(rel string) {
+	var err error
+	if _, perr := s.git("rev-parse", "-q", "--verify", "HEAD~1"); perr == nil {
+		_, err = s.git("reset", "-q", "--hard", "HEAD~1")
+	} else if _, err = s.git("update-ref", "-d", "HEAD"); err == nil {
+		// the first commit: nothing to reset to
+		if _, err = s.git("rm", "-q", "--cached", "--", rel); err == nil {
+			err = os.Remove(filepath.Join(s.dir, rel))
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: undoing the commit of %s: %v\n", rel, err)
+	}
+}
+
+// gitVersionTag is the tag of a calibration version. The scale is escaped as
+// in the session paths.
+func gitVersionTag(scale string, version int) string {
+	return fmt.Sprintf("%s/v%d", url.PathEscape(scale), version)
+}
+
+// globEscape quotes the pattern metacharacters of filepath.Match in s.
+func globEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`).Replace(s)
+}
+
+// push replicates HEAD and tags to $CAL_GIT_REMOTE when it is set.
+func (s *gitStore) push() {
+	if s.remote == "" {
+		return
+	}
+	if _, err := s.git("push", "-q", "--follow-tags", s.remote, "HEAD"); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+}
+
+// readAll decodes every JSON file matching pattern (relative to the repository) into out.
+func readAll[T any](dir, pattern string) ([]T, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		return nil, err
+	}
+	var out []T
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		var v T
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func (s *gitStore) SaveSession(sess *Session) error {
+	all, err := readAll[Session](s.dir, "sessions/*/*.json")
+	if err != nil {
+		return err
+	}
+	sess.ID, err = s.lastSessionID()
+	if err != nil {
+		return err
+	}
+	for _, p := range all {
+		sess.ID = max(sess.ID, p.ID)
+	}
+	sess.ID++
+	rel := fmt.Sprintf("sessions/%s/v%d.json", url.PathEscape(sess.Scale), sess.Version)
+	msg := fmt.Sprintf("Calibrate %s v%d (sha256 %.12s)\n\nSource: %s\nSession: #%d", sess.Scale, sess.Version, sess.Checksum, sess.Source, sess.ID)
+	return s.commit(rel, sess, msg, gitVersionTag(sess.Scale, sess.Version))
+}
+
+// gitSessionID matches the session line of a calibration commit message.
+var gitSessionID = regexp.MustCompile(`(?m)^Session: #(\d+)$`)
+
+// lastSessionID returns the highest session ID in the history of sessions/,
+// deleted sessions included.
+func (s *gitStore) lastSessionID() (int64, error) {
+	if _, err := s.git("rev-parse", "-q", "--verify", "HEAD"); err != nil {
+		return 0, nil // no commits yet
+	}
+	out, err := s.git("log", "--format=%B", "--", "sessions")
+	if err != nil {
+		return 0, err
+	}
+	var last int64
+	for _, m := range gitSessionID.FindAllStringSubmatch(out, -1) {
+		if id, err := strconv.ParseInt(m[1], 10, 64); err == nil {
+			last = max(last, id)
+		}
+	}
+	return last, nil
+}
+
+// LastVersion reads the version tags, which outlive deleted versions.
+func (s *gitStore) LastVersion(scale string) (int, error) {
+	out, err := s.git("tag", "-l")
+	if err != nil {
+		return 0, err
+	}
+	last := 0
+	for _, tag := range strings.Fields(out) {
+		if v, ok := strings.CutPrefix(tag, url.PathEscape(scale)+"/v"); ok {
+			if n, err := strconv.Atoi(v); err == nil {
+				last = max(last, n)
+			}
+		}
+	}
+	sessions, err := s.Sessions(scale)
+	for _, sess := range sessions {
+		last = max(last, sess.Version)
+	}
+	return last, err
+}
+
+func (s *gitStore) Sessions(scale string) ([]Session, error) {
+	pattern := "sessions/*/*.json"
+	if scale != "" {
+		pattern = "sessions/" + globEscape(url.PathEscape(scale)) + "/*.json"
+	}
+	out, err := readAll[Session](s.dir, pattern)
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, err
+}
+
+func (s *gitStore) DeleteSession(scale string, version int) error {
+	rel := fmt.Sprintf("sessions/%s/v%d.json", url.PathEscape(scale), version)
+	if _, err := os.Stat(filepath.Join(s.dir, rel)); errors.Is(err, os.ErrNotExist) {
+		return errNoSession
+	}
+	if _, err := s.git("rm", "-q", "--", rel); err != nil {
+		return err
+	}
+	if _, err := s.git("commit", "-q", "-m", fmt.Sprintf("Delete %s v%d", scale, version)); err != nil {
+		return err
+	}
+	s.push()
+	return nil
+}
+
+func (s *gitStore) SaveBatch(b *BatchSummary) error {
+	all, err := readAll[BatchSummary](s.dir, "batches/*.json")
+	if err != nil {
+		return err
+	}
+	b.ID = 1
+	for _, p := range all {
+		if p.ID >= b.ID {
+			b.ID = p.ID + 1
+		}
+	}
+	msg := fmt.Sprintf("Record batch #%d for %s (%d readings)", b.ID, b.Scale, b.Readings)
+	return s.commit(fmt.Sprintf("batches/%d.json", b.ID), b, msg, "")
+}
+
+func (s *gitStore) Batches(scale string) ([]BatchSummary, error) {
+	all, err := readAll[BatchSummary](s.dir, "batches/*.json")
+	var out []BatchSummary
+	for _, b := range all {
+		if scale == "" || b.Scale == scale {
+			out = append(out, b)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, err
+}
+
+func (s *gitStore) DeleteBatches(before time.Time) (int, error) {
+	all, err := s.Batches("")
+	if err != nil {
+		return 0, err
+	}
+	var rels []string
+	for _, b := range all {
+		if b.Time.Before(before) {
+			rels = append(rels, fmt.Sprintf("batches/%d.json", b.ID))
+		}
+	}
+	if len(rels) == 0 {
+		return 0, nil
+	}
+	if _, err := s.git(append([]string{"rm", "-q", "--"}, rels...)...); err != nil {
+		return 0, err
+	}
+	msg := fmt.Sprintf("Prune %d batch summaries before %s", len(rels), before.Format("2006-01-02"))
+	if _, err := s.git("commit", "-q", "-m", msg); err != nil {
+		return 0, err
+	}
+	s.push()
+	return len(rels), nil
+}
+
+func (s *gitStore) SaveCheck(c *CheckRecord) error {
+	all, err := readAll[CheckRecord](s.dir, "checks/*.json")
+	if err != nil {
+		return err
+	}
+	c.ID = 1
+	for _, p := range all {
+		if p.ID >= c.ID {
+			c.ID = p.ID + 1
+		}
+	}
+	verdict := "pass"
+	if !c.Pass {
+		verdict = "fail"
+	}
+	msg := fmt.Sprintf("Record %s check #%d for %s (%s)", c.Check, c.ID, c.Scale, verdict)
+	return s.commit(fmt.Sprintf("checks/%d.json", c.ID), c, msg, "")
+}
+
+func (s *gitStore) Checks(scale string) ([]CheckRecord, error) {
+	all, err := readAll[CheckRecord](s.dir, "checks/*.json")
+	var out []CheckRecord
+	for _, c := range all {
+		if scale == "" || c.Scale == scale {
+			out = append(out, c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, err
+}
+
+func (s *gitStore) active() (map[string]int, error) {
+	m := map[string]int{}
+	b, err := os.ReadFile(filepath.Join(s.dir, "active.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, json.Unmarshal(b, &m)
+}
+
+func (s *gitStore) SetActive(scale string, version int) error {
+	m, err := s.active()
+	if err != nil {
+		return err
+	}
+	if m[scale] == version {
+		return nil
+	}
+	prev := m[scale]
+	m[scale] = version
+	return s.commit("active.json", m, fmt.Sprintf("Activate %s v%d (was v%d)", scale, version, prev), "")
+}
+
+func (s *gitStore) Active(scale string) (int, error) {
+	m, err := s.active()
+	return m[scale], err
+}
+
+func (s *gitStore) SaveScale(sc *ScaleInfo) error {
+	rel := fmt.Sprintf("registry/%s.json", url.PathEscape(sc.ID))
+	return s.commit(rel, sc, fmt.Sprintf("Register %s (%s)", sc.ID, sc.Location), "")
+}
+
+func (s *gitStore) Scales() ([]ScaleInfo, error) {
+	out, err := readAll[ScaleInfo](s.dir, "registry/*.json")
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, err
+}
+
+func (s *gitStore) SaveRefWeight(w *ReferenceWeight) error {
+	rel := fmt.Sprintf("refweights/%s.json", url.PathEscape(w.ID))
+	return s.commit(rel, w, fmt.Sprintf("Register reference weight %s (certificate %s)", w.ID, w.Certificate), "")
+}
+
+func (s *gitStore) RefWeights() ([]ReferenceWeight, error) {
+	out, err := readAll[ReferenceWeight](s.dir, "refweights/*.json")
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, err
+}
+
+func (s *gitStore) SaveProduct(p *Product) error {
+	rel := fmt.Sprintf("products/%s.json", url.PathEscape(p.ID))
+	return s.commit(rel, p, fmt.Sprintf("Save product %s (target %g)", p.ID, p.Target), "")
+}
+
+func (s *gitStore) Products() ([]Product, error) {
+	out, err := readAll[Product](s.dir, "products/*.json")
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, err
+}
+
+func (s *gitStore) Close() error {
+	s.unlock()
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGitStoreScaleNames(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git command")
+	}
+	tests := []struct {
+		name    string
+		scales  []string // saved in order, one version each
+		list    string
+		want    int // sessions listed for list
+		wantErr bool
+	}{
+		{name: "space", scales: []string{"line 1"}, list: "line 1", want: 1},
+		{name: "glob star", scales: []string{"a*", "ab"}, list: "a*", want: 1},
+		{name: "glob class", scales: []string{"[ab]", "a"}, list: "[ab]", want: 1},
+		{name: "glob question", scales: []string{"a?", "ab"}, list: "a?", want: 1},
+		{name: "invalid tag", scales: []string{"a:b"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "git")
+			st, err := openGitStore(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer st.Close()
+			for _, scale := range tt.scales {
+				_, _, err = RecordSession(st, testSession(scale, 1))
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("RecordSession succeeded, want an error")
+				}
+				if sessions, _ := st.Sessions(""); len(sessions) != 0 {
+					t.Errorf("%d sessions stored after the failed save", len(sessions))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RecordSession: %v", err)
+			}
+			sessions, err := st.Sessions(tt.list)
+			if err != nil || len(sessions) != tt.want {
+				t.Fatalf("Sessions(%q) = %d sessions, %v; want %d", tt.list, len(sessions), err, tt.want)
+			}
+			if last, err := st.LastVersion(tt.list); err != nil || last != 1 {
+				t.Errorf("LastVersion(%q) = %d, %v; want 1", tt.list, last, err)
+			}
+			out, err := exec.Command("git", "-C", dir, "tag", "-l").Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tag := gitVersionTag(tt.list, 1); !strings.Contains(string(out), tag+"\n") {
+				t.Errorf("tags %q do not include %q", out, tag)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"time"
+)
+
+// jsonStore keeps the whole store in one JSON file, rewritten on every save.
+// It needs no drivers and suits small installations. The store holds a lock
+// on the file from open to Close, so concurrent runs take turns instead of
+// overwriting each other's changes.
+type jsonStore struct {
+	path   string
+	unlock func()
+	data   struct {
+		Sessions []Session         `json:"sessions"`
+		Batches  []BatchSummary    `json:"batches"`
+		Checks   []CheckRecord     `json:"checks,omitempty"`
+		Active   map[string]int    `json:"active"`
+		Scales   []ScaleInfo       `json:"scales,omitempty"`
+		Weights  []ReferenceWeight `json:"reference_weights,omitempty"`
+		Products []Product         `json:"products,omitempty"`
+		// NextID and Versions (the highest version saved per scale) outlive
+		// deleted sessions, so their IDs and versions are not reused.
+		NextID   int64          `json:"next_session_id,omitempty"`
+		Versions map[string]int `json:"session_versions,omitempty"`
+	}
+}
+
+func openJSONStore(path string) (Store, error) {
+	unlock, err := lockFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &jsonStore{path: path, unlock: unlock}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(b, &s.data)
+	}
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *jsonStore) SaveSession(sess *Session) error {
+	sess.ID = max(s.data.NextID, 1)
+	if n := len(s.data.Sessions); n > 0 {
+		sess.ID = max(sess.ID, s.data.Sessions[n-1].ID+1)
+	}
+	s.data.NextID = sess.ID + 1
+	if s.data.Versions == nil {
+		s.data.Versions = map[string]int{}
+	}
+	s.data.Versions[sess.Scale] = max(s.data.Versions[sess.Scale], sess.Version)
+	s.data.Sessions = append(s.data.Sessions, *sess)
+	return s.flush()
+}
+
+func (s *jsonStore) Sessions(scale string) ([]Session, error) {
+	var out []Session
+	for _, sess := range s.data.Sessions {
+		if scale == "" || sess.Scale == scale {
+			out = append(out, sess)
+		}
+	}
+	return out, nil
+}
+
+func (s *jsonStore) LastVersion(scale string) (int, error) {
+	last := s.data.Versions[scale]
+	for _, sess := range s.data.Sessions {
+		if sess.Scale == scale {
+			last = max(last, sess.Version)
+		}
+	}
+	return last, nil
+}
+
+func (s *jsonStore) DeleteSession(scale string, version int) error {
+	for i, sess := range s.data.Sessions {
+		if sess.Scale == scale && sess.Version == version {
+			s.data.Sessions = append(s.data.Sessions[:i], s.data.Sessions[i+1:]...)
+			return s.flush()
+		}
+	}
+	return errNoSession
+}
+
+func (s *jsonStore) SaveBatch(b *BatchSummary) error {
+	b.ID = 1
+	if n := len(s.data.Batches); n > 0 {
+		b.ID = s.data.Batches[n-1].ID + 1
+	}
+	s.data.Batches = append(s.data.Batches, *b)
+	return s.flush()
+}
+
+func (s *jsonStore) Batches(scale string) ([]BatchSummary, error) {
+	var out []BatchSummary
+	for _, b := range s.data.Batches {
+		if scale == "" || b.Scale == scale {
+			out = append(out, b)
+		}
+	}
+	return out, nil
+}
+
+func (s *jsonStore) DeleteBatches(before time.Time) (int, error) {
+	kept := s.data.Batches[:0]
+	for _, b := range s.data.Batches {
+		if !b.Time.Before(before) {
+			kept = append(kept, b)
+		}
+	}
+	n := len(s.data.Batches) - len(kept)
+	if n == 0 {
+		return 0, nil
+	}
+	s.data.Batches = kept
+	return n, s.flush()
+}
+
+func (s *jsonStore) SaveCheck(c *CheckRecord) error {
+	c.ID = 1
+	if n := len(s.data.Checks); n > 0 {
+		c.ID = s.data.Checks[n-1].ID + 1
+	}
+	s.data.Checks = append(s.data.Checks, *c)
+	return s.flush()
+}
+
+func (s *jsonStore) Checks(scale string) ([]CheckRecord, error) {
+	var out []CheckRecord
+	for _, c := range s.data.Checks {
+		if scale == "" || c.Scale == scale {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+func (s *jsonStore) SetActive(scale string, version int) error {
+	if s.data.Active == nil {
+		s.data.Active = map[string]int{}
+	}
+	s.data.Active[scale] = version
+	return s.flush()
+}
+
+func (s *jsonStore) Active(scale string) (int, error) {
+	return s.data.Active[scale], nil
+}
+
+func (s *jsonStore) SaveScale(sc *ScaleInfo) error {
+	for i := range s.data.Scales {
+		if s.data.Scales[i].ID == sc.ID {
+			s.data.Scales[i] = *sc
+			return s.flush()
+		}
+	}
+	s.data.Scales = append(s.data.Scales, *sc)
+	sort.Slice(s.data.Scales, func(i, j int) bool { return s.data.Scales[i].ID < s.data.Scales[j].ID })
+	return s.flush()
+}
+
+func (s *jsonStore) Scales() ([]ScaleInfo, error) {
+	return append([]ScaleInfo(nil), s.data.Scales...), nil
+}
+
+func (s *jsonStore) SaveRefWeight(w *ReferenceWeight) error {
+	for i := range s.data.Weights {
+		if s.data.Weights[i].ID == w.ID {
+			s.data.Weights[i] = *w
+			return s.flush()
+		}
+	}
+	s.data.Weights = append(s.data.Weights, *w)
+	sort.Slice(s.data.Weights, func(i, j int) bool { return s.data.Weights[i].ID < s.data.Weights[j].ID })
+	return s.flush()
+}
+
+func (s *jsonStore) RefWeights() ([]ReferenceWeight, error) {
+	return append([]ReferenceWeight(nil), s.data.Weights...), nil
+}
+
+func (s *jsonStore) SaveProduct(p *Product) error {
+	for i := range s.data.Products {
+		if s.data.Products[i].ID == p.ID {
+			s.data.Products[i] = *p
+			return s.flush()
+		}
+	}
+	s.data.Products = append(s.data.Products, *p)
+	sort.Slice(s.data.Products, func(i, j int) bool { return s.data.Products[i].ID < s.data.Products[j].ID })
+	return s.flush()
+}
+
+func (s *jsonStore) Products() ([]Product, error) {
+	return append([]Product(nil), s.data.Products...), nil
+}
+
+func (s *jsonStore) Close() error {
+	s.unlock()
+	return nil
+}
+
+// flush rewrites the store atomically so a crash never leaves a truncated
+// store behind.
+func (s *jsonStore) flush() error {
+	out, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, append(out, '\n'), 0644)
+}
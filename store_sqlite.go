@@ -0,0 +1,405 @@
+//go:build sqlite || full
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // pure-Go SQLite driver
+)
+
+func init() {
+	storeBackends["sqlite"] = openSQLiteStore
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS sessions (
+	id           INTEGER PRIMARY KEY AUTOINCREMENT,
+	scale        TEXT NOT NULL,
+	version      INTEGER NOT NULL DEFAULT 0,
+	checksum     TEXT NOT NULL DEFAULT '',
+	created      TEXT NOT NULL,
+	source       TEXT NOT NULL,
+	f0           REAL, f1 REAL, f2 REAL, f3 REAL,
+	residual_var REAL,
+	calibration_ok INTEGER,
+	calibration  TEXT NOT NULL,
+	result       TEXT NOT NULL,
+	signature    TEXT NOT NULL DEFAULT '',
+	sealed       TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS sessions_scale ON sessions(scale, id);
+CREATE TABLE IF NOT EXISTS session_versions (
+	scale TEXT PRIMARY KEY,
+	last  INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS batches (
+	id             INTEGER PRIMARY KEY AUTOINCREMENT,
+	session_id     INTEGER NOT NULL REFERENCES sessions(id),
+	scale          TEXT NOT NULL,
+	created        TEXT NOT NULL,
+	readings       INTEGER, valid INTEGER, invalid INTEGER,
+	mean_weight    REAL, min_weight REAL, max_weight REAL,
+	accepted       INTEGER, accepted_total REAL
+);
+CREATE INDEX IF NOT EXISTS batches_scale ON batches(scale, id);
+CREATE TABLE IF NOT EXISTS checks (
+	id      INTEGER PRIMARY KEY AUTOINCREMENT,
+	scale   TEXT NOT NULL,
+	created TEXT NOT NULL,
+	kind    TEXT NOT NULL,
+	pass    INTEGER NOT NULL,
+	info    TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS checks_scale ON checks(scale, id);
+CREATE TABLE IF NOT EXISTS active (
+	scale   TEXT PRIMARY KEY,
+	version INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS scales (
+	id       TEXT PRIMARY KEY,
+	location TEXT NOT NULL DEFAULT '',
+	info     TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS ref_weights (
+	id          TEXT PRIMARY KEY,
+	cert_expiry TEXT NOT NULL DEFAULT '',
+	info        TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS products (
+	id   TEXT PRIMARY KEY,
+	info TEXT NOT NULL
+);
+`
+
+// sqliteUpgrades bring stores created by older builds up to the current
+// schema; "duplicate column" errors mean the upgrade was already applied.
+var sqliteUpgrades = []string{
+	`ALTER TABLE sessions ADD COLUMN version INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE sessions ADD COLUMN checksum TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE sessions ADD COLUMN signature TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE sessions ADD COLUMN sealed TEXT NOT NULL DEFAULT ''`,
+}
+
+// sqliteStore keeps sessions and batches in SQLite tables. The factors and
+// headline diagnostics have their own columns for ad-hoc SQL queries; the
+// complete calibration and result are kept as JSON.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (Store, error) {
+	// wait for other processes' write transactions instead of failing with
+	// "database is locked"
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(10000)")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, u := range sqliteUpgrades {
+		if _, err := db.Exec(u); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) SaveSession(sess *Session) error {
+	calJSON, err := json.Marshal(sess.Calibration)
+	if err != nil {
+		return err
+	}
+	resJSON, err := json.Marshal(sess.Result)
+	if err != nil {
+		return err
+	}
+	sigJSON := ""
+	if sess.Signature != nil {
+		b, err := json.Marshal(sess.Signature)
+		if err != nil {
+			return err
+		}
+		sigJSON = string(b)
+	}
+	f := sess.Result.Factors
+	r, err := s.db.Exec(`INSERT INTO sessions (scale, version, checksum, created, source, f0, f1, f2, f3, residual_var, calibration_ok, calibration, result, signature, sealed)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		sess.Scale, sess.Version, sess.Checksum, sess.Time.UTC().Format(time.RFC3339Nano), sess.Source, f[0], f[1], f[2], f[3],
+		sess.Result.ResidualVar, sess.Result.CalibrationOK, string(calJSON), string(resJSON), sigJSON, sess.Sealed)
+	if err != nil {
+		return err
+	}
+	if sess.ID, err = r.LastInsertId(); err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO session_versions (scale, last) VALUES (?, ?)
+		ON CONFLICT (scale) DO UPDATE SET last = MAX(last, excluded.last)`, sess.Scale, sess.Version)
+	return err
+}
+
+// LastVersion also reads the sessions table, for versions saved before
+// session_versions existed.
+func (s *sqliteStore) LastVersion(scale string) (int, error) {
+	var last int
+	err := s.db.QueryRow(`SELECT COALESCE(MAX(v), 0) FROM (
+		SELECT last AS v FROM session_versions WHERE scale = ?
+		UNION ALL SELECT version FROM sessions WHERE scale = ?)`, scale, scale).Scan(&last)
+	return last, err
+}
+
+func (s *sqliteStore) Sessions(scale string) ([]Session, error) {
+	rows, err := s.db.Query(`SELECT id, scale, version, checksum, created, source, calibration, result, signature, sealed FROM sessions
+		WHERE ? = '' OR scale = ? ORDER BY id`, scale, scale)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Session
+	for rows.Next() {
+		var sess Session
+		var created, calJSON, resJSON, sigJSON string
+		if err := rows.Scan(&sess.ID, &sess.Scale, &sess.Version, &sess.Checksum, &created, &sess.Source, &calJSON, &resJSON, &sigJSON, &sess.Sealed); err != nil {
+			return nil, err
+		}
+		if sess.Time, err = time.Parse(time.RFC3339Nano, created); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(calJSON), &sess.Calibration); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(resJSON), &sess.Result); err != nil {
+			return nil, err
+		}
+		if sigJSON != "" {
+			sess.Signature = new(CalSignature)
+			if err := json.Unmarshal([]byte(sigJSON), sess.Signature); err != nil {
+				return nil, err
+			}
+		}
+		out = append(out, sess)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) DeleteSession(scale string, version int) error {
+	r, err := s.db.Exec(`DELETE FROM sessions WHERE scale = ? AND version = ?`, scale, version)
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err == nil && n == 0 {
+		return errNoSession
+	}
+	return err
+}
+
+func (s *sqliteStore) SaveBatch(b *BatchSummary) error {
+	r, err := s.db.Exec(`INSERT INTO batches (session_id, scale, created, readings, valid, invalid, mean_weight, min_weight, max_weight, accepted, accepted_total)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		b.SessionID, b.Scale, b.Time.UTC().Format(time.RFC3339Nano), b.Readings, b.Valid, b.Invalid,
+		b.MeanWeight, b.MinWeight, b.MaxWeight, b.Accepted, b.AcceptedTotal)
+	if err != nil {
+		return err
+	}
+	b.ID, err = r.LastInsertId()
+	return err
+}
+
+func (s *sqliteStore) Batches(scale string) ([]BatchSummary, error) {
+	rows, err := s.db.Query(`SELECT id, session_id, scale, created, readings, valid, invalid, mean_weight, min_weight, max_weight, accepted, accepted_total
+		FROM batches WHERE ? = '' OR scale = ? ORDER BY id`, scale, scale)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []BatchSummary
+	for rows.Next() {
+		var b BatchSummary
+		var created string
+		if err := rows.Scan(&b.ID, &b.SessionID, &b.Scale, &created, &b.Readings, &b.Valid, &b.Invalid,
+			&b.MeanWeight, &b.MinWeight, &b.MaxWeight, &b.Accepted, &b.AcceptedTotal); err != nil {
+			return nil, err
+		}
+		if b.Time, err = time.Parse(time.RFC3339Nano, created); err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) DeleteBatches(before time.Time) (int, error) {
+	// created is text, so compare the parsed times rather than the strings
+	all, err := s.Batches("")
+	if err != nil {
+		return 0, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	n := 0
+	for _, b := range all {
+		if b.Time.Before(before) {
+			if _, err := tx.Exec(`DELETE FROM batches WHERE id = ?`, b.ID); err != nil {
+				return 0, err
+			}
+			n++
+		}
+	}
+	return n, tx.Commit()
+}
+
+func (s *sqliteStore) SaveCheck(c *CheckRecord) error {
+	info, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	r, err := s.db.Exec(`INSERT INTO checks (scale, created, kind, pass, info) VALUES (?, ?, ?, ?, ?)`,
+		c.Scale, c.Time.UTC().Format(time.RFC3339Nano), c.Check, c.Pass, string(info))
+	if err != nil {
+		return err
+	}
+	c.ID, err = r.LastInsertId()
+	return err
+}
+
+func (s *sqliteStore) Checks(scale string) ([]CheckRecord, error) {
+	rows, err := s.db.Query(`SELECT id, info FROM checks WHERE ? = '' OR scale = ? ORDER BY id`, scale, scale)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []CheckRecord
+	for rows.Next() {
+		var id int64
+		var info string
+		if err := rows.Scan(&id, &info); err != nil {
+			return nil, err
+		}
+		var c CheckRecord
+		if err := json.Unmarshal([]byte(info), &c); err != nil {
+			return nil, err
+		}
+		c.ID = id
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) SetActive(scale string, version int) error {
+	_, err := s.db.Exec(`INSERT INTO active (scale, version) VALUES (?, ?)
+		ON CONFLICT(scale) DO UPDATE SET version = excluded.version`, scale, version)
+	return err
+}
+
+func (s *sqliteStore) Active(scale string) (int, error) {
+	var version int
+	err := s.db.QueryRow(`SELECT version FROM active WHERE scale = ?`, scale).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+func (s *sqliteStore) SaveScale(sc *ScaleInfo) error {
+	info, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO scales (id, location, info) VALUES (?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET location = excluded.location, info = excluded.info`, sc.ID, sc.Location, string(info))
+	return err
+}
+
+func (s *sqliteStore) Scales() ([]ScaleInfo, error) {
+	rows, err := s.db.Query(`SELECT info FROM scales ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []ScaleInfo
+	for rows.Next() {
+		var info string
+		if err := rows.Scan(&info); err != nil {
+			return nil, err
+		}
+		var sc ScaleInfo
+		if err := json.Unmarshal([]byte(info), &sc); err != nil {
+			return nil, err
+		}
+		out = append(out, sc)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) SaveRefWeight(w *ReferenceWeight) error {
+	info, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO ref_weights (id, cert_expiry, info) VALUES (?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET cert_expiry = excluded.cert_expiry, info = excluded.info`, w.ID, w.CertExpiry, string(info))
+	return err
+}
+
+func (s *sqliteStore) RefWeights() ([]ReferenceWeight, error) {
+	rows, err := s.db.Query(`SELECT info FROM ref_weights ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []ReferenceWeight
+	for rows.Next() {
+		var info string
+		if err := rows.Scan(&info); err != nil {
+			return nil, err
+		}
+		var w ReferenceWeight
+		if err := json.Unmarshal([]byte(info), &w); err != nil {
+			return nil, err
+		}
+		out = append(out, w)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) SaveProduct(p *Product) error {
+	info, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO products (id, info) VALUES (?, ?)
+		ON CONFLICT(id) DO UPDATE SET info = excluded.info`, p.ID, string(info))
+	return err
+}
+
+func (s *sqliteStore) Products() ([]Product, error) {
+	rows, err := s.db.Query(`SELECT info FROM products ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Product
+	for rows.Next() {
+		var info string
+		if err := rows.Scan(&info); err != nil {
+			return nil, err
+		}
+		var p Product
+		if err := json.Unmarshal([]byte(info), &p); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) Close() error { return s.db.Close() }
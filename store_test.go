@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storeUnderTest opens a fresh store of one backend in a test directory.
+type storeUnderTest struct {
+	name string
+	open func(t *testing.T, dir string) Store
+}
+
+// storesUnderTest returns every backend compiled in, plus the json backend
+// behind the encryption layer.
+func storesUnderTest() []storeUnderTest {
+	var names []string
+	for name := range storeBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out []storeUnderTest
+	for _, name := range names {
+		out = append(out, storeUnderTest{name, func(t *testing.T, dir string) Store {
+			if name == "git" {
+				if _, err := exec.LookPath("git"); err != nil {
+					t.Skip("no git command")
+				}
+			}
+			st, err := OpenStore(name+":"+filepath.Join(dir, "store"), "")
+			if err != nil {
+				t.Fatalf("open %s store: %v", name, err)
+			}
+			return st
+		}})
+	}
+	out = append(out, storeUnderTest{"sealed json", func(t *testing.T, dir string) Store {
+		key := filepath.Join(dir, "key.hex")
+		if err := os.WriteFile(key, []byte(strings.Repeat("0123456789abcdef", 4)), 0600); err != nil {
+			t.Fatal(err)
+		}
+		st, err := OpenStore("json:"+filepath.Join(dir, "store"), key)
+		if err != nil {
+			t.Fatalf("open sealed store: %v", err)
+		}
+		return st
+	}})
+	return out
+}
+
+// testSession returns a session of scale whose calibration is told apart by n.
+func testSession(scale string, n int) *Session {
+	cal := exactCalibration(uint64(n), [4]float64{0.004, 0.0045, 0.0055, 0.006}, float64(100*n))
+	res, _ := FitCalibration(cal, 0)
+	return &Session{Scale: scale, Time: time.Date(2026, 1, n, 0, 0, 0, 0, time.UTC), Source: "test",
+		Calibration: cal, Checksum: CalibrationChecksum(cal), Result: res}
+}
+
+func TestStoreContract(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, st Store)
+	}{
+		{"sessions", testStoreSessions},
+		{"delete session", testStoreDeleteSession},
+		{"record session", testStoreRecordSession},
+		{"active version", testStoreActive},
+		{"batches", testStoreBatches},
+		{"checks", testStoreChecks},
+		{"registers", testStoreRegisters},
+	}
+	for _, backend := range storesUnderTest() {
+		t.Run(backend.name, func(t *testing.T) {
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					st := backend.open(t, t.TempDir())
+					defer st.Close()
+					tt.run(t, st)
+				})
+			}
+		})
+	}
+}
+
+func testStoreSessions(t *testing.T, st Store) {
+	saved := []*Session{testSession("a", 1), testSession("b", 2), testSession("a", 3)}
+	saved[0].Version, saved[1].Version, saved[2].Version = 1, 1, 2
+	for _, s := range saved {
+		if err := st.SaveSession(s); err != nil {
+			t.Fatalf("SaveSession: %v", err)
+		}
+	}
+	if saved[0].ID < 1 || saved[1].ID <= saved[0].ID || saved[2].ID <= saved[1].ID {
+		t.Fatalf("IDs %d, %d, %d do not count up", saved[0].ID, saved[1].ID, saved[2].ID)
+	}
+	all, err := st.Sessions("")
+	if err != nil || len(all) != 3 {
+		t.Fatalf("Sessions(\"\") = %d sessions, %v; want 3", len(all), err)
+	}
+	a, err := st.Sessions("a")
+	if err != nil || len(a) != 2 {
+		t.Fatalf("Sessions(a) = %d sessions, %v; want 2", len(a), err)
+	}
+	for i, want := range []*Session{saved[0], saved[2]} {
+		got := a[i]
+		if got.ID != want.ID || got.Version != want.Version || got.Checksum != want.Checksum || !got.Time.Equal(want.Time) {
+			t.Errorf("session %d = #%d v%d %s, want #%d v%d %s", i, got.ID, got.Version, got.Time, want.ID, want.Version, want.Time)
+		}
+		if got.Calibration != want.Calibration || got.Result.Factors != want.Result.Factors {
+			t.Errorf("session %d: calibration or factors changed in the store", i)
+		}
+		if got.Sealed != "" {
+			t.Errorf("session %d is still sealed", i)
+		}
+	}
+	if none, err := st.Sessions("c"); err != nil || len(none) != 0 {
+		t.Errorf("Sessions(c) = %d sessions, %v; want none", len(none), err)
+	}
+}
+
+func testStoreDeleteSession(t *testing.T, st Store) {
+	for n := 1; n <= 2; n++ {
+		s := testSession("a", n)
+		s.Version = n
+		if err := st.SaveSession(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.DeleteSession("a", 7); !errors.Is(err, errNoSession) {
+		t.Fatalf("DeleteSession of an unknown version = %v, want errNoSession", err)
+	}
+	if err := st.DeleteSession("a", 2); err != nil {
+		t.Fatalf("DeleteSession: %v", err)
+	}
+	left, err := st.Sessions("a")
+	if err != nil || len(left) != 1 || left[0].Version != 1 {
+		t.Fatalf("after delete: %d sessions, %v; want v1 only", len(left), err)
+	}
+	if last, err := st.LastVersion("a"); err != nil || last != 2 {
+		t.Errorf("LastVersion = %d, %v; want 2 (deleted versions count)", last, err)
+	}
+	s := testSession("a", 3)
+	s.Version = 3
+	if err := st.SaveSession(s); err != nil {
+		t.Fatal(err)
+	}
+	if s.ID <= 2 {
+		t.Errorf("a session saved after a delete got ID %d, want > 2", s.ID)
+	}
+}
+
+func testStoreRecordSession(t *testing.T, st Store) {
+	first, second := testSession("a", 1), testSession("a", 2)
+	if _, v, err := RecordSession(st, first); err != nil || v != 1 {
+		t.Fatalf("RecordSession = v%d, %v; want v1", v, err)
+	}
+	if _, v, err := RecordSession(st, second); err != nil || v != 2 {
+		t.Fatalf("RecordSession = v%d, %v; want v2", v, err)
+	}
+	again := testSession("a", 1)
+	if id, v, err := RecordSession(st, again); err != nil || v != 1 || id != first.ID {
+		t.Fatalf("RecordSession of the same input = #%d v%d, %v; want #%d v1", id, v, err, first.ID)
+	}
+	if active, err := st.Active("a"); err != nil || active != 1 {
+		t.Errorf("Active = %d, %v; want the reused v1", active, err)
+	}
+}
+
+func testStoreActive(t *testing.T, st Store) {
+	if v, err := st.Active("a"); err != nil || v != 0 {
+		t.Fatalf("Active before SetActive = %d, %v; want 0", v, err)
+	}
+	steps := []struct {
+		scale   string
+		version int
+	}{{"a", 1}, {"b", 4}, {"a", 3}, {"a", 3}}
+	for _, s := range steps {
+		if err := st.SetActive(s.scale, s.version); err != nil {
+			t.Fatalf("SetActive(%s, %d): %v", s.scale, s.version, err)
+		}
+	}
+	for scale, want := range map[string]int{"a": 3, "b": 4, "c": 0} {
+		if v, err := st.Active(scale); err != nil || v != want {
+			t.Errorf("Active(%s) = %d, %v; want %d", scale, v, err, want)
+		}
+	}
+}
+
+func testStoreBatches(t *testing.T, st Store) {
+	day := func(d int) time.Time { return time.Date(2026, 3, d, 12, 0, 0, 0, time.UTC) }
+	batches := []*BatchSummary{
+		{Scale: "a", Time: day(1), Readings: 10, Valid: 9, Invalid: 1},
+		{Scale: "b", Time: day(2), Readings: 5, Valid: 5},
+		{Scale: "a", Time: day(3), Readings: 7, Valid: 7},
+	}
+	for _, b := range batches {
+		if err := st.SaveBatch(b); err != nil {
+			t.Fatalf("SaveBatch: %v", err)
+		}
+	}
+	if batches[1].ID <= batches[0].ID || batches[2].ID <= batches[1].ID {
+		t.Fatalf("batch IDs %d, %d, %d do not count up", batches[0].ID, batches[1].ID, batches[2].ID)
+	}
+	a, err := st.Batches("a")
+	if err != nil || len(a) != 2 || a[0].ID != batches[0].ID || a[1].Readings != 7 {
+		t.Fatalf("Batches(a) = %+v, %v", a, err)
+	}
+	n, err := st.DeleteBatches(day(3))
+	if err != nil || n != 2 {
+		t.Fatalf("DeleteBatches = %d, %v; want 2", n, err)
+	}
+	left, err := st.Batches("")
+	if err != nil || len(left) != 1 || left[0].ID != batches[2].ID {
+		t.Errorf("after DeleteBatches: %+v, %v; want the last batch only", left, err)
+	}
+}
+
+func testStoreChecks(t *testing.T, st Store) {
+	checks := []*CheckRecord{
+		{CheckResult: CheckResult{Scale: "a", Check: "span", Pass: true}, Readings: 3},
+		{CheckResult: CheckResult{Scale: "b", Check: "zero", Pass: false}, Readings: 1, Drift: &[4]float64{1, 2, 3, 4}},
+	}
+	for _, c := range checks {
+		if err := st.SaveCheck(c); err != nil {
+			t.Fatalf("SaveCheck: %v", err)
+		}
+	}
+	b, err := st.Checks("b")
+	if err != nil || len(b) != 1 || b[0].ID != checks[1].ID || b[0].Drift == nil || *b[0].Drift != *checks[1].Drift {
+		t.Fatalf("Checks(b) = %+v, %v", b, err)
+	}
+	if all, err := st.Checks(""); err != nil || len(all) != 2 || all[0].ID >= all[1].ID {
+		t.Errorf("Checks(\"\") = %+v, %v; want both in ID order", all, err)
+	}
+}
+
+func testStoreRegisters(t *testing.T, st Store) {
+	for _, sc := range []*ScaleInfo{{ID: "b", Location: "hall"}, {ID: "a", Location: "lab"}, {ID: "b", Location: "dock"}} {
+		if err := st.SaveScale(sc); err != nil {
+			t.Fatalf("SaveScale: %v", err)
+		}
+	}
+	scales, err := st.Scales()
+	if err != nil || len(scales) != 2 || scales[0].ID != "a" || scales[1].Location != "dock" {
+		t.Errorf("Scales = %+v, %v; want a, then b replaced", scales, err)
+	}
+	for _, w := range []*ReferenceWeight{{ID: "w2", Nominal: 20, Certificate: "c2"}, {ID: "w1", Nominal: 10, Certificate: "c1"}} {
+		if err := st.SaveRefWeight(w); err != nil {
+			t.Fatalf("SaveRefWeight: %v", err)
+		}
+	}
+	weights, err := st.RefWeights()
+	if err != nil || len(weights) != 2 || weights[0].ID != "w1" || weights[1].Nominal != 20 {
+		t.Errorf("RefWeights = %+v, %v", weights, err)
+	}
+	for _, p := range []*Product{{ID: "p1", Target: 500, Under: 5, Over: 10}, {ID: "p1", Target: 250}} {
+		if err := st.SaveProduct(p); err != nil {
+			t.Fatalf("SaveProduct: %v", err)
+		}
+	}
+	products, err := st.Products()
+	if err != nil || len(products) != 1 || products[0].Target != 250 {
+		t.Errorf("Products = %+v, %v; want p1 replaced", products, err)
+	}
+}
+
+// TestSealedStoreAtRest checks that the encryption layer leaves no
+// calibration in the backend.
+func TestSealedStoreAtRest(t *testing.T) {
+	dir := t.TempDir()
+	sealed := storesUnderTest()[len(storeBackends)]
+	st := sealed.open(t, dir)
+	s := testSession("a", 1)
+	if _, _, err := RecordSession(st, s); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+	raw, err := openBackend("json:" + filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	sessions, err := raw.Sessions("a")
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("raw Sessions = %d, %v", len(sessions), err)
+	}
+	if got := sessions[0]; got.Sealed == "" || got.Calibration != (CalibrationData{}) || got.Checksum != s.Checksum {
+		t.Errorf("raw session: sealed %t, calibration %+v, checksum %q; want only the checksum in the clear",
+			got.Sealed != "", got.Calibration, got.Checksum)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// readingStream decodes the readings of an adc file one at a time, so apply
+// mode (-stream) runs in constant memory on captures larger than memory. It
+// reads the list forms, [[..], ..] and {"adc": [[..], ..]}, with or without
+// expected weights.
+type readingStream struct {
+	path   string
+	data   []byte // the mapped file
+	unmap  func() error
+	dec    *json.Decoder
+	prefix string
+	n      int
+}
+
+// openReadingStream opens path and positions the decoder at its first reading.
+func openReadingStream(path string) (*readingStream, error) {
+	data, unmap, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &readingStream{path: path, data: data, unmap: unmap, dec: json.NewDecoder(bytes.NewReader(data))}
+	if err := s.start(); err != nil {
+		unmap()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *readingStream) start() error {
+	tok, err := s.dec.Token()
+	if err != nil {
+		return s.locate(err, "")
+	}
+	switch tok {
+	case json.Delim('['):
+		return nil
+	case json.Delim('{'):
+		for s.dec.More() {
+			key, err := s.dec.Token()
+			if err != nil {
+				return s.locate(err, "")
+			}
+			if key != "adc" {
+				var skip json.RawMessage
+				if err := s.dec.Decode(&skip); err != nil {
+					return s.locate(err, "")
+				}
+				continue
+			}
+			s.prefix = "/adc"
+			if tok, err := s.dec.Token(); err != nil || tok != json.Delim('[') {
+				if err == nil {
+					err = fieldErrorf("/adc", "\"adc\" must be a list of readings")
+				}
+				return s.locate(err, "/adc")
+			}
+			return nil
+		}
+		return s.locate(fieldErrorf("/adc", "missing \"adc\""), "")
+	}
+	return s.locate(errors.New("want [[..], ..] or {\"adc\": [[..], ..]}"), "")
+}
+
+// Next returns the next reading with its expected weight and tilt (nil when
+// it has none); ok is false after the last reading.
+func (s *readingStream) Next() (adc [4]float64, meta readingMeta, ok bool, err error) {
+	if !s.dec.More() {
+		if _, err := s.dec.Token(); err != nil {
+			return adc, meta, false, s.locate(err, s.prefix)
+		}
+		return adc, meta, false, nil
+	}
+	at := fmt.Sprintf("%s/%d", s.prefix, s.n)
+	var raw json.RawMessage
+	if err := s.dec.Decode(&raw); err != nil {
+		return adc, meta, false, s.locate(err, at)
+	}
+	if s.n == 0 && strings.IndexByte("[{", raw[0]) < 0 {
+		return adc, meta, false, s.locate(fieldErrorf(s.prefix, "-stream needs a list of readings, not a single reading"), s.prefix)
+	}
+	s.n++
+	adc, meta, err = parseADCReading(raw, at, fmt.Sprintf("reading %d", s.n))
+	if err != nil {
+		e := s.locate(err, at).(*JSONError)
+		// point at the offending value rather than past the reading
+		off := s.dec.InputOffset() - int64(len(raw)) + int64(jsonValueStart(raw, strings.TrimPrefix(e.Pointer, at)))
+		e.Line, e.Column = lineColumn(s.data, int(off))
+		return adc, meta, false, e
+	}
+	return adc, meta, true, nil
+}
+
+func (s *readingStream) Close() error { return s.unmap() }
+
+// locate turns err into a *JSONError. The position comes from a syntax
+// error's offset or else the decoder's.
+func (s *readingStream) locate(err error, pointer string) error {
+	e := &JSONError{File: s.path, Pointer: pointer, Err: err}
+	off := s.dec.InputOffset()
+	var syntaxErr *json.SyntaxError
+	var fieldErr *jsonFieldError
+	switch {
+	case errors.As(err, &syntaxErr):
+		off = max(syntaxErr.Offset-1, 0)
+		e.Err = errors.New(strings.TrimPrefix(syntaxErr.Error(), "json: "))
+	case errors.As(err, &fieldErr):
+		e.Pointer, e.Err = fieldErr.Pointer, fieldErr.Err
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		e.Err = errors.New("unexpected end of JSON input")
+	}
+	e.Line, e.Column = lineColumn(s.data, int(off))
+	return e
+}
+
+// reportBuffer collects the text of output.txt. Normally it is kept in memory
+// and written at the end; once streamTo is called (streaming apply) flush
+// moves what was written so far out of memory, so the report of a long run
+// is never held whole.
+type reportBuffer struct {
+	strings.Builder
+	streaming bool
+	path      string   // output.txt, or "" when it is not written
+	tmp       *os.File // created on the first spill, renamed into place by save
+	err       error
+}
+
+// streamTo starts spilling the report into a temporary file next to path,
+// or into nothing when path is "" (no output.txt is written).
+func (r *reportBuffer) streamTo(path string) {
+	r.streaming, r.path = true, path
+}
+
+// flush moves the buffered text out of memory once enough has accumulated;
+// it does nothing while the report is kept in memory.
+func (r *reportBuffer) flush() {
+	if !r.streaming || r.Len() < 1<<16 {
+		return
+	}
+	if r.path != "" && r.tmp == nil && r.err == nil {
+		r.tmp, r.err = os.CreateTemp(filepath.Dir(r.path), "."+filepath.Base(r.path)+".tmp*")
+	}
+	if r.tmp != nil && r.err == nil {
+		_, r.err = r.tmp.WriteString(r.String())
+	}
+	r.Reset()
+}
+
+// discard drops a spilled report, for runs that end in an error.
+func (r *reportBuffer) discard() {
+	if r.tmp != nil {
+		_ = r.tmp.Close()
+		os.Remove(r.tmp.Name())
+		r.tmp = nil
+	}
+}
+
+// save writes the report to path atomically.
+func (r *reportBuffer) save(path string) error {
+	if r.tmp == nil && r.err == nil {
+		return writeFileAtomic(path, []byte(r.String()), 0644)
+	}
+	defer r.discard()
+	err := r.err
+	if err == nil {
+		_, err = r.tmp.WriteString(r.String())
+	}
+	if err == nil {
+		err = r.tmp.Sync()
+	}
+	if err == nil {
+		err = r.tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = r.tmp.Close()
+	}
+	if err == nil {
+		if err = os.Rename(r.tmp.Name(), path); err == nil {
+			r.tmp = nil
+		}
+	}
+	return err
+}
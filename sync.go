@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Remote is an object store that calibration records are synced through:
+// an HTTP endpoint accepting GET and PUT, or an S3-compatible bucket.
+// Get returns errRemoteNotFound for missing objects. PutIf is a conditional
+// write that fails with errRemoteChanged unless the object still has the
+// given ETag ("" meaning it must not exist yet).
+type Remote interface {
+	Get(key string) (data []byte, etag string, err error)
+	Put(key string, data []byte) error
+	PutIf(key string, data []byte, etag string) error
+}
+
+var (
+	errRemoteNotFound = errors.New("not found on remote")
+	errRemoteChanged  = errors.New("remote changed concurrently")
+)
+
+// syncIndexKey is the object listing every calibration version on the remote.
+const syncIndexKey = "index.json"
+
+// SyncIndex lists the calibration versions held by a remote and the active
+// version of each scale. Session objects are immutable; the index is only
+// replaced with a conditional write, so two devices syncing at once cannot
+// silently overwrite each other.
+type SyncIndex struct {
+	Updated time.Time      `json:"updated"`
+	Entries []SyncEntry    `json:"entries"`
+	Active  map[string]int `json:"active"`
+}
+
+// SyncEntry is one calibration version on the remote.
+type SyncEntry struct {
+	Scale    string    `json:"scale"`
+	Version  int       `json:"version"`
+	Checksum string    `json:"checksum"`
+	Key      string    `json:"key"`
+	Origin   string    `json:"origin,omitempty"`
+	Pushed   time.Time `json:"pushed"`
+}
+
+// httpRemote talks plain HTTP GET/PUT to base/key. authorize, when set, adds
+// credentials to each request (a bearer token, or an S3 signature).
+type httpRemote struct {
+	base      string
+	client    *http.Client
+	authorize func(req *http.Request, body []byte)
+}
+
+func init() { registerFeature("sync remotes", "http", "https") }
+
+// OpenRemote parses a remote spec: an http:// or https:// base URL (with
+// $CAL_SYNC_TOKEN sent as a bearer token when set), or s3://bucket/prefix for
+// an S3-compatible bucket (see newS3Remote).
+func OpenRemote(spec string) (Remote, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		r := &httpRemote{base: strings.TrimSuffix(spec, "/"), client: &http.Client{Timeout: 30 * time.Second}}
+		if tok := os.Getenv("CAL_SYNC_TOKEN"); tok != "" {
+			r.authorize = func(req *http.Request, _ []byte) { req.Header.Set("Authorization", "Bearer "+tok) }
+		}
+		return r, nil
+	case "s3":
+		return newS3Remote(u.Host, strings.Trim(u.Path, "/"))
+	}
+	return nil, fmt.Errorf("unsupported remote %q (use http(s)://... or s3://bucket/prefix)", spec)
+}
+
+func (r *httpRemote) do(method, key string, body []byte, header map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(method, r.base+"/"+key, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if r.authorize != nil {
+		r.authorize(req, body)
+	}
+	return r.client.Do(req)
+}
+
+func (r *httpRemote) Get(key string) ([]byte, string, error) {
+	resp, err := r.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", errRemoteNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("GET %s: %s", key, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	return data, resp.Header.Get("ETag"), err
+}
+
+func (r *httpRemote) Put(key string, data []byte) error {
+	return r.put(key, data, nil)
+}
+
+func (r *httpRemote) PutIf(key string, data []byte, etag string) error {
+	if etag == "" {
+		return r.put(key, data, map[string]string{"If-None-Match": "*"})
+	}
+	return r.put(key, data, map[string]string{"If-Match": etag})
+}
+
+func (r *httpRemote) put(key string, data []byte, header map[string]string) error {
+	resp, err := r.do(http.MethodPut, key, data, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusConflict:
+		return errRemoteChanged
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("PUT %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+// loadSyncIndex reads the remote index; a missing index is an empty one with ETag "".
+func loadSyncIndex(r Remote) (SyncIndex, string, error) {
+	idx := SyncIndex{Active: map[string]int{}}
+	data, etag, err := r.Get(syncIndexKey)
+	if errors.Is(err, errRemoteNotFound) {
+		return idx, "", nil
+	}
+	if err != nil {
+		return idx, "", err
+	}
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return idx, "", fmt.Errorf("remote index: %w", err)
+	}
+	if idx.Active == nil {
+		idx.Active = map[string]int{}
+	}
+	return idx, etag, nil
+}
+
+// syncObjectKey names the remote object of a calibration version.
+func syncObjectKey(s Session) string {
+	return fmt.Sprintf("sessions/%s/v%d-%.12s.json", url.PathEscape(s.Scale), s.Version, s.Checksum)
+}
+
+// SyncResult counts what a push or pull did; Conflicts describes the versions
+// (or active pointers) that differ on both sides and were left alone.
+type SyncResult struct {
+	Transferred int
+	Unchanged   int
+	Conflicts   []string
+}
+
+// PushStore uploads the local versions the remote lacks and the local active
+// pointers. A version number holding different calibrations on the two sides,
+// or a remote active version unknown locally, is a conflict and not pushed.
+// st is the backend without the encryption layer, so encrypted sessions are
+// uploaded sealed; their checksum stays readable for the index.
+func PushStore(st Store, r Remote, scale, origin string) (SyncResult, error) {
+	var res SyncResult
+	idx, etag, err := loadSyncIndex(r)
+	if err != nil {
+		return res, err
+	}
+	sessions, err := st.Sessions(scale)
+	if err != nil {
+		return res, err
+	}
+	remote := map[string]SyncEntry{}
+	for _, e := range idx.Entries {
+		remote[fmt.Sprintf("%s/%d", e.Scale, e.Version)] = e
+	}
+	known := map[string]bool{}
+	for _, s := range sessions {
+		known[fmt.Sprintf("%s/%d", s.Scale, s.Version)] = true
+		e, ok := remote[fmt.Sprintf("%s/%d", s.Scale, s.Version)]
+		switch {
+		case ok && e.Checksum == s.Checksum:
+			res.Unchanged++
+			continue
+		case ok:
+			res.Conflicts = append(res.Conflicts, fmt.Sprintf("scale %s v%d: local %.12s, remote %.12s", s.Scale, s.Version, s.Checksum, e.Checksum))
+			continue
+		}
+		data, err := json.Marshal(s)
+		if err != nil {
+			return res, err
+		}
+		key := syncObjectKey(s)
+		if err := r.Put(key, data); err != nil {
+			return res, err
+		}
+		idx.Entries = append(idx.Entries, SyncEntry{Scale: s.Scale, Version: s.Version, Checksum: s.Checksum,
+			Key: key, Origin: origin, Pushed: time.Now().UTC()})
+		res.Transferred++
+	}
+	scales := map[string]bool{}
+	for _, s := range sessions {
+		scales[s.Scale] = true
+	}
+	for sc := range scales {
+		v, err := st.Active(sc)
+		if err != nil {
+			return res, err
+		}
+		if rv := idx.Active[sc]; rv != 0 && rv != v && !known[fmt.Sprintf("%s/%d", sc, rv)] {
+			res.Conflicts = append(res.Conflicts, fmt.Sprintf("scale %s: remote active v%d is not known locally (pull first)", sc, rv))
+			continue
+		}
+		if v != 0 {
+			idx.Active[sc] = v
+		}
+	}
+	sort.Slice(idx.Entries, func(i, j int) bool {
+		a, b := idx.Entries[i], idx.Entries[j]
+		return a.Scale < b.Scale || (a.Scale == b.Scale && a.Version < b.Version)
+	})
+	idx.Updated = time.Now().UTC()
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return res, err
+	}
+	return res, r.PutIf(syncIndexKey, data, etag)
+}
+
+// PullStore downloads the remote versions the store lacks, keeping their
+// version numbers (sealed versions are stored sealed), and adopts the remote active pointer for scales without
+// one (or always, with activate). It returns the scales whose calibrations or
+// active version changed, for the audit log.
+func PullStore(st Store, r Remote, scale string, activate bool) (SyncResult, []string, error) {
+	var res SyncResult
+	var changed []string
+	idx, _, err := loadSyncIndex(r)
+	if err != nil {
+		return res, nil, err
+	}
+	byScale := map[string][]SyncEntry{}
+	for _, e := range idx.Entries {
+		if scale == "" || e.Scale == scale {
+			byScale[e.Scale] = append(byScale[e.Scale], e)
+		}
+	}
+	var names []string
+	for n := range byScale {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		existing, err := st.Sessions(name)
+		if err != nil {
+			return res, changed, err
+		}
+		byVersion := map[int]string{}
+		for _, s := range existing {
+			byVersion[s.Version] = s.Checksum
+		}
+		var incoming []Session
+		for _, e := range byScale[name] {
+			c, ok := byVersion[e.Version]
+			switch {
+			case ok && c == e.Checksum:
+				res.Unchanged++
+				continue
+			case ok:
+				res.Conflicts = append(res.Conflicts, fmt.Sprintf("scale %s v%d: local %.12s, remote %.12s", name, e.Version, c, e.Checksum))
+				continue
+			}
+			data, _, err := r.Get(e.Key)
+			if err != nil {
+				return res, changed, fmt.Errorf("%s: %w", e.Key, err)
+			}
+			var s Session
+			if err := json.Unmarshal(data, &s); err != nil {
+				return res, changed, fmt.Errorf("%s: %w", e.Key, err)
+			}
+			if s.Scale != name || s.Version != e.Version || s.Checksum != e.Checksum {
+				return res, changed, fmt.Errorf("%s does not match the remote index", e.Key)
+			}
+			incoming = append(incoming, s)
+		}
+		if err := versionConflict(name, existing, incoming); err != nil {
+			return res, changed, err
+		}
+		_, added, err := mergeVersions(st, name, existing, incoming)
+		if err != nil {
+			return res, changed, err
+		}
+		res.Transferred += added
+		touched := added > 0
+		local, err := st.Active(name)
+		if err != nil {
+			return res, changed, err
+		}
+		if rv := idx.Active[name]; rv != 0 && rv != local && (local == 0 || activate) {
+			if err := st.SetActive(name, rv); err != nil {
+				return res, changed, err
+			}
+			touched = true
+		}
+		if touched {
+			changed = append(changed, name)
+		}
+	}
+	return res, changed, nil
+}
+
+// runSync implements `calibrate sync push|pull`: exchange calibration records
+// with a remote so edge devices and the central database stay consistent.
+func runSync(args []string) int {
+	if len(args) == 0 || (args[0] != "push" && args[0] != "pull") {
+		fmt.Fprintln(os.Stderr, "usage: calibrate sync push|pull -remote URL [-store SPEC] [-scale ID]")
+		return 2
+	}
+	dir := args[0]
+	fs := flag.NewFlagSet("sync "+dir, flag.ExitOnError)
+	storeFlag, storeKey := storeFlags(fs)
+	remoteFlag := fs.String("remote", "", "remote: https://host/path or s3://bucket/prefix (default $CAL_SYNC_REMOTE)")
+	scale := fs.String("scale", "", "only sync this scale (default all scales)")
+	activate := fs.Bool("activate", false, "pull: adopt the remote active version even when the scale already has one")
+	auditLog := fs.String("audit-log", "", "pull: append changes to this audit log (default $CAL_AUDIT_LOG)")
+	operator := fs.String("operator", "", "operator name for the audit log (default $CAL_OPERATOR, then the login name)")
+	_ = fs.Parse(args[1:])
+
+	spec := *remoteFlag
+	if spec == "" {
+		spec = os.Getenv("CAL_SYNC_REMOTE")
+	}
+	if spec == "" {
+		fmt.Fprintln(os.Stderr, "error: no remote configured (use -remote or CAL_SYNC_REMOTE)")
+		return 2
+	}
+	remote, err := OpenRemote(spec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+	// push reads the backend without the encryption layer and needs no key:
+	// encrypted sessions are uploaded sealed, as backup copies them
+	var st Store
+	if dir == "push" {
+		if storeSpec(*storeFlag) == "" {
+			fmt.Fprintln(os.Stderr, "error: no store configured (use -store or CAL_STORE)")
+			return 1
+		}
+		if st, err = openBackend(storeSpec(*storeFlag)); err != nil {
+			fmt.Fprintf(os.Stderr, "error opening store: %v\n", err)
+			return 1
+		}
+	} else if st = openStoreOrExit(*storeFlag, *storeKey); st == nil {
+		return 1
+	}
+	defer st.Close()
+
+	var res SyncResult
+	if dir == "push" {
+		origin, _ := os.Hostname()
+		res, err = PushStore(st, remote, *scale, origin)
+		if errors.Is(err, errRemoteChanged) {
+			fmt.Fprintln(os.Stderr, "error: the remote index changed during the push; run the push again")
+			return 1
+		}
+	} else {
+		befores := map[string]*Session{}
+		if sessions, serr := st.Sessions(*scale); serr == nil {
+			for _, s := range sessions {
+				if _, ok := befores[s.Scale]; !ok {
+					befores[s.Scale], _ = ActiveSession(st, s.Scale)
+				}
+			}
+		}
+		var changed []string
+		res, changed, err = PullStore(st, remote, *scale, *activate)
+		for _, sc := range changed {
+			after, _ := ActiveSession(st, sc)
+			if aerr := AppendAudit(auditPath(*auditLog), "sync-pull", operatorName(*operator), sc, "pulled from "+spec,
+				auditSnapshot(befores[sc]), auditSnapshot(after)); aerr != nil {
+				fmt.Fprintf(os.Stderr, "error writing audit log: %v\n", aerr)
+				return 1
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: sync %s: %v\n", dir, err)
+		return 1
+	}
+	verb := map[string]string{"push": "pushed", "pull": "pulled"}[dir]
+	fmt.Printf("Sync %s %s: %d version(s) %s, %d already in sync, %d conflict(s)\n",
+		dir, spec, res.Transferred, verb, res.Unchanged, len(res.Conflicts))
+	for _, c := range res.Conflicts {
+		fmt.Printf("  CONFLICT %s\n", c)
+	}
+	if len(res.Conflicts) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,226 @@
+//go:build syslog || full
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log backends for services: -log-format syslog sends each record to the
+// local syslog socket (RFC 3164 with facility daemon, the record's attributes
+// as key=value after the message), -log-format journald to the systemd
+// journal's native socket with the attributes as journal fields. Both set
+// the priority from the record's level.
+
+const logIdentifier = "calibrate"
+
+func init() {
+	for format, sockets := range map[string][]string{"syslog": syslogSockets, "journald": journalSockets} {
+		encode := syslogRecord
+		if format == "journald" {
+			encode = journalRecord
+		}
+		logFormats[format] = func() (slog.Handler, error) {
+			sink, err := newLogSink(sockets, encode)
+			if err != nil {
+				return nil, err
+			}
+			return sinkHandler{sink: sink}, nil
+		}
+		registerFeature("log formats", format)
+	}
+}
+
+var (
+	syslogSockets  = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+	journalSockets = []string{"/run/systemd/journal/socket"}
+)
+
+// logSink is the connection to a local log daemon. A write that fails is
+// retried once on a new connection (the daemon may have restarted), then the
+// line goes to stderr so it is not lost.
+type logSink struct {
+	mu      sync.Mutex
+	sockets []string
+	stream  bool // connected over SOCK_STREAM: records end in a newline
+	conn    net.Conn
+	encode  func(level slog.Level, t time.Time, msg string, attrs []slog.Attr) []byte
+}
+
+func newLogSink(sockets []string, encode func(slog.Level, time.Time, string, []slog.Attr) []byte) (*logSink, error) {
+	s := &logSink{sockets: sockets, encode: encode}
+	if err := s.dial(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *logSink) dial() error {
+	for _, path := range s.sockets {
+		for _, network := range []string{"unixgram", "unix"} {
+			if c, err := net.Dial(network, path); err == nil {
+				s.conn, s.stream = c, network == "unix"
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no log socket at %s", strings.Join(s.sockets, ", "))
+}
+
+func (s *logSink) write(level slog.Level, t time.Time, msg string, attrs []slog.Attr) {
+	b := s.encode(level, t, msg, attrs)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for range 2 {
+		if s.conn == nil && s.dial() != nil {
+			break
+		}
+		rec := b
+		if s.stream {
+			rec = append(b[:len(b):len(b)], '\n')
+		}
+		if _, err := s.conn.Write(rec); err == nil {
+			return
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	fmt.Fprintf(os.Stderr, "%s %s %s%s\n", t.Format("2006/01/02 15:04:05"), level, msg, logfmt(attrs))
+}
+
+// syslogRecord encodes a record for the local syslog daemon.
+func syslogRecord(level slog.Level, t time.Time, msg string, attrs []slog.Attr) []byte {
+	const facilityDaemon = 3
+	pri := facilityDaemon*8 + syslogSeverity(level)
+	return fmt.Appendf(nil, "<%d>%s %s[%d]: %s%s", pri, t.Format(time.Stamp), logIdentifier, os.Getpid(), msg, logfmt(attrs))
+}
+
+// journalRecord encodes a record in the journal's native protocol: a field
+// per line, KEY=value, or KEY, newline, 64-bit little-endian length and the
+// value when the value spans lines.
+func journalRecord(level slog.Level, t time.Time, msg string, attrs []slog.Attr) []byte {
+	var b []byte
+	field := func(key, value string) {
+		if !strings.Contains(value, "\n") {
+			b = append(append(append(append(b, key...), '='), value...), '\n')
+			return
+		}
+		b = append(append(b, key...), '\n')
+		n := uint64(len(value))
+		for range 8 {
+			b = append(b, byte(n))
+			n >>= 8
+		}
+		b = append(append(b, value...), '\n')
+	}
+	field("MESSAGE", msg)
+	field("PRIORITY", strconv.Itoa(syslogSeverity(level)))
+	field("SYSLOG_IDENTIFIER", logIdentifier)
+	field("SYSLOG_PID", strconv.Itoa(os.Getpid()))
+	for _, a := range attrs {
+		field(journalKey(a.Key), a.Value.String())
+	}
+	return b
+}
+
+// syslogSeverity maps a level to the syslog severities err, warning, info
+// and debug.
+func syslogSeverity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
+
+// journalKey turns an attribute key into a journal field name: upper case
+// letters, digits and underscores, not starting with an underscore or digit.
+func journalKey(key string) string {
+	k := []byte(strings.ToUpper(key))
+	for i, c := range k {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			k[i] = '_'
+		}
+	}
+	if len(k) == 0 || k[0] == '_' || k[0] >= '0' && k[0] <= '9' {
+		k = append([]byte("CAL_"), k...)
+	}
+	return string(k)
+}
+
+// logfmt renders attributes as " key=value ...", quoting values that need it.
+func logfmt(attrs []slog.Attr) string {
+	var sb strings.Builder
+	for _, a := range attrs {
+		v := a.Value.String()
+		if v == "" || strings.ContainsAny(v, " =\"\n") {
+			v = strconv.Quote(v)
+		}
+		sb.WriteString(" " + a.Key + "=" + v)
+	}
+	return sb.String()
+}
+
+// sinkHandler is the slog.Handler writing to a logSink; attributes in groups
+// get dotted keys.
+type sinkHandler struct {
+	sink   *logSink
+	attrs  []slog.Attr
+	prefix string
+}
+
+func (h sinkHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo
+}
+
+func (h sinkHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := append([]slog.Attr(nil), h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = appendAttr(attrs, h.prefix, a)
+		return true
+	})
+	h.sink.write(r.Level, r.Time, r.Message, attrs)
+	return nil
+}
+
+func (h sinkHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	all := append([]slog.Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		all = appendAttr(all, h.prefix, a)
+	}
+	return sinkHandler{h.sink, all, h.prefix}
+}
+
+func (h sinkHandler) WithGroup(name string) slog.Handler {
+	return sinkHandler{h.sink, h.attrs, h.prefix + name + "."}
+}
+
+// appendAttr appends a, flattening groups into dotted keys.
+func appendAttr(attrs []slog.Attr, prefix string, a slog.Attr) []slog.Attr {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, g := range a.Value.Group() {
+			attrs = appendAttr(attrs, prefix, g)
+		}
+		return attrs
+	}
+	if a.Key == "" {
+		return attrs
+	}
+	return append(attrs, slog.Attr{Key: prefix + a.Key, Value: a.Value})
+}
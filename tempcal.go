@@ -0,0 +1,354 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Temperature-indexed calibration. Load cell zero and span drift with
+// temperature, so a scale calibrated at several temperatures weighs with the
+// zero and factors interpolated linearly to the current temperature between
+// the two calibrations around it. Outside the covered range the nearest
+// calibration is used as it is: extrapolating a drift is not safe.
+
+// TempCalibrationsConfig is the -temp-cals file: calibration files (relative
+// to it) and the temperature each was taken at.
+type TempCalibrationsConfig struct {
+	Calibrations []TempCalibrationEntry `json:"calibrations"`
+}
+
+// TempCalibrationEntry is one calibration of a -temp-cals file.
+type TempCalibrationEntry struct {
+	TemperatureC *float64 `json:"temperature_c"`
+	Cal          string   `json:"cal"`
+}
+
+// tempCalChecks are the checks every calibration of a temperature set passes,
+// as the -cal one does: its stage, its signature when trusted is set
+// (-require-signed) and its validity period, refused when expired with
+// refuseExpired (-expired-policy refuse).
+type tempCalChecks struct {
+	trusted       ed25519.PublicKey
+	refuseExpired bool
+}
+
+// check checks the calibration cal named source, signed with sig (nil when
+// unsigned) and recorded at recorded (zero for files). It returns whether
+// the calibration has expired, when that is not refused.
+func (c tempCalChecks) check(source string, cal CalibrationData, sig *CalSignature, recorded time.Time) (expired bool, err error) {
+	if err := checkStage(cal); err != nil {
+		return false, fmt.Errorf("%s: %w", source, err)
+	}
+	if c.trusted != nil {
+		if sig == nil {
+			return false, fmt.Errorf("refusing unsigned calibration %s (-require-signed)", source)
+		}
+		if err := VerifyCalibration(cal, *sig, c.trusted); err != nil {
+			return false, fmt.Errorf("refusing calibration %s: %w", source, err)
+		}
+	}
+	expiry, ok, err := CalibrationExpiry(cal, recorded)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", source, err)
+	}
+	if !ok || daysUntil(expiry, nowUTC()) >= 0 {
+		return false, nil
+	}
+	if c.refuseExpired {
+		return false, fmt.Errorf("refusing calibration %s: expired on %s (-expired-policy refuse)", source, expiry.Format("2006-01-02"))
+	}
+	return true, nil
+}
+
+// tempPoint is one calibration of a temperature set with its fitted factors.
+type tempPoint struct {
+	temp          float64
+	source        string
+	expired       bool
+	zero, factors [4]float64
+}
+
+func newTempPoint(temp float64, source string, cal CalibrationData) (tempPoint, error) {
+	factors, _, _, err := ComputeFactors(cal, envRidge())
+	if err != nil {
+		return tempPoint{}, fmt.Errorf("%s: %w", source, err)
+	}
+	return tempPoint{temp: temp, source: source, zero: cal.Zero, factors: factors}, nil
+}
+
+// LoadTempCalibrations reads a -temp-cals file and fits each calibration
+// that passes checks; a calibration's signature is its detached <cal>.sig.
+func LoadTempCalibrations(path string, checks tempCalChecks) ([]tempPoint, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg TempCalibrationsConfig
+	if err := decodeJSON(path, b, &cfg); err != nil {
+		return nil, err
+	}
+	var points []tempPoint
+	for i, e := range cfg.Calibrations {
+		if e.TemperatureC == nil || e.Cal == "" {
+			return nil, fmt.Errorf("%s: calibration %d needs temperature_c and cal", path, i+1)
+		}
+		file := e.Cal
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(path), file)
+		}
+		cal, err := loadCalibrationFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var sig *CalSignature
+		if s, err := LoadSignature(file + ".sig"); err == nil {
+			sig = &s
+		}
+		expired, err := checks.check(e.Cal, cal, sig, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		p, err := newTempPoint(*e.TemperatureC, e.Cal, cal)
+		if err != nil {
+			return nil, err
+		}
+		p.expired = expired
+		points = append(points, p)
+	}
+	return sortTempPoints(points)
+}
+
+// TempCalibrationsFromStore returns the calibrations of scale recorded with
+// an ambient temperature (-ambient-temp): at each temperature, the latest
+// version, which must pass checks.
+func TempCalibrationsFromStore(st Store, scale string, checks tempCalChecks) ([]tempPoint, error) {
+	sessions, err := st.Sessions(scale)
+	if err != nil {
+		return nil, err
+	}
+	latest := map[float64]*Session{}
+	for i := range sessions {
+		s := &sessions[i]
+		if m := s.Result.Session; m != nil && m.TemperatureC != nil {
+			if prev := latest[*m.TemperatureC]; prev == nil || s.Version > prev.Version {
+				latest[*m.TemperatureC] = s
+			}
+		}
+	}
+	if len(latest) == 0 {
+		return nil, fmt.Errorf("scale %q has no calibrations recorded with -ambient-temp", scale)
+	}
+	var points []tempPoint
+	for temp, s := range latest {
+		source := fmt.Sprintf("%s v%d", s.Scale, s.Version)
+		expired, err := checks.check(source, s.Calibration, s.Signature, s.Time)
+		if err != nil {
+			return nil, err
+		}
+		p, err := newTempPoint(temp, source, s.Calibration)
+		if err != nil {
+			return nil, err
+		}
+		p.expired = expired
+		points = append(points, p)
+	}
+	return sortTempPoints(points)
+}
+
+// sortTempPoints orders a temperature set by temperature, refusing an empty
+// set and two calibrations at the same temperature.
+func sortTempPoints(points []tempPoint) ([]tempPoint, error) {
+	if len(points) == 0 {
+		return nil, errors.New("no calibrations with a temperature")
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].temp < points[j].temp })
+	for i, p := range points {
+		if math.IsNaN(p.temp) || math.IsInf(p.temp, 0) {
+			return nil, fmt.Errorf("%s: temperature %g is not a finite number", p.source, p.temp)
+		}
+		if i > 0 && p.temp == points[i-1].temp {
+			return nil, fmt.Errorf("%s and %s are both at %g °C", points[i-1].source, p.source, p.temp)
+		}
+	}
+	return points, nil
+}
+
+// TempCalRef names a calibration of a temperature set.
+type TempCalRef struct {
+	TemperatureC float64 `json:"temperature_c"`
+	Source       string  `json:"source"`
+}
+
+// TemperatureReport is the temperature section of apply mode: the zero and
+// factors weighed with at the current temperature.
+type TemperatureReport struct {
+	TemperatureC float64 `json:"temperature_c"`
+	// Covered is the temperature range of the calibrations; Outside is set
+	// when TemperatureC lies beyond it and Lower, the nearest, is used alone.
+	Covered [2]float64 `json:"covered_c"`
+	Outside bool       `json:"outside_range,omitempty"`
+	// Lower and Upper are the calibrations interpolated between; Fraction is
+	// the way from Lower to Upper.
+	Lower    TempCalRef  `json:"lower"`
+	Upper    *TempCalRef `json:"upper,omitempty"`
+	Fraction float64     `json:"fraction,omitempty"`
+	Zero     [4]float64  `json:"zero"`
+	Factors  [4]float64  `json:"factors"`
+	// Expired lists the calibrations weighed with whose validity period has
+	// ended (-expired-policy warn).
+	Expired []string `json:"expired,omitempty"`
+}
+
+// InterpolateTemperature returns the zero and factors of a temperature set
+// at temperature t (points sorted by temperature).
+func InterpolateTemperature(points []tempPoint, t float64) TemperatureReport {
+	first, last := points[0], points[len(points)-1]
+	rep := TemperatureReport{TemperatureC: t, Covered: [2]float64{first.temp, last.temp}}
+	use := func(p tempPoint) TemperatureReport {
+		rep.Lower = TempCalRef{p.temp, p.source}
+		rep.Zero, rep.Factors = p.zero, p.factors
+		if p.expired {
+			rep.Expired = append(rep.Expired, p.source)
+		}
+		return rep
+	}
+	switch {
+	case t < first.temp:
+		rep.Outside = true
+		return use(first)
+	case t > last.temp:
+		rep.Outside = true
+		return use(last)
+	}
+	k := sort.Search(len(points), func(i int) bool { return points[i].temp >= t })
+	if points[k].temp == t {
+		return use(points[k])
+	}
+	lo, hi := points[k-1], points[k]
+	rep = use(lo)
+	rep.Upper = &TempCalRef{hi.temp, hi.source}
+	if hi.expired {
+		rep.Expired = append(rep.Expired, hi.source)
+	}
+	rep.Fraction = (t - lo.temp) / (hi.temp - lo.temp)
+	for i := range rep.Zero {
+		rep.Zero[i] = lo.zero[i] + rep.Fraction*(hi.zero[i]-lo.zero[i])
+		rep.Factors[i] = lo.factors[i] + rep.Fraction*(hi.factors[i]-lo.factors[i])
+	}
+	return rep
+}
+
+// temperatureCalibration returns the zero and factors at temperature t from
+// the -temp-cals file or, without one, the calibrations of scale in the store
+// spec (with key), each of which must pass checks.
+func temperatureCalibration(t float64, tempCals, spec, key, scale string, checks tempCalChecks) (*TemperatureReport, error) {
+	var points []tempPoint
+	var err error
+	switch {
+	case tempCals != "":
+		points, err = LoadTempCalibrations(tempCals, checks)
+	case spec == "":
+		return nil, errors.New("-temp needs -temp-cals or a store (-store or CAL_STORE) with calibrations of the scale recorded with -ambient-temp")
+	default:
+		var st Store
+		if st, err = OpenStore(spec, key); err != nil {
+			return nil, err
+		}
+		points, err = TempCalibrationsFromStore(st, scale, checks)
+		st.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	rep := InterpolateTemperature(points, t)
+	return &rep, nil
+}
+
+// loadTemperature reads the -temp of a calibrate run and interpolates the
+// temperature calibrations to it, with warnings for expired ones and for a
+// temperature outside them. It returns nil without -temp or -temp-cals.
+func loadTemperature(f *calibrateFlags, trusted ed25519.PublicKey) (*TemperatureReport, []Warning) {
+	if f.tempSpec == "" && f.tempCals == "" {
+		return nil, nil
+	}
+	if f.tempSpec == "" {
+		fmt.Fprintln(os.Stderr, "error: -temp-cals needs -temp, the current temperature")
+		os.Exit(2)
+	}
+	t, err := ReadTemperature(f.tempSpec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: -temp: %v\n", err)
+		os.Exit(2)
+	}
+	rep, err := temperatureCalibration(t, f.tempCals, storeSpec(*f.storeFlag), storeKeySpec(*f.storeKey), f.scaleID,
+		tempCalChecks{trusted: trusted, refuseExpired: f.expiredPolicy == "refuse"})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: temperature calibrations: %v\n", err)
+		os.Exit(1)
+	}
+	var warnings []Warning
+	for _, src := range rep.Expired {
+		fmt.Fprintf(os.Stderr, "WARNING: temperature calibration %s has expired; recertification required\n", src)
+		warnings = append(warnings, newWarning("calibration-expired", src, "temperature calibration %s has expired", src))
+	}
+	if rep.Outside {
+		warnings = append(warnings, newWarning("temperature-range", fmt.Sprintf("%g °C", t),
+			"%g °C is outside the calibrated %g..%g °C; weighing with the nearest calibration (%s at %g °C)",
+			t, rep.Covered[0], rep.Covered[1], rep.Lower.Source, rep.Lower.TemperatureC))
+	}
+	return rep, warnings
+}
+
+// useTemperature has a calibrate run weigh with the zero and factors at the
+// -temp, reporting where they come from. The fit reported and recorded stays
+// that of the calibration.
+func (c *calibrateRun) useTemperature() {
+	r := c.res.Temperature
+	if r == nil {
+		return
+	}
+	c.weighZero, c.weighFactors = r.Zero, r.Factors
+	switch {
+	case r.Outside:
+		emit(&c.sb, "\nTemperature %g °C: WARNING: outside the calibrated %g..%g °C; weighing with the nearest calibration, %s at %g °C\n",
+			r.TemperatureC, r.Covered[0], r.Covered[1], r.Lower.Source, r.Lower.TemperatureC)
+	case r.Upper == nil:
+		emit(&c.sb, "\nTemperature %g °C: weighing with the calibration taken at it, %s\n", r.TemperatureC, r.Lower.Source)
+	default:
+		emit(&c.sb, "\nTemperature %g °C: zero and factors interpolated between %s at %g °C and %s at %g °C (%.0f%% of the way)\n",
+			r.TemperatureC, r.Lower.Source, r.Lower.TemperatureC, r.Upper.Source, r.Upper.TemperatureC, 100*r.Fraction)
+	}
+	emit(&c.sb, "  zero %s, factors %s\n", formatVector(r.Zero), formatVector(r.Factors))
+}
+
+// ReadTemperature returns the current temperature for -temp: a number in °C,
+// or for "cmd:<command>" the number a command reading the sensor prints (the
+// first line of its output).
+func ReadTemperature(spec string) (float64, error) {
+	value := spec
+	if cmdline, ok := strings.CutPrefix(spec, "cmd:"); ok {
+		args := strings.Fields(cmdline)
+		if len(args) == 0 {
+			return 0, errors.New("empty temperature command")
+		}
+		out, err := exec.Command(args[0], args[1:]...).Output()
+		if err != nil {
+			return 0, fmt.Errorf("temperature command failed: %w", err)
+		}
+		value, _, _ = strings.Cut(strings.TrimSpace(string(out)), "\n")
+	}
+	t, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || math.IsNaN(t) || math.IsInf(t, 0) {
+		return 0, fmt.Errorf("invalid temperature %q", value)
+	}
+	return t, nil
+}
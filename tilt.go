@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Tilt compensation. Load cells measure the force normal to the platform, so
+// a platform tilted by an angle t from level shows W cos t for a weight W; the
+// weight is recovered by dividing by cos t. A platform pitched by p and rolled
+// by r is tilted by the angle whose cosine is cos p cos r.
+
+// combinedTilt returns the tilt in degrees of a platform pitched by pitch and
+// rolled by roll degrees.
+func combinedTilt(pitch, roll float64) float64 {
+	c := math.Cos(pitch*math.Pi/180) * math.Cos(roll*math.Pi/180)
+	return math.Acos(math.Min(1, c)) * 180 / math.Pi
+}
+
+// TiltCorrected returns weight measured on a platform tilted by tilt degrees,
+// corrected to the weight on a level platform.
+func TiltCorrected(weight, tilt float64) float64 {
+	return weight / math.Cos(tilt*math.Pi/180)
+}
+
+// checkTiltAngles accepts angles strictly between -90 and 90 degrees.
+func checkTiltAngles(angles ...float64) error {
+	for _, a := range angles {
+		if math.IsNaN(a) || math.Abs(a) >= 90 {
+			return fmt.Errorf("angle %g out of range (-90..90 degrees)", a)
+		}
+	}
+	return nil
+}
+
+// parseTiltValues reads one angle (the tilt) or two (pitch and roll), in
+// degrees, separated by commas or spaces.
+func parseTiltValues(s string) (float64, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r' })
+	if len(fields) < 1 || len(fields) > 2 {
+		return 0, errors.New("want a tilt angle or pitch,roll in degrees")
+	}
+	angles := make([]float64, len(fields))
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid angle %q", f)
+		}
+		angles[i] = v
+	}
+	if err := checkTiltAngles(angles...); err != nil {
+		return 0, err
+	}
+	if len(angles) == 1 {
+		return math.Abs(angles[0]), nil
+	}
+	return combinedTilt(angles[0], angles[1]), nil
+}
+
+// parseTiltJSON reads the "tilt" of a reading: an angle or [pitch, roll], in
+// degrees.
+func parseTiltJSON(raw json.RawMessage) (float64, error) {
+	var angle float64
+	if err := json.Unmarshal(raw, &angle); err == nil {
+		if err := checkTiltAngles(angle); err != nil {
+			return 0, err
+		}
+		return math.Abs(angle), nil
+	}
+	var pr []float64
+	if err := json.Unmarshal(raw, &pr); err != nil || len(pr) != 2 {
+		return 0, errors.New("must be an angle or [pitch, roll] in degrees")
+	}
+	if err := checkTiltAngles(pr...); err != nil {
+		return 0, err
+	}
+	return combinedTilt(pr[0], pr[1]), nil
+}
+
+// ReadTiltSource returns the platform tilt for -tilt: an angle or pitch,roll
+// in degrees, or for "cmd:<command>" the same printed by a command reading the
+// IMU (the first line of its output).
+func ReadTiltSource(spec string) (float64, error) {
+	cmdline, ok := strings.CutPrefix(spec, "cmd:")
+	if !ok {
+		return parseTiltValues(spec)
+	}
+	args := strings.Fields(cmdline)
+	if len(args) == 0 {
+		return 0, errors.New("empty tilt command")
+	}
+	out, err := exec.Command(args[0], args[1:]...).Output()
+	if err != nil {
+		return 0, fmt.Errorf("tilt command failed: %w", err)
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	t, err := parseTiltValues(line)
+	if err != nil {
+		return 0, fmt.Errorf("tilt command output %q: %w", line, err)
+	}
+	return t, nil
+}
+
+// TiltSummary is the tilt section of apply mode.
+type TiltSummary struct {
+	Max float64 `json:"max_tilt"`
+	// Limit is -tilt-max; Beyond lists the readings tilted more.
+	Limit  float64 `json:"limit"`
+	Beyond []int   `json:"beyond_limit"`
+	// Readings counts the readings corrected.
+	Readings int `json:"readings"`
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// exitOutOfTolerance is the exit code of a calibration run whose fit fails
+// the configured tolerances.
+const exitOutOfTolerance = 4
+
+// Tolerance is a set of pass/fail limits for a calibration fit. Zero fields
+// are not checked.
+type Tolerance struct {
+	// AbsError is the largest allowed |estimate - W| over the calibration
+	// rows, in weight units.
+	AbsError float64 `json:"abs_error,omitempty"`
+	// PctError is the same limit as a percentage of W.
+	PctError float64 `json:"pct_error,omitempty"`
+	// MinScore is the lowest allowed quality score (see QualityScore).
+	MinScore float64 `json:"min_score,omitempty"`
+}
+
+func (t Tolerance) empty() bool { return t.AbsError <= 0 && t.PctError <= 0 && t.MinScore <= 0 }
+
+// ToleranceResult is the tolerance section of CalibrationResult.
+type ToleranceResult struct {
+	Profile     string    `json:"profile,omitempty"`
+	Limits      Tolerance `json:"limits"`
+	MaxAbsError float64   `json:"max_abs_error"`
+	MaxPctError float64   `json:"max_pct_error"`
+	Score       float64   `json:"quality_score"`
+	Pass        bool      `json:"pass"`
+	Failures    []string  `json:"failures,omitempty"`
+}
+
+// QualityScore rates a fit from 100 (exact) down to 0: 100 minus 20 points
+// per percent of RMS row error relative to W, so 0.5% RMS scores 90 and 5% or
+// more scores 0.
+func QualityScore(rss, w float64) float64 {
+	if w <= 0 {
+		return 0
+	}
+	rmsPct := 100 * math.Sqrt(rss/5) / w
+	return math.Max(0, 100-20*rmsPct)
+}
+
+// EvaluateTolerance checks the fit of cal with factors against t.
+func EvaluateTolerance(cal CalibrationData, factors [4]float64, rss float64, t Tolerance) ToleranceResult {
+	r := ToleranceResult{Limits: t, Score: QualityScore(rss, cal.CalibrationWeight), Pass: true}
+	for _, row := range calRows(cal) {
+		r.MaxAbsError = math.Max(r.MaxAbsError, math.Abs(ComputeWeight(row, cal.Zero, factors)-cal.CalibrationWeight))
+	}
+	if cal.CalibrationWeight > 0 {
+		r.MaxPctError = 100 * r.MaxAbsError / cal.CalibrationWeight
+	}
+	fail := func(format string, args ...any) {
+		r.Pass = false
+		r.Failures = append(r.Failures, fmt.Sprintf(format, args...))
+	}
+	if t.AbsError > 0 && r.MaxAbsError > t.AbsError {
+		fail("largest row error %.4g exceeds %g", r.MaxAbsError, t.AbsError)
+	}
+	if t.PctError > 0 && r.MaxPctError > t.PctError {
+		fail("largest row error %.4g%% exceeds %g%%", r.MaxPctError, t.PctError)
+	}
+	if t.MinScore > 0 && r.Score < t.MinScore {
+		fail("quality score %.1f is below %g", r.Score, t.MinScore)
+	}
+	return r
+}
+
+// LoadToleranceProfiles reads a JSON object of named tolerance profiles,
+// e.g. {"lab": {"pct_error": 0.02, "min_score": 95}, "floor": {"abs_error": 0.5}}.
+func LoadToleranceProfiles(path string) (map[string]Tolerance, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var profiles map[string]Tolerance
+	if err := json.Unmarshal(b, &profiles); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return profiles, nil
+}
+
+// toleranceFlags registers the tolerance flags on fs. The returned function
+// resolves them after parsing: the named profile (from -tolerance-file or
+// $CAL_TOLERANCES) first, then the individual -tol-* flags on top. It returns
+// the profile name ("" without one) and the limits.
+func toleranceFlags(fs *flag.FlagSet) func() (string, Tolerance, error) {
+	var t Tolerance
+	fs.Float64Var(&t.AbsError, "tol-abs", 0, "pass/fail: largest allowed calibration-row error, weight units")
+	fs.Float64Var(&t.PctError, "tol-pct", 0, "pass/fail: largest allowed calibration-row error, percent of the calibration weight")
+	fs.Float64Var(&t.MinScore, "tol-score", 0, "pass/fail: lowest allowed quality score (0-100)")
+	profile := fs.String("tolerance-profile", "", "named tolerance profile from the -tolerance-file")
+	file := fs.String("tolerance-file", "", "JSON file of named tolerance profiles (default $CAL_TOLERANCES)")
+	return func() (string, Tolerance, error) {
+		if *profile == "" {
+			return "", t, nil
+		}
+		path := *file
+		if path == "" {
+			path = os.Getenv("CAL_TOLERANCES")
+		}
+		if path == "" {
+			return "", t, fmt.Errorf("-tolerance-profile needs -tolerance-file or CAL_TOLERANCES")
+		}
+		profiles, err := LoadToleranceProfiles(path)
+		if err != nil {
+			return "", t, err
+		}
+		p, ok := profiles[*profile]
+		if !ok {
+			var names []string
+			for n := range profiles {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return "", t, fmt.Errorf("no tolerance profile %q in %s (have %s)", *profile, path, strings.Join(names, ", "))
+		}
+		set := map[string]bool{}
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if set["tol-abs"] {
+			p.AbsError = t.AbsError
+		}
+		if set["tol-pct"] {
+			p.PctError = t.PctError
+		}
+		if set["tol-score"] {
+			p.MinScore = t.MinScore
+		}
+		return *profile, p, nil
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"time"
+)
+
+// Totalizer is the persisted accumulation register. It sums the weights of
+// accepted weighments across runs, as on a commercial indicator.
+type Totalizer struct {
+	Total   float64 `json:"total"`
+	Count   int     `json:"count"`
+	Updated string  `json:"updated,omitempty"`
+}
+
+// TotalizerSummary is the JSON schema for the totalizer section of -json-out.
+type TotalizerSummary struct {
+	Mode      string  `json:"mode"`
+	Accepted  []int   `json:"accepted"`
+	RunTotal  float64 `json:"run_total"`
+	Total     float64 `json:"total"`
+	Count     int     `json:"count"`
+	StoreFile string  `json:"store_file,omitempty"`
+}
+
+// LoadTotalizer reads the register from path. A missing file yields an empty register.
+func LoadTotalizer(path string) (Totalizer, error) {
+	var t Totalizer
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return t, err
+	}
+	if err := json.Unmarshal(b, &t); err != nil {
+		return t, err
+	}
+	return t, nil
+}
+
+// SaveTotalizer writes the register to path, stamping the update time.
+func SaveTotalizer(path string, t Totalizer) error {
+	t.Updated = nowUTC().Format(time.RFC3339)
+	out, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(out, '\n'), 0644)
+}
+
+// weighment tracks accept triggers over a sequence of readings.
+//
+// In auto mode a weight is accepted once the last `window` readings agree
+// within `band` and the weight is at least `min`; the register is then locked
+// until the weight drops back below `min` (the platform is unloaded), so one
+// load is never counted twice. In manual mode only the reading numbers listed
+// in `manual` are accepted, regardless of stability.
+type weighment struct {
+	auto   bool
+	window int
+	band   float64
+	min    float64
+	manual map[int]bool
+
+	recent []float64
+	locked bool
+}
+
+func newWeighment(auto bool, window int, band, min float64, manual []int) *weighment {
+	if window < 1 {
+		window = 1
+	}
+	w := &weighment{auto: auto, window: window, band: band, min: min, manual: map[int]bool{}}
+	for _, n := range manual {
+		w.manual[n] = true
+	}
+	return w
+}
+
+// offer feeds reading number n (1-based) with the given weight and reports whether it is accepted.
+func (w *weighment) offer(n int, weight float64) bool {
+	if !w.auto {
+		return w.manual[n]
+	}
+	if weight < w.min {
+		w.locked = false
+		w.recent = w.recent[:0]
+		return false
+	}
+	w.recent = append(w.recent, weight)
+	if len(w.recent) > w.window {
+		w.recent = w.recent[1:]
+	}
+	if w.locked || len(w.recent) < w.window {
+		return false
+	}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, v := range w.recent {
+		lo = math.Min(lo, v)
+		hi = math.Max(hi, v)
+	}
+	if hi-lo > w.band {
+		return false
+	}
+	w.locked = true
+	return true
+}
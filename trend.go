@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TrendSeries is how one calibration quantity moved across the stored
+// versions of a scale. Slope is the least-squares change per 30 days; Change
+// is last minus first, ChangePct relative to |first| (0 when first is 0).
+// Monotonic means every step moved the same way; Drift flags a monotonic
+// series whose total change reaches the drift threshold, the signature of a
+// fatiguing or creeping load cell rather than random recalibration scatter.
+type TrendSeries struct {
+	Name      string    `json:"name"`
+	Values    []float64 `json:"values"`
+	Slope     float64   `json:"slope_per_30d"`
+	Change    float64   `json:"change"`
+	ChangePct float64   `json:"change_pct"`
+	Monotonic bool      `json:"monotonic"`
+	Drift     bool      `json:"drift"`
+}
+
+// TrendReport is the JSON schema of the `trend` command.
+type TrendReport struct {
+	Scale    string        `json:"scale"`
+	Versions []int         `json:"versions"`
+	Dates    []string      `json:"dates"`
+	Series   []TrendSeries `json:"series"`
+	Drifting []string      `json:"drifting"`
+}
+
+// sessionDate is when the calibration was performed: calibrated_at when
+// present, otherwise the time it entered the store.
+func sessionDate(s Session) time.Time {
+	if s.Calibration.CalibratedAt != "" {
+		if t, err := parseCalDate(s.Calibration.CalibratedAt); err == nil {
+			return t
+		}
+	}
+	return s.Time
+}
+
+// AnalyzeTrend builds the trend report over sessions (one scale). Series with
+// fewer than minPoints values are never flagged as drifting.
+func AnalyzeTrend(sessions []Session, minPoints int, driftPct float64) TrendReport {
+	sorted := append([]Session(nil), sessions...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sessionDate(sorted[i]).Before(sessionDate(sorted[j])) })
+
+	rep := TrendReport{Drifting: []string{}}
+	var days []float64
+	var t0 time.Time
+	for i, s := range sorted {
+		d := sessionDate(s)
+		if i == 0 {
+			t0 = d
+			rep.Scale = s.Scale
+		}
+		days = append(days, d.Sub(t0).Hours()/24)
+		rep.Versions = append(rep.Versions, s.Version)
+		rep.Dates = append(rep.Dates, d.Format("2006-01-02"))
+	}
+	add := func(name string, value func(Session) float64) {
+		ts := TrendSeries{Name: name}
+		for _, s := range sorted {
+			ts.Values = append(ts.Values, value(s))
+		}
+		n := len(ts.Values)
+		if n == 0 {
+			return
+		}
+		ts.Slope = trendSlope(days, ts.Values) * 30
+		ts.Change = ts.Values[n-1] - ts.Values[0]
+		if ts.Values[0] != 0 {
+			ts.ChangePct = 100 * ts.Change / math.Abs(ts.Values[0])
+		}
+		ts.Monotonic = n >= 2
+		for i := 1; i < n; i++ {
+			if d := ts.Values[i] - ts.Values[i-1]; d == 0 || (d > 0) != (ts.Change > 0) {
+				ts.Monotonic = false
+			}
+		}
+		ts.Drift = ts.Monotonic && n >= minPoints && math.Abs(ts.ChangePct) >= driftPct
+		if ts.Drift {
+			rep.Drifting = append(rep.Drifting, name)
+		}
+		rep.Series = append(rep.Series, ts)
+	}
+	for ch := 0; ch < 4; ch++ {
+		ch := ch
+		add(fmt.Sprintf("factor[%d]", ch), func(s Session) float64 { return s.Result.Factors[ch] })
+	}
+	for ch := 0; ch < 4; ch++ {
+		ch := ch
+		add(fmt.Sprintf("zero[%d]", ch), func(s Session) float64 { return s.Calibration.Zero[ch] })
+	}
+	add("residual_variance", func(s Session) float64 { return s.Result.ResidualVar })
+	return rep
+}
+
+// trendSlope is the least-squares slope of y over x (0 when x does not vary).
+func trendSlope(x, y []float64) float64 {
+	n := float64(len(x))
+	var sx, sy, sxx, sxy float64
+	for i := range x {
+		sx += x[i]
+		sy += y[i]
+		sxx += x[i] * x[i]
+		sxy += x[i] * y[i]
+	}
+	den := n*sxx - sx*sx
+	if den == 0 {
+		return 0
+	}
+	return (n*sxy - sx*sy) / den
+}
+
+// sparkline renders values as a row of block characters scaled to their range.
+func sparkline(values []float64) string {
+	const bars = "▁▂▃▄▅▆▇█"
+	runes := []rune(bars)
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		lo = math.Min(lo, v)
+		hi = math.Max(hi, v)
+	}
+	var sb strings.Builder
+	for _, v := range values {
+		i := 0
+		if hi > lo {
+			i = int(math.Round((v - lo) / (hi - lo) * float64(len(runes)-1)))
+		}
+		sb.WriteRune(runes[i])
+	}
+	return sb.String()
+}
+
+// runTrend implements `calibrate trend`: report how the factors, zero and
+// residual variance of a scale changed across its stored calibrations.
+func runTrend(args []string) int {
+	fs := flag.NewFlagSet("trend", flag.ExitOnError)
+	storeFlag, storeKey := storeFlags(fs)
+	scale := fs.String("scale", "default", "scale ID")
+	minPoints := fs.Int("min-points", 3, "calibrations needed before a monotonic series counts as drift")
+	driftPct := fs.Float64("drift-pct", 1, "total change (percent of the first value) at which a monotonic series is flagged")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	_ = fs.Parse(args)
+
+	st := openStoreOrExit(*storeFlag, *storeKey)
+	if st == nil {
+		return 1
+	}
+	defer st.Close()
+	sessions, err := st.Sessions(*scale)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading sessions: %v\n", err)
+		return 1
+	}
+	if len(sessions) == 0 {
+		fmt.Fprintf(os.Stderr, "error: no calibrations stored for scale %q\n", *scale)
+		return 1
+	}
+	rep := AnalyzeTrend(sessions, *minPoints, *driftPct)
+
+	if *asJSON {
+		out, _ := json.MarshalIndent(rep, "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+	fmt.Printf("Calibration trend for scale %s (%d versions, %s to %s):\n",
+		rep.Scale, len(rep.Versions), rep.Dates[0], rep.Dates[len(rep.Dates)-1])
+	for _, ts := range rep.Series {
+		mark := ""
+		if ts.Drift {
+			mark = "  DRIFT"
+		} else if ts.Monotonic {
+			mark = "  monotonic"
+		}
+		fmt.Printf("  %-18s %s  first %-12.6g last %-12.6g change %+8.3f%%  slope %+.4g/30d%s\n",
+			ts.Name, sparkline(ts.Values), ts.Values[0], ts.Values[len(ts.Values)-1], ts.ChangePct, ts.Slope, mark)
+	}
+	if len(rep.Drifting) > 0 {
+		fmt.Printf("Monotonic drift in %s: check the load cells for fatigue or creep.\n", strings.Join(rep.Drifting, ", "))
+	}
+	return 0
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// CornerTrim is the recommended adjustment of one corner. Sensitivity is the
+// cell's signal per unit load relative to the mean of the four (1/|f|
+// normalized); CornerError is how far a summed, untrimmed signal reads high
+// or low for a load directly over the cell, in percent. Gain is the factor
+// to scale the cell's signal by, given as a digital trim in percent and as a
+// series resistor in the cell's excitation line.
+type CornerTrim struct {
+	Cell        int         `json:"cell"`
+	Position    *[2]float64 `json:"position,omitempty"`
+	Sensitivity float64     `json:"sensitivity"`
+	CornerError float64     `json:"corner_error_pct"`
+	Gain        float64     `json:"gain"`
+	TrimPct     float64     `json:"trim_pct"`
+	SeriesOhms  float64     `json:"series_ohms"`
+}
+
+// TrimReport recommends trims that equalize the corner sensitivities. Trims
+// only attenuate (as a resistor can), so the least sensitive cell, Reference,
+// is left as it is and the others are brought down to it.
+type TrimReport struct {
+	Reference      int          `json:"reference_cell"`
+	BridgeOhms     float64      `json:"bridge_ohms"`
+	Corners        []CornerTrim `json:"corners"`
+	MaxCornerError float64      `json:"max_corner_error_pct"`
+}
+
+// CornerTrimAnalysis derives corner trims from the fitted factors (weight per
+// count, so a larger |f| is a less sensitive cell). pos, when the calibration
+// has cell_positions, labels each corner. bridgeOhms is the input resistance
+// of one cell's bridge, used to size the series excitation resistors
+// R = bridgeOhms * (1/gain - 1).
+func CornerTrimAnalysis(factors [4]float64, pos *[4][2]float64, bridgeOhms float64) (TrimReport, error) {
+	rep := TrimReport{BridgeOhms: bridgeOhms}
+	var sens [4]float64
+	mean, maxF := 0.0, 0.0
+	for i, f := range factors {
+		if f == 0 {
+			return rep, errors.New("a zero factor has no sensitivity to trim")
+		}
+		sens[i] = 1 / math.Abs(f)
+		mean += sens[i] / 4
+		if math.Abs(f) > maxF {
+			maxF, rep.Reference = math.Abs(f), i
+		}
+	}
+	for i, f := range factors {
+		c := CornerTrim{Cell: i, Sensitivity: sens[i] / mean, Gain: math.Abs(f) / maxF}
+		if pos != nil {
+			c.Position = &pos[i]
+		}
+		c.CornerError = 100 * (c.Sensitivity - 1)
+		c.TrimPct = 100 * (c.Gain - 1)
+		c.SeriesOhms = bridgeOhms * (1/c.Gain - 1)
+		rep.MaxCornerError = math.Max(rep.MaxCornerError, math.Abs(c.CornerError))
+		rep.Corners = append(rep.Corners, c)
+	}
+	return rep, nil
+}
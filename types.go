@@ -9,6 +9,25 @@ type CalibrationData struct {
 	OnCell2           [4]float64 `json:"on_cell_2"`
 	OnCell3           [4]float64 `json:"on_cell_3"`
 	OnCenter          [4]float64 `json:"on_center"`
+	// Units optionally names the weight unit of calibration_weight (e.g. "g", "kg").
+	Units string `json:"units,omitempty"`
+	// CalibratedAt (RFC 3339 or YYYY-MM-DD) and ValidDays optionally give the
+	// calibration a validity period; see -expired-policy.
+	CalibratedAt string `json:"calibrated_at,omitempty"`
+	ValidDays    int    `json:"valid_days,omitempty"`
+	// CellPositions optionally gives the (x, y) mounting position of each cell,
+	// in any length unit, enabling center-of-load estimation in apply mode.
+	CellPositions *[4][2]float64 `json:"cell_positions,omitempty"`
+	// Electrical optionally describes the excitation, ADC and cell rating,
+	// enabling the conversion of the factors to mV/V.
+	Electrical *ElectricalParams `json:"electrical,omitempty"`
+	// Stage is "coarse" for a single-point span calibration (zero and
+	// on_center only) made before the full one, "partial" for the refit of
+	// one replaced cell; empty or "full" otherwise.
+	Stage string `json:"stage,omitempty"`
+	// Replacement is the replaced cell and the factors kept of a "partial"
+	// calibration.
+	Replacement *CellReplacement `json:"cell_replacement,omitempty"`
 }
 
 // CalibrationResult is the JSON schema written when -json-out is used.
@@ -20,4 +39,105 @@ type CalibrationResult struct {
 	ErrorDet      float64    `json:"error_det"`
 	CalibrationW  float64    `json:"calibration_weight"`
 	CalibrationOK bool       `json:"calibration_ok"`
+	// Grade rates the calibration A-F with what lowered it.
+	Grade *Grade `json:"grade,omitempty"`
+	// Influence is the refit-without-each-row analysis.
+	Influence *InfluenceReport `json:"row_influence,omitempty"`
+	// Balance is the hypothesis test of equal corner factors.
+	Balance *BalanceTest `json:"corner_balance,omitempty"`
+	// Trim recommends corner trims when -trim is given.
+	Trim *TrimReport `json:"corner_trim,omitempty"`
+	// Physical converts the factors to mV/V when the calibration has
+	// electrical parameters.
+	Physical *PhysicalReport `json:"physical_units,omitempty"`
+	// Stage is the calibration's stage and the error expected from it.
+	Stage *StageInfo `json:"stage,omitempty"`
+	// CrossCheck compares the factors with a QR solution (-cross-check).
+	CrossCheck *CrossCheck `json:"cross_check,omitempty"`
+	// Tolerance is the pass/fail evaluation when tolerances are configured;
+	// it then decides CalibrationOK instead of the residual variance.
+	Tolerance *ToleranceResult `json:"tolerance,omitempty"`
+	// Totalizer is present when -total-file is used in apply mode.
+	Totalizer *TotalizerSummary `json:"totalizer,omitempty"`
+	// ADCRange counts overload/underload events in apply mode.
+	ADCRange *ADCRangeSummary `json:"adc_range,omitempty"`
+	// CellHealth reports dead/noisy cell detection in apply mode.
+	CellHealth *CellHealthSummary `json:"cell_health,omitempty"`
+	// Eccentricity is the eccentricity test section when -ecc-file is used.
+	Eccentricity *EccentricityReport `json:"eccentricity,omitempty"`
+	// Linearity is the linearity test section when -linearity-file is used.
+	Linearity *LinearityReport `json:"linearity,omitempty"`
+	// Accuracy compares applied readings with the expected weights given in
+	// the -adc-file.
+	Accuracy *AccuracyReport `json:"accuracy,omitempty"`
+	// Repeatability is the repeatability test section when -repeat-file is used.
+	Repeatability *RepeatabilityReport `json:"repeatability,omitempty"`
+	// MinimumWeight is derived from the repeatability test.
+	MinimumWeight *MinWeightReport `json:"minimum_weight,omitempty"`
+	// Noise holds per-channel noise diagnostics when -zero-capture is used.
+	Noise *NoiseReport `json:"noise,omitempty"`
+	// Dynamic lists the items weighed in -dynamic mode.
+	Dynamic *DynamicReport `json:"dynamic,omitempty"`
+	// Checkweigh counts the applied weights per zone of the -product band.
+	Checkweigh *CheckweighReport `json:"checkweighing,omitempty"`
+	// Tilt summarizes the tilt compensation of the applied readings.
+	Tilt *TiltSummary `json:"tilt,omitempty"`
+	// Vibration is the spectrum of the applied weights and the notch filter.
+	Vibration *VibrationReport `json:"vibration,omitempty"`
+	// Decimation counts the readings averaged into the applied ones.
+	Decimation *DecimationSummary `json:"decimation,omitempty"`
+	// Temperature is the zero and factors weighed with at the -temp
+	// temperature.
+	Temperature *TemperatureReport `json:"temperature,omitempty"`
+	// Expiry is the end of the calibration's validity period, when it has one.
+	Expiry  string `json:"expiry,omitempty"`
+	Expired bool   `json:"expired,omitempty"`
+	// Sanity lists the input problems found before fitting.
+	Sanity []Warning `json:"sanity_warnings,omitempty"`
+	// Warnings lists every warning of the run, sanity checks included, with
+	// its stable code.
+	Warnings []Warning `json:"warnings,omitempty"`
+	// ChannelSwap is set when the on_cell rows peak on swapped channels.
+	ChannelSwap *ChannelSwapReport `json:"channel_swap,omitempty"`
+	// Collinearity explains an ill-conditioned fit in terms of the rows.
+	Collinearity *CollinearityReport `json:"collinearity,omitempty"`
+	// Session is the operator, location, ambient and reference-weight
+	// metadata of the calibration session, when recorded.
+	Session *SessionMeta `json:"session,omitempty"`
+	// Readings holds the per-reading results of apply mode.
+	Readings []ReadingResult `json:"readings,omitempty"`
+}
+
+// ReadingResult is the JSON schema for one applied ADC reading. Weight is only
+// meaningful when Valid is set; Invalid explains why it is not. Weight is always
+// the raw high-resolution value; Display is the displayed value after the zero
+// dead band (-zero-band) and rounding to the display division (-d).
+type ReadingResult struct {
+	Reading        int        `json:"reading"`
+	ADC            [4]float64 `json:"adc"`
+	Delta          [4]float64 `json:"delta"`
+	Contrib        [4]float64 `json:"contrib"`
+	Weight         float64    `json:"weight"`
+	Display        *float64   `json:"display_weight,omitempty"`
+	Valid          bool       `json:"valid"`
+	Invalid        string     `json:"invalid,omitempty"`
+	DegradedWeight *float64   `json:"degraded_weight,omitempty"`
+	// Gross is the weight before the tare of ApplyReadings; Filtered its
+	// moving average (see ApplyOptions).
+	Gross    *float64 `json:"gross_weight,omitempty"`
+	Filtered *float64 `json:"filtered_weight,omitempty"`
+	// Uncertainty is the expanded (k=2) uncertainty of Weight from the factor
+	// covariance of the fit and, with -zero-capture, the channel noise.
+	Uncertainty *float64 `json:"uncertainty,omitempty"`
+	// CenterOfLoad is the (x, y) point of load application when the calibration
+	// has cell_positions; OffCenter is its distance from the platform center as
+	// a fraction of the center-to-outermost-cell distance.
+	CenterOfLoad *[2]float64 `json:"center_of_load,omitempty"`
+	OffCenter    *float64    `json:"off_center,omitempty"`
+	// Class is the checkweighing zone (under, accept, over) with -product.
+	Class string `json:"class,omitempty"`
+	// Tilt is the platform tilt in degrees the weight was corrected for.
+	Tilt *float64 `json:"tilt,omitempty"`
+	// Fields are the derived fields set by a -post-script.
+	Fields map[string]any `json:"fields,omitempty"`
 }
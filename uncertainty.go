@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"Calibration-Demo/core"
+)
+
+// uncertaintyK is the coverage factor of the reported reading uncertainty
+// (k = 2, about 95% for normally distributed errors).
+const uncertaintyK = 2
+
+// FactorCovariance returns the covariance of the fitted factors,
+// residualVar * A^-1, where A is the normal matrix X^T X of the fit.
+func FactorCovariance(A [4][4]float64, residualVar float64) ([4][4]float64, error) {
+	var cov [4][4]float64
+	for j := 0; j < 4; j++ {
+		var e [4]float64
+		e[j] = 1
+		col, err := core.Solve4x4(A, e)
+		if err != nil {
+			return cov, fmt.Errorf("inverting the normal matrix: %w", err)
+		}
+		for i := 0; i < 4; i++ {
+			cov[i][j] = residualVar * col[i]
+		}
+	}
+	return cov, nil
+}
+
+// ReadingUncertainty returns the expanded (k = uncertaintyK) uncertainty of
+// the weight computed from a reading with the given delta:
+//
+//	u^2 = delta^T Cov(f) delta + sum_j f_j^2 sigma_j^2
+//
+// The first term is the calibration's contribution, growing with the load;
+// the second is the reading's own noise, sigma_j the per-channel noise in
+// counts (zero without a -zero-capture).
+func ReadingUncertainty(delta, factors [4]float64, cov [4][4]float64, sigma [4]float64) float64 {
+	v := 0.0
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			v += delta[i] * cov[i][j] * delta[j]
+		}
+		v += factors[i] * factors[i] * sigma[i] * sigma[i]
+	}
+	return uncertaintyK * math.Sqrt(math.Max(0, v))
+}
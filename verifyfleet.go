@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FleetCheck is one scale's zero or span check in the fleet verification
+// report: the latest check of the period, how much of its tolerance the
+// error used, and how many checks of the kind the period had and failed.
+type FleetCheck struct {
+	Time      time.Time `json:"time"`
+	Version   int       `json:"version"`
+	Measured  float64   `json:"measured"`
+	Expected  float64   `json:"expected"`
+	Deviation float64   `json:"error"`
+	Tolerance float64   `json:"tolerance"`
+	Used      float64   `json:"tolerance_used"`
+	Pass      bool      `json:"pass"`
+	Error     string    `json:"check_error,omitempty"`
+	Source    string    `json:"source,omitempty"`
+	Checks    int       `json:"checks"`
+	Failed    int       `json:"failed"`
+}
+
+// FleetVerifyEntry is one scale of the report. Used is the largest tolerance
+// used by its checks, the ranking key.
+type FleetVerifyEntry struct {
+	Rank     int         `json:"rank,omitempty"`
+	Scale    string      `json:"scale"`
+	Location string      `json:"location,omitempty"`
+	Zero     *FleetCheck `json:"zero,omitempty"`
+	Span     *FleetCheck `json:"span,omitempty"`
+	Used     float64     `json:"tolerance_used"`
+	Status   string      `json:"status"`
+	Issues   []string    `json:"issues"`
+}
+
+// FleetVerifyReport is the consolidated verification report of `calibrate
+// verify-fleet`, scales ranked by error.
+type FleetVerifyReport struct {
+	Generated time.Time          `json:"generated"`
+	Source    string             `json:"source"`
+	From      *time.Time         `json:"from,omitempty"`
+	Until     *time.Time         `json:"until,omitempty"`
+	Pass      int                `json:"pass"`
+	Fail      int                `json:"fail"`
+	NoData    int                `json:"no_data"`
+	Scales    []FleetVerifyEntry `json:"scales"`
+}
+
+// fleetKinds are the check kinds of the report, in report order.
+var fleetKinds = []string{"zero", "span"}
+
+// fleetCheck summarizes a check result; a check that could not be made uses
+// an infinite share of its tolerance.
+func fleetCheck(r CheckResult) *FleetCheck {
+	c := &FleetCheck{Time: r.Time, Version: r.Version, Measured: r.Measured, Expected: r.Expected,
+		Deviation: r.Measured - r.Expected, Tolerance: r.Tolerance, Pass: r.Pass && r.Error == "", Error: r.Error, Checks: 1}
+	switch {
+	case r.Error != "":
+		c.Used = math.Inf(1)
+	case r.Tolerance > 0:
+		c.Used = math.Abs(c.Deviation) / r.Tolerance
+	}
+	if !c.Pass {
+		c.Failed = 1
+	}
+	return c
+}
+
+// rankFleet sets the status of each entry and sorts them: failed checks
+// first, then by the share of the tolerance used, scales without checks
+// last.
+func rankFleet(rep *FleetVerifyReport) {
+	for i := range rep.Scales {
+		e := &rep.Scales[i]
+		e.Status = "PASS"
+		for _, c := range []*FleetCheck{e.Zero, e.Span} {
+			if c == nil {
+				continue
+			}
+			e.Used = math.Max(e.Used, c.Used)
+			if !c.Pass {
+				e.Status = "FAIL"
+			}
+		}
+		switch {
+		case e.Zero == nil && e.Span == nil:
+			e.Status = "no data"
+			rep.NoData++
+		case e.Status == "FAIL":
+			rep.Fail++
+		default:
+			rep.Pass++
+		}
+	}
+	order := map[string]int{"FAIL": 0, "PASS": 1, "no data": 2}
+	sort.SliceStable(rep.Scales, func(i, j int) bool {
+		a, b := rep.Scales[i], rep.Scales[j]
+		if order[a.Status] != order[b.Status] {
+			return order[a.Status] < order[b.Status]
+		}
+		if a.Used != b.Used {
+			return a.Used > b.Used
+		}
+		return a.Scale < b.Scale
+	})
+	for i := range rep.Scales {
+		if rep.Scales[i].Status != "no data" {
+			rep.Scales[i].Rank = i + 1
+		}
+	}
+}
+
+// fleetFromChecks builds the report entries from the checks recorded in the
+// store between from and until (either may be zero): per scale and kind the
+// latest check, with the counts over the period. Registered scales without
+// checks are listed as having no data.
+func fleetFromChecks(records []CheckRecord, registry []ScaleInfo, from, until time.Time) []FleetVerifyEntry {
+	entries := map[string]*FleetVerifyEntry{}
+	entry := func(scale string) *FleetVerifyEntry {
+		if entries[scale] == nil {
+			entries[scale] = &FleetVerifyEntry{Scale: scale, Issues: []string{}}
+		}
+		return entries[scale]
+	}
+	for _, sc := range registry {
+		entry(sc.ID).Location = sc.Location
+	}
+	for _, r := range records {
+		if r.Time.Before(from) || (!until.IsZero() && !r.Time.Before(until)) {
+			continue
+		}
+		e := entry(r.Scale)
+		slot := &e.Zero
+		if r.Check == "span" {
+			slot = &e.Span
+		}
+		c := fleetCheck(r.CheckResult)
+		c.Source = r.Source
+		if prev := *slot; prev != nil {
+			c.Checks += prev.Checks
+			c.Failed += prev.Failed
+		}
+		*slot = c
+	}
+	out := []FleetVerifyEntry{}
+	for _, e := range entries {
+		out = append(out, *e)
+	}
+	return out
+}
+
+// fleetDirScales returns the scales with capture files in dir, named
+// <scale>.zero.<ext> and <scale>.span.<ext>, and their files by kind.
+func fleetDirScales(dir string) (map[string]map[string]string, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	scales := map[string]map[string]string{}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		base := strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))
+		for _, kind := range fleetKinds {
+			if scale, ok := strings.CutSuffix(base, "."+kind); ok && scale != "" {
+				if scales[scale] == nil {
+					scales[scale] = map[string]string{}
+				}
+				scales[scale][kind] = filepath.Join(dir, f.Name())
+			}
+		}
+	}
+	return scales, nil
+}
+
+// runVerifyFleet implements `calibrate verify-fleet`: one report of the zero
+// and span verification of every scale, ranked by how much of its tolerance
+// the error used, for the periodic metrology review. The checks are taken
+// from the store (the latest of each kind in the period) or, with -dir, run
+// now from a directory of capture files against each scale's active
+// calibration.
+func runVerifyFleet(args []string) int {
+	fs := flag.NewFlagSet("verify-fleet", flag.ExitOnError)
+	storeFlag, storeKey := storeFlags(fs)
+	dir := fs.String("dir", "", "run the checks from the capture files <scale>.zero.json and <scale>.span.json in this directory instead of reporting the recorded ones")
+	month := fs.String("month", "", "report the checks recorded in this month (YYYY-MM)")
+	since := fs.String("since", "", "report the checks recorded at or after this date (YYYY-MM-DD or RFC 3339)")
+	until := fs.String("until", "", "report the checks recorded before this date (YYYY-MM-DD or RFC 3339)")
+	zeroTol := fs.Float64("zero-tol", 0, "with -dir: zero tolerance for scales without a registered one")
+	spanTol := fs.Float64("span-tol", 0, "with -dir: span tolerance for scales without a registered one")
+	spanWeight := fs.Float64("span-weight", 0, "with -dir: span check weight for scales without a registered one")
+	record := fs.Bool("record", false, "with -dir: record the checks in the store like verify-zero and verify-span")
+	operator := fs.String("operator", "", "with -record: operator making the checks (default $CAL_OPERATOR or the login name)")
+	format := fs.String("format", "text", "report format: text, json or csv")
+	out := fs.String("o", "", "write the report to this file instead of stdout")
+	_ = fs.Parse(args)
+
+	if *format != "text" && *format != "json" && *format != "csv" {
+		fmt.Fprintf(os.Stderr, "error: -format must be text, json or csv, got %q\n", *format)
+		return 2
+	}
+	var from, to time.Time
+	var err error
+	switch {
+	case *month != "" && (*since != "" || *until != ""):
+		err = fmt.Errorf("give either -month or -since/-until")
+	case *month != "":
+		if from, err = time.Parse("2006-01", *month); err == nil {
+			to = from.AddDate(0, 1, 0)
+		}
+	default:
+		if *since != "" {
+			from, err = parseCalDate(*since)
+		}
+		if err == nil && *until != "" {
+			to, err = parseCalDate(*until)
+		}
+	}
+	if err == nil && *dir != "" && (!from.IsZero() || !to.IsZero()) {
+		err = fmt.Errorf("-month, -since and -until select recorded checks; -dir runs them now")
+	}
+	if err == nil && *record && *dir == "" {
+		err = fmt.Errorf("-record needs -dir")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+
+	st := openStoreOrExit(*storeFlag, *storeKey)
+	if st == nil {
+		return 1
+	}
+	defer st.Close()
+	registry, err := st.Scales()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading registry: %v\n", err)
+		return 1
+	}
+	rep := FleetVerifyReport{Generated: nowUTC(), Source: "store " + storeSpec(*storeFlag)}
+	if !from.IsZero() {
+		rep.From = &from
+	}
+	if !to.IsZero() {
+		rep.Until = &to
+	}
+
+	if *dir == "" {
+		records, err := st.Checks("")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading checks: %v\n", err)
+			return 1
+		}
+		rep.Scales = fleetFromChecks(records, registry, from, to)
+	} else {
+		rep.Source = "capture files in " + *dir
+		files, err := fleetDirScales(*dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		info := map[string]ScaleInfo{}
+		for _, sc := range registry {
+			info[sc.ID] = sc
+		}
+		rep.Scales = []FleetVerifyEntry{}
+		for scale, byKind := range files {
+			e := FleetVerifyEntry{Scale: scale, Location: info[scale].Location, Issues: []string{}}
+			tol := CheckTolerances{ZeroTol: *zeroTol, SpanTol: *spanTol, SpanWeight: *spanWeight}
+			if reg := info[scale].Check; reg != nil {
+				if reg.ZeroTol > 0 {
+					tol.ZeroTol = reg.ZeroTol
+				}
+				if reg.SpanTol > 0 {
+					tol.SpanTol, tol.SpanWeight = reg.SpanTol, reg.SpanWeight
+				}
+			}
+			active, err := ActiveSession(st, scale)
+			if err == nil && active == nil {
+				err = fmt.Errorf("no active calibration")
+			}
+			if err != nil {
+				e.Issues = append(e.Issues, err.Error())
+				rep.Scales = append(rep.Scales, e)
+				continue
+			}
+			for i, kind := range fleetKinds {
+				if byKind[kind] != "" && [2]float64{tol.ZeroTol, tol.SpanTol}[i] <= 0 {
+					e.Issues = append(e.Issues, fmt.Sprintf("no %s tolerance registered or given; %s not checked", kind, filepath.Base(byKind[kind])))
+				}
+			}
+			for _, r := range RunChecks(active, tol, byKind["zero"], byKind["span"], rep.Generated) {
+				c := fleetCheck(r)
+				c.Source = byKind[r.Check]
+				if r.Check == "span" {
+					e.Span = c
+				} else {
+					e.Zero = c
+				}
+				if *record && r.Error == "" {
+					rec := &CheckRecord{CheckResult: r, SessionID: active.ID, Operator: operatorName(*operator), Source: c.Source}
+					if readings, err := ReadReadingsSource(c.Source); err == nil {
+						rec.Readings = len(readings)
+					}
+					if err := st.SaveCheck(rec); err != nil {
+						fmt.Fprintf(os.Stderr, "error recording check: %v\n", err)
+						return 1
+					}
+				}
+			}
+			rep.Scales = append(rep.Scales, e)
+		}
+		for _, sc := range registry {
+			if files[sc.ID] == nil {
+				rep.Scales = append(rep.Scales, FleetVerifyEntry{Scale: sc.ID, Location: sc.Location, Issues: []string{"no capture files"}})
+			}
+		}
+	}
+	rankFleet(&rep)
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error creating report: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	switch *format {
+	case "json":
+		b, err := json.MarshalIndent(jsonSafeFleet(rep), "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		fmt.Fprintln(w, string(b))
+	case "csv":
+		if err := writeFleetCSV(w, rep); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing csv: %v\n", err)
+			return 1
+		}
+	default:
+		writeFleetText(w, rep)
+	}
+	if rep.Fail > 0 {
+		return 4
+	}
+	return 0
+}
+
+// jsonSafeFleet replaces the infinite share of checks that could not be made
+// with -1, which JSON can carry.
+func jsonSafeFleet(rep FleetVerifyReport) FleetVerifyReport {
+	scales := make([]FleetVerifyEntry, len(rep.Scales))
+	for i, e := range rep.Scales {
+		if math.IsInf(e.Used, 1) {
+			e.Used = -1
+		}
+		for _, c := range []**FleetCheck{&e.Zero, &e.Span} {
+			if *c != nil && math.IsInf((*c).Used, 1) {
+				cc := **c
+				cc.Used = -1
+				*c = &cc
+			}
+		}
+		scales[i] = e
+	}
+	rep.Scales = scales
+	return rep
+}
+
+// fleetUsed formats a share of the tolerance.
+func fleetUsed(used float64) string {
+	if math.IsInf(used, 1) {
+		return "error"
+	}
+	return fmt.Sprintf("%.0f%%", 100*used)
+}
+
+// fleetCell formats one check for the text report.
+func fleetCell(c *FleetCheck) string {
+	switch {
+	case c == nil:
+		return "-"
+	case c.Error != "":
+		return "error"
+	}
+	return fmt.Sprintf("%+.4g/±%g", c.Deviation, c.Tolerance)
+}
+
+func writeFleetText(w io.Writer, rep FleetVerifyReport) {
+	period := "all recorded checks"
+	switch {
+	case rep.From != nil && rep.Until != nil:
+		period = fmt.Sprintf("checks from %s to %s", rep.From.Format("2006-01-02"), rep.Until.AddDate(0, 0, -1).Format("2006-01-02"))
+	case rep.From != nil:
+		period = "checks since " + rep.From.Format("2006-01-02")
+	case rep.Until != nil:
+		period = "checks before " + rep.Until.Format("2006-01-02")
+	}
+	if !strings.HasPrefix(rep.Source, "store") {
+		period = "checks run " + rep.Generated.Format("2006-01-02 15:04")
+	}
+	fmt.Fprintf(w, "Fleet verification report, %s (%s): %d scales, %d pass, %d fail, %d without checks\n",
+		period, rep.Source, len(rep.Scales), rep.Pass, rep.Fail, rep.NoData)
+	fmt.Fprintf(w, "  %4s  %-20s %-16s %5s  %-20s %-20s %6s  %s\n", "rank", "scale", "location", "v", "zero error/tol", "span error/tol", "used", "status")
+	for _, e := range rep.Scales {
+		rank, version := "", ""
+		if e.Rank > 0 {
+			rank = fmt.Sprint(e.Rank)
+		}
+		for _, c := range []*FleetCheck{e.Span, e.Zero} {
+			if c != nil {
+				version = fmt.Sprintf("v%d", c.Version)
+			}
+		}
+		used := fleetUsed(e.Used)
+		if e.Zero == nil && e.Span == nil {
+			used = "-"
+		}
+		fmt.Fprintf(w, "  %4s  %-20s %-16s %5s  %-20s %-20s %6s  %s\n", rank, e.Scale, e.Location, version,
+			fleetCell(e.Zero), fleetCell(e.Span), used, e.Status)
+		for i, c := range []*FleetCheck{e.Zero, e.Span} {
+			if c != nil && c.Error != "" {
+				fmt.Fprintf(w, "        - %s check failed: %s\n", fleetKinds[i], c.Error)
+			}
+			if c != nil && c.Checks > 1 {
+				fmt.Fprintf(w, "        - %d %s checks in the period, %d failed; the latest is shown\n", c.Checks, fleetKinds[i], c.Failed)
+			}
+		}
+		for _, is := range e.Issues {
+			fmt.Fprintf(w, "        - %s\n", is)
+		}
+	}
+}
+
+func writeFleetCSV(w io.Writer, rep FleetVerifyReport) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"rank", "scale", "location", "status", "tolerance_used", "check", "time", "version",
+		"measured", "expected", "error", "tolerance", "pass", "checks", "failed", "check_error", "source"})
+	for _, e := range rep.Scales {
+		rank := ""
+		if e.Rank > 0 {
+			rank = fmt.Sprint(e.Rank)
+		}
+		head := []string{rank, e.Scale, e.Location, e.Status, fleetUsed(e.Used)}
+		if e.Zero == nil && e.Span == nil {
+			head[4] = ""
+			_ = cw.Write(append(head, make([]string, 12)...))
+			continue
+		}
+		for i, c := range []*FleetCheck{e.Zero, e.Span} {
+			if c == nil {
+				continue
+			}
+			_ = cw.Write(append(head, fleetKinds[i], c.Time.Format(time.RFC3339), fmt.Sprint(c.Version),
+				fmt.Sprint(c.Measured), fmt.Sprint(c.Expected), fmt.Sprint(c.Deviation), fmt.Sprint(c.Tolerance),
+				fmt.Sprint(c.Pass), fmt.Sprint(c.Checks), fmt.Sprint(c.Failed), c.Error, c.Source))
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// BuildInfo is the JSON schema of `calibrate version`: what was built and
+// which optional integrations it includes. The sqlite and bolt stores and the
+// network integrations (features.go) are compiled in only with their build
+// tag, or all of them with -tags full; the lists are what registered itself
+// in this binary.
+type BuildInfo struct {
+	Version     string   `json:"version"`
+	Revision    string   `json:"revision,omitempty"`
+	Modified    bool     `json:"modified,omitempty"`
+	Go          string   `json:"go"`
+	Platform    string   `json:"platform"`
+	BuildTags   string   `json:"build_tags,omitempty"`
+	Stores      []string `json:"stores"`
+	Remotes     []string `json:"sync_remotes"`
+	Alerts      []string `json:"alerts"`
+	API         []string `json:"api"`
+	LiveOutputs []string `json:"live_outputs"`
+	LogFormats  []string `json:"log_formats"`
+	Telemetry   []string `json:"telemetry"`
+}
+
+// currentBuild describes the running binary.
+func currentBuild() BuildInfo {
+	b := BuildInfo{
+		Version:     "(devel)",
+		Go:          runtime.Version(),
+		Platform:    runtime.GOOS + "/" + runtime.GOARCH,
+		Remotes:     features("sync remotes"),
+		Alerts:      features("alerts"),
+		API:         features("api"),
+		LiveOutputs: features("live outputs"),
+		LogFormats:  features("log formats"),
+		Telemetry:   features("telemetry"),
+	}
+	for name := range storeBackends {
+		b.Stores = append(b.Stores, name)
+	}
+	sort.Strings(b.Stores)
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if v := bi.Main.Version; v != "" {
+			b.Version = v
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				b.Revision = s.Value
+			case "vcs.modified":
+				b.Modified = s.Value == "true"
+			case "-tags":
+				b.BuildTags = s.Value
+			}
+		}
+	}
+	return b
+}
+
+// runVersion implements `calibrate version`.
+func runVersion(args []string) int {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the build information as JSON")
+	_ = fs.Parse(args)
+
+	b := currentBuild()
+	if *asJSON {
+		out, _ := json.MarshalIndent(b, "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+	rev := b.Revision
+	if rev == "" {
+		rev = "unknown revision"
+	} else if b.Modified {
+		rev += " (modified)"
+	}
+	tags := b.BuildTags
+	if tags == "" {
+		tags = "none"
+	}
+	orNone := func(names []string) string {
+		if len(names) == 0 {
+			return "none"
+		}
+		return strings.Join(names, ", ")
+	}
+	fmt.Printf("calibrate %s, %s, %s %s\n", b.Version, rev, b.Go, b.Platform)
+	fmt.Printf("  build tags:   %s\n", tags)
+	fmt.Printf("  stores:       %s\n", strings.Join(b.Stores, ", "))
+	fmt.Printf("  sync remotes: %s\n", strings.Join(b.Remotes, ", "))
+	fmt.Printf("  alerts:       %s\n", strings.Join(b.Alerts, ", "))
+	fmt.Printf("  api:          %s\n", strings.Join(b.API, ", "))
+	fmt.Printf("  live outputs: %s\n", orNone(b.LiveOutputs))
+	fmt.Printf("  log formats:  %s\n", strings.Join(b.LogFormats, ", "))
+	fmt.Printf("  telemetry:    %s\n", orNone(b.Telemetry))
+	return 0
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// runActivate implements `calibrate activate`: move a scale's active-version
+// pointer to an existing version, e.g. to roll back a bad calibration.
+func runActivate(args []string) int {
+	fs := flag.NewFlagSet("activate", flag.ExitOnError)
+	storeFlag, storeKey := storeFlags(fs)
+	scale := fs.String("scale", "default", "scale ID")
+	version := fs.Int("version", 0, "calibration version to make active (required)")
+	auditLog := fs.String("audit-log", "", "append the change to this audit log (default $CAL_AUDIT_LOG)")
+	operator := fs.String("operator", "", "operator name for the audit log (default $CAL_OPERATOR, then the login name)")
+	_ = fs.Parse(args)
+
+	if *version < 1 {
+		fmt.Fprintln(os.Stderr, "error: -version is required")
+		return 2
+	}
+	st := openStoreOrExit(*storeFlag, *storeKey)
+	if st == nil {
+		return 1
+	}
+	defer st.Close()
+	sessions, err := st.Sessions(*scale)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading sessions: %v\n", err)
+		return 1
+	}
+	prev, _ := st.Active(*scale)
+	var before *Session
+	for i := range sessions {
+		if sessions[i].Version == prev {
+			before = &sessions[i]
+		}
+	}
+	for i, s := range sessions {
+		if s.Version != *version {
+			continue
+		}
+		if err := st.SetActive(*scale, *version); err != nil {
+			fmt.Fprintf(os.Stderr, "error setting active version: %v\n", err)
+			return 1
+		}
+		op := "activate"
+		if *version < prev {
+			op = "rollback"
+		}
+		detail := fmt.Sprintf("active version v%d to v%d", prev, *version)
+		if err := AppendAudit(auditPath(*auditLog), op, operatorName(*operator), *scale, detail,
+			auditSnapshot(before), auditSnapshot(&sessions[i])); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing audit log: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Scale %s: active calibration v%d -> v%d (checksum %.12s)\n", *scale, prev, *version, s.Checksum)
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "error: scale %q has no version %d\n", *scale, *version)
+	return 1
+}
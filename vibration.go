@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/cmplx"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fft computes the discrete Fourier transform of x in place; len(x) must be
+// a power of two.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j |= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		w := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			wk := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a, b := x[start+k], x[start+k+size/2]*wk
+				x[start+k], x[start+k+size/2] = a+b, a-b
+				wk *= w
+			}
+		}
+	}
+}
+
+// AmplitudeSpectrum returns the single-sided amplitude spectrum of a signal
+// sampled at rate Hz: the mean is removed, a Hann window applied and the
+// signal zero-padded to a power of two. amps[k] is the amplitude of a sine at
+// freqs[k] in the units of x.
+func AmplitudeSpectrum(x []float64, rate float64) (freqs, amps []float64) {
+	n := 1
+	for n < len(x) {
+		n <<= 1
+	}
+	mean := 0.0
+	for _, v := range x {
+		mean += v / float64(len(x))
+	}
+	buf := make([]complex128, n)
+	gain := 0.0
+	for i, v := range x {
+		w := 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(len(x)-1))
+		buf[i] = complex((v-mean)*w, 0)
+		gain += w
+	}
+	fft(buf)
+	freqs, amps = make([]float64, n/2+1), make([]float64, n/2+1)
+	for k := range freqs {
+		freqs[k] = float64(k) * rate / float64(n)
+		amps[k] = 2 * cmplx.Abs(buf[k]) / gain
+	}
+	return freqs, amps
+}
+
+// VibrationPeak is a dominant frequency of the weight signal.
+type VibrationPeak struct {
+	Freq      float64 `json:"freq_hz"`
+	Amplitude float64 `json:"amplitude"`
+	// After is the amplitude at the frequency once the notch filter ran.
+	After   *float64 `json:"after_filter,omitempty"`
+	Notched bool     `json:"notched"`
+}
+
+// FindVibrationPeaks returns up to limit local maxima of the spectrum above
+// minFreq that stand snr times above its noise floor (the median amplitude
+// above minFreq), largest first, with the frequency refined by parabolic
+// interpolation between the bins.
+func FindVibrationPeaks(freqs, amps []float64, minFreq, snr float64, limit int) ([]VibrationPeak, float64) {
+	lo := 1
+	for lo < len(freqs) && freqs[lo] < minFreq {
+		lo++
+	}
+	if lo >= len(amps)-1 {
+		return nil, 0
+	}
+	floor := median(append([]float64(nil), amps[lo:]...))
+	var peaks []VibrationPeak
+	for k := lo; k < len(amps)-1; k++ {
+		a, b, c := amps[k-1], amps[k], amps[k+1]
+		if b <= a || b < c || b < snr*floor || b == 0 {
+			continue
+		}
+		p := VibrationPeak{Freq: freqs[k], Amplitude: b}
+		if den := a - 2*b + c; den != 0 {
+			d := 0.5 * (a - c) / den
+			p.Freq += d * (freqs[1] - freqs[0])
+			p.Amplitude = b - 0.25*(a-c)*d
+		}
+		peaks = append(peaks, p)
+	}
+	sort.Slice(peaks, func(i, j int) bool { return peaks[i].Amplitude > peaks[j].Amplitude })
+	if len(peaks) > limit {
+		peaks = peaks[:limit]
+	}
+	return peaks, floor
+}
+
+// amplitudeAt returns the largest amplitude of the spectrum within half a
+// width of f.
+func amplitudeAt(freqs, amps []float64, f, width float64) float64 {
+	out := 0.0
+	for k, fk := range freqs {
+		if math.Abs(fk-f) <= width/2 {
+			out = math.Max(out, amps[k])
+		}
+	}
+	return out
+}
+
+// notchFilter is a second-order IIR notch (the RBJ audio EQ cookbook biquad)
+// removing a band of the given width around f0.
+type notchFilter struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+	primed             bool
+}
+
+func newNotchFilter(f0, width, rate float64) *notchFilter {
+	w0 := 2 * math.Pi * f0 / rate
+	alpha := math.Sin(w0) / (2 * f0 / width)
+	a0 := 1 + alpha
+	return &notchFilter{b0: 1 / a0, b1: -2 * math.Cos(w0) / a0, b2: 1 / a0, a1: -2 * math.Cos(w0) / a0, a2: (1 - alpha) / a0}
+}
+
+// step filters the next sample. The state starts settled on the first
+// sample, so a constant signal passes without a transient.
+func (f *notchFilter) step(x float64) float64 {
+	if !f.primed {
+		f.x1, f.x2, f.y1, f.y2, f.primed = x, x, x, x, true
+	}
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1, f.y2, f.y1 = f.x1, x, f.y1, y
+	return y
+}
+
+// vibrationFilter notches the same frequencies out of each ADC channel,
+// before the weight is computed.
+type vibrationFilter struct {
+	ch [4][]*notchFilter
+}
+
+func newVibrationFilter(freqs []float64, width, rate float64) *vibrationFilter {
+	v := &vibrationFilter{}
+	for ch := range v.ch {
+		for _, f := range freqs {
+			v.ch[ch] = append(v.ch[ch], newNotchFilter(f, width, rate))
+		}
+	}
+	return v
+}
+
+func (v *vibrationFilter) apply(adc [4]float64) [4]float64 {
+	for ch := range adc {
+		for _, f := range v.ch[ch] {
+			adc[ch] = f.step(adc[ch])
+		}
+	}
+	return adc
+}
+
+// parseNotches reads the -notch frequencies, checking each against the
+// Nyquist frequency of the sample rate.
+func parseNotches(s string, rate float64) ([]float64, error) {
+	var out []float64
+	for _, p := range strings.Split(s, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid frequency %q", p)
+		}
+		if f <= 0 || f >= rate/2 {
+			return nil, fmt.Errorf("frequency %g Hz outside 0..%g Hz (half the sample rate)", f, rate/2)
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+// minVibrationReadings is the shortest series the spectrum is computed for.
+const minVibrationReadings = 32
+
+// VibrationReport is the vibration section of apply mode: the dominant
+// frequencies of the weight signal and the notch filter applied.
+type VibrationReport struct {
+	SampleRate float64 `json:"sample_rate_hz"`
+	Readings   int     `json:"readings"`
+	// Resolution is the frequency step of the spectrum; Floor its median
+	// amplitude above MinFreq, in weight units.
+	Resolution float64         `json:"resolution_hz"`
+	MinFreq    float64         `json:"min_freq_hz"`
+	Floor      float64         `json:"noise_floor"`
+	Peaks      []VibrationPeak `json:"peaks"`
+	Notches    []float64       `json:"notches_hz,omitempty"`
+	Width      float64         `json:"notch_width_hz,omitempty"`
+}
+
+// weightSeries converts readings to weights, holding the last weight over
+// readings the range check rejects so they do not put a step into the
+// spectrum.
+func weightSeries(readings [][4]float64, zero, factors [4]float64, inRange func([4]float64) bool) []float64 {
+	out := make([]float64, len(readings))
+	last := math.NaN()
+	for i, adc := range readings {
+		if inRange(adc) {
+			last = ComputeWeight(adc, zero, factors)
+		}
+		out[i] = last
+	}
+	// before the first in-range reading, use the first in-range weight
+	first := math.NaN()
+	for _, w := range out {
+		if !math.IsNaN(w) {
+			first = w
+			break
+		}
+	}
+	for i := range out {
+		if !math.IsNaN(out[i]) {
+			break
+		}
+		out[i] = first
+	}
+	return out
+}
+
+// AnalyzeVibration computes the spectrum of the weights of readings sampled
+// at rate Hz and finds its dominant frequencies (see FindVibrationPeaks).
+func AnalyzeVibration(weights []float64, rate, minFreq, snr float64, limit int) (VibrationReport, error) {
+	rep := VibrationReport{SampleRate: rate, Readings: len(weights), MinFreq: minFreq, Peaks: []VibrationPeak{}}
+	if len(weights) < minVibrationReadings {
+		return rep, fmt.Errorf("vibration analysis needs at least %d readings, have %d", minVibrationReadings, len(weights))
+	}
+	for _, w := range weights {
+		if math.IsNaN(w) {
+			return rep, errors.New("vibration analysis: no reading within the ADC range")
+		}
+	}
+	freqs, amps := AmplitudeSpectrum(weights, rate)
+	rep.Resolution = freqs[1]
+	peaks, floor := FindVibrationPeaks(freqs, amps, minFreq, snr, limit)
+	rep.Floor = floor
+	if peaks != nil {
+		rep.Peaks = peaks
+	}
+	return rep, nil
+}
+
+// residual fills in the amplitude left at each peak in the filtered weights.
+func (r *VibrationReport) residual(filtered []float64) {
+	freqs, amps := AmplitudeSpectrum(filtered, r.SampleRate)
+	for i := range r.Peaks {
+		a := amplitudeAt(freqs, amps, r.Peaks[i].Freq, math.Max(r.Width, 2*r.Resolution))
+		r.Peaks[i].After = &a
+	}
+}
+
+// formatFreqs lists frequencies for the text report.
+func formatFreqs(freqs []float64) string {
+	parts := make([]string, len(freqs))
+	for i, f := range freqs {
+		parts[i] = strconv.FormatFloat(f, 'f', 3, 64)
+	}
+	return strings.Join(parts, ", ")
+}
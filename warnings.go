@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+)
+
+// Warning is one condition worth a look that does not stop the run. Code is
+// stable across releases (see warningCodes), so automation can react to it
+// without matching messages; Check is its readable name and Subject names
+// the row, channel or reading concerned ("" for the whole run).
+type Warning struct {
+	Code    string `json:"code"`
+	Check   string `json:"check"`
+	Subject string `json:"subject,omitempty"`
+	Message string `json:"message"`
+}
+
+func (w Warning) String() string {
+	if w.Subject == "" {
+		return fmt.Sprintf("%s [%s] %s", w.Code, w.Check, w.Message)
+	}
+	return fmt.Sprintf("%s [%s] %s: %s", w.Code, w.Check, w.Subject, w.Message)
+}
+
+// warningCode documents one stable warning code.
+type warningCode struct {
+	Code        string `json:"code"`
+	Check       string `json:"check"`
+	Description string `json:"description"`
+}
+
+// warningCodes is the registry of warning codes. Codes are never reused or
+// renumbered; new checks are appended.
+var warningCodes = []warningCode{
+	{"CAL-W001", "ill-conditioned", "calibration rows are (nearly) linearly dependent; the factors are poorly determined"},
+	{"CAL-W002", "channel-swap", "the on_cell rows peak on a permutation of the channels"},
+	{"CAL-W003", "calibration-expired", "the validity period of the calibration has ended"},
+	{"CAL-W004", "negative-factor", "a factor has the opposite sign of its channel's load response"},
+	{"CAL-W005", "weight-not-positive", "calibration_weight is not greater than 0"},
+	{"CAL-W006", "zero-out-of-range", "a zero count is at or beyond the ADC limits"},
+	{"CAL-W007", "row-out-of-range", "a loaded calibration count is at or beyond the ADC limits"},
+	{"CAL-W008", "flat-channel", "a channel does not move with the center load"},
+	{"CAL-W009", "negative-delta", "on_cell_X moved channel X against its polarity"},
+	{"CAL-W010", "dominant-channel", "the largest delta of on_cell_X is not on channel X"},
+	{"CAL-W011", "duplicate-row", "two calibration rows are identical or nearly so"},
+	{"CAL-W012", "calibration-expiring", "the calibration expires within -remind-days"},
+	{"CAL-W013", "adc-out-of-range", "applied readings were overloaded or underloaded and marked invalid"},
+	{"CAL-W014", "cell-degraded", "a load cell looks dead or noisy in the applied readings"},
+	{"CAL-W015", "off-center-load", "a reading's center of load is beyond -off-center-max"},
+	{"CAL-W016", "resolution-exceeds-division", "the noise-limited resolution is worse than the display division"},
+	{"CAL-W017", "division-mismatch", "e is not a whole multiple of the display division d"},
+	{"CAL-W018", "out-of-tolerance", "the fit fails the configured tolerances"},
+	{"CAL-W019", "reference-weight", "a problem with the reference weight used for the calibration"},
+	{"CAL-W020", "influential-row", "leaving one calibration row out moves the factors by more than 5% (needs two more rows than factors)"},
+	{"CAL-W021", "corner-imbalance", "the corner factors differ significantly (mechanical or corner-loading problem)"},
+	{"CAL-W022", "apply-interrupted", "a -stream apply was stopped by a signal before the end of the adc file"},
+	{"CAL-W023", "readings-shed", "-shed-load dropped readings because applying them fell behind the input"},
+	{"CAL-W024", "cell-out-of-family", "a cell's mV/V sensitivity differs from the median of the four by more than the electrical tolerance"},
+	{"CAL-W025", "cell-off-datasheet", "a cell's mV/V sensitivity differs from its datasheet rated output by more than the electrical tolerance"},
+	{"CAL-W026", "tilt-exceeded", "a reading's platform tilt is beyond -tilt-max"},
+	{"CAL-W027", "vibration", "the weight signal has a dominant vibration frequency that no -notch suppresses"},
+	{"CAL-W028", "temperature-range", "the -temp temperature is outside the range of the temperature calibrations"},
+}
+
+// warningCodeOf returns the code registered for check.
+func warningCodeOf(check string) string {
+	for _, c := range warningCodes {
+		if c.Check == check {
+			return c.Code
+		}
+	}
+	panic("unregistered warning check " + check)
+}
+
+// newWarning builds a Warning for a registered check.
+func newWarning(check, subject, format string, args ...any) Warning {
+	return Warning{Code: warningCodeOf(check), Check: check, Subject: subject, Message: fmt.Sprintf(format, args...)}
+}
+
+// runWarnings implements `calibrate warnings`: list the warning codes.
+func runWarnings(args []string) int {
+	fs := flag.NewFlagSet("warnings", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the codes as JSON")
+	_ = fs.Parse(args)
+
+	if *asJSON {
+		out, _ := json.MarshalIndent(warningCodes, "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+	for _, c := range warningCodes {
+		fmt.Printf("%s  %-28s %s\n", c.Code, c.Check, c.Description)
+	}
+	return 0
+}
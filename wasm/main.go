@@ -0,0 +1,147 @@
+//go:build js && wasm
+
+// Command wasm is the calibration solver for the browser: built with
+//
+//	GOOS=js GOARCH=wasm go build -o calibrate.wasm ./wasm
+//
+// and loaded with Go's wasm_exec.js, it defines two global functions that run
+// the same core arithmetic as the calibrate tool, without a backend call:
+//
+//	calibrate(json) fits a calibration file (schema v1 or v2) and returns
+//	    {factors, rss, residual_variance, calibration_ok}, keeping the
+//	    calibration for weigh
+//	weigh(adc) returns the weight of a reading [a, b, c, d] with the last
+//	    calibration
+//
+// On bad input both return {error: message} instead.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"syscall/js"
+
+	"Calibration-Demo/core"
+)
+
+// calibrationOKVar is the residual variance below which calibrate reports
+// calibration_ok, as the calibrate tool does.
+const calibrationOKVar = 1e-6
+
+// calFile is the part of a calibration file the solver needs, in both layouts.
+type calFile struct {
+	SchemaVersion     int        `json:"schema_version"`
+	CalibrationWeight float64    `json:"calibration_weight"`
+	Zero              [4]float64 `json:"zero"`
+	OnCell0           [4]float64 `json:"on_cell_0"`
+	OnCell1           [4]float64 `json:"on_cell_1"`
+	OnCell2           [4]float64 `json:"on_cell_2"`
+	OnCell3           [4]float64 `json:"on_cell_3"`
+	OnCenter          [4]float64 `json:"on_center"`
+	Readings          *struct {
+		Zero   [4]float64 `json:"zero"`
+		Cell0  [4]float64 `json:"cell_0"`
+		Cell1  [4]float64 `json:"cell_1"`
+		Cell2  [4]float64 `json:"cell_2"`
+		Cell3  [4]float64 `json:"cell_3"`
+		Center [4]float64 `json:"center"`
+	} `json:"readings"`
+}
+
+// calibration is the one fitted by the last successful calibrate call.
+var calibration struct {
+	ok      bool
+	zero    [4]float64
+	factors [4]float64
+}
+
+// fit decodes a calibration file and fits its factors.
+func fit(input string) (map[string]any, error) {
+	var f calFile
+	if err := json.Unmarshal([]byte(input), &f); err != nil {
+		return nil, err
+	}
+	rows := [core.Placements][4]float64{f.OnCell0, f.OnCell1, f.OnCell2, f.OnCell3, f.OnCenter}
+	zero := f.Zero
+	switch {
+	case f.SchemaVersion > 2:
+		return nil, fmt.Errorf("schema_version %d is newer than supported (2)", f.SchemaVersion)
+	case f.SchemaVersion == 2 && f.Readings == nil:
+		return nil, errors.New("schema_version 2 needs a \"readings\" object")
+	case f.SchemaVersion == 2:
+		r := f.Readings
+		rows, zero = [core.Placements][4]float64{r.Cell0, r.Cell1, r.Cell2, r.Cell3, r.Center}, r.Zero
+	case f.Readings != nil:
+		return nil, errors.New("\"readings\" needs \"schema_version\": 2")
+	}
+	factors, err := core.Factors(rows, zero, f.CalibrationWeight, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not solve normal equations: %w", err)
+	}
+	for i, v := range factors {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("solver produced f%d = %v", i, v)
+		}
+	}
+	rss := 0.0
+	for _, row := range rows {
+		resid := f.CalibrationWeight - core.Weight(row, zero, factors)
+		rss += resid * resid
+	}
+	residualVar := rss / float64(core.Placements-4)
+	calibration.ok, calibration.zero, calibration.factors = true, zero, factors
+	return map[string]any{
+		"factors":           []any{factors[0], factors[1], factors[2], factors[3]},
+		"rss":               rss,
+		"residual_variance": residualVar,
+		"calibration_ok":    residualVar < calibrationOKVar,
+	}, nil
+}
+
+// weigh computes the weight of a JS array of 4 ADC counts.
+func weigh(v js.Value) (float64, error) {
+	if !calibration.ok {
+		return 0, errors.New("no calibration: call calibrate first")
+	}
+	if !js.Global().Get("Array").Call("isArray", v).Bool() || v.Length() != 4 {
+		return 0, errors.New("want an array of 4 ADC counts")
+	}
+	var adc [4]float64
+	for i := range adc {
+		if v.Index(i).Type() != js.TypeNumber {
+			return 0, fmt.Errorf("adc[%d] is not a number", i)
+		}
+		adc[i] = v.Index(i).Float()
+	}
+	return core.Weight(adc, calibration.zero, calibration.factors), nil
+}
+
+func errorResult(err error) any {
+	return map[string]any{"error": err.Error()}
+}
+
+func main() {
+	js.Global().Set("calibrate", js.FuncOf(func(this js.Value, args []js.Value) any {
+		if len(args) != 1 || args[0].Type() != js.TypeString {
+			return errorResult(errors.New("calibrate takes the calibration JSON as a string"))
+		}
+		res, err := fit(args[0].String())
+		if err != nil {
+			return errorResult(err)
+		}
+		return res
+	}))
+	js.Global().Set("weigh", js.FuncOf(func(this js.Value, args []js.Value) any {
+		if len(args) != 1 {
+			return errorResult(errors.New("weigh takes one reading [a, b, c, d]"))
+		}
+		w, err := weigh(args[0])
+		if err != nil {
+			return errorResult(err)
+		}
+		return w
+	}))
+	select {} // keep the functions alive
+}
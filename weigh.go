@@ -0,0 +1,690 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+// weighing is the state of the weighing phase of a calibrate run: the
+// readings of -adc, -adc-file or -stream weighed with the fitted (or
+// temperature-interpolated) zero and factors.
+type weighing struct {
+	tot        Totalizer
+	totSummary *TotalizerSummary
+	accepter   *weighment
+
+	rangeSummary *ADCRangeSummary
+	cellHealth   *CellHealthSummary
+	factorCov    [4][4]float64
+	covErr       error
+	chanSigma    [4]float64
+
+	results       []ReadingResult
+	batch         batchTally
+	accTally      *accuracyTally
+	scriptDropped int
+
+	// -readings-out is written by its own stage, behind a bounded queue,
+	// so a slow disk holds back the apply stage rather than growing memory
+	readingsOut  *pipe[timedReading]
+	readingsErr  error
+	readingsDone chan struct{}
+
+	// the weight known to be on the platform and the tilt of the reading
+	// being weighed (nil when not given)
+	expected, tilt *float64
+}
+
+// appliedInput is a reading to weigh with its 1-based number.
+type appliedInput struct {
+	n   int
+	adc [4]float64
+}
+
+// loadTotalizer loads the persisted register before the readings are
+// weighed. Concurrent apply runs take turns on the register until it is
+// saved: the returned func releases it.
+func (c *calibrateRun) loadTotalizer() (unlock func()) {
+	f := c.f
+	if f.totalFile == "" || !f.apply || !c.haveADC {
+		return func() {}
+	}
+	unlock, err := lockFile(f.totalFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error locking totalizer file: %v\n", err)
+		os.Exit(1)
+	}
+	tot, err := LoadTotalizer(f.totalFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading totalizer file: %v\n", err)
+		os.Exit(1)
+	}
+	if f.totalReset {
+		if err := AppendAudit(auditPath(f.auditLog), "totalizer-reset", operatorName(f.operator), f.scaleID,
+			f.totalFile, tot, Totalizer{}); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing audit log: %v\n", err)
+			os.Exit(1)
+		}
+		tot = Totalizer{}
+	}
+	window := f.stableWindow
+	if len(c.manyReadings) == 0 && c.stream == nil {
+		// a single reading is treated as already settled
+		window = 1
+	}
+	c.w.tot = tot
+	c.w.accepter = newWeighment(f.totalMode == "auto", window, f.stableBand, f.totalMin, c.manualAccept)
+	c.w.totSummary = &TotalizerSummary{Mode: f.totalMode, Accepted: []int{}, StoreFile: f.totalFile}
+	return unlock
+}
+
+// weigh weighs the readings of the run, reporting each, and then their
+// decimation, range events and accuracy.
+func (c *calibrateRun) weigh() {
+	f, w := c.f, &c.w
+
+	// ADC range checks: a channel at or beyond the rails is saturated (overload)
+	// or implausibly low (underload), and the weight computed from it is garbage.
+	w.rangeSummary = &ADCRangeSummary{Min: f.adcMin, Max: f.adcMax, Invalid: []int{}}
+
+	var inputs []appliedInput
+	if f.apply && c.haveADC && c.stream == nil {
+		if len(c.manyReadings) > 0 {
+			for idx, row := range c.manyReadings {
+				inputs = append(inputs, appliedInput{n: idx + 1, adc: row})
+			}
+		} else {
+			inputs = append(inputs, appliedInput{n: 1, adc: c.adcInput})
+		}
+	}
+	c.assessCells(inputs)
+
+	// Reading uncertainty: the factor covariance of the fit plus, with a zero
+	// capture, each channel's noise
+	if c.zeroSamples != nil {
+		rep, err := EstimateNoise(c.zeroSamples, c.cal, c.factors, f.adcMax-f.adcMin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "noise estimation error: %v\n", err)
+			os.Exit(1)
+		}
+		c.res.Noise = &rep
+		for _, ch := range rep.Channels {
+			w.chanSigma[ch.Channel] = ch.Sigma
+		}
+	}
+	w.factorCov, w.covErr = FactorCovariance(c.A, c.res.ResidualVar)
+
+	c.applied = len(inputs) > 0 || c.stream != nil
+	if f.readingsOut != "" && c.applied {
+		c.startReadingsOut()
+	}
+
+	// Decimation of the readings in memory; a -stream is decimated as it is
+	// read
+	var decim *decimator
+	if c.decIn > 0 && c.applied && (len(c.manyReadings) > 0 || c.stream != nil) {
+		decim = newDecimator(c.decIn, c.decOut, w.rangeSummary.within)
+	}
+	if decim != nil && len(c.manyReadings) > 0 {
+		inputs = c.decimate(decim, inputs)
+	}
+	vibFilter := c.vibration(inputs)
+
+	if !c.applied {
+		c.reportAccuracy()
+		return
+	}
+	_, span := c.tel.start(c.ctx, "apply", attr("calibrate.stream", c.stream != nil))
+	for _, in := range inputs {
+		w.expected = nil
+		if in.n <= len(c.adcExpected) {
+			w.expected = c.adcExpected[in.n-1]
+		}
+		w.tilt = c.runTilt
+		if in.n <= len(c.adcTilt) && c.adcTilt[in.n-1] != nil {
+			w.tilt = c.adcTilt[in.n-1]
+		}
+		c.weighReading(in.n, in.adc, len(c.manyReadings) == 0)
+	}
+	var stages []StageStats
+	if c.stream != nil {
+		stages = append(stages, c.weighStream(decim, vibFilter))
+	}
+	if w.readingsOut != nil {
+		w.readingsOut.close()
+		<-w.readingsDone
+		stages = append(stages, w.readingsOut.Stats())
+		if w.readingsErr != nil {
+			c.sb.discard()
+			fmt.Fprintf(os.Stderr, "error writing readings: %v\n", w.readingsErr)
+			os.Exit(1)
+		}
+	}
+	if f.pipeStats {
+		for _, st := range stages {
+			fmt.Fprintf(os.Stderr, "pipeline %s\n", st)
+		}
+	}
+	if decim != nil {
+		d := decim.summary(f.sampleRate)
+		c.res.Decimation = d
+		emit(&c.sb, "\nDecimation: %d reading(s) averaged to %d", d.Inputs, d.Outputs)
+		if d.InRate > 0 {
+			emit(&c.sb, ", %g Hz to %.4g Hz", d.InRate, d.OutRate)
+		}
+		emit(&c.sb, " (%.4g readings per output)\n", d.Factor)
+	}
+	if w.scriptDropped > 0 {
+		emit(&c.sb, "\nPost-script: %d reading(s) dropped by %s\n", w.scriptDropped, f.postScriptFile)
+	}
+	if rs := w.rangeSummary; rs.Overload > 0 || rs.Underload > 0 {
+		emit(&c.sb, "\nADC range events: %d overload, %d underload; %d invalid reading(s) %v (limits %.0f..%.0f)\n",
+			rs.Overload, rs.Underload, len(rs.Invalid), rs.Invalid, f.adcMin, f.adcMax)
+		c.warnings = append(c.warnings, newWarning("adc-out-of-range", "", "%d overload, %d underload; readings %v invalid",
+			rs.Overload, rs.Underload, rs.Invalid))
+	}
+	span.set(attr("calibrate.readings", w.batch.b.Readings), attr("calibrate.invalid", w.batch.b.Invalid))
+	span.end()
+	c.tel.countReadings(true, int64(w.batch.b.Valid))
+	c.tel.countReadings(false, int64(w.batch.b.Invalid))
+	c.reportAccuracy()
+}
+
+// assessCells detects dead or degraded cells over the in-range readings of
+// the run.
+func (c *calibrateRun) assessCells(inputs []appliedInput) {
+	if len(inputs) == 0 {
+		return
+	}
+	f := c.f
+	var usable [][4]float64
+	for _, in := range inputs {
+		if c.w.rangeSummary.within(in.adc) {
+			usable = append(usable, in.adc)
+		}
+	}
+	h := AssessCells(usable, c.weighZero, f.deadRatio, f.noiseRatio, f.deadMinMove)
+	h.CenterShare = CenterShares(c.cal, c.factors)
+	c.w.cellHealth = &h
+	for _, ch := range h.Channels {
+		if ch.Status != cellOK {
+			emit(&c.sb, "WARNING: cell %d looks %s (delta span %.1f, noise %.1f counts); degraded-mode estimates use the remaining cells\n",
+				ch.Channel, ch.Status, ch.Span, ch.Noise)
+			c.warnings = append(c.warnings, newWarning("cell-degraded", fmt.Sprintf("ch%d", ch.Channel),
+				"looks %s (delta span %.1f, noise %.1f counts)", ch.Status, ch.Span, ch.Noise))
+		}
+	}
+}
+
+// startReadingsOut starts the stage writing -readings-out.
+func (c *calibrateRun) startReadingsOut() {
+	f, w := c.f, &c.w
+	file, err := os.Create(f.readingsOut)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error writing readings: %v\n", err)
+		os.Exit(1)
+	}
+	w.readingsOut = newPipe[timedReading]("apply→readings-out", f.pipeDepth, false)
+	w.readingsDone = make(chan struct{})
+	go func() {
+		defer close(w.readingsDone)
+		buf := bufio.NewWriter(file)
+		enc := json.NewEncoder(buf)
+		var lab *labCSVWriter // readings.csv: the lab DAQ columns
+		if isCSVPath(f.readingsOut) {
+			lab, w.readingsErr = newLabCSVWriter(buf, c.cal.Units)
+		}
+		for {
+			r, ok := w.readingsOut.recv()
+			if !ok {
+				break
+			}
+			switch {
+			case w.readingsErr != nil:
+			case lab != nil:
+				w.readingsErr = lab.write(r)
+			default:
+				w.readingsErr = enc.Encode(r.ReadingResult)
+			}
+		}
+		if lab != nil && w.readingsErr == nil {
+			w.readingsErr = lab.flush()
+		}
+		if err := buf.Flush(); w.readingsErr == nil {
+			w.readingsErr = err
+		}
+		if err := file.Close(); w.readingsErr == nil {
+			w.readingsErr = err
+		}
+	}()
+}
+
+// decimate averages the readings in memory down to the lower rate, keeping
+// the expected weight and tilt of each output.
+func (c *calibrateRun) decimate(decim *decimator, inputs []appliedInput) []appliedInput {
+	var out []appliedInput
+	var expected, tilts []*float64
+	take := func(d decimated) {
+		out = append(out, appliedInput{n: len(out) + 1, adc: d.adc})
+		expected, tilts = append(expected, d.meta.Expected), append(tilts, d.meta.Tilt)
+	}
+	for _, in := range inputs {
+		var meta readingMeta
+		if in.n <= len(c.adcExpected) {
+			meta.Expected = c.adcExpected[in.n-1]
+		}
+		if in.n <= len(c.adcTilt) {
+			meta.Tilt = c.adcTilt[in.n-1]
+		}
+		if d, ok := decim.add(in.adc, meta); ok {
+			take(d)
+		}
+	}
+	if d, ok := decim.flush(); ok {
+		take(d)
+	}
+	c.adcTilt = tilts
+	if c.adcExpected != nil {
+		c.adcExpected = expected
+	}
+	return out
+}
+
+// vibration analyses the spectrum of the weight signal over the readings and
+// notch filters the ADC channels of inputs before their weights are
+// computed. It returns the filter for the readings of a -stream, or nil.
+func (c *calibrateRun) vibration(inputs []appliedInput) *vibrationFilter {
+	f := c.f
+	if !c.applied || (!f.vibration && f.notch == "") {
+		return nil
+	}
+	within := c.w.rangeSummary.within
+	series := func() []float64 {
+		raw := make([][4]float64, len(inputs))
+		for i, in := range inputs {
+			raw[i] = in.adc
+		}
+		return weightSeries(raw, c.weighZero, c.weighFactors, within)
+	}
+	var vibReport *VibrationReport
+	var vibFilter *vibrationFilter
+	if len(inputs) > 0 && (f.vibration || f.notch == "auto") {
+		rep, err := AnalyzeVibration(series(), c.rate, f.vibMinFreq, f.vibSNR, f.vibPeaks)
+		if err != nil {
+			c.sb.discard()
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(2)
+		}
+		vibReport = &rep
+		if f.notch == "auto" {
+			for _, p := range rep.Peaks {
+				c.notches = append(c.notches, p.Freq)
+			}
+		}
+	}
+	notches := c.notches
+	if len(notches) > 0 {
+		vibFilter = newVibrationFilter(notches, f.notchWidth, c.rate)
+		for i := range inputs {
+			if within(inputs[i].adc) {
+				inputs[i].adc = vibFilter.apply(inputs[i].adc)
+			}
+		}
+	}
+	if vr := vibReport; vr != nil {
+		if len(notches) > 0 {
+			vr.Notches, vr.Width = notches, f.notchWidth
+			for i := range vr.Peaks {
+				for _, freq := range notches {
+					vr.Peaks[i].Notched = vr.Peaks[i].Notched || math.Abs(vr.Peaks[i].Freq-freq) <= f.notchWidth/2
+				}
+			}
+			vr.residual(series())
+		}
+		emit(&c.sb, "\nVibration spectrum (%d readings at %g Hz, resolution %.3g Hz, noise floor %.4g above %g Hz):\n",
+			vr.Readings, vr.SampleRate, vr.Resolution, vr.Floor, vr.MinFreq)
+		if len(vr.Peaks) == 0 {
+			emit(&c.sb, "  no dominant frequency (none %g times above the noise floor)\n", f.vibSNR)
+		}
+		for _, p := range vr.Peaks {
+			emit(&c.sb, "  %8.3f Hz  amplitude %.4g", p.Freq, p.Amplitude)
+			switch {
+			case p.After != nil && p.Notched:
+				emit(&c.sb, " -> %.4g after the notch filter\n", *p.After)
+			default:
+				emit(&c.sb, " (not filtered)\n")
+				c.warnings = append(c.warnings, newWarning("vibration", fmt.Sprintf("%.3f Hz", p.Freq),
+					"vibration of amplitude %.4g at %.3f Hz", p.Amplitude, p.Freq))
+			}
+		}
+		c.res.Vibration = vr
+	}
+	if vibFilter != nil {
+		emit(&c.sb, "Notch filter: %s Hz (width %g Hz) on every channel before weight estimation\n", formatFreqs(notches), f.notchWidth)
+	}
+	return vibFilter
+}
+
+// weighStream weighs a -stream as a pipeline: the decode stage reads the
+// file ahead into a bounded queue for the apply stage (this loop), which
+// feeds the -readings-out stage. With -shed-load, readings the apply stage
+// has no room for are dropped at decode. It returns the decode stage's
+// statistics.
+func (c *calibrateRun) weighStream(decim *decimator, vibFilter *vibrationFilter) StageStats {
+	f := c.f
+	type streamReading struct {
+		n    int
+		adc  [4]float64
+		meta readingMeta
+	}
+	decoded := newPipe[streamReading]("decode→apply", f.pipeDepth, f.shedLoad)
+	var decodeErr error
+	decodeDone := make(chan struct{})
+	go func() {
+		defer close(decodeDone)
+		defer decoded.close()
+		for n := 1; ; n++ {
+			adc, meta, ok, err := c.stream.Next()
+			if err != nil || !ok {
+				decodeErr = err
+				return
+			}
+			if !decoded.send(streamReading{n, adc, meta}) {
+				return
+			}
+		}
+	}()
+	applyStreamed := func(n int, adc [4]float64, meta readingMeta) {
+		c.w.expected, c.w.tilt = meta.Expected, c.runTilt
+		if meta.Tilt != nil {
+			c.w.tilt = meta.Tilt
+		}
+		if vibFilter != nil && c.w.rangeSummary.within(adc) {
+			adc = vibFilter.apply(adc)
+		}
+		c.weighReading(n, adc, false)
+	}
+	done := 0
+	for {
+		if c.interrupted.Err() != nil {
+			emit(&c.sb, "\nInterrupted: stopped after %d reading(s); the summaries below cover those only\n", done)
+			c.warnings = append(c.warnings, newWarning("apply-interrupted", "", "stopped by a signal after %d reading(s) of %s", done, f.adcFile))
+			decoded.stop()
+			break
+		}
+		r, ok := decoded.recv()
+		if !ok {
+			break
+		}
+		done++
+		if decim == nil {
+			applyStreamed(r.n, r.adc, r.meta)
+		} else if d, ok := decim.add(r.adc, r.meta); ok {
+			applyStreamed(decim.outputs, d.adc, d.meta)
+		}
+	}
+	if decim != nil {
+		if d, ok := decim.flush(); ok {
+			applyStreamed(decim.outputs, d.adc, d.meta)
+		}
+	}
+	<-decodeDone // the stream is unmapped on return
+	if decodeErr != nil && c.interrupted.Err() == nil {
+		c.sb.discard()
+		fmt.Fprintf(os.Stderr, "error parsing adc file: %v\n", decodeErr)
+		os.Exit(1)
+	}
+	st := decoded.Stats()
+	if st.Dropped > 0 {
+		emit(&c.sb, "\nLoad shed: %d of %d reading(s) dropped because the apply stage fell behind\n", st.Dropped, st.In)
+		c.warnings = append(c.warnings, newWarning("readings-shed", "", "%d of %d reading(s) of %s dropped (-shed-load)", st.Dropped, st.In, f.adcFile))
+	}
+	return st
+}
+
+// weighReading reports one ADC reading; n is its 1-based number, single
+// selects the layout used for a lone -adc / {"adc": [..]} input.
+func (c *calibrateRun) weighReading(n int, adr [4]float64, single bool) {
+	f, w, sb := c.f, &c.w, &c.sb
+	if c.deadband != nil && w.rangeSummary.within(adr) {
+		adr = c.deadband.apply(adr)
+	}
+	var delta [4]float64
+	var contrib [4]float64
+	for i := 0; i < 4; i++ {
+		delta[i] = adr[i] - c.weighZero[i]
+		contrib[i] = c.weighFactors[i] * delta[i]
+	}
+	weight := 0.0
+	for i := 0; i < 4; i++ {
+		weight += contrib[i]
+	}
+	rr := ReadingResult{Reading: n, ADC: adr, Delta: delta, Contrib: contrib}
+	defer func() { c.record(rr, w.expected) }()
+	if s := nonFinite(weight); s != "" {
+		// overflow in the weight: report it like an out-of-range reading
+		rr.Delta, rr.Contrib = [4]float64{}, [4]float64{}
+		w.rangeSummary.Invalid = append(w.rangeSummary.Invalid, n)
+		rr.Invalid = "weight is " + s
+		if single {
+			emit(sb, "Input ADC: %s\n", formatVector(adr))
+		} else {
+			fmt.Printf("Reading %d: ADC=%s\n", n, formatVector(adr))
+			sb.WriteString(fmt.Sprintf("\nReading %d: ADC=%s\n", n, formatVector(adr)))
+		}
+		emit(sb, "  Estimated weight = INVALID (%s)\n", rr.Invalid)
+		return
+	}
+	if single {
+		emit(sb, "Input ADC: %s\n", formatVector(adr))
+	} else {
+		fmt.Printf("Reading %d: ADC=%s\n", n, formatVector(adr))
+		sb.WriteString(fmt.Sprintf("\nReading %d: ADC=%s\n", n, formatVector(adr)))
+	}
+	emit(sb, "  Delta: %s\n", formatVector(delta))
+	// print Contrib with two decimals
+	emit(sb, "  Contrib: [%.2f %.2f %.2f %.2f]\n", contrib[0], contrib[1], contrib[2], contrib[3])
+	if reason := w.rangeSummary.check(adr); reason != "" {
+		w.rangeSummary.Invalid = append(w.rangeSummary.Invalid, n)
+		rr.Invalid = reason
+		emit(sb, "  Estimated weight = INVALID (%s)\n", reason)
+		return
+	}
+	tiltScale := 1.0
+	if w.tilt != nil {
+		t := *w.tilt
+		weight, tiltScale = TiltCorrected(weight, t), TiltCorrected(1, t)
+		rr.Tilt = &t
+		if c.res.Tilt == nil {
+			c.res.Tilt = &TiltSummary{Limit: f.tiltMax, Beyond: []int{}}
+		}
+		ts := c.res.Tilt
+		ts.Readings++
+		ts.Max = math.Max(ts.Max, t)
+		emit(sb, "  Tilt: %.2f° (weight ×%.5f)\n", t, tiltScale)
+		if t > f.tiltMax {
+			ts.Beyond = append(ts.Beyond, n)
+			emit(sb, "  WARNING: tilt %.2f° beyond -tilt-max %g°; the cosine correction does not cover side loads\n", t, f.tiltMax)
+			c.warnings = append(c.warnings, newWarning("tilt-exceeded", fmt.Sprintf("reading %d", n),
+				"platform tilted %.2f° (limit %g°)", t, f.tiltMax))
+		}
+	}
+	rr.Valid = true
+	rr.Weight = weight
+	uncertainty := ""
+	if w.covErr == nil {
+		u := ReadingUncertainty(delta, c.weighFactors, w.factorCov, w.chanSigma) * tiltScale
+		rr.Uncertainty = &u
+		uncertainty = fmt.Sprintf(" ± %.3g (k=%d)", u, uncertaintyK)
+	}
+	shown := fmt.Sprintf("%.2f", weight)
+	totalized := weight
+	if f.displayDiv > 0 || f.zeroBand > 0 || c.hyst != nil {
+		// legal-for-trade display: blank the zero dead band, round to d
+		// (holding the display within the hysteresis), and keep the raw
+		// value alongside
+		disp := RoundToDivision(ApplyZeroBand(weight, f.zeroBand), f.displayDiv)
+		if c.hyst != nil {
+			disp = c.hyst.step(ApplyZeroBand(weight, f.zeroBand))
+		}
+		rr.Display = &disp
+		if f.displayDiv > 0 {
+			shown = fmt.Sprintf("%s (d = %g, raw %.4f)", formatDivision(disp, f.displayDiv), f.displayDiv, weight)
+		} else {
+			shown = fmt.Sprintf("%.2f (raw %.4f)", disp, weight)
+		}
+		totalized = disp
+	}
+	if single {
+		emit(sb, "  Estimated weight = %s%s (same units as calibration weight)\n", shown, uncertainty)
+	} else {
+		emit(sb, "  Estimated weight = %s%s\n", shown, uncertainty)
+	}
+	if pos := c.cal.CellPositions; pos != nil && math.Abs(weight) >= f.colMin {
+		if x, y, ok := CenterOfLoad(contrib, *pos); ok {
+			off := OffCenterRatio(x, y, *pos)
+			rr.CenterOfLoad = &[2]float64{x, y}
+			rr.OffCenter = &off
+			emit(sb, "  Center of load: x=%.1f y=%.1f (%.0f%% off center)\n", x, y, off*100)
+			if off > f.offCenterMax {
+				emit(sb, "  WARNING: off-center load (limit %.0f%%)\n", f.offCenterMax*100)
+				c.warnings = append(c.warnings, newWarning("off-center-load", fmt.Sprintf("reading %d", n),
+					"center of load %.0f%% off center (limit %.0f%%)", off*100, f.offCenterMax*100))
+			}
+		}
+	}
+	if h := w.cellHealth; h != nil && len(h.Degraded) > 0 {
+		if dw, ok := DegradedWeight(contrib, h.Degraded, h.CenterShare); ok {
+			dw *= tiltScale
+			rr.DegradedWeight = &dw
+			emit(sb, "  Degraded-mode estimate (without cells %v) = %.2f\n", h.Degraded, dw)
+		}
+	}
+	if cw := c.res.Checkweigh; cw != nil && !f.dynamic {
+		rr.Class = cw.add(totalized)
+		emit(sb, "  Class: %s\n", strings.ToUpper(rr.Class))
+		c.classified(rr.Class, map[string]any{"reading": n, "weight": totalized})
+	}
+	c.acceptWeight(n, totalized)
+}
+
+// record keeps the result of a reading: in the results list, or with
+// -stream only in the running batch and accuracy totals. expected is the
+// weight known to be on the platform (nil when not given).
+func (c *calibrateRun) record(rr ReadingResult, expected *float64) {
+	f, w, sb := c.f, &c.w, &c.sb
+	if c.postScript != nil {
+		weight := rr.Weight
+		keep, err := c.postScript.Apply(&rr)
+		if err != nil {
+			sb.discard()
+			fmt.Fprintf(os.Stderr, "error: reading %d: %v\n", rr.Reading, err)
+			os.Exit(1)
+		}
+		if !keep {
+			w.scriptDropped++
+			emit(sb, "  Dropped by -post-script\n")
+			sb.flush()
+			return
+		}
+		if rr.Weight != weight {
+			emit(sb, "  Post-script weight = %.4f\n", rr.Weight)
+		}
+		if len(rr.Fields) > 0 {
+			emit(sb, "  Post-script fields: %s\n", scriptFieldList(rr.Fields))
+		}
+	}
+	w.batch.add(rr)
+	if c.stream == nil {
+		w.results = append(w.results, rr)
+	}
+	if expected != nil {
+		if w.accTally == nil {
+			w.accTally = newAccuracyTally(f.accuracyTol, f.accClass, f.verifInterval, c.stream == nil)
+		}
+		a, err := w.accTally.add(rr, *expected)
+		if err != nil {
+			sb.discard()
+			fmt.Fprintf(os.Stderr, "accuracy report error: %v\n", err)
+			os.Exit(1)
+		}
+		if c.stream != nil && a.Invalid == "" {
+			verdict := "PASS"
+			if !a.Pass {
+				verdict = "FAIL"
+			}
+			emit(sb, "  Expected %.4f, error %+.4f (tolerance %.4f): %s\n", a.Expected, a.Error, a.Tolerance, verdict)
+		}
+	}
+	if w.readingsOut != nil {
+		// nowUTC, so a recorded run's CSV timestamps replay identically
+		w.readingsOut.send(timedReading{rr, nowUTC()})
+	}
+	sb.flush()
+}
+
+// acceptWeight offers the weight of reading n to the totalizer.
+func (c *calibrateRun) acceptWeight(n int, weight float64) {
+	w := &c.w
+	if w.accepter == nil || !w.accepter.offer(n, weight) {
+		return
+	}
+	w.tot.Total += weight
+	w.tot.Count++
+	w.totSummary.Accepted = append(w.totSummary.Accepted, n)
+	w.totSummary.RunTotal += weight
+	emit(&c.sb, "  Accepted into total (total = %.2f, count = %d)\n", w.tot.Total, w.tot.Count)
+	c.event(eventAccepted, map[string]any{"reading": n, "weight": weight, "total": w.tot.Total, "count": w.tot.Count})
+}
+
+// classified fires the under/over events of a checkweighing class.
+func (c *calibrateRun) classified(class string, fields map[string]any) {
+	if class == classAccept {
+		return
+	}
+	cw := c.res.Checkweigh
+	p := cw.Product
+	fields["class"], fields["product"], fields["target"] = class, p.ID, p.Target
+	fields["lower_limit"], fields["upper_limit"] = cw.Lower, cw.Upper
+	name := eventUnder
+	if class == classOver {
+		name = eventOver
+	}
+	c.event(name, fields)
+}
+
+// reportAccuracy compares the weights with the expected weights given in
+// the adc file.
+func (c *calibrateRun) reportAccuracy() {
+	if c.w.accTally == nil {
+		return
+	}
+	sb := &c.sb
+	rep := c.w.accTally.report()
+	c.res.Accuracy = &rep
+	emit(sb, "\nAccuracy report (%d reading(s) with an expected weight):\n", rep.Count)
+	if len(rep.Readings) > 0 {
+		emit(sb, "  %7s %12s %12s %10s %10s\n", "reading", "expected", "weight", "error", "tolerance")
+	}
+	for _, a := range rep.Readings {
+		if a.Invalid != "" {
+			emit(sb, "  %7d %12.4f %12s %10s %10.4f  FAIL (%s)\n", a.Reading, a.Expected, "INVALID", "", a.Tolerance, a.Invalid)
+			continue
+		}
+		verdict := "PASS"
+		if !a.Pass {
+			verdict = "FAIL"
+		}
+		emit(sb, "  %7d %12.4f %12.4f %+10.4f %10.4f  %s\n", a.Reading, a.Expected, a.Weight, a.Error, a.Tolerance, verdict)
+	}
+	verdict := "PASS"
+	if !rep.Pass {
+		verdict = "FAIL"
+	}
+	emit(sb, "  Result: %s (MAE %.4f, max |error| %.4f, pass rate %.1f%% = %d/%d)\n",
+		verdict, rep.MAE, rep.MaxError, 100*rep.PassRate, rep.Passed, rep.Count)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// workersFlag registers -workers, the size of the goroutine pool of a heavy
+// analysis, on fs.
+func workersFlag(fs *flag.FlagSet) *int {
+	return fs.Int("workers", 0, "goroutines to spread the work over (0 = one per available core)")
+}
+
+// parallelFor calls fn(i) for every i in [0, n) on a pool of at most workers
+// goroutines (one per available core when workers <= 0). fn must only write
+// the result of its own i: the caller then reduces the results in index
+// order, so the outcome does not depend on the pool size or scheduling.
+func parallelFor(n, workers int, fn func(i int)) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range min(workers, n) {
+		wg.Go(func() {
+			for i := int(next.Add(1) - 1); i < n; i = int(next.Add(1) - 1) {
+				fn(i)
+			}
+		})
+	}
+	wg.Wait()
+}
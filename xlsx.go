@@ -0,0 +1,325 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The -xlsx-out workbook, written as Office Open XML by hand (a zip of a few
+// XML parts, strings inline) so QA gets a spreadsheet without a spreadsheet
+// library. Numbers are written as numbers so they stay usable in formulas.
+
+// xlsxHeader is a bold cell.
+type xlsxHeader string
+
+type xlsxSheet struct {
+	name string
+	rows [][]any // string, xlsxHeader, float64, int, bool or nil (empty)
+}
+
+func (s *xlsxSheet) add(cells ...any) { s.rows = append(s.rows, cells) }
+
+// header adds a row of bold cells.
+func (s *xlsxSheet) header(names ...string) {
+	row := make([]any, len(names))
+	for i, n := range names {
+		row[i] = xlsxHeader(n)
+	}
+	s.rows = append(s.rows, row)
+}
+
+// WriteXLSX writes the report of a run to path as an .xlsx workbook with
+// the calibration inputs, the factors and diagnostics, the verification
+// tests and the applied readings.
+func WriteXLSX(path string, cal CalibrationData, res CalibrationResult) error {
+	b, err := xlsxWorkbook(xlsxReport(cal, res))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b, 0644)
+}
+
+func xlsxReport(cal CalibrationData, res CalibrationResult) []*xlsxSheet {
+	units := "" // " (kg)" after weights
+	if cal.Units != "" {
+		units = " (" + cal.Units + ")"
+	}
+
+	in := &xlsxSheet{name: "Calibration inputs"}
+	in.header("Row", "Ch0", "Ch1", "Ch2", "Ch3")
+	for i, row := range [][4]float64{cal.Zero, cal.OnCell0, cal.OnCell1, cal.OnCell2, cal.OnCell3, cal.OnCenter} {
+		name := "zero"
+		if i > 0 {
+			name = calRowNames[i-1]
+		}
+		in.add(name, row[0], row[1], row[2], row[3])
+	}
+	in.add()
+	in.add(xlsxHeader("Calibration weight"+units), cal.CalibrationWeight)
+	if cal.CalibratedAt != "" {
+		in.add(xlsxHeader("Calibrated at"), cal.CalibratedAt)
+	}
+	if cal.ValidDays > 0 {
+		in.add(xlsxHeader("Valid days"), cal.ValidDays)
+	}
+	if m := res.Session; m != nil {
+		for _, kv := range [][2]string{{"Operator", m.Operator}, {"Operator ID", m.OperatorID}, {"Location", m.Location},
+			{"Reference weight ID", m.ReferenceWeightID}, {"Notes", m.Notes}} {
+			if kv[1] != "" {
+				in.add(xlsxHeader(kv[0]), kv[1])
+			}
+		}
+		for _, kv := range []struct {
+			name string
+			v    *float64
+		}{{"Temperature (°C)", m.TemperatureC}, {"Humidity (%)", m.HumidityPct}, {"Pressure (hPa)", m.PressureHPa}} {
+			if kv.v != nil {
+				in.add(xlsxHeader(kv.name), *kv.v)
+			}
+		}
+	}
+
+	fit := &xlsxSheet{name: "Factors"}
+	fit.header("Channel", "Factor")
+	for i, f := range res.Factors {
+		fit.add(fmt.Sprintf("Ch%d", i), f)
+	}
+	fit.add()
+	fit.header("Diagnostic", "Value")
+	fit.add("Residual variance", res.ResidualVar)
+	fit.add("RSS", res.RSS)
+	fit.add("det(A)", res.DetA)
+	fit.add("Error det", res.ErrorDet)
+	fit.add("Calibration OK", res.CalibrationOK)
+	if res.Grade != nil {
+		fit.add("Grade", res.Grade.Letter)
+		fit.add("Grade score", res.Grade.Score)
+	}
+	if res.Expiry != "" {
+		fit.add("Expiry", res.Expiry)
+		fit.add("Expired", res.Expired)
+	}
+	if len(res.Warnings) > 0 {
+		fit.add()
+		fit.header("Warning", "Check", "Subject", "Message")
+		for _, w := range res.Warnings {
+			fit.add(w.Code, w.Check, w.Subject, w.Message)
+		}
+	}
+
+	ver := &xlsxSheet{name: "Verification"}
+	if t := res.Tolerance; t != nil {
+		ver.header("Tolerance", "Value")
+		if t.Profile != "" {
+			ver.add("Profile", t.Profile)
+		}
+		ver.add("Max abs error"+units, t.MaxAbsError)
+		ver.add("Max error (%)", t.MaxPctError)
+		ver.add("Quality score", t.Score)
+		ver.add("Pass", t.Pass)
+		for _, f := range t.Failures {
+			ver.add("Failure", f)
+		}
+		ver.add()
+	}
+	if a := res.Accuracy; a != nil {
+		ver.header("Accuracy", "Value")
+		ver.add("Readings", a.Count)
+		ver.add("MAE"+units, a.MAE)
+		ver.add("Max error"+units, a.MaxError)
+		ver.add("Pass rate (%)", 100*a.PassRate)
+		ver.add("Pass", a.Pass)
+		if len(a.Readings) > 0 {
+			ver.header("Reading", "Expected", "Weight", "Error", "Tolerance", "Pass", "Invalid")
+			for _, r := range a.Readings {
+				ver.add(r.Reading, r.Expected, r.Weight, r.Error, r.Tolerance, r.Pass, r.Invalid)
+			}
+		}
+		ver.add()
+	}
+	if e := res.Eccentricity; e != nil {
+		ver.header("Eccentricity", "Value")
+		ver.add("Test weight"+units, e.TestWeight)
+		ver.add("MPE"+units, e.MPE)
+		ver.add("Max error"+units, e.MaxError)
+		ver.add("Pass", e.Pass)
+		ver.header("Position", "Indication", "Error", "Eccentricity", "Pass")
+		for _, p := range e.Positions {
+			ver.add(p.Position, p.Indication, p.Error, p.Eccentricity, p.Pass)
+		}
+		ver.add()
+	}
+	if l := res.Linearity; l != nil {
+		ver.header("Linearity", "Value")
+		ver.add("Slope", l.Slope)
+		ver.add("Offset", l.Offset)
+		ver.add("Max deviation (%)", l.MaxDeviationPct)
+		ver.add("Pass", l.Pass)
+		ver.header("Load", "Indication", "Error", "Deviation", "Tolerance", "Pass")
+		for _, p := range l.Points {
+			ver.add(p.Load, p.Indication, p.Error, p.Deviation, p.Tolerance, p.Pass)
+		}
+		ver.add()
+	}
+	if r := res.Repeatability; r != nil {
+		ver.header("Repeatability", "Value")
+		ver.add("Test weight"+units, r.TestWeight)
+		ver.add("Mean", r.Mean)
+		ver.add("Std dev", r.StdDev)
+		ver.add("Range", r.Range)
+		ver.add("MPE", r.MPE)
+		ver.add("Pass", r.Pass)
+	}
+	if len(ver.rows) == 0 {
+		ver.add("No verification tests in this run (-tol-*, expected weights in -adc-file, -ecc-file, -linearity-file, -repeat-file).")
+	}
+
+	rd := &xlsxSheet{name: "Readings"}
+	rd.header("Reading", "Ch0 Raw", "Ch1 Raw", "Ch2 Raw", "Ch3 Raw", "Ch0 Delta", "Ch1 Delta", "Ch2 Delta", "Ch3 Delta",
+		"Weight"+units, "Display", "Valid", "Invalid")
+	for _, r := range res.Readings {
+		var display any
+		if r.Display != nil {
+			display = *r.Display
+		}
+		rd.add(r.Reading, r.ADC[0], r.ADC[1], r.ADC[2], r.ADC[3], r.Delta[0], r.Delta[1], r.Delta[2], r.Delta[3],
+			r.Weight, display, r.Valid, r.Invalid)
+	}
+	if len(res.Readings) == 0 {
+		rd.add("No readings applied (or -stream, which does not keep them; use -readings-out).")
+	}
+	return []*xlsxSheet{in, fit, ver, rd}
+}
+
+// xlsxColumn returns the column letters of the 0-based column i.
+func xlsxColumn(i int) string {
+	s := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		s = string(rune('A'+(i-1)%26)) + s
+	}
+	return s
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func (s *xlsxSheet) xml() []byte {
+	cols := 1
+	for _, row := range s.rows {
+		cols = max(cols, len(row))
+	}
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	fmt.Fprintf(&b, `<cols><col min="1" max="%d" width="18" customWidth="1"/></cols><sheetData>`, cols)
+	for r, row := range s.rows {
+		fmt.Fprintf(&b, `<row r="%d">`, r+1)
+		for c, v := range row {
+			ref := xlsxColumn(c) + strconv.Itoa(r+1)
+			str := func(s string, style int) {
+				fmt.Fprintf(&b, `<c r="%s" t="inlineStr" s="%d"><is><t xml:space="preserve">%s</t></is></c>`, ref, style, xmlEscape(s))
+			}
+			switch v := v.(type) {
+			case nil:
+			case xlsxHeader:
+				str(string(v), 1)
+			case string:
+				if v != "" {
+					str(v, 0)
+				}
+			case bool:
+				bit := 0
+				if v {
+					bit = 1
+				}
+				fmt.Fprintf(&b, `<c r="%s" t="b"><v>%d</v></c>`, ref, bit)
+			case int:
+				fmt.Fprintf(&b, `<c r="%s"><v>%d</v></c>`, ref, v)
+			case float64:
+				if math.IsNaN(v) || math.IsInf(v, 0) {
+					str(strconv.FormatFloat(v, 'g', -1, 64), 0)
+				} else {
+					fmt.Fprintf(&b, `<c r="%s"><v>%s</v></c>`, ref, strconv.FormatFloat(v, 'g', -1, 64))
+				}
+			default:
+				str(fmt.Sprint(v), 0)
+			}
+		}
+		b.WriteString(`</row>`)
+	}
+	b.WriteString(`</sheetData></worksheet>`)
+	return b.Bytes()
+}
+
+const (
+	xlsxMain   = "http://schemas.openxmlformats.org/spreadsheetml/2006/main"
+	xlsxRelDoc = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+	xlsxRelPkg = "http://schemas.openxmlformats.org/package/2006/relationships"
+	xlsxTypes  = "application/vnd.openxmlformats-officedocument.spreadsheetml."
+
+	xlsxStyles = `<styleSheet xmlns="` + xlsxMain + `">` +
+		`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+		`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+		`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+		`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+		`<cellXfs count="2"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+		`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs></styleSheet>`
+)
+
+// xlsxWorkbook packages the sheets.
+func xlsxWorkbook(sheets []*xlsxSheet) ([]byte, error) {
+	var types, wbSheets, wbRels strings.Builder
+	types.WriteString(`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="` + xlsxTypes + `sheet.main+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="` + xlsxTypes + `styles+xml"/>`)
+	wbRels.WriteString(`<Relationships xmlns="` + xlsxRelPkg + `">` +
+		`<Relationship Id="rStyles" Type="` + xlsxRelDoc + `/styles" Target="styles.xml"/>`)
+	parts := map[string][]byte{}
+	for i, s := range sheets {
+		n := strconv.Itoa(i + 1)
+		parts["xl/worksheets/sheet"+n+".xml"] = s.xml()
+		types.WriteString(`<Override PartName="/xl/worksheets/sheet` + n + `.xml" ContentType="` + xlsxTypes + `worksheet+xml"/>`)
+		wbSheets.WriteString(`<sheet name="` + xmlEscape(s.name) + `" sheetId="` + n + `" r:id="rId` + n + `"/>`)
+		wbRels.WriteString(`<Relationship Id="rId` + n + `" Type="` + xlsxRelDoc + `/worksheet" Target="worksheets/sheet` + n + `.xml"/>`)
+	}
+	types.WriteString(`</Types>`)
+	wbRels.WriteString(`</Relationships>`)
+	parts["[Content_Types].xml"] = []byte(xml.Header + types.String())
+	parts["_rels/.rels"] = []byte(xml.Header + `<Relationships xmlns="` + xlsxRelPkg + `">` +
+		`<Relationship Id="rId1" Type="` + xlsxRelDoc + `/officeDocument" Target="xl/workbook.xml"/></Relationships>`)
+	parts["xl/workbook.xml"] = []byte(xml.Header + `<workbook xmlns="` + xlsxMain + `" xmlns:r="` + xlsxRelDoc + `"><sheets>` +
+		wbSheets.String() + `</sheets></workbook>`)
+	parts["xl/_rels/workbook.xml.rels"] = []byte(xml.Header + wbRels.String())
+	parts["xl/styles.xml"] = []byte(xml.Header + xlsxStyles)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	// [Content_Types].xml first, as Office expects
+	order := []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/styles.xml"}
+	for i := range sheets {
+		order = append(order, "xl/worksheets/sheet"+strconv.Itoa(i+1)+".xml")
+	}
+	for _, name := range order {
+		w, err := zw.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(parts[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}